@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Non zero while the server is refusing writes
+var readOnly int32
+
+func isReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) != 0
+}
+
+func setReadOnly(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&readOnly, value)
+}
+
+// Wraps the handlers of endpoints which modify the database so that they are
+// refused while in read-only mode, and mirrored with --mirror-url.
+func mutationHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isReadOnly() {
+			HttpError(w, 403, "READ_ONLY")
+			return
+		}
+		if mirror != nil {
+			mirror.serve(handler, w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Returns whether the server is in read-only mode.  Passing `enabled` switches
+// read-only mode on or off.
+func ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	if enabled_raw := reqParams.Get("enabled"); enabled_raw != "" {
+		enabled, err := strconv.ParseBool(enabled_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_ENABLED")
+			return
+		}
+		setReadOnly(enabled)
+	}
+	HttpResponse(w, 200, isReadOnly())
+}
+
+// Returns the current batching policy.  Any of `max_size`, `max_latency` (eg:
+// 5ms), `max_bytes`, `flush` and `sync` change the policy.
+func BatchingHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	policy := getBatchPolicy()
+	if maxSize_raw := reqParams.Get("max_size"); maxSize_raw != "" {
+		policy.MaxSize, err = strconv.Atoi(maxSize_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_MAX_SIZE")
+			return
+		}
+	}
+	if maxLatency_raw := reqParams.Get("max_latency"); maxLatency_raw != "" {
+		policy.MaxLatency, err = time.ParseDuration(maxLatency_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_MAX_LATENCY")
+			return
+		}
+	}
+	if maxBytes_raw := reqParams.Get("max_bytes"); maxBytes_raw != "" {
+		policy.MaxBytes, err = strconv.Atoi(maxBytes_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_MAX_BYTES")
+			return
+		}
+	}
+	if flush := reqParams.Get("flush"); flush != "" {
+		policy.Flush = FlushMode(flush)
+	}
+	if sync_raw := reqParams.Get("sync"); sync_raw != "" {
+		policy.Sync, err = strconv.ParseBool(sync_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_SYNC")
+			return
+		}
+	}
+	if err := policy.validate(); err != nil {
+		HttpError(w, 500, "INVALID_BATCH_POLICY")
+		return
+	}
+
+	setBatchPolicy(policy)
+	HttpResponse(w, 200, policy)
+}
+
+// Token administrative requests must carry, empty if there is none
+var adminToken string
+
+// Whether a path can only be requested with the admin token.  Profiling and
+// heap dumps can leak data and stall the server, so they need it even when
+// no token is set, which leaves them disabled.
+func adminPath(path string) (protected, alwaysProtected bool) {
+	if strings.HasPrefix(path, "/debug/") || path == "/admin/heapdump" {
+		return true, true
+	}
+	return strings.HasPrefix(path, "/admin/") || path == "/exit", false
+}
+
+// Takes the token as a bearer token or as the password of basic auth, so that
+// the user name can still be recorded in the audit log
+func hasAdminToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// Refuses administrative requests without the admin token
+func adminAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protected, alwaysProtected := adminPath(r.URL.Path)
+		if protected && adminToken == "" && alwaysProtected {
+			HttpError(w, 403, "ADMIN_TOKEN_NOT_SET")
+			return
+		}
+		if protected && adminToken != "" && !hasAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gocountme admin"`)
+			HttpError(w, 401, "UNAUTHORIZED")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	defer setReadOnly(false)
+
+	called := false
+	handler := mutationHandler(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	toggle := httptest.NewRecorder()
+	ReadOnlyHandler(toggle, httptest.NewRequest("GET", "/admin/readonly?enabled=true", nil))
+	assert.Equal(t, toggle.Code, 200)
+	assert.Equal(t, isReadOnly(), true)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/add?key=foo&value=bar", nil))
+	assert.Equal(t, w.Code, 403)
+	assert.Equal(t, called, false)
+
+	ReadOnlyHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/admin/readonly?enabled=false", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/add?key=foo&value=bar", nil))
+	assert.Equal(t, called, true)
+}
+
+func TestAdminAuth(t *testing.T) {
+	defer func() { adminToken = "" }()
+	handler := adminAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	code := func(path, authorization string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, code("/admin/readonly", ""), 200)
+	assert.Equal(t, code("/debug/pprof/", ""), 403)
+	assert.Equal(t, code("/admin/heapdump", ""), 403)
+	assert.Equal(t, code("/cardinality", ""), 200)
+
+	adminToken = "secret"
+	assert.Equal(t, code("/admin/readonly", ""), 401)
+	assert.Equal(t, code("/exit", "Bearer wrong"), 401)
+	assert.Equal(t, code("/debug/pprof/", "Bearer secret"), 200)
+	r := httptest.NewRequest("GET", "/admin/heapdump", nil)
+	r.SetBasicAuth("alice", "secret")
+	assert.Equal(t, code("/admin/heapdump", r.Header.Get("Authorization")), 200)
+	assert.Equal(t, code("/cardinality", ""), 200)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alert rules evaluate a query every --alert-interval and notify a sink when
+// its result crosses a threshold or grows too fast, eg:
+//
+//	[{"name" : "overlap", "query" : {"method" : "jaccard", "keys" : ["a", "b"]},
+//	  "above" : 0.9, "sink" : {"type" : "slack", "url" : "https://..."}},
+//	 {"name" : "growth", "query" : {"method" : "cardinality", "keys" : ["k"]},
+//	  "growth" : 0.2, "window" : "1h", "sink" : {"type" : "webhook", "url" : "http://..."}}]
+//
+// A rule fires once when its condition starts holding and again only after it
+// has cleared.
+type AlertRule struct {
+	Name   string    `json:"name"`
+	Query  Element   `json:"query"`
+	Above  *float64  `json:"above,omitempty"`
+	Below  *float64  `json:"below,omitempty"`
+	Growth *float64  `json:"growth,omitempty"`
+	Window string    `json:"window,omitempty"`
+	Sink   AlertSink `json:"sink"`
+	window time.Duration
+}
+
+// Where notifications are sent.  A webhook gets the alert as JSON while slack
+// gets a message for an incoming webhook.
+type AlertSink struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type alert struct {
+	Rule     string    `json:"rule"`
+	Query    string    `json:"query"`
+	Value    float64   `json:"value"`
+	Previous *float64  `json:"previous,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+type alertSample struct {
+	time  time.Time
+	value float64
+}
+
+type alertStatus struct {
+	Rule      string    `json:"rule"`
+	Value     float64   `json:"value"`
+	Firing    bool      `json:"firing"`
+	LastFired time.Time `json:"last_fired,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type alertState struct {
+	rule    AlertRule
+	status  alertStatus
+	samples []alertSample
+}
+
+var (
+	alerter          *Alerter
+	InvalidAlertRule = errors.New("Alert rule needs a name, a sink and one of above, below or growth")
+	InvalidAlertSink = errors.New("Alert sink must be a webhook or slack with a url")
+	notifyClient     = &http.Client{Timeout: 10 * time.Second}
+)
+
+func LoadAlertRules(filename string) ([]AlertRule, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []AlertRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" || rule.Above == nil && rule.Below == nil && rule.Growth == nil {
+			return nil, InvalidAlertRule
+		}
+		if rule.Sink.URL == "" || rule.Sink.Type != "webhook" && rule.Sink.Type != "slack" {
+			return nil, InvalidAlertSink
+		}
+		if rule.Growth != nil {
+			rule.window, err = time.ParseDuration(rule.Window)
+			if err != nil || rule.window <= 0 {
+				return nil, fmt.Errorf("Alert rule %q needs a window for growth", rule.Name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Periodically evaluates alert rules and sends their notifications
+type Alerter struct {
+	sync.Mutex
+	states   []*alertState
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewAlerter(rules []AlertRule, interval time.Duration) *Alerter {
+	states := make([]*alertState, len(rules))
+	for i, rule := range rules {
+		states[i] = &alertState{rule: rule, status: alertStatus{Rule: rule.Name}}
+	}
+	return &Alerter{
+		states:   states,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (a *Alerter) Start() {
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				a.Check(now)
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops evaluating rules, waiting for a running evaluation to finish
+func (a *Alerter) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+// Evaluates every rule once
+func (a *Alerter) Check(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	for _, state := range a.states {
+		notification, err := state.evaluate(now)
+		if err == nil && notification != nil {
+			err = notify(state.rule.Sink, notification)
+		}
+		if err != nil {
+			log.Printf("Alert rule %q failed: %s", state.rule.Name, err)
+			state.status.LastError = err.Error()
+		} else {
+			state.status.LastError = ""
+		}
+	}
+}
+
+func (a *Alerter) Status() []alertStatus {
+	a.Lock()
+	defer a.Unlock()
+	statuses := make([]alertStatus, len(a.states))
+	for i, state := range a.states {
+		statuses[i] = state.status
+	}
+	return statuses
+}
+
+// Runs the rule's query and returns the alert to send, if the rule just
+// started firing
+func (state *alertState) evaluate(now time.Time) (*alert, error) {
+	query := state.rule.Query
+	result, err := parseQuery(&query)
+	if err != nil {
+		return nil, err
+	}
+	value := result.Value()
+	if result.Kmv != nil {
+		result.Kmv.Release()
+	}
+	state.status.Value = value
+
+	var message string
+	var previous *float64
+	if growth := state.rule.Growth; growth != nil {
+		if then, ok := state.sampleAt(now, value); ok && then != 0 && (value-then)/then > *growth {
+			previous = &then
+			message = fmt.Sprintf("%s grew from %g to %g in %s", result.Key, then, value, state.rule.window)
+		}
+	}
+	if above := state.rule.Above; above != nil && value > *above {
+		message = fmt.Sprintf("%s is %g, above %g", result.Key, value, *above)
+	} else if below := state.rule.Below; below != nil && value < *below {
+		message = fmt.Sprintf("%s is %g, below %g", result.Key, value, *below)
+	}
+
+	firing := message != ""
+	if !firing || state.status.Firing {
+		state.status.Firing = firing
+		return nil, nil
+	}
+	state.status.Firing = true
+	state.status.LastFired = now
+	return &alert{
+		Rule:     state.rule.Name,
+		Query:    result.Key,
+		Value:    value,
+		Previous: previous,
+		Message:  message,
+		Time:     now,
+	}, nil
+}
+
+// Records value and returns the latest value from at least a window ago
+func (state *alertState) sampleAt(now time.Time, value float64) (float64, bool) {
+	state.samples = append(state.samples, alertSample{now, value})
+	cutoff := now.Add(-state.rule.window)
+	i := -1
+	for j, sample := range state.samples {
+		if sample.time.After(cutoff) {
+			break
+		}
+		i = j
+	}
+	if i < 0 {
+		return 0, false
+	}
+	state.samples = state.samples[i:]
+	return state.samples[0].value, true
+}
+
+func notify(sink AlertSink, notification *alert) error {
+	var body []byte
+	var err error
+	if sink.Type == "slack" {
+		body, err = json.Marshal(map[string]string{
+			"text": fmt.Sprintf("gocountme alert %s: %s", notification.Rule, notification.Message),
+		})
+	} else {
+		body, err = json.Marshal(notification)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := notifyClient.Post(sink.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s sink returned %s", sink.Type, resp.Status)
+	}
+	return nil
+}
+
+// Lists the alert rules with their latest value and whether they are firing
+func AlertsHandler(w http.ResponseWriter, r *http.Request) {
+	if alerter == nil {
+		HttpResponse(w, 200, []alertStatus{})
+		return
+	}
+	HttpResponse(w, 200, alerter.Status())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlerts(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_ALERTS"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kminvalues.NewKMinValues(16), ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+	add := func(hash uint64) {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, ResultChan: resultChan})
+		<-resultChan
+	}
+
+	var received []alert
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification alert
+		json.NewDecoder(r.Body).Decode(&notification)
+		received = append(received, notification)
+	}))
+	defer sink.Close()
+
+	above, growth := 2.0, 0.5
+	query := Element{Method: "cardinality", Keys: []string{key}}
+	rules := []AlertRule{
+		{Name: "big", Query: query, Above: &above, Sink: AlertSink{"webhook", sink.URL}},
+		{Name: "growing", Query: query, Growth: &growth, Sink: AlertSink{"webhook", sink.URL}, window: time.Hour},
+	}
+	a := NewAlerter(rules, time.Minute)
+
+	now := time.Now()
+	add(1 << 60)
+	add(2 << 60)
+	a.Check(now)
+	assert.Equal(t, len(received), 0)
+
+	// Crossing the threshold fires once until the rule clears
+	add(3 << 60)
+	a.Check(now.Add(30 * time.Minute))
+	assert.Equal(t, len(received), 1)
+	assert.Equal(t, received[0].Rule, "big")
+	assert.Equal(t, received[0].Value, 3.0)
+	a.Check(now.Add(45 * time.Minute))
+	assert.Equal(t, len(received), 1)
+
+	// Growth compares against the value from a window ago: 2 -> 4 is 100%
+	add(4 << 60)
+	a.Check(now.Add(time.Hour))
+	assert.Equal(t, len(received), 2)
+	assert.Equal(t, received[1].Rule, "growing")
+	assert.Equal(t, *received[1].Previous, 2.0)
+
+	status := a.Status()
+	assert.Equal(t, status[0].Firing, true)
+	assert.Equal(t, status[1].Firing, true)
+	assert.Equal(t, status[1].Value, 4.0)
+}
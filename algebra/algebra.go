@@ -0,0 +1,358 @@
+// Package algebra parses, plans and evaluates the set expressions of
+// gocountme's /query over sketches from any SketchProvider, so that programs
+// embedding the sketches run the same expressions as the server does.
+//
+// An expression is a recursively defined json object,
+//
+//	{"method" : "...", "keys" : ["...", "..."], "set" : [{...}, {...}]}
+//
+// where `keys` are sketches to load and `set` the expressions whose sets are
+// operated on instead, eg: Jaccard( key1 u key2, key8 n key3 ) is
+//
+//	{"method" : "jaccard", "set" : [
+//	    {"method" : "union", "keys" : ["key1", "key2"]},
+//	    {"method" : "intersection", "keys" : ["key8", "key3"]}]}
+//
+// and the number of values in at least 3 of 7 keys is
+//
+//	{"method" : "at_least", "m" : 3, "keys" : ["day1", "day2", "day3", "day4", "day5", "day6", "day7"]}
+package algebra
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"strings"
+)
+
+var (
+	KeysAndSetError            = errors.New("Both keys and set are specified in query")
+	CardinalitySingleTermError = errors.New("Method 'cardinality' can only take in one data source")
+	SetNeedsKMV                = errors.New("Set specified with float output")
+	InvalidMethod              = errors.New("Unrecognized method")
+	MethodSetSize              = errors.New("Method requires 2+ sets or keys")
+	InvalidM                   = errors.New("Method 'at_least' needs an m between 1 and the number of sets")
+)
+
+// Methods whose result is a set, which other expressions can operate on
+var setMethods = map[string]bool{
+	"get":   true,
+	"union": true,
+}
+
+type Element struct {
+	Method string    `json:"method"`
+	Set    []Element `json:"set,omitempty"`
+	Keys   []string  `json:"keys,omitempty"`
+	M      int       `json:"m,omitempty"` // for at_least, the number of sets a value must be in
+}
+
+type QueryResult struct {
+	Key        string                 `json:"key"`
+	Kmv        *kminvalues.KMinValues `json:"set"`
+	Num        float64                `json:"result"`
+	Multi      []*QueryResult         `json:"multi_result,omitempty"`
+	SampleSize *int                   `json:"sample_size,omitempty"`
+	Warning    string                 `json:"warning,omitempty"`
+}
+
+// Builds the result of an intersection estimate, flagging estimates based on
+// fewer than minCommon hashes since they are mostly noise.  The sample size
+// is the number of hashes the sets have in common.
+func IntersectionResult(key string, num float64, common, minCommon int) *QueryResult {
+	return &QueryResult{
+		Key:        key,
+		Num:        num,
+		SampleSize: &common,
+		Warning:    IntersectionWarning(common, minCommon),
+	}
+}
+
+func IntersectionWarning(common, minCommon int) string {
+	if common < minCommon {
+		return "FEW_COMMON_HASHES"
+	}
+	return ""
+}
+
+// The number a query comes down to, the cardinality of the resulting set for
+// set operations.  The set is left to the caller, since a get's is the
+// provider's own sketch.
+func (qr *QueryResult) Value() float64 {
+	if qr.Kmv == nil {
+		return qr.Num
+	}
+	return qr.Kmv.Cardinality()
+}
+
+// Parses and checks an expression, without loading any sketch
+func Parse(raw []byte) (*Element, error) {
+	e := Element{}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err
+	}
+	if err := e.Check(); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Checks that every method of the expression is known and has as many
+// operands as it takes
+func (e *Element) Check() error {
+	_, err := NewPlan(e)
+	return err
+}
+
+// A step of the evaluation of an expression.  Reads is the number of sketches
+// the step reads, once per pair for correlations since every pair is
+// intersected.
+type Step struct {
+	Expression string   `json:"expression"`
+	Method     string   `json:"method"`
+	Keys       []string `json:"keys,omitempty"`
+	Operands   int      `json:"operands"`
+	Reads      int      `json:"reads"`
+}
+
+// How an expression is evaluated, innermost expressions first
+type Plan struct {
+	Steps []Step `json:"steps"`
+}
+
+func NewPlan(e *Element) (*Plan, error) {
+	plan := &Plan{}
+	if _, err := plan.add(e); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// Adds the steps of e and returns the name of its result, which is how
+// QueryResult.Key names it
+func (p *Plan) add(e *Element) (string, error) {
+	if len(e.Keys) != 0 && len(e.Set) != 0 {
+		return "", KeysAndSetError
+	}
+	names := e.Keys
+	if len(e.Set) != 0 {
+		names = make([]string, len(e.Set))
+		for i := range e.Set {
+			name, err := p.add(&e.Set[i])
+			if err != nil {
+				return "", err
+			} else if !setMethods[e.Set[i].Method] {
+				return "", SetNeedsKMV
+			}
+			names[i] = name
+		}
+	}
+
+	n := len(names)
+	step := Step{Method: e.Method, Keys: e.Keys, Operands: n, Reads: n}
+	switch e.Method {
+	case "cardinality", "get":
+		if n != 1 {
+			return "", CardinalitySingleTermError
+		}
+	case "union", "jaccard", "cardinality_intersection", "cardinality_union", "correlation":
+		if n < 2 {
+			return "", MethodSetSize
+		}
+	case "at_least":
+		if n < 2 {
+			return "", MethodSetSize
+		} else if e.M < 1 || e.M > n {
+			return "", InvalidM
+		}
+	default:
+		return "", InvalidMethod
+	}
+
+	switch e.Method {
+	case "cardinality":
+		step.Expression = fmt.Sprintf("||%s||", names[0])
+	case "get":
+		step.Expression = names[0]
+	case "union":
+		step.Expression = strings.Join(names, " u ")
+	case "jaccard":
+		step.Expression = fmt.Sprintf("Jaccard(%s)", strings.Join(names, ", "))
+	case "cardinality_intersection":
+		step.Expression = fmt.Sprintf("||%s||", strings.Join(names, " n "))
+	case "at_least":
+		step.Expression = fmt.Sprintf("||%d of (%s)||", e.M, strings.Join(names, ", "))
+	case "cardinality_union":
+		step.Expression = fmt.Sprintf("||%s||", strings.Join(names, " u "))
+	case "correlation":
+		step.Expression = fmt.Sprintf("Corr(%s)", strings.Join(names, ", "))
+		step.Reads = n * (n - 1)
+	}
+	p.Steps = append(p.Steps, step)
+	return step.Expression, nil
+}
+
+// Every key the plan loads, once each, in the order they are first loaded
+func (p *Plan) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, step := range p.Steps {
+		for _, key := range step.Keys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// The number of hashes the plan reads if every set holds k of them
+func (p *Plan) Cost(k int) int {
+	cost := 0
+	for _, step := range p.Steps {
+		cost += step.Reads * k
+	}
+	return cost
+}
+
+// Where the sketches of an expression's keys come from
+type SketchProvider interface {
+	// The sketches of keys, in their order, with an empty set for a key that
+	// doesn't exist
+	Sketches(keys []string) ([]*kminvalues.KMinValues, error)
+}
+
+// A SketchProvider over sketches in memory.  Keys that aren't in Sets are
+// empty sets of K hashes of Width bits.
+type MapProvider struct {
+	Sets  map[string]*kminvalues.KMinValues
+	K     int
+	Width int
+}
+
+func (mp *MapProvider) Sketches(keys []string) ([]*kminvalues.KMinValues, error) {
+	sets := make([]*kminvalues.KMinValues, len(keys))
+	for i, key := range keys {
+		if kmv, found := mp.Sets[key]; found {
+			sets[i] = kmv
+			continue
+		}
+		kmv, err := kminvalues.NewKMinValuesWidth(mp.K, mp.Width)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = kmv
+	}
+	return sets, nil
+}
+
+// Intersects sets, eg: from a cache of earlier intersections
+type Intersector interface {
+	IntersectAtLeast(m int, sets ...*kminvalues.KMinValues) kminvalues.Intersection
+	// Intersects every pair of sets, in order
+	Correlate(sets []*kminvalues.KMinValues, f func(i, j int, intersection kminvalues.Intersection))
+}
+
+type directIntersector struct{}
+
+func (directIntersector) IntersectAtLeast(m int, sets ...*kminvalues.KMinValues) kminvalues.Intersection {
+	return kminvalues.IntersectAtLeast(m, sets...)
+}
+
+func (directIntersector) Correlate(sets []*kminvalues.KMinValues, f func(i, j int, intersection kminvalues.Intersection)) {
+	for i := range sets {
+		for j := i + 1; j < len(sets); j++ {
+			f(i, j, kminvalues.Intersect(sets[i], sets[j]))
+		}
+	}
+}
+
+// Evaluates expressions over the sketches of Provider.  Intersections are
+// computed by Intersector, directly if it is nil, and those on fewer than
+// MinCommonHashes common hashes carry a warning.
+type Evaluator struct {
+	Provider        SketchProvider
+	Intersector     Intersector
+	MinCommonHashes int
+}
+
+func (ev *Evaluator) Evaluate(e *Element) (*QueryResult, error) {
+	if err := e.Check(); err != nil {
+		return nil, err
+	}
+	intersector := ev.Intersector
+	if intersector == nil {
+		intersector = directIntersector{}
+	}
+	return ev.evaluate(e, intersector)
+}
+
+func (ev *Evaluator) evaluate(e *Element, intersector Intersector) (*QueryResult, error) {
+	var data []*kminvalues.KMinValues
+	var keys []string
+
+	if len(e.Keys) != 0 {
+		var err error
+		data, err = ev.Provider.Sketches(e.Keys)
+		if err != nil {
+			return nil, err
+		}
+		keys = e.Keys
+	} else {
+		data = make([]*kminvalues.KMinValues, len(e.Set))
+		keys = make([]string, len(e.Set))
+		for i := range e.Set {
+			tmp, err := ev.evaluate(&e.Set[i], intersector)
+			if err != nil {
+				return nil, err
+			}
+			data[i] = tmp.Kmv
+			keys[i] = tmp.Key
+		}
+	}
+
+	switch e.Method {
+	case "cardinality":
+		return &QueryResult{
+			Key: fmt.Sprintf("||%s||", keys[0]),
+			Num: data[0].Cardinality(),
+		}, nil
+	case "get":
+		return &QueryResult{
+			Key: keys[0],
+			Kmv: data[0],
+		}, nil
+	case "union":
+		return &QueryResult{
+			Key: strings.Join(keys, " u "),
+			Kmv: data[0].Union(data[1:]...),
+		}, nil
+	case "jaccard":
+		tmp := intersector.IntersectAtLeast(len(data), data...)
+		return IntersectionResult(fmt.Sprintf("Jaccard(%s)", strings.Join(keys, ", ")), tmp.Jaccard, tmp.Common, ev.MinCommonHashes), nil
+	case "cardinality_intersection":
+		tmp := intersector.IntersectAtLeast(len(data), data...)
+		return IntersectionResult(fmt.Sprintf("||%s||", strings.Join(keys, " n ")), tmp.Cardinality, tmp.Common, ev.MinCommonHashes), nil
+	case "at_least":
+		tmp := intersector.IntersectAtLeast(e.M, data...)
+		return IntersectionResult(fmt.Sprintf("||%d of (%s)||", e.M, strings.Join(keys, ", ")), tmp.Cardinality, tmp.Common, ev.MinCommonHashes), nil
+	case "cardinality_union":
+		return &QueryResult{
+			Key: fmt.Sprintf("||%s||", strings.Join(keys, " u ")),
+			Num: data[0].CardinalityUnion(data[1:]...),
+		}, nil
+	case "correlation":
+		N := len(data)
+		correlation := make([]*QueryResult, 0, N*(N-1)/2)
+		intersector.Correlate(data, func(i, j int, tmp kminvalues.Intersection) {
+			correlation = append(correlation, IntersectionResult(fmt.Sprintf("Jaccard(%s, %s)", keys[i], keys[j]), tmp.Jaccard, tmp.Common, ev.MinCommonHashes))
+		})
+		return &QueryResult{
+			Key:   fmt.Sprintf("Corr(%s)", strings.Join(keys, ", ")),
+			Multi: correlation,
+		}, nil
+	}
+	return nil, InvalidMethod
+}
@@ -0,0 +1,105 @@
+package algebra
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"math"
+	"testing"
+)
+
+// A set of the hashes of start..end, spread over the uint64 range
+func setOf(start, end int) *kminvalues.KMinValues {
+	kmv := kminvalues.NewKMinValues(256)
+	for i := start; i < end; i++ {
+		kmv.AddHash(uint64(i) * 0x9E3779B97F4A7C15)
+	}
+	return kmv
+}
+
+func TestParse(t *testing.T) {
+	e, err := Parse([]byte(`{"method" : "jaccard", "set" : [{"method" : "union", "keys" : ["a", "b"]}, {"method" : "get", "keys" : ["c"]}]}`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, e.Set[0].Keys, []string{"a", "b"})
+
+	for query, expected := range map[string]error{
+		`{"method" : "union", "keys" : ["a"], "set" : [{"method" : "get", "keys" : ["b"]}]}`:                             KeysAndSetError,
+		`{"method" : "cardinality", "keys" : ["a", "b"]}`:                                                                CardinalitySingleTermError,
+		`{"method" : "union", "set" : [{"method" : "cardinality", "keys" : ["a"]}, {"method" : "get", "keys" : ["b"]}]}`: SetNeedsKMV,
+		`{"method" : "difference", "keys" : ["a", "b"]}`:                                                                 InvalidMethod,
+		`{"method" : "jaccard", "keys" : ["a"]}`:                                                                         MethodSetSize,
+		`{"method" : "at_least", "m" : 3, "keys" : ["a", "b"]}`:                                                          InvalidM,
+	} {
+		_, err := Parse([]byte(query))
+		assert.Equal(t, err, expected, query)
+	}
+	_, err = Parse([]byte(`{"method" :`))
+	assert.NotEqual(t, err, nil)
+}
+
+func TestPlan(t *testing.T) {
+	e, _ := Parse([]byte(`{"method" : "jaccard", "set" : [{"method" : "union", "keys" : ["a", "b"]}, {"method" : "get", "keys" : ["a"]}]}`))
+	plan, err := NewPlan(e)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, plan.Steps, []Step{
+		{Expression: "a u b", Method: "union", Keys: []string{"a", "b"}, Operands: 2, Reads: 2},
+		{Expression: "a", Method: "get", Keys: []string{"a"}, Operands: 1, Reads: 1},
+		{Expression: "Jaccard(a u b, a)", Method: "jaccard", Operands: 2, Reads: 2},
+	})
+	assert.Equal(t, plan.Keys(), []string{"a", "b"})
+	assert.Equal(t, plan.Cost(100), 500)
+
+	e, _ = Parse([]byte(`{"method" : "correlation", "keys" : ["a", "b", "c"]}`))
+	plan, _ = NewPlan(e)
+	assert.Equal(t, plan.Cost(100), 600)
+}
+
+func TestEvaluate(t *testing.T) {
+	evaluator := Evaluator{
+		Provider:        &MapProvider{Sets: map[string]*kminvalues.KMinValues{"a": setOf(0, 1000), "b": setOf(500, 1500)}, K: 256, Width: 64},
+		MinCommonHashes: 10,
+	}
+
+	e, _ := Parse([]byte(`{"method" : "cardinality", "set" : [{"method" : "union", "keys" : ["a", "b"]}]}`))
+	result, err := evaluator.Evaluate(e)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, result.Key, "||a u b||")
+	assert.T(t, math.Abs(result.Num-1500)/1500 < 0.2, result.Num)
+
+	e, _ = Parse([]byte(`{"method" : "jaccard", "keys" : ["a", "b"]}`))
+	result, _ = evaluator.Evaluate(e)
+	assert.Equal(t, result.Key, "Jaccard(a, b)")
+	assert.T(t, math.Abs(result.Num-1.0/3) < 0.1, result.Num)
+	assert.Equal(t, result.Warning, "")
+
+	// keys that aren't provided are empty sets
+	e, _ = Parse([]byte(`{"method" : "cardinality_intersection", "keys" : ["a", "missing"]}`))
+	result, _ = evaluator.Evaluate(e)
+	assert.Equal(t, result.Num, 0.0)
+	assert.Equal(t, *result.SampleSize, 0)
+	assert.Equal(t, result.Warning, "FEW_COMMON_HASHES")
+
+	e, _ = Parse([]byte(`{"method" : "correlation", "keys" : ["a", "b", "missing"]}`))
+	result, _ = evaluator.Evaluate(e)
+	assert.Equal(t, len(result.Multi), 3)
+	assert.Equal(t, result.Multi[2].Key, "Jaccard(b, missing)")
+
+	_, err = evaluator.Evaluate(&Element{Method: "union", Keys: []string{"a"}})
+	assert.Equal(t, err, MethodSetSize)
+}
+
+// The value of a get leaves the provider's sketch as it was
+func TestValueOfGet(t *testing.T) {
+	provider := &MapProvider{Sets: map[string]*kminvalues.KMinValues{"a": setOf(0, 1000)}, K: 256, Width: 64}
+	evaluator := Evaluator{Provider: provider}
+	e, _ := Parse([]byte(`{"method" : "get", "keys" : ["a"]}`))
+
+	first, err := evaluator.Evaluate(e)
+	assert.Equal(t, err, nil)
+	value := first.Value()
+	assert.T(t, math.Abs(value-1000)/1000 < 0.2, value)
+
+	second, err := evaluator.Evaluate(e)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, second.Value(), value)
+	assert.Equal(t, provider.Sets["a"].Len(), 256)
+}
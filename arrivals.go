@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+type arrivalBucket struct {
+	Start   time.Time `json:"start"`
+	Uniques float64   `json:"uniques"`
+}
+
+type arrivals struct {
+	Key         string          `json:"key"`
+	Cardinality float64         `json:"cardinality"`
+	Interval    string          `json:"interval"`
+	Buckets     []arrivalBucket `json:"buckets"`
+	Untracked   float64         `json:"untracked"`
+}
+
+func firstSeenKey(key string) []byte {
+	return []byte(internalKeyPrefix + "firstseen:" + key)
+}
+
+// Records when a hash the set just retained was first seen.  A hash that ends
+// up among the final minima was retained from the moment it first arrived, so
+// the timestamps of the retained hashes are a uniform sample of the arrival
+// times of the set's distinct values.  Timestamps of hashes the set no longer
+// retains are dropped.
+func recordFirstSeen(batch *Batch, key string, kmv *kminvalues.KMinValues, hash uint64) error {
+	if !*trackFirstSeen {
+		return nil
+	}
+	data, err := batch.Get(firstSeenKey(key))
+	if err != nil {
+		return err
+	}
+	entries, err := decodeValues(data)
+	if err != nil {
+		return err
+	}
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.hash != hash && kmv.FindHash(entry.hash) >= 0 {
+			kept = append(kept, entry)
+		}
+	}
+	i := sort.Search(len(kept), func(i int) bool { return kept[i].hash >= hash })
+	kept = append(kept, valueEntry{})
+	copy(kept[i+1:], kept[i:])
+	timestamp := make([]byte, binary.MaxVarintLen64)
+	kept[i] = valueEntry{hash, timestamp[:binary.PutVarint(timestamp, time.Now().Unix())]}
+
+	batch.Put(firstSeenKey(key), encodeValues(kept))
+	return nil
+}
+
+// Estimates how many of the distinct values of `key` first arrived during each
+// `interval` (default 24h), from the first-seen timestamps of the hashes the
+// set retains.  Hashes retained before --track-first-seen was turned on, or
+// merged in from other sets, are counted as `untracked`.
+func ArrivalsHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	interval := 24 * time.Hour
+	if interval_raw := reqParams.Get("interval"); interval_raw != "" {
+		interval, err = time.ParseDuration(interval_raw)
+		if err != nil || interval <= 0 {
+			HttpError(w, 500, "INVALID_ARG_INTERVAL")
+			return
+		}
+	}
+
+	resultChan := make(chan Result)
+	getRequest := GetRequest{
+		Key:        key,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(getRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+		return
+	}
+	kmv := result.Data
+	defer kmv.Release()
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := readValue(dispatcher.database, ro, firstSeenKey(key))
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	entries, err := decodeValues(data)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+
+	response := arrivals{
+		Key:         key,
+		Cardinality: kmv.Cardinality(),
+		Interval:    interval.String(),
+		Buckets:     []arrivalBucket{},
+	}
+	if kmv.Len() == 0 {
+		HttpResponse(w, 200, response)
+		return
+	}
+
+	// Every retained hash stands in for the same share of the distinct values
+	weight := response.Cardinality / float64(kmv.Len())
+	counts := make(map[int64]int)
+	tracked := 0
+	for _, entry := range entries {
+		if kmv.FindHash(entry.hash) < 0 {
+			continue
+		}
+		timestamp, n := binary.Varint(entry.value)
+		if n <= 0 {
+			HttpResultError(w, key, CorruptValues)
+			return
+		}
+		start := time.Unix(timestamp, 0).Truncate(interval).Unix()
+		counts[start]++
+		tracked++
+	}
+	for start, count := range counts {
+		response.Buckets = append(response.Buckets, arrivalBucket{
+			Start:   time.Unix(start, 0).UTC(),
+			Uniques: float64(count) * weight,
+		})
+	}
+	sort.Slice(response.Buckets, func(i, j int) bool {
+		return response.Buckets[i].Start.Before(response.Buckets[j].Start)
+	})
+	response.Untracked = float64(kmv.Len()-tracked) * weight
+	HttpResponse(w, 200, response)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestArrivals(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_ARRIVALS"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kminvalues.NewKMinValues(4), ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	add := func(hash uint64) {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, ResultChan: resultChan})
+		<-resultChan
+	}
+	add(1 << 50)
+	*trackFirstSeen = true
+	defer func() { *trackFirstSeen = false }()
+	for i := uint64(2); i <= 6; i++ {
+		add(i << 58)
+	}
+	add(1 << 40)
+
+	w := httptest.NewRecorder()
+	ArrivalsHandler(w, httptest.NewRequest("GET", "/arrivals?interval=1h&key="+key, nil))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data arrivals `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	assert.Equal(t, len(response.Data.Buckets), 1)
+	weight := response.Data.Cardinality / 4
+	assert.Equal(t, response.Data.Buckets[0].Uniques, 3*weight)
+	assert.Equal(t, time.Since(response.Data.Buckets[0].Start) < time.Hour, true)
+	assert.Equal(t, response.Data.Untracked, weight)
+}
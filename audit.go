@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultAuditLimit = 100
+
+var auditLog *AuditLog
+
+type auditEntry struct {
+	Time      time.Time  `json:"time"`
+	Operation string     `json:"operation"`
+	Keys      []string   `json:"keys,omitempty"`
+	Params    url.Values `json:"params,omitempty"`
+	User      string     `json:"user,omitempty"`
+	Remote    string     `json:"remote"`
+	Status    int        `json:"status"`
+}
+
+// An append only file of the administrative and destructive requests made,
+// one JSON entry per line
+type AuditLog struct {
+	sync.Mutex
+	filename string
+	file     *os.File
+}
+
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{filename: filename, file: file}, nil
+}
+
+func (al *AuditLog) Record(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	al.Lock()
+	defer al.Unlock()
+	if _, err := al.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return al.file.Sync()
+}
+
+// Returns the last limit entries matching the key and operation, if given,
+// recorded after since
+func (al *AuditLog) Query(key, operation string, since time.Time, limit int) ([]auditEntry, error) {
+	al.Lock()
+	defer al.Unlock()
+	file, err := os.Open(al.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]auditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if !entry.Time.After(since) || operation != "" && entry.Operation != operation {
+			continue
+		}
+		if key != "" && !containsString(entry.Keys, key) {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (al *AuditLog) Close() error {
+	return al.file.Close()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Recorded responses can still be streamed
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Wraps a handler so that its requests are recorded in the audit log.  If
+// params are given only requests passing one of them are recorded, so that
+// eg: reading the batching policy isn't recorded but changing it is.  The user
+// is taken from basic auth or the X-Remote-User header set by a proxy in
+// front of the server.
+func auditHandler(operation string, handler http.HandlerFunc, params ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auditLog == nil {
+			handler(w, r)
+			return
+		}
+		reqParams, _ := url.ParseQuery(r.URL.RawQuery)
+		audited := len(params) == 0
+		for _, param := range params {
+			if _, found := reqParams[param]; found {
+				audited = true
+			}
+		}
+		if !audited {
+			handler(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		handler(recorder, r)
+		recordAudit(operation, r, recorder.status)
+	}
+}
+
+// Records a request in the audit log, if there is one.  Values are left out
+// since they can be the personal data a request is meant to remove.
+func recordAudit(operation string, r *http.Request, status int) {
+	if auditLog == nil {
+		return
+	}
+	reqParams, _ := url.ParseQuery(r.URL.RawQuery)
+	delete(reqParams, "value")
+	user, _, _ := r.BasicAuth()
+	if user == "" {
+		user = r.Header.Get("X-Remote-User")
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	entry := auditEntry{
+		Time:      time.Now(),
+		Operation: operation,
+		Keys:      reqParams["key"],
+		Params:    reqParams,
+		User:      user,
+		Remote:    remote,
+		Status:    status,
+	}
+	if err := auditLog.Record(entry); err != nil {
+		log.Printf("Could not record %s in the audit log: %s", operation, err)
+	}
+}
+
+// Returns the last `limit` (default 100) entries of the audit log, optionally
+// only those for a `key` or `operation` or recorded after `since` (RFC3339)
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+	if auditLog == nil {
+		HttpError(w, 500, "AUDIT_LOG_DISABLED")
+		return
+	}
+
+	limit := defaultAuditLimit
+	if limit_raw := reqParams.Get("limit"); limit_raw != "" {
+		limit, err = strconv.Atoi(limit_raw)
+		if err != nil || limit <= 0 {
+			HttpError(w, 500, "INVALID_ARG_LIMIT")
+			return
+		}
+	}
+
+	var since time.Time
+	if since_raw := reqParams.Get("since"); since_raw != "" {
+		since, err = time.Parse(time.RFC3339, since_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_SINCE")
+			return
+		}
+	}
+
+	entries, err := auditLog.Query(reqParams.Get("key"), reqParams.Get("operation"), since, limit)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	HttpResponse(w, 200, entries)
+}
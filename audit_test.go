@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	file, _ := ioutil.TempFile("", "audit")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	var err error
+	auditLog, err = OpenAuditLog(file.Name())
+	assert.Equal(t, err, nil)
+	defer func() {
+		auditLog.Close()
+		auditLog = nil
+	}()
+
+	handler := auditHandler("readonly", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+	}, "enabled")
+	request := func(target string) {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("X-Remote-User", "alice")
+		handler(httptest.NewRecorder(), r)
+	}
+	request("/admin/readonly")
+	request("/admin/readonly?enabled=true&key=k1")
+	request("/admin/readonly?enabled=false&key=k2")
+
+	w := httptest.NewRecorder()
+	AuditHandler(w, httptest.NewRequest("GET", "/admin/audit", nil))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data []auditEntry `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, len(response.Data), 2)
+	assert.Equal(t, response.Data[0].Operation, "readonly")
+	assert.Equal(t, response.Data[0].User, "alice")
+	assert.Equal(t, response.Data[0].Status, 202)
+	assert.Equal(t, response.Data[0].Params.Get("enabled"), "true")
+
+	entries, err := auditLog.Query("k2", "", response.Data[0].Time.Add(-1), 100)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Keys, []string{"k2"})
+	entries, _ = auditLog.Query("", "", response.Data[0].Time.Add(-1), 1)
+	assert.Equal(t, entries[0].Keys, []string{"k2"})
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"sync"
+	"time"
+)
+
+// Controls how many requests a worker groups into a single write to the
+// database.  A batch is written once it holds MaxSize requests or MaxBytes of
+// data, or once MaxLatency has passed since it was started.  With a MaxLatency
+// of 0 a worker never waits for more requests and writes whatever was already
+// queued up.
+//
+// Flush picks when requests get their results, and so how much can be lost in
+// a crash, and Sync makes every write wait for the OS to flush it to disk.
+type BatchPolicy struct {
+	MaxSize    int           `json:"max_size"`
+	MaxLatency time.Duration `json:"max_latency"`
+	MaxBytes   int           `json:"max_bytes"`
+	Flush      FlushMode     `json:"flush"`
+	Sync       bool          `json:"sync"`
+}
+
+type FlushMode string
+
+const (
+	// Every request is written on its own before it gets its result
+	FlushPerRequest FlushMode = "request"
+	// Requests get their results once their batch has been written
+	FlushPerBatch FlushMode = "batch"
+	// Requests get their results as soon as they are executed and batches
+	// are written in the background, at most MaxLatency later
+	FlushOnTimer FlushMode = "timer"
+)
+
+var (
+	batchPolicyLock sync.RWMutex
+	batchPolicy     = BatchPolicy{
+		MaxSize:    *batchMaxSize,
+		MaxLatency: *batchMaxLatency,
+		MaxBytes:   *batchMaxBytes,
+		Flush:      FlushPerBatch,
+	}
+)
+
+func (policy BatchPolicy) validate() error {
+	if policy.MaxSize <= 0 {
+		return errors.New("batch size must be greater than 0")
+	} else if policy.MaxBytes <= 0 {
+		return errors.New("batch bytes must be greater than 0")
+	} else if policy.MaxLatency < 0 {
+		return errors.New("batch latency can't be negative")
+	}
+	switch policy.Flush {
+	case FlushPerRequest, FlushPerBatch:
+	case FlushOnTimer:
+		if policy.MaxLatency == 0 {
+			return errors.New("flushing on a timer needs a batch latency")
+		}
+	default:
+		return errors.New("flush mode must be request, batch or timer")
+	}
+	return nil
+}
+
+func getBatchPolicy() BatchPolicy {
+	batchPolicyLock.RLock()
+	defer batchPolicyLock.RUnlock()
+	return batchPolicy
+}
+
+func setBatchPolicy(policy BatchPolicy) {
+	batchPolicyLock.Lock()
+	batchPolicy = policy
+	batchPolicyLock.Unlock()
+}
+
+// Wrapping a request in a FlushRequest makes the worker write out its batch
+// as soon as the request has been executed, for writers that care more about
+// latency than throughput.
+type FlushRequest struct {
+	RequestCommand
+}
+
+// Wrapping a request in a DurableRequest holds its result back until its
+// batch has been written, even when flushing on a timer, for writers that
+// acknowledge what they were sent, eg: event sources.
+type DurableRequest struct {
+	RequestCommand
+}
+
+type batchOp struct {
+	key    string
+	value  []byte
+	delete bool
+	pooled bool // value goes back to the buffer pool once written
+}
+
+type pendingResult struct {
+	request RequestCommand
+	result  Result
+}
+
+// A Batch collects the writes of several requests so they can be written to
+// the database at once.  Reads through the batch see the writes it holds, and
+// changes are only published, and results only given back, once the batch has
+// been committed.
+type Batch struct {
+	database *levigo.DB
+	ro       *levigo.ReadOptions
+	ops      []batchOp
+	pending  map[string]int  // key -> index of latest op in ops
+	stored   map[string]bool // whether keys read from the DB exist there
+	existed  map[string]bool // whether keys written held a set, until their change is published
+	changes  []Change
+	exact    []exactUpdate // applied to the verifier once the batch is written
+	results  []pendingResult
+	requests int
+	size     int
+	started  time.Time
+
+	// Keys reserved against --max-keys by the batch and keys it deleted,
+	// which only free their slot once the batch has been written
+	newKeys     int
+	deletedKeys int
+}
+
+// Marks a point in the batch that it can be rolled back to
+type savepoint struct {
+	ops         int
+	changes     int
+	exact       int
+	size        int
+	newKeys     int
+	deletedKeys int
+}
+
+func NewBatch(database *levigo.DB, ro *levigo.ReadOptions) *Batch {
+	return &Batch{
+		database: database,
+		ro:       ro,
+		pending:  make(map[string]int),
+		stored:   make(map[string]bool),
+		existed:  make(map[string]bool),
+	}
+}
+
+func (b *Batch) Get(key []byte) ([]byte, error) {
+	if i, found := b.pending[string(key)]; found {
+		if b.ops[i].delete {
+			return nil, nil
+		}
+		// Requests deserialize sets in place, so they get their own copy
+		value := make([]byte, len(b.ops[i].value))
+		copy(value, b.ops[i].value)
+		return value, nil
+	}
+	value, err := readValue(b.database, b.ro, key)
+	if err == nil {
+		b.stored[string(key)] = len(value) != 0
+	}
+	return value, err
+}
+
+// Whether key holds a set, taking the writes in the batch into account
+func (b *Batch) exists(key []byte) (bool, error) {
+	if i, found := b.pending[string(key)]; found {
+		return !b.ops[i].delete, nil
+	} else if stored, found := b.stored[string(key)]; found {
+		return stored, nil
+	}
+	value, err := b.Get(key)
+	return len(value) != 0, err
+}
+
+// Checks a set that is about to be written against the limits on new keys
+func (b *Batch) checkLimits(key []byte, kmv *kminvalues.KMinValues) error {
+	if *maxK <= 0 && !keyLimitEnabled() {
+		return nil
+	}
+	exists, err := b.exists(key)
+	if err != nil || exists {
+		return err
+	}
+	if *maxK > 0 && kmv.MaxSize() > *maxK {
+		return SketchTooLarge
+	}
+	if keyLimitEnabled() {
+		if err := reserveKey(); err != nil {
+			return err
+		}
+		b.newKeys++
+	}
+	return nil
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.put(batchOp{key: string(key), value: value})
+}
+
+// Puts the serialized sketch, using a pooled buffer that is recycled once the
+// batch is done with it
+func (b *Batch) PutSketch(key []byte, kmv *kminvalues.KMinValues) error {
+	if isInternalKey(key) {
+		return InvalidKey
+	}
+	exists, err := b.exists(key)
+	if err != nil {
+		return err
+	}
+	b.existed[string(key)] = exists
+	if err := b.checkLimits(key, kmv); err != nil {
+		return err
+	}
+	if !exists {
+		if err := applyKeyPolicy(b, string(key)); err != nil {
+			return err
+		}
+	}
+	value := kmv.PooledBytes()
+	if *compressSketches {
+		value = kmv.PooledCompressedBytes()
+	}
+	b.put(batchOp{key: string(key), value: value, pooled: true})
+	b.Put(summaryKey(string(key)), encodeSummary(newKeySummary(kmv, value, time.Now())))
+	return nil
+}
+
+func (b *Batch) put(op batchOp) {
+	b.pending[op.key] = len(b.ops)
+	b.ops = append(b.ops, op)
+	b.size += len(op.key) + len(op.value)
+}
+
+func (b *Batch) Delete(key []byte) error {
+	if !isInternalKey(key) {
+		exists, err := b.exists(key)
+		if err != nil {
+			return err
+		}
+		b.existed[string(key)] = exists
+		if exists && keyLimitEnabled() {
+			b.deletedKeys++
+		}
+	}
+	b.pending[string(key)] = len(b.ops)
+	b.ops = append(b.ops, batchOp{key: string(key), delete: true})
+	b.size += len(key)
+	return nil
+}
+
+// Queues a change to be published once the batch is committed
+func (b *Batch) Publish(key string, kmv, delta *kminvalues.KMinValues) {
+	existed := b.existed[key]
+	delete(b.existed, key)
+	b.changes = append(b.changes, Change{Key: key, Kmv: kmv, Delta: delta, Existed: existed})
+}
+
+// Records hashes added to key, whose set was empty before if fresh, in its
+// exact set once the batch is committed
+func (b *Batch) ObserveExact(key string, fresh bool, hashes ...uint64) {
+	if verifier.tracks(key) {
+		b.exact = append(b.exact, exactUpdate{key: key, fresh: fresh, hashes: append([]uint64(nil), hashes...)})
+	}
+}
+
+// Same as ExactVerifier.Invalidate once the batch is committed
+func (b *Batch) InvalidateExact(key string) {
+	if verifier.tracks(key) {
+		b.exact = append(b.exact, exactUpdate{key: key, invalidate: true})
+	}
+}
+
+// Same as ExactVerifier.Forget once the batch is committed
+func (b *Batch) ForgetExact(key string) {
+	if verifier.tracks(key) {
+		b.exact = append(b.exact, exactUpdate{key: key, forget: true})
+	}
+}
+
+func (b *Batch) savepoint() savepoint {
+	return savepoint{len(b.ops), len(b.changes), len(b.exact), b.size, b.newKeys, b.deletedKeys}
+}
+
+// Throws away everything added to the batch since the savepoint
+func (b *Batch) rollback(sp savepoint) {
+	b.exact = b.exact[:sp.exact]
+	b.changes = b.changes[:sp.changes]
+	// Keys are reserved before the ops that write them, eg: by a key policy
+	// that fails, so they are given back even if nothing was written
+	releaseKeys(b.newKeys - sp.newKeys)
+	b.newKeys = sp.newKeys
+	b.deletedKeys = sp.deletedKeys
+	if len(b.ops) == sp.ops {
+		return
+	}
+	recycleOps(b.ops[sp.ops:])
+	b.ops = b.ops[:sp.ops]
+	b.size = sp.size
+	b.pending = make(map[string]int, len(b.ops))
+	for i, op := range b.ops {
+		b.pending[op.key] = i
+	}
+}
+
+// Executes a request against the batch.  Requests that fail leave the batch
+// as it was before they ran.
+func (b *Batch) execute(request RequestCommand) {
+	if b.requests == 0 {
+		b.started = time.Now()
+	}
+	b.requests++
+	sp := b.savepoint()
+	kmv, err := request.Execute(b)
+	if err != nil {
+		b.rollback(sp)
+	}
+	b.results = append(b.results, pendingResult{request, Result{Data: kmv, Error: err}})
+}
+
+// Number of requests executed since the batch was last written
+func (b *Batch) Len() int { return b.requests }
+
+// Whether the batch should be written out under the given policy
+func (b *Batch) full(policy BatchPolicy) bool {
+	return policy.Flush == FlushPerRequest || b.requests >= policy.MaxSize || b.size >= policy.MaxBytes
+}
+
+// Gives requests their results without waiting for the batch to be written,
+// except for durable requests
+func (b *Batch) acknowledge() {
+	held := b.results[:0]
+	for _, pr := range b.results {
+		if _, durable := pr.request.(DurableRequest); durable {
+			held = append(held, pr)
+			continue
+		}
+		pr.request.WriteResult(pr.result)
+	}
+	b.results = held
+}
+
+// Writes the batch to the database, publishes its changes and gives every
+// request still waiting its result.  If the write fails those requests get the
+// error, since even reads could have seen the lost writes.
+func (b *Batch) Commit(wo *levigo.WriteOptions) error {
+	var err error
+	if len(b.ops) != 0 {
+		wb := levigo.NewWriteBatch()
+		for _, op := range b.ops {
+			if op.delete {
+				wb.Delete([]byte(op.key))
+			} else {
+				wb.Put([]byte(op.key), sealValue([]byte(op.key), op.value))
+			}
+		}
+		err = b.database.Write(wo, wb)
+		wb.Close()
+	}
+
+	if err == nil {
+		releaseKeys(b.deletedKeys)
+		for _, change := range b.changes {
+			changes.publish(change)
+		}
+		for _, update := range b.exact {
+			verifier.apply(update)
+		}
+	} else {
+		releaseKeys(b.newKeys)
+	}
+	for _, pr := range b.results {
+		if err != nil && pr.result.Error == nil {
+			pr.result = Result{Error: err}
+		}
+		pr.request.WriteResult(pr.result)
+	}
+
+	recycleOps(b.ops)
+	b.ops = b.ops[:0]
+	b.changes = b.changes[:0]
+	b.exact = b.exact[:0]
+	b.results = b.results[:0]
+	b.pending = make(map[string]int)
+	b.stored = make(map[string]bool)
+	b.existed = make(map[string]bool)
+	b.newKeys = 0
+	b.deletedKeys = 0
+	b.requests = 0
+	b.size = 0
+	return err
+}
+
+func recycleOps(ops []batchOp) {
+	for i := range ops {
+		if ops[i].pooled {
+			kminvalues.PutBuffer(ops[i].value)
+		}
+		ops[i] = batchOp{}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open("./db/tmp", opts)
+	assert.Equal(t, err, nil)
+	defer db.Close()
+	ro := levigo.NewReadOptions()
+	wo := levigo.NewWriteOptions()
+	defer ro.Close()
+	defer wo.Close()
+
+	key := "_GOTEST_TESTBATCH"
+	db.Delete(wo, []byte(key))
+	defer db.Delete(wo, []byte(key))
+
+	oldChanges := changes
+	changes = NewChangeFeed(0)
+	defer func() { changes = oldChanges }()
+	updates := changes.Subscribe([]string{key}, 10)
+
+	resultChan := make(chan Result, 10)
+	batch := NewBatch(db, ro)
+	batch.execute(AddHashRequest{Key: key, Hash: 1, ResultChan: resultChan})
+	batch.execute(AddHashRequest{Key: key, Hash: 2, ResultChan: resultChan})
+	batch.execute(MultiAddHashRequest{Keys: []string{key, ""}, Hash: 3, ResultChan: resultChan})
+	batch.execute(GetRequest{Key: key, ResultChan: resultChan})
+
+	// nothing is written, published or returned until the batch is committed
+	data, _ := db.Get(ro, []byte(key))
+	assert.Equal(t, len(data), 0)
+	assert.Equal(t, len(updates), 0)
+	assert.Equal(t, len(resultChan), 0)
+	assert.Equal(t, batch.Len(), 4)
+
+	err = batch.Commit(wo)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, batch.Len(), 0)
+	assert.Equal(t, len(updates), 2)
+
+	for i := 0; i < 3; i++ {
+		result := <-resultChan
+		if i == 2 {
+			assert.Equal(t, result.Error, NoKeySpecified)
+		} else {
+			assert.Equal(t, result.Error, nil)
+		}
+	}
+	// the get sees the adds from earlier in the batch but not the failed one
+	result := <-resultChan
+	assert.Equal(t, result.Data.Cardinality(), 2.0)
+
+	data, _ = db.Get(ro, []byte(key))
+	kmv, _ := kminvalues.KMinValuesFromBytes(data)
+	assert.Equal(t, kmv.Cardinality(), 2.0)
+}
+
+func TestBatchPolicy(t *testing.T) {
+	oldPolicy := getBatchPolicy()
+	defer setBatchPolicy(oldPolicy)
+	setBatchPolicy(BatchPolicy{MaxSize: 3, MaxLatency: time.Hour, MaxBytes: 1 << 20})
+
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_TESTBATCHPOLICY"
+	resultChan := make(chan Result, 10)
+	for i := 0; i < 2; i++ {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, len(resultChan), 0)
+
+	// a full batch gets written
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	for i := 0; i < 3; i++ {
+		result := <-resultChan
+		assert.Equal(t, result.Error, nil)
+	}
+
+	// and so does a batch with a request that asks for it
+	dispatcher.Dispatch(FlushRequest{GetRequest{Key: key, ResultChan: resultChan}})
+	result := <-resultChan
+	assert.Equal(t, result.Data.Len(), 0)
+}
+
+func TestFlushOnTimer(t *testing.T) {
+	oldPolicy := getBatchPolicy()
+	defer setBatchPolicy(oldPolicy)
+	policy := BatchPolicy{MaxSize: 100, MaxBytes: 1 << 20, Flush: FlushOnTimer}
+	assert.NotEqual(t, policy.validate(), nil)
+	policy.MaxLatency = 50 * time.Millisecond
+	assert.Equal(t, policy.validate(), nil)
+	setBatchPolicy(policy)
+
+	SetupDB()
+	defer CloseDB()
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+
+	key := "_GOTEST_TESTFLUSHONTIMER"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(FlushRequest{DeleteRequest{Key: key, ResultChan: resultChan}})
+		<-resultChan
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// the add is acknowledged before it is written
+	dispatcher.Dispatch(AddHashRequest{Key: key, Hash: 1, ResultChan: resultChan})
+	result := <-resultChan
+	assert.Equal(t, result.Error, nil)
+	data, _ := dispatcher.database.Get(ro, []byte(key))
+	assert.Equal(t, len(data), 0)
+
+	time.Sleep(100 * time.Millisecond)
+	data, _ = dispatcher.database.Get(ro, []byte(key))
+	kmv, _ := kminvalues.KMinValuesFromBytes(data)
+	assert.Equal(t, kmv.Len(), 1)
+
+	// while durable adds only get their result once written
+	dispatcher.Dispatch(DurableRequest{AddHashRequest{Key: key, Hash: 2, ResultChan: resultChan}})
+	result = <-resultChan
+	assert.Equal(t, result.Error, nil)
+	data, _ = dispatcher.database.Get(ro, []byte(key))
+	kmv, _ = kminvalues.KMinValuesFromBytes(data)
+	assert.Equal(t, kmv.Len(), 2)
+}
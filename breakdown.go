@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Label that values are counted under once a key has --max-labels labels
+const overflowLabel = "_other"
+
+type breakdown struct {
+	Key    string             `json:"key"`
+	Total  float64            `json:"total"`
+	Labels map[string]float64 `json:"labels"`
+}
+
+func breakdownKey(key string) []byte {
+	return []byte(internalKeyPrefix + "breakdown:" + key)
+}
+
+// A breakdown keeps one sketch per label of a set, eg: per country, stored
+// together sorted by label as the uvarint length of the label, the label, the
+// uvarint length of the sketch and the sketch.  The set itself stays the
+// de-duplicated total over all labels.
+func decodeBreakdown(data []byte) (map[string]*kminvalues.KMinValues, error) {
+	labels := make(map[string]*kminvalues.KMinValues)
+	for len(data) != 0 {
+		var fields [2][]byte
+		for i := range fields {
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, CorruptValues
+			}
+			fields[i] = data[n : n+int(length)]
+			data = data[n+int(length):]
+		}
+		kmv, err := kminvalues.KMinValuesFromBytes(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		labels[string(fields[0])] = kmv
+	}
+	return labels, nil
+}
+
+func encodeBreakdown(labels map[string]*kminvalues.KMinValues) []byte {
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	for _, label := range names {
+		sketch := labels[label].Bytes()
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(label)))])
+		buf.WriteString(label)
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(sketch)))])
+		buf.Write(sketch)
+	}
+	return buf.Bytes()
+}
+
+// Adds hash to the sketch of label in the breakdown of key.  New label
+// sketches get the same size and width as the set.  Once the key has
+// --max-labels labels, new labels are counted under "_other".
+func updateBreakdown(batch *Batch, key string, kmv *kminvalues.KMinValues, hash uint64, label string) error {
+	data, err := batch.Get(breakdownKey(key))
+	if err != nil {
+		return err
+	}
+	labels, err := decodeBreakdown(data)
+	if err != nil {
+		return err
+	}
+
+	sketch, found := labels[label]
+	if !found && *maxLabels > 0 && len(labels) >= *maxLabels {
+		label = overflowLabel
+		sketch, found = labels[label]
+	}
+	if !found {
+		sketch, err = kminvalues.NewKMinValuesWidth(kmv.MaxSize(), kmv.HashWidth())
+		if err != nil {
+			return err
+		}
+		labels[label] = sketch
+	}
+	if !sketch.AddHash(hash) {
+		return nil
+	}
+	batch.Put(breakdownKey(key), encodeBreakdown(labels))
+	return nil
+}
+
+// Returns the cardinality of every label of `key`, for values added with a
+// `label`, along with the de-duplicated total of the set.
+func BreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	resultChan := make(chan Result)
+	getRequest := GetRequest{
+		Key:        key,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(getRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+		return
+	}
+	total := result.Data.Cardinality()
+	result.Data.Release()
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := readValue(dispatcher.database, ro, breakdownKey(key))
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	labels, err := decodeBreakdown(data)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+
+	response := breakdown{
+		Key:    key,
+		Total:  total,
+		Labels: make(map[string]float64, len(labels)),
+	}
+	for label, sketch := range labels {
+		response.Labels[label] = sketch.Cardinality()
+	}
+	HttpResponse(w, 200, response)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBreakdown(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_BREAKDOWN"
+	resultChan := make(chan Result)
+	clean := func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}
+	clean()
+	defer clean()
+
+	*maxLabels = 2
+	defer func() { *maxLabels = 64 }()
+
+	add := func(value, label string) {
+		w := httptest.NewRecorder()
+		AddHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/add?key=%s&value=%s&label=%s", key, value, label), nil))
+		assert.Equal(t, w.Code, 200)
+	}
+	for i := 0; i < 10; i++ {
+		add(fmt.Sprintf("user%d", i), "US")
+	}
+	for i := 5; i < 12; i++ {
+		add(fmt.Sprintf("user%d", i), "FR")
+	}
+	add("user20", "DE")
+	add("user21", "")
+
+	w := httptest.NewRecorder()
+	BreakdownHandler(w, httptest.NewRequest("GET", "/breakdown?key="+key, nil))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data breakdown `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, response.Data.Total, 14.0)
+	assert.Equal(t, response.Data.Labels, map[string]float64{"US": 10, "FR": 7, overflowLabel: 1})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"math"
+	"sync"
+)
+
+var (
+	ChangelogDisabled = NewAPIError(500, "CHANGELOG_DISABLED", "Changelog is disabled", false)
+	CursorExpired     = NewAPIError(410, "CURSOR_EXPIRED", "Changes since cursor are no longer retained", false)
+)
+
+// A Change is published every time a set is written to the database.  Kmv is
+// nil when the key was deleted.  Delta holds the hashes inserted by the change
+// (see kminvalues.Diff) and is nil when the change can't be expressed as one,
+// eg: when the set was replaced or deleted.  Seq increases by one for every
+// change.  Existed is whether the key held a set before the change, so a
+// change with a set that didn't exist created the key.
+type Change struct {
+	Seq     uint64
+	Key     string
+	Kmv     *kminvalues.KMinValues
+	Delta   *kminvalues.KMinValues
+	Existed bool
+}
+
+type subscription struct {
+	keys     map[string]bool // nil for every key
+	lossless bool
+}
+
+// Fans out changes to subscribers interested in particular keys.  Publishing
+// never blocks the database workers, so subscribers that fall behind miss
+// changes instead.  Followers of the full changelog can't miss changes, so
+// they are dropped if they fall behind and have to resume from their last
+// sequence number.
+//
+// If logSize is non zero the last logSize changes are kept so followers can
+// resume from a cursor.  Changes kept in the log hold their own copy of the
+// set.
+type ChangeFeed struct {
+	sync.Mutex
+	seq         uint64
+	log         []Change
+	logSize     int
+	subscribers map[chan Change]subscription
+}
+
+var changes = NewChangeFeed(0)
+
+func NewChangeFeed(logSize int) *ChangeFeed {
+	return &ChangeFeed{
+		log:         make([]Change, 0, logSize),
+		logSize:     logSize,
+		subscribers: make(map[chan Change]subscription),
+	}
+}
+
+// Returns a channel receiving changes to any of the given keys.  The channel
+// must be given back to Unsubscribe once the caller is done with it.
+func (cf *ChangeFeed) Subscribe(keys []string, buffer int) chan Change {
+	keySet := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		keySet[key] = true
+	}
+
+	c := make(chan Change, buffer)
+	cf.Lock()
+	cf.subscribers[c] = subscription{keys: keySet}
+	cf.Unlock()
+	return c
+}
+
+// Returns all retained changes after the sequence number since along with a
+// channel receiving every change after those.  The channel is closed if the
+// follower falls more than buffer changes behind.
+func (cf *ChangeFeed) Follow(since uint64, buffer int) ([]Change, chan Change, error) {
+	cf.Lock()
+	defer cf.Unlock()
+
+	if cf.logSize == 0 {
+		return nil, nil, ChangelogDisabled
+	}
+	if since > cf.seq {
+		since = cf.seq
+	}
+	missed := int(cf.seq - since)
+	if missed > len(cf.log) {
+		return nil, nil, CursorExpired
+	}
+	backlog := make([]Change, 0, missed)
+	for s := since + 1; s <= cf.seq; s++ {
+		backlog = append(backlog, cf.log[int((s-1)%uint64(cf.logSize))])
+	}
+
+	c := make(chan Change, buffer)
+	cf.subscribers[c] = subscription{lossless: true}
+	return backlog, c, nil
+}
+
+func (cf *ChangeFeed) Unsubscribe(c chan Change) {
+	cf.Lock()
+	defer cf.Unlock()
+	if _, found := cf.subscribers[c]; found {
+		delete(cf.subscribers, c)
+		close(c)
+	}
+}
+
+// Returns a channel receiving changes to every key, see Subscribe
+func (cf *ChangeFeed) SubscribeAll(buffer int) chan Change {
+	c := make(chan Change, buffer)
+	cf.Lock()
+	cf.subscribers[c] = subscription{}
+	cf.Unlock()
+	return c
+}
+
+func (cf *ChangeFeed) Publish(key string, kmv, delta *kminvalues.KMinValues) {
+	cf.publish(Change{Key: key, Kmv: kmv, Delta: delta})
+}
+
+func (cf *ChangeFeed) publish(change Change) {
+	cf.Lock()
+	defer cf.Unlock()
+
+	cf.seq++
+	change.Seq = cf.seq
+	key := change.Key
+	if cf.logSize > 0 {
+		if change.Kmv != nil {
+			change.Kmv, _ = kminvalues.KMinValuesFromBytes(change.Kmv.Bytes())
+		}
+		if change.Delta != nil {
+			change.Delta, _ = kminvalues.KMinValuesFromBytes(change.Delta.Bytes())
+		}
+		if len(cf.log) < cf.logSize {
+			cf.log = append(cf.log, change)
+		} else {
+			cf.log[int((cf.seq-1)%uint64(cf.logSize))] = change
+		}
+	}
+
+	for c, sub := range cf.subscribers {
+		if sub.keys != nil && !sub.keys[key] {
+			continue
+		}
+		select {
+		case c <- change:
+		default:
+			if sub.lossless {
+				delete(cf.subscribers, c)
+				close(c)
+			}
+		}
+	}
+}
+
+// Whether a cardinality moved by more than delta, relative to the previous
+// value.  A delta of 0 reports every change.
+func cardinalityChanged(prev, card, delta float64) bool {
+	return math.Abs(card-prev) > delta*math.Max(prev, 1)
+}
+
+// Approximate bytes held by the sets in the log
+func (cf *ChangeFeed) memoryBytes() int64 {
+	cf.Lock()
+	defer cf.Unlock()
+	var total int64
+	for _, change := range cf.log {
+		total += int64(len(change.Key)) + sketchMemory(change.Kmv) + sketchMemory(change.Delta)
+	}
+	return total
+}
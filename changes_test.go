@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"testing"
+)
+
+func TestChangeFeed(t *testing.T) {
+	cf := NewChangeFeed(0)
+
+	c := cf.Subscribe([]string{"key1", "key2"}, 2)
+	kmv := kminvalues.NewKMinValues(10)
+
+	cf.Publish("key1", kmv, nil)
+	cf.Publish("key3", kmv, nil)
+	cf.Publish("key2", nil, nil)
+	// the subscriber's buffer is full so this change is dropped
+	cf.Publish("key1", kmv, nil)
+
+	change := <-c
+	assert.Equal(t, change.Key, "key1")
+	assert.Equal(t, change.Kmv, kmv)
+	change = <-c
+	assert.Equal(t, change.Key, "key2")
+	assert.Equal(t, len(c), 0)
+
+	cf.Unsubscribe(c)
+	cf.Publish("key1", kmv, nil)
+	_, ok := <-c
+	assert.Equal(t, ok, false)
+}
+
+func TestCardinalityChanged(t *testing.T) {
+	assert.Equal(t, cardinalityChanged(100, 100, 0), false)
+	assert.Equal(t, cardinalityChanged(100, 101, 0), true)
+	assert.Equal(t, cardinalityChanged(100, 105, 0.1), false)
+	assert.Equal(t, cardinalityChanged(100, 89, 0.1), true)
+	assert.Equal(t, cardinalityChanged(0, 1, 0.5), true)
+}
+
+func TestChangeFeedFollow(t *testing.T) {
+	cf := NewChangeFeed(3)
+	kmv := kminvalues.NewKMinValues(10)
+
+	_, _, err := NewChangeFeed(0).Follow(0, 1)
+	assert.Equal(t, err, ChangelogDisabled)
+
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		hash := GetRandHash()
+		kmv.AddHash(hash)
+		cf.Publish(key, kmv, kmv.HashDelta(hash))
+	}
+
+	_, _, err = cf.Follow(0, 1)
+	assert.Equal(t, err, CursorExpired)
+
+	backlog, c, err := cf.Follow(2, 1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(backlog), 2)
+	assert.Equal(t, backlog[0].Seq, uint64(3))
+	assert.Equal(t, backlog[0].Key, "key3")
+	assert.Equal(t, backlog[0].Kmv.Cardinality(), 3.0)
+	assert.Equal(t, backlog[1].Key, "key4")
+	assert.Equal(t, backlog[1].Delta.Len(), 1)
+
+	cf.Publish("key5", nil, nil)
+	change := <-c
+	assert.Equal(t, change.Seq, uint64(5))
+	assert.Equal(t, change.Kmv == nil, true)
+
+	// followers that fall behind get dropped
+	cf.Publish("key6", nil, nil)
+	cf.Publish("key7", nil, nil)
+	<-c
+	_, ok := <-c
+	assert.Equal(t, ok, false)
+	cf.Unsubscribe(c)
+
+	backlog, _, err = cf.Follow(10, 1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(backlog), 0)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"io"
+)
+
+// The hash used for values, so implementations in other languages know
+// exactly what to reproduce
+const vectorHashFunction = "murmur3_x64_128, first 8 bytes as a little endian uint64"
+
+// The values prefix+start, prefix+start+1, ... up to count of them, so that
+// vectors of large sets stay small
+type vectorValues struct {
+	Prefix string `json:"prefix"`
+	Start  int    `json:"start"`
+	Count  int    `json:"count"`
+}
+
+func (vv vectorValues) each(f func(value string)) {
+	for i := vv.Start; i < vv.Start+vv.Count; i++ {
+		f(fmt.Sprintf("%s%d", vv.Prefix, i))
+	}
+}
+
+type hashVector struct {
+	Value string `json:"value"`
+	Hash  uint64 `json:"hash"`
+}
+
+type sketchVector struct {
+	Name          string                 `json:"name"`
+	K             int                    `json:"k"`
+	Width         int                    `json:"width"`
+	Values        vectorValues           `json:"values"`
+	Serialized    string                 `json:"serialized"`
+	Compressed    string                 `json:"compressed"`
+	Set           *kminvalues.KMinValues `json:"set"`
+	Cardinality   float64                `json:"cardinality"`
+	RelativeError float64                `json:"relative_error"`
+}
+
+type pairVector struct {
+	Name         string  `json:"name"`
+	A            string  `json:"a"`
+	B            string  `json:"b"`
+	Jaccard      float64 `json:"jaccard"`
+	Union        float64 `json:"union"`
+	Intersection float64 `json:"intersection"`
+}
+
+type testVectors struct {
+	Version      string         `json:"version"`
+	HashFunction string         `json:"hash_function"`
+	Hashes       []hashVector   `json:"hashes"`
+	Sketches     []sketchVector `json:"sketches"`
+	Pairs        []pairVector   `json:"pairs"`
+}
+
+// Builds golden vectors that other implementations can check themselves
+// against: the hashes of a few values, the sets built from adding ranges of
+// values along with their serialized bytes and estimates, and comparisons of
+// pairs of those sets.  Everything is deterministic, so the vectors only
+// change when the hash, encoding or estimators do.
+func buildTestVectors() (*testVectors, error) {
+	vectors := &testVectors{Version: VERSION, HashFunction: vectorHashFunction}
+	for _, value := range []string{"", "a", "hello world", "user@example.com", "ünïcödé", "value-0"} {
+		vectors.Hashes = append(vectors.Hashes, hashVector{value, Hashify([]byte(value))})
+	}
+
+	specs := []struct {
+		name   string
+		k      int
+		width  int
+		values vectorValues
+	}{
+		{"exact", 16, 64, vectorValues{"value-", 0, 10}},
+		{"full", 16, 64, vectorValues{"value-", 0, 1000}},
+		{"width32", 64, 32, vectorValues{"value-", 0, 5000}},
+		{"large", 1024, 64, vectorValues{"value-", 0, 100000}},
+		{"overlap_a", 256, 64, vectorValues{"value-", 0, 3000}},
+		{"overlap_b", 256, 64, vectorValues{"value-", 2000, 3000}},
+	}
+	sets := make(map[string]*kminvalues.KMinValues, len(specs))
+	for _, spec := range specs {
+		kmv, err := kminvalues.NewKMinValuesWidth(spec.k, spec.width)
+		if err != nil {
+			return nil, err
+		}
+		spec.values.each(func(value string) {
+			kmv.AddHash(Hashify([]byte(value)))
+		})
+		sets[spec.name] = kmv
+		vectors.Sketches = append(vectors.Sketches, sketchVector{
+			Name:          spec.name,
+			K:             spec.k,
+			Width:         spec.width,
+			Values:        spec.values,
+			Serialized:    base64.StdEncoding.EncodeToString(kmv.Bytes()),
+			Compressed:    base64.StdEncoding.EncodeToString(kmv.CompressedBytes()),
+			Set:           kmv,
+			Cardinality:   kmv.Cardinality(),
+			RelativeError: kmv.RelativeError(),
+		})
+	}
+
+	for _, pair := range [][2]string{{"overlap_a", "overlap_b"}, {"full", "width32"}} {
+		a, b := sets[pair[0]], sets[pair[1]]
+		vectors.Pairs = append(vectors.Pairs, pairVector{
+			Name:         pair[0] + "+" + pair[1],
+			A:            pair[0],
+			B:            pair[1],
+			Jaccard:      a.Jaccard(b),
+			Union:        a.CardinalityUnion(b),
+			Intersection: a.CardinalityIntersection(b),
+		})
+	}
+	return vectors, nil
+}
+
+// Writes the test vectors as indented JSON, for `gocountme test-vectors`
+func writeTestVectors(w io.Writer) error {
+	vectors, err := buildTestVectors()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(vectors, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
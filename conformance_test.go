@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"testing"
+)
+
+func TestTestVectors(t *testing.T) {
+	vectors, err := buildTestVectors()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, vectors.Hashes[0].Hash, Hashify([]byte("")))
+
+	for _, vector := range vectors.Sketches {
+		raw, err := base64.StdEncoding.DecodeString(vector.Serialized)
+		assert.Equal(t, err, nil)
+		kmv, err := kminvalues.KMinValuesFromBytes(raw)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, kmv.MaxSize(), vector.K)
+		assert.Equal(t, kmv.HashWidth(), vector.Width)
+		assert.Equal(t, kmv.Cardinality(), vector.Cardinality)
+		assert.Equal(t, kmv.Bytes(), vector.Set.Bytes())
+
+		raw, _ = base64.StdEncoding.DecodeString(vector.Compressed)
+		compressed, err := kminvalues.KMinValuesFromBytes(raw)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, compressed.Bytes(), kmv.Bytes())
+	}
+	assert.Equal(t, vectors.Sketches[0].Cardinality, 10.0)
+	assert.Equal(t, len(vectors.Pairs), 2)
+
+	// the vectors are the same every time they are built
+	var first, second bytes.Buffer
+	assert.Equal(t, writeTestVectors(&first), nil)
+	assert.Equal(t, writeTestVectors(&second), nil)
+	assert.Equal(t, first.String(), second.String())
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var corsPolicy *CORSPolicy
+
+// Which cross origin requests browsers are allowed to make
+type CORSPolicy struct {
+	origins   map[string]bool
+	anyOrigin bool
+	methods   string
+	headers   string
+	maxAge    string
+}
+
+// Takes comma separated origins, where * allows any, methods and headers
+func NewCORSPolicy(origins, methods, headers string, maxAge time.Duration) *CORSPolicy {
+	cp := &CORSPolicy{
+		origins: make(map[string]bool),
+		methods: strings.Join(splitList(methods), ", "),
+		headers: strings.Join(splitList(headers), ", "),
+		maxAge:  strconv.Itoa(int(maxAge / time.Second)),
+	}
+	for _, origin := range splitList(origins) {
+		if origin == "*" {
+			cp.anyOrigin = true
+		}
+		cp.origins[origin] = true
+	}
+	return cp
+}
+
+func (cp *CORSPolicy) allows(origin string) bool {
+	return cp.anyOrigin || cp.origins[origin]
+}
+
+// Adds the CORS headers to requests from allowed origins and answers their
+// preflight requests.  Requests from other origins are served as usual,
+// without the headers, so browsers won't let scripts read the responses.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if corsPolicy == nil || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !corsPolicy.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if corsPolicy.anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsPolicy.methods)
+			w.Header().Set("Access-Control-Allow-Headers", corsPolicy.headers)
+			w.Header().Set("Access-Control-Max-Age", corsPolicy.maxAge)
+			w.WriteHeader(204)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func splitList(list_raw string) []string {
+	var items []string
+	for _, item := range strings.Split(list_raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
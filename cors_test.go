@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsRequest(method, origin string, preflight bool) *httptest.ResponseRecorder {
+	served := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	r := httptest.NewRequest(method, "/cardinality?key=a", nil)
+	r.Header.Set("Origin", origin)
+	if preflight {
+		r.Header.Set("Access-Control-Request-Method", "GET")
+	}
+	w := httptest.NewRecorder()
+	corsMiddleware(served).ServeHTTP(w, r)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	defer func() { corsPolicy = nil }()
+	corsPolicy = NewCORSPolicy("https://a.example.com, https://b.example.com", "GET, POST", "Content-Type,X-Token", time.Hour)
+
+	w := corsRequest("GET", "https://a.example.com", false)
+	if w.Code != 200 || w.Header().Get("Access-Control-Allow-Origin") != "https://a.example.com" {
+		t.Errorf("Allowed origin not given CORS headers: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Error("Preflight headers sent on a simple request")
+	}
+
+	w = corsRequest("OPTIONS", "https://b.example.com", true)
+	if w.Code != 204 {
+		t.Errorf("Preflight not answered: %d", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != "GET, POST" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type, X-Token" ||
+		w.Header().Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("Wrong preflight headers: %v", w.Header())
+	}
+
+	w = corsRequest("OPTIONS", "https://evil.example.com", true)
+	if w.Code != 200 || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Disallowed origin given CORS headers: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Vary") != "Origin" {
+		t.Error("Responses should vary by origin")
+	}
+
+	corsPolicy = NewCORSPolicy("*", "GET", "", time.Minute)
+	w = corsRequest("GET", "https://any.example.com", false)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Any origin not allowed: %v", w.Header())
+	}
+}
@@ -1,33 +1,69 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/jmhodges/levigo"
 	"github.com/mynameisfiber/gocountme/kminvalues"
+	"log"
+	"time"
 )
 
 var (
-	NoKeySpecified = errors.New("No Key supplied for db Request")
+	NoKeySpecified = NewAPIError(500, "MISSING_ARG_KEY", "No Key supplied for db Request", false)
 	NotImplemented = errors.New("Not Implemented")
 )
 
 type Result struct {
-	Key   string
-	Data  *kminvalues.KMinValues
-	Error error
+	Key   string                 `json:"key"`
+	Data  *kminvalues.KMinValues `json:"data"`
+	Error error                  `json:"-"`
 }
 
 type RequestCommand interface {
-	Execute(database *levigo.DB, ro *levigo.ReadOptions, wo *levigo.WriteOptions) (*kminvalues.KMinValues, error)
+	Execute(batch *Batch) (*kminvalues.KMinValues, error)
 	WriteResult(result Result)
+	RequestKeys() []string // the keys the request touches, used to pick its shard
 }
 
+// Requests that only read the DB, which can be served by the read pool
+type readRequest interface {
+	RequestCommand
+	readOnly()
+}
+
+func (gr GetRequest) readOnly()           {}
+func (cr CardinalityRequest) readOnly()   {}
+func (cr CardinalitiesRequest) readOnly() {}
+func (tr TopKRequest) readOnly()          {}
+func (qr QuantileRequest) readOnly()      {}
+
 type GetRequest struct {
 	Key        string
 	ResultChan chan Result
 }
 
+// Reads only the cardinality of a set, and a version of it for ETags, from
+// its summary or, for sets without one, without deserializing it.  The
+// cardinality is estimated with Estimator, which defaults to Classic.
+type CardinalityRequest struct {
+	Key         string
+	Estimator   kminvalues.Estimator
+	Cardinality *float64
+	Version     *uint64
+	ResultChan  chan Result
+}
+
+// Reads the cardinalities of several sets at once, in the same batch, into
+// Cardinalities in the order of Keys
+type CardinalitiesRequest struct {
+	Keys          []string
+	Estimator     kminvalues.Estimator
+	Cardinalities []float64
+	ResultChan    chan Result
+}
+
 type SetRequest struct {
 	Key        string
 	Kmv        *kminvalues.KMinValues
@@ -42,9 +78,37 @@ type DeleteRequest struct {
 type AddHashRequest struct {
 	Key        string
 	Hash       uint64
+	Low        uint64 // the low half of the value's 128bit hash, only kept by 128bit sets
+	HashWidth  int    // only used when Key is created; 0 means --default-hash-width
+	Value      []byte // the value that was hashed, if known, for the key's sample
+	Label      string // if set, the hash is also counted under this label of the key's breakdown
 	ResultChan chan Result
 }
 
+// Adds Hash to every key in Keys.  Requests are never split between batches,
+// so either every key sees the hash or none of them do.
+type MultiAddHashRequest struct {
+	Keys       []string
+	Hash       uint64
+	Low        uint64
+	HashWidth  int
+	Value      []byte
+	Hashes     []uint64 // if set, the hash to add to each of Keys instead of Hash
+	Lows       []uint64 // the low halves of Hashes
+	Values     [][]byte // the values behind Hashes
+	ResultChan chan Result
+}
+
+// Merges Kmv into the set stored at Key, creating the key if it doesn't exist.
+// With SkipUnchanged, merges that leave the set as it was aren't written.
+type MergeRequest struct {
+	Key           string
+	Kmv           *kminvalues.KMinValues
+	SkipUnchanged bool
+	Job           *unionJob // marked done in the same batch as the merge
+	ResultChan    chan Result
+}
+
 type ResizeRequest struct {
 	Key        string
 	NewSize    int
@@ -55,6 +119,13 @@ func (gr GetRequest) WriteResult(result Result) {
 	result.Key = gr.Key
 	gr.ResultChan <- result
 }
+func (cr CardinalityRequest) WriteResult(result Result) {
+	result.Key = cr.Key
+	cr.ResultChan <- result
+}
+func (cr CardinalitiesRequest) WriteResult(result Result) {
+	cr.ResultChan <- result
+}
 func (sr SetRequest) WriteResult(result Result) {
 	result.Key = sr.Key
 	sr.ResultChan <- result
@@ -67,62 +138,246 @@ func (ahr AddHashRequest) WriteResult(result Result) {
 	result.Key = ahr.Key
 	ahr.ResultChan <- result
 }
+func (mahr MultiAddHashRequest) WriteResult(result Result) {
+	mahr.ResultChan <- result
+}
+func (mr MergeRequest) WriteResult(result Result) {
+	result.Key = mr.Key
+	mr.ResultChan <- result
+}
 func (rr ResizeRequest) WriteResult(result Result) {
 	result.Key = rr.Key
 	rr.ResultChan <- result
 }
 
-func (gr GetRequest) Execute(database *levigo.DB, ro *levigo.ReadOptions, wo *levigo.WriteOptions) (*kminvalues.KMinValues, error) {
+func (gr GetRequest) RequestKeys() []string            { return []string{gr.Key} }
+func (cr CardinalityRequest) RequestKeys() []string    { return []string{cr.Key} }
+func (cr CardinalitiesRequest) RequestKeys() []string  { return cr.Keys }
+func (sr SetRequest) RequestKeys() []string            { return []string{sr.Key} }
+func (dr DeleteRequest) RequestKeys() []string         { return []string{dr.Key} }
+func (ahr AddHashRequest) RequestKeys() []string       { return []string{ahr.Key} }
+func (mahr MultiAddHashRequest) RequestKeys() []string { return mahr.Keys }
+func (mr MergeRequest) RequestKeys() []string          { return []string{mr.Key} }
+func (rr ResizeRequest) RequestKeys() []string         { return []string{rr.Key} }
+
+func (gr GetRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
 	if gr.Key == "" {
 		return nil, NoKeySpecified
 	}
 
-	data, err := database.Get(ro, []byte(gr.Key))
+	return getOrCreate(batch, []byte(gr.Key), 0)
+}
+
+func (cr CardinalityRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if cr.Key == "" {
+		return nil, NoKeySpecified
+	}
+
+	var err error
+	*cr.Cardinality, *cr.Version, err = readCardinality(batch, cr.Key, cr.Estimator)
+	return nil, err
+}
+
+func (cr CardinalitiesRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if len(cr.Keys) == 0 {
+		return nil, NoKeySpecified
+	}
+
+	for i, key := range cr.Keys {
+		if key == "" {
+			return nil, NoKeySpecified
+		}
+		cardinality, _, err := readCardinality(batch, key, cr.Estimator)
+		if err != nil {
+			return nil, err
+		}
+		cr.Cardinalities[i] = cardinality
+	}
+	return nil, nil
+}
+
+// Reads the cardinality and version of a set from its summary or, for sets
+// without one, from the header and largest hash of the set, or the whole set
+// for estimators other than Classic
+func readCardinality(batch *Batch, key string, estimator kminvalues.Estimator) (float64, uint64, error) {
+	summary, found, err := readSummary(batch, key)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
+	} else if found && (estimator == "" || estimator == kminvalues.Classic) {
+		return summary.Cardinality, summary.Version, nil
+	} else if found {
+		return kminvalues.Estimate(estimator, summary.K, summary.Hashes, summary.Width, summary.Max), summary.Version, nil
 	}
 
+	data, err := batch.Get([]byte(key))
+	if err != nil || len(data) == 0 {
+		return 0, dataVersion(data), err
+	}
+	if estimator == "" || estimator == kminvalues.Classic {
+		cardinality, err := kminvalues.CardinalityFromBytes(data)
+		return cardinality, dataVersion(data), err
+	}
 	kmv, err := kminvalues.KMinValuesFromBytes(data)
 	if err != nil {
-		if len(data) == 0 {
-			kmv = kminvalues.NewKMinValues(*defaultSize)
-		} else {
-			return nil, err
-		}
+		return 0, 0, err
 	}
-	return kmv, err
+	defer kmv.Release()
+	return kmv.Estimate(estimator), dataVersion(data), nil
 }
 
-func (sr SetRequest) Execute(database *levigo.DB, ro *levigo.ReadOptions, wo *levigo.WriteOptions) (*kminvalues.KMinValues, error) {
+func (sr SetRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
 	if sr.Key == "" {
 		return nil, NoKeySpecified
 	}
 
-	keyBytes := []byte(sr.Key)
-	err := database.Put(wo, keyBytes, sr.Kmv.Bytes())
-
-	return sr.Kmv, err
+	if err := batch.PutSketch([]byte(sr.Key), sr.Kmv); err != nil {
+		return nil, err
+	}
+	batch.InvalidateExact(sr.Key)
+	batch.Publish(sr.Key, sr.Kmv, nil)
+	return sr.Kmv, nil
 }
 
-func (dr DeleteRequest) Execute(database *levigo.DB, ro *levigo.ReadOptions, wo *levigo.WriteOptions) (*kminvalues.KMinValues, error) {
+func (dr DeleteRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
 	if dr.Key == "" {
 		return nil, NoKeySpecified
+	} else if isInternalKey([]byte(dr.Key)) {
+		return nil, InvalidKey
 	}
 
-	keyBytes := []byte(dr.Key)
-	err := database.Delete(wo, keyBytes)
-
-	return nil, err
+	if err := batch.Delete([]byte(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(sampleKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(valueIndexKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(firstSeenKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(breakdownKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(quantileKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(heavyHittersKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(summaryKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(historyKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(tagsKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(shadowKey(dr.Key)); err != nil {
+		return nil, err
+	}
+	batch.ForgetExact(dr.Key)
+	batch.Publish(dr.Key, nil, nil)
+	return nil, nil
 }
 
-func (ahr AddHashRequest) Execute(database *levigo.DB, ro *levigo.ReadOptions, wo *levigo.WriteOptions) (*kminvalues.KMinValues, error) {
+func (ahr AddHashRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
 	if ahr.Key == "" {
 		return nil, NoKeySpecified
 	}
 
 	keyBytes := []byte(ahr.Key)
 
-	data, err := database.Get(ro, keyBytes)
+	kmv, err := getOrCreate(batch, keyBytes, ahr.HashWidth)
+	if err != nil {
+		return nil, err
+	}
+	batch.ObserveExact(ahr.Key, kmv.Len() == 0, ahr.Hash)
+	added := kmv.AddHash128(ahr.Hash, ahr.Low)
+	if added {
+		if err := batch.PutSketch(keyBytes, kmv); err != nil {
+			return nil, err
+		}
+		batch.Publish(ahr.Key, kmv, kmv.HashDelta128(ahr.Hash, ahr.Low))
+		if err := recordFirstSeen(batch, ahr.Key, kmv, ahr.Hash); err != nil {
+			return nil, err
+		}
+	}
+	if err := mirrorShadow(batch, ahr.Key, kmv, []uint64{ahr.Hash}, []uint64{ahr.Low}); err != nil {
+		return nil, err
+	}
+	if err := recordValue(batch, ahr.Key, kmv, ahr.Hash, ahr.Value, added); err != nil {
+		return nil, err
+	}
+	if ahr.Label != "" {
+		if err := updateBreakdown(batch, ahr.Key, kmv, ahr.Hash, ahr.Label); err != nil {
+			return nil, err
+		}
+	}
+	return kmv, nil
+}
+
+func (mahr MultiAddHashRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if len(mahr.Keys) == 0 {
+		return nil, NoKeySpecified
+	}
+
+	seen := make(map[string]bool, len(mahr.Keys))
+	for i, key := range mahr.Keys {
+		if key == "" {
+			return nil, NoKeySpecified
+		} else if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		keyBytes := []byte(key)
+		kmv, err := getOrCreate(batch, keyBytes, mahr.HashWidth)
+		if err != nil {
+			return nil, err
+		}
+		hash, low, value := mahr.hashFor(i)
+		batch.ObserveExact(key, kmv.Len() == 0, hash)
+		added := kmv.AddHash128(hash, low)
+		if added {
+			if err := batch.PutSketch(keyBytes, kmv); err != nil {
+				return nil, err
+			}
+			batch.Publish(key, kmv, kmv.HashDelta128(hash, low))
+			if err := recordFirstSeen(batch, key, kmv, hash); err != nil {
+				return nil, err
+			}
+		}
+		if err := mirrorShadow(batch, key, kmv, []uint64{hash}, []uint64{low}); err != nil {
+			return nil, err
+		}
+		if err := recordValue(batch, key, kmv, hash, value, added); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// Returns the hash, the low half of its 128bit hash and the value added to
+// the i'th key.  Hashes, when set, gives every key its own hash, eg: when
+// values are normalized differently per key.
+func (mahr MultiAddHashRequest) hashFor(i int) (uint64, uint64, []byte) {
+	if mahr.Hashes == nil {
+		return mahr.Hash, mahr.Low, mahr.Value
+	}
+	var low uint64
+	if mahr.Lows != nil {
+		low = mahr.Lows[i]
+	}
+	return mahr.Hashes[i], low, mahr.Values[i]
+}
+
+// Fetches the set stored at key, creating an empty one of the default size if
+// it doesn't exist.  width only applies to newly created sets.
+func getOrCreate(batch *Batch, key []byte, width int) (*kminvalues.KMinValues, error) {
+	data, err := batch.Get(key)
 	if err != nil {
 		return nil, err
 	}
@@ -130,35 +385,155 @@ func (ahr AddHashRequest) Execute(database *levigo.DB, ro *levigo.ReadOptions, w
 	kmv, err := kminvalues.KMinValuesFromBytes(data)
 	if err != nil {
 		if len(data) == 0 {
-			kmv = kminvalues.NewKMinValues(*defaultSize)
-		} else {
+			size := *defaultSize
+			if policy := keyPolicies.For(string(key)); policy != nil {
+				if policy.K > 0 {
+					size = policy.K
+				}
+				if width == 0 {
+					width = policy.Width
+				}
+			}
+			if width == 0 {
+				width = *defaultHashWidth
+			}
+			return kminvalues.NewKMinValuesWidth(size, width)
+		}
+		return nil, err
+	}
+	return kmv, nil
+}
+
+func (mr MergeRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if mr.Key == "" {
+		return nil, NoKeySpecified
+	}
+
+	keyBytes := []byte(mr.Key)
+
+	data, err := batch.Get(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored *kminvalues.KMinValues
+	if len(data) != 0 {
+		stored, err = kminvalues.KMinValuesFromBytes(data)
+		if err != nil {
 			return nil, err
 		}
 	}
-	kmv.AddHash(ahr.Hash)
+	batch.InvalidateExact(mr.Key)
+	kmv := kminvalues.Merge(stored, mr.Kmv)
+	if mr.Job != nil {
+		batch.Put(jobKey(mr.Job.ID), mr.Job.encode(jobDone))
+	}
+	if mr.SkipUnchanged && stored != nil && bytes.Equal(stored.Bytes(), kmv.Bytes()) {
+		return kmv, nil
+	}
 
-	err = database.Put(wo, keyBytes, kmv.Bytes())
-	return kmv, err
+	if err := batch.PutSketch(keyBytes, kmv); err != nil {
+		return nil, err
+	}
+	batch.Publish(mr.Key, kmv, mr.Kmv)
+	return kmv, nil
 }
 
-func (rr ResizeRequest) Execute(database *levigo.DB, ro *levigo.ReadOptions, wo *levigo.WriteOptions) (*kminvalues.KMinValues, error) {
+func (rr ResizeRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
 	// TODO: fix this
 	return nil, fmt.Errorf("Not implemented")
 }
 
+// Executes requests from requestChan, grouping them into batches according to
+// the current BatchPolicy.
 func levelDBWorker(database *levigo.DB, requestChan chan RequestCommand) error {
 	ro := levigo.NewReadOptions()
 	wo := levigo.NewWriteOptions()
 	defer ro.Close()
 	defer wo.Close()
 
+	batch := NewBatch(database, ro)
+	commit := func() {
+		wo.SetSync(getBatchPolicy().Sync)
+		if err := batch.Commit(wo); err != nil {
+			log.Printf("Could not write batch: %s", err)
+		}
+	}
+
+	for {
+		request, ok := nextRequest(requestChan, batch)
+		if request == nil {
+			if batch.Len() != 0 {
+				commit()
+			}
+			if !ok {
+				return nil
+			}
+			continue
+		}
+
+		if b, isBarrier := request.(*barrier); isBarrier {
+			// Whatever the barrier's request does has to see our writes
+			if batch.Len() != 0 {
+				commit()
+			}
+			b.ready <- struct{}{}
+			<-b.release
+			continue
+		}
+
+		policy := getBatchPolicy()
+		batch.execute(request)
+		_, flush := request.(FlushRequest)
+		if policy.Flush == FlushOnTimer && !flush {
+			batch.acknowledge()
+		}
+		if flush || batch.full(policy) {
+			commit()
+		}
+	}
+}
+
+// Executes reads from requestChan one at a time.  Reads write nothing, so each
+// one is answered on its own instead of waiting for a batch.
+func readWorker(database *levigo.DB, requestChan chan RequestCommand) {
+	ro := levigo.NewReadOptions()
+	wo := levigo.NewWriteOptions()
+	defer ro.Close()
+	defer wo.Close()
+
+	batch := NewBatch(database, ro)
 	for request := range requestChan {
-		kmv, err := request.Execute(database, ro, wo)
-		request.WriteResult(Result{
-			Data:  kmv,
-			Error: err,
-		})
+		batch.execute(request)
+		batch.Commit(wo)
+	}
+}
+
+// Waits for the next request to add to the batch.  Returns a nil request if
+// the batch should be committed before waiting for more requests, and false if
+// requestChan was closed.
+func nextRequest(requestChan chan RequestCommand, batch *Batch) (RequestCommand, bool) {
+	if batch.Len() == 0 {
+		request, ok := <-requestChan
+		return request, ok
 	}
 
-	return nil
+	select {
+	case request, ok := <-requestChan:
+		return request, ok
+	default:
+	}
+
+	wait := getBatchPolicy().MaxLatency - time.Since(batch.started)
+	if wait <= 0 {
+		return nil, true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case request, ok := <-requestChan:
+		return request, ok
+	case <-timer.C:
+		return nil, true
+	}
 }
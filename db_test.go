@@ -29,7 +29,7 @@ func TestDB(t *testing.T) {
 			Key:        key,
 			ResultChan: resultChan,
 		}
-		RequestChan <- delRequest
+		dispatcher.Dispatch(delRequest)
 		<-resultChan
 	}
 	clean()
@@ -48,7 +48,7 @@ func TestDB(t *testing.T) {
 		Kmv:        kmv,
 		ResultChan: resultChan,
 	}
-	RequestChan <- setRequest
+	dispatcher.Dispatch(setRequest)
 	result := <-resultChan
 	assert.Equal(t, result.Error, nil)
 
@@ -58,7 +58,7 @@ func TestDB(t *testing.T) {
 			Hash:       GetRandHash(),
 			ResultChan: resultChan,
 		}
-		RequestChan <- addHashRequest
+		dispatcher.Dispatch(addHashRequest)
 		result = <-resultChan
 		assert.Equal(t, result.Error, nil)
 	}
@@ -70,6 +70,104 @@ func TestDB(t *testing.T) {
 	}
 }
 
+func TestDBMerge(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_TESTDBMERGE"
+	resultChan := make(chan Result)
+
+	clean := func() {
+		delRequest := DeleteRequest{
+			Key:        key,
+			ResultChan: resultChan,
+		}
+		dispatcher.Dispatch(delRequest)
+		<-resultChan
+	}
+	clean()
+	defer clean()
+
+	kmv1 := kminvalues.NewKMinValues(50)
+	kmv2 := kminvalues.NewKMinValues(50)
+	for i := 0; i < 20; i++ {
+		kmv1.AddHash(GetRandHash())
+		kmv2.AddHash(GetRandHash())
+	}
+
+	for _, kmv := range []*kminvalues.KMinValues{kmv1, kmv2} {
+		mergeRequest := MergeRequest{
+			Key:        key,
+			Kmv:        kmv,
+			ResultChan: resultChan,
+		}
+		dispatcher.Dispatch(mergeRequest)
+		result := <-resultChan
+		assert.Equal(t, result.Error, nil)
+	}
+
+	getRequest := GetRequest{
+		Key:        key,
+		ResultChan: resultChan,
+	}
+	dispatcher.Dispatch(getRequest)
+	result := <-resultChan
+	assert.Equal(t, result.Error, nil)
+	assert.Equal(t, result.Data.Cardinality(), 40.0)
+}
+
+func TestDBMultiAdd(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	keys := []string{"_GOTEST_MULTIADD1", "_GOTEST_MULTIADD2", "_GOTEST_MULTIADD1"}
+	resultChan := make(chan Result)
+
+	clean := func() {
+		for _, key := range keys[:2] {
+			delRequest := DeleteRequest{
+				Key:        key,
+				ResultChan: resultChan,
+			}
+			dispatcher.Dispatch(delRequest)
+			<-resultChan
+		}
+	}
+	clean()
+	defer clean()
+
+	for i := 0; i < 10; i++ {
+		multiAddHashRequest := MultiAddHashRequest{
+			Keys:       keys,
+			Hash:       GetRandHash(),
+			ResultChan: resultChan,
+		}
+		dispatcher.Dispatch(multiAddHashRequest)
+		result := <-resultChan
+		assert.Equal(t, result.Error, nil)
+	}
+
+	multiAddHashRequest := MultiAddHashRequest{
+		Keys:       []string{keys[0], ""},
+		Hash:       GetRandHash(),
+		ResultChan: resultChan,
+	}
+	dispatcher.Dispatch(multiAddHashRequest)
+	result := <-resultChan
+	assert.Equal(t, result.Error, NoKeySpecified)
+
+	for _, key := range keys[:2] {
+		getRequest := GetRequest{
+			Key:        key,
+			ResultChan: resultChan,
+		}
+		dispatcher.Dispatch(getRequest)
+		result := <-resultChan
+		assert.Equal(t, result.Error, nil)
+		assert.Equal(t, result.Data.Cardinality(), 10.0)
+	}
+}
+
 func SetupDB() {
 	opts := levigo.NewOptions()
 	opts.SetCache(levigo.NewLRUCache(1024))
@@ -80,13 +178,76 @@ func SetupDB() {
 		log.Panicln(err)
 	}
 
-	RequestChan = make(chan RequestCommand)
-	go func() {
-		levelDBWorker(db, RequestChan)
-		db.Close()
-	}()
+	dispatcher = NewDispatcher(db, 4, 16)
+	dispatcher.Start()
 }
 
 func CloseDB() {
-	close(RequestChan)
+	dispatcher.Close()
+	dispatcher.database.Close()
+}
+
+func TestDBCompressedSketches(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	*compressSketches = true
+	defer func() { *compressSketches = false }()
+
+	key := "_GOTEST_TESTDBCOMPRESSED"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	kmv := kminvalues.NewKMinValues(100)
+	for i := 0; i < 100; i++ {
+		kmv.AddHash(uint64(i+1) << 20)
+	}
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kmv, ResultChan: resultChan})
+	<-resultChan
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, _ := dispatcher.database.Get(ro, []byte(key))
+	assert.Equal(t, len(data) < len(kmv.Bytes()), true)
+
+	dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+	result := <-resultChan
+	assert.Equal(t, result.Error, nil)
+	assert.Equal(t, result.Data.Bytes(), kmv.Bytes())
+
+	// unchanged merges are still recognized
+	dispatcher.Dispatch(MergeRequest{Key: key, Kmv: kmv, SkipUnchanged: true, ResultChan: resultChan})
+	assert.Equal(t, (<-resultChan).Error, nil)
+}
+
+func TestDB128BitHashes(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_128BIT"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	// two values whose 64bit hashes collide are both counted
+	for low := uint64(1); low <= 2; low++ {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: 1 << 40, Low: low, HashWidth: 128, ResultChan: resultChan})
+		assert.Equal(t, (<-resultChan).Error, nil)
+	}
+	high, low := hashValue128(key, "value")
+	assert.Equal(t, high, Hashify([]byte("value")))
+	dispatcher.Dispatch(MultiAddHashRequest{Keys: []string{key}, Hash: high, Low: low, ResultChan: resultChan})
+	assert.Equal(t, (<-resultChan).Error, nil)
+
+	dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+	result := <-resultChan
+	assert.Equal(t, result.Error, nil)
+	assert.Equal(t, result.Data.HashWidth(), 128)
+	assert.Equal(t, result.Data.Len(), 3)
+	assert.Equal(t, result.Data.FindHash(high) >= 0, true)
 }
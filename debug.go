@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+type heapDump struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Writes a dump of the heap to a file in --heapdump-dir, for when a profile
+// isn't enough to tell what is holding on to memory.  The world is stopped
+// while the dump is written, which can take a while on a large heap.
+func HeapDumpHandler(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("gocountme-%s.heapdump", time.Now().UTC().Format("20060102T150405.000"))
+	path := filepath.Join(*heapDumpDir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	defer f.Close()
+
+	debug.WriteHeapDump(f.Fd())
+	info, err := f.Stat()
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	HttpResponse(w, 200, heapDump{path, info.Size()})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHeapDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocountme-heapdump")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	defer func(old string) { *heapDumpDir = old }(*heapDumpDir)
+	*heapDumpDir = dir
+
+	w := httptest.NewRecorder()
+	HeapDumpHandler(w, httptest.NewRequest("GET", "/admin/heapdump", nil))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data heapDump `json:"data"`
+	}{}
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &response), nil)
+
+	info, err := os.Stat(response.Data.Path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info.Size(), response.Data.Bytes)
+	assert.Equal(t, info.Size() > 0, true)
+}
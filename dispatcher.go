@@ -0,0 +1,248 @@
+package main
+
+import (
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+// Closed so that sends given it as their deadline never wait
+var noWait = make(chan time.Time)
+
+func init() {
+	close(noWait)
+}
+
+// Spreads requests over a set of shards by key.  Every shard has its own queue
+// and worker, so requests for the same key are executed in order while
+// unrelated keys don't have to wait for each other.
+type Dispatcher struct {
+	database *levigo.DB
+	shards   []chan RequestCommand
+
+	// Requests spanning several shards queue a barrier on each of them.  They
+	// do so one at a time so that every shard sees the barriers in the same
+	// order and no two requests can end up waiting on each other.
+	barrierLock sync.Mutex
+
+	// With a read pool, reads are served by their own workers so that heavy
+	// queries can't hold up the writes queued behind them on a shard
+	reads       chan RequestCommand
+	readWorkers int
+
+	workers sync.WaitGroup
+}
+
+var dispatcher *Dispatcher
+
+// Stops the workers of every shard a request touches so that it can be
+// executed against the database on its own
+type barrier struct {
+	ready   chan struct{}
+	release chan struct{}
+}
+
+func (b *barrier) Execute(batch *Batch) (*kminvalues.KMinValues, error) { return nil, nil }
+func (b *barrier) WriteResult(result Result)                            {}
+func (b *barrier) RequestKeys() []string                                { return nil }
+
+func NewDispatcher(database *levigo.DB, nShards, queueSize int) *Dispatcher {
+	d := &Dispatcher{
+		database: database,
+		shards:   make([]chan RequestCommand, nShards),
+	}
+	for i := range d.shards {
+		d.shards[i] = make(chan RequestCommand, queueSize)
+	}
+	return d
+}
+
+// Serves reads from a pool of workers of their own, sharing a queue of
+// queueSize.  Must be called before Start.
+func (d *Dispatcher) SetReadPool(workers, queueSize int) {
+	d.readWorkers = workers
+	d.reads = make(chan RequestCommand, queueSize)
+}
+
+// Starts a worker for every shard, and the read pool if there is one
+func (d *Dispatcher) Start() {
+	for _, shard := range d.shards {
+		d.workers.Add(1)
+		go func(shard chan RequestCommand) {
+			levelDBWorker(d.database, shard)
+			d.workers.Done()
+		}(shard)
+	}
+	for i := 0; i < d.readWorkers; i++ {
+		d.workers.Add(1)
+		go func() {
+			readWorker(d.database, d.reads)
+			d.workers.Done()
+		}()
+	}
+}
+
+// Stops taking requests and waits for the workers to finish the ones they
+// already have
+func (d *Dispatcher) Close() {
+	for _, shard := range d.shards {
+		close(shard)
+	}
+	if d.reads != nil {
+		close(d.reads)
+	}
+	d.Wait()
+}
+
+func (d *Dispatcher) Wait() {
+	d.workers.Wait()
+}
+
+func (d *Dispatcher) shardFor(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(d.shards)))
+}
+
+// The distinct shards holding the keys of a request.  Requests without keys
+// go to the first shard so they can fail there.
+func (d *Dispatcher) shardsFor(request RequestCommand) []int {
+	keys := request.RequestKeys()
+	if len(keys) <= 1 {
+		if len(keys) == 0 {
+			return []int{0}
+		}
+		return []int{d.shardFor(keys[0])}
+	}
+
+	seen := make(map[int]bool, len(keys))
+	shards := make([]int, 0, len(keys))
+	for _, key := range keys {
+		shard := d.shardFor(key)
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// Queues a request, giving up with QueueFull if there is no room for it
+// within timeout
+func (d *Dispatcher) Submit(request RequestCommand, timeout time.Duration) error {
+	giveUp := (<-chan time.Time)(noWait)
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		giveUp = timer.C
+	}
+	return d.submit(request, giveUp)
+}
+
+// Queues a request, waiting for as long as it takes
+func (d *Dispatcher) Dispatch(request RequestCommand) {
+	d.submit(request, nil)
+}
+
+func (d *Dispatcher) submit(request RequestCommand, giveUp <-chan time.Time) error {
+	if d.readsPooled(request) {
+		if !sendTo(d.reads, request, giveUp) {
+			return QueueFull
+		}
+		return nil
+	}
+
+	shards := d.shardsFor(request)
+	if len(shards) == 1 {
+		if !d.send(shards[0], request, giveUp) {
+			return QueueFull
+		}
+		return nil
+	}
+
+	b := &barrier{
+		ready:   make(chan struct{}, len(shards)),
+		release: make(chan struct{}),
+	}
+	d.barrierLock.Lock()
+	for _, shard := range shards {
+		if !d.send(shard, b, giveUp) {
+			d.barrierLock.Unlock()
+			// Shards that already got the barrier just pass through it
+			close(b.release)
+			return QueueFull
+		}
+	}
+	d.barrierLock.Unlock()
+
+	go d.coordinate(request, b, len(shards))
+	return nil
+}
+
+// Queues request on a shard, waiting until giveUp fires for there to be room.
+// A nil giveUp waits forever.
+func (d *Dispatcher) send(shard int, request RequestCommand, giveUp <-chan time.Time) bool {
+	return sendTo(d.shards[shard], request, giveUp)
+}
+
+func sendTo(queue chan RequestCommand, request RequestCommand, giveUp <-chan time.Time) bool {
+	select {
+	case queue <- request:
+		return true
+	default:
+	}
+
+	select {
+	case queue <- request:
+		return true
+	case <-giveUp:
+		return false
+	}
+}
+
+// Read workers only see what was written to the DB, so while writes are
+// acknowledged before being written reads stay on the shards to see them
+func (d *Dispatcher) readsPooled(request RequestCommand) bool {
+	if d.reads == nil || getBatchPolicy().Flush == FlushOnTimer {
+		return false
+	}
+	_, isRead := request.(readRequest)
+	return isRead
+}
+
+// Executes a request spanning several shards once all of their workers have
+// reached its barrier
+func (d *Dispatcher) coordinate(request RequestCommand, b *barrier, nShards int) {
+	defer close(b.release)
+	for i := 0; i < nShards; i++ {
+		<-b.ready
+	}
+
+	ro := levigo.NewReadOptions()
+	wo := levigo.NewWriteOptions()
+	defer ro.Close()
+	defer wo.Close()
+	wo.SetSync(getBatchPolicy().Sync)
+
+	batch := NewBatch(d.database, ro)
+	batch.execute(request)
+	if err := batch.Commit(wo); err != nil {
+		log.Printf("Could not write batch: %s", err)
+	}
+}
+
+func (d *Dispatcher) stats() queueStats {
+	stats := queueStats{Shards: len(d.shards), ReadWorkers: d.readWorkers}
+	for _, shard := range d.shards {
+		stats.Depth += len(shard)
+		stats.Capacity += cap(shard)
+	}
+	if d.reads != nil {
+		stats.ReadDepth = len(d.reads)
+		stats.ReadCapacity = cap(d.reads)
+	}
+	return stats
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"sync"
+	"testing"
+)
+
+func TestDispatcherShards(t *testing.T) {
+	d := NewDispatcher(nil, 4, 0)
+	assert.Equal(t, d.shardFor("foo"), d.shardFor("foo"))
+
+	shards := d.shardsFor(MultiAddHashRequest{Keys: []string{"foo", "foo", "foo"}})
+	assert.Equal(t, shards, []int{d.shardFor("foo")})
+	assert.Equal(t, d.shardsFor(MultiAddHashRequest{}), []int{0})
+}
+
+func TestDispatcherSpanningShards(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	keys := make([]string, 8)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("_GOTEST_DISPATCHER%d", i)
+	}
+	assert.Equal(t, len(dispatcher.shardsFor(MultiAddHashRequest{Keys: keys})) > 1, true)
+
+	clean := func() {
+		resultChan := make(chan Result)
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}
+	clean()
+	defer clean()
+
+	// multi key adds racing single key adds must neither deadlock nor lose
+	// writes
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(hash uint64) {
+			resultChan := make(chan Result)
+			dispatcher.Dispatch(MultiAddHashRequest{Keys: keys, Hash: hash, ResultChan: resultChan})
+			assert.Equal(t, (<-resultChan).Error, nil)
+			wg.Done()
+		}(uint64(i + 1))
+		go func(hash uint64) {
+			resultChan := make(chan Result)
+			for _, key := range keys {
+				dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, ResultChan: resultChan})
+				assert.Equal(t, (<-resultChan).Error, nil)
+			}
+			wg.Done()
+		}(uint64(i + 1000))
+	}
+	wg.Wait()
+
+	resultChan := make(chan Result)
+	for _, key := range keys {
+		dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+		result := <-resultChan
+		assert.Equal(t, result.Data.Len(), 40)
+	}
+}
+
+func TestDispatcherReadPool(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	d := NewDispatcher(dispatcher.database, 1, 0)
+	d.SetReadPool(1, 1)
+	d.Start()
+	defer d.Close()
+
+	// hold up the only shard worker
+	b := &barrier{ready: make(chan struct{}, 1), release: make(chan struct{})}
+	d.send(0, b, nil)
+	<-b.ready
+	defer close(b.release)
+
+	resultChan := make(chan Result, 1)
+	assert.Equal(t, d.Submit(AddHashRequest{Key: "_GOTEST_READPOOL", Hash: 1, ResultChan: resultChan}, 0), QueueFull)
+	assert.Equal(t, d.Submit(GetRequest{Key: "_GOTEST_READPOOL", ResultChan: resultChan}, 0), nil)
+	result := <-resultChan
+	assert.Equal(t, result.Error, nil)
+	assert.Equal(t, result.Data.Len(), 0)
+	assert.Equal(t, d.stats().ReadWorkers, 1)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// What a request would do to one of its keys
+type dryRunChange struct {
+	Key               string  `json:"key"`
+	Existed           bool    `json:"existed"`
+	Changed           bool    `json:"changed"`
+	Deleted           bool    `json:"deleted"`
+	CardinalityBefore float64 `json:"cardinality_before"`
+	CardinalityAfter  float64 `json:"cardinality_after"`
+}
+
+// Wrapping a request in a DryRunRequest executes it and then rolls it back,
+// recording what it would have changed in Changes instead of writing anything.
+type DryRunRequest struct {
+	RequestCommand
+	Changes    *[]dryRunChange
+	ResultChan chan Result
+}
+
+func (drr DryRunRequest) WriteResult(result Result) {
+	drr.ResultChan <- result
+}
+
+func (drr DryRunRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	keys := drr.RequestKeys()
+	before := make([][]byte, len(keys))
+	for i, key := range keys {
+		data, err := batch.Get([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		before[i] = data
+	}
+
+	sp := batch.savepoint()
+	defer batch.rollback(sp)
+	if _, err := drr.RequestCommand.Execute(batch); err != nil {
+		return nil, err
+	}
+
+	changes := make([]dryRunChange, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		after, err := batch.Get([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		change := dryRunChange{
+			Key:     key,
+			Existed: len(before[i]) != 0,
+			Changed: !bytes.Equal(before[i], after),
+			Deleted: len(before[i]) != 0 && len(after) == 0,
+		}
+		change.CardinalityBefore, err = cardinalityOf(before[i])
+		if err != nil {
+			return nil, err
+		}
+		change.CardinalityAfter, err = cardinalityOf(after)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	*drr.Changes = changes
+	return nil, nil
+}
+
+func cardinalityOf(data []byte) (float64, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	kmv, err := kminvalues.KMinValuesFromBytes(data)
+	if err != nil {
+		return 0, err
+	}
+	return kmv.Cardinality(), nil
+}
+
+// Mutations with `dryrun=true` report what they would change without writing
+// anything
+func isDryRun(reqParams url.Values) bool {
+	dryrun, _ := strconv.ParseBool(reqParams.Get("dryrun"))
+	return dryrun
+}
+
+// Runs request as a dry run and responds with the changes it would make to
+// each of its keys.  The request is fenced by the `token` of reqParams as its
+// write would be.
+func HttpDryRun(w http.ResponseWriter, request RequestCommand, reqParams url.Values) {
+	var changes []dryRunChange
+	resultChan := make(chan Result)
+	dryRunRequest := DryRunRequest{
+		RequestCommand: withFencing(request, reqParams),
+		Changes:        &changes,
+		ResultChan:     resultChan,
+	}
+	if err := submitRequest(dryRunRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error == nil {
+		HttpResponse(w, 200, changes)
+	} else {
+		HttpResultError(w, result.Key, result.Error)
+	}
+}
+
+// Same as HttpDryRun for an add that went through the poison guard and the
+// sampler, which changes nothing unless the sampler admitted it
+func httpDryRunAdmitted(w http.ResponseWriter, request RequestCommand, admitted bool, reqParams url.Values) {
+	if !admitted {
+		HttpResponse(w, 200, []dryRunChange{})
+		return
+	}
+	HttpDryRun(w, request, reqParams)
+}
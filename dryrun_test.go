@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_DRYRUN"
+	resultChan := make(chan Result)
+	clean := func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}
+	clean()
+	defer clean()
+
+	dryRun := func(handler http.HandlerFunc, query string) []dryRunChange {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/?"+query, nil))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data []dryRunChange `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data
+	}
+	cardinality := func() float64 {
+		dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+		return (<-resultChan).Data.Cardinality()
+	}
+
+	changes := dryRun(AddHashHandler, "key="+key+"&hash=12345&dryrun=true")
+	assert.Equal(t, changes, []dryRunChange{{Key: key, Changed: true, CardinalityAfter: 1}})
+	assert.Equal(t, cardinality(), 0.0)
+
+	dispatcher.Dispatch(AddHashRequest{Key: key, Hash: 12345, ResultChan: resultChan})
+	<-resultChan
+
+	changes = dryRun(AddHashHandler, "key="+key+"&hash=12345&dryrun=true")
+	assert.Equal(t, changes, []dryRunChange{{Key: key, Existed: true, CardinalityBefore: 1, CardinalityAfter: 1}})
+
+	changes = dryRun(DeleteHandler, "key="+key+"&dryrun=true")
+	assert.Equal(t, changes, []dryRunChange{{Key: key, Existed: true, Changed: true, Deleted: true, CardinalityBefore: 1}})
+	assert.Equal(t, cardinality(), 1.0)
+}
+
+// Dry runs fail the way their writes would, eg: on a key leased to another
+// producer
+func TestDryRunFenced(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	*fencingFlag = true
+	defer func() { *fencingFlag = false }()
+
+	key := "_GOTEST_DRYRUN_FENCED"
+	resultChan := make(chan Result, 1)
+	leased := lease{}
+	dispatcher.Dispatch(LeaseRequest{Key: key, TTL: time.Hour, Lease: &leased, ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		wo := levigo.NewWriteOptions()
+		defer wo.Close()
+		dispatcher.database.Delete(wo, leaseKey(key))
+	}()
+
+	dryRun := func(handler http.HandlerFunc, query string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/?key="+key+"&dryrun=true"+query, nil))
+		return w.Code
+	}
+	assert.Equal(t, dryRun(AddHandler, "&value=a"), 409)
+	assert.Equal(t, dryRun(AddHashHandler, "&hash=12345"), 409)
+	assert.Equal(t, dryRun(DeleteHandler, ""), 409)
+	assert.Equal(t, dryRun(AddHandler, fmt.Sprintf("&value=a&token=%d", leased.Token)), 200)
+}
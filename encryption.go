@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Marks a value as encrypted, followed by the nonce and the sealed value
+const encryptedMarker = 0xE1
+
+var (
+	encryptionKeys       map[string]cipher.AEAD
+	InvalidEncryptionKey = errors.New("Encryption keys must be the base64 encoding of 16, 24 or 32 bytes")
+)
+
+// Loads a JSON file of key prefixes and the environment variable holding the
+// AES key for keys starting with them, eg: {"users:" : "USERS_KEY"}, so that
+// the keys themselves never have to be written to disk
+func LoadEncryptionKeys(filename string) (map[string]cipher.AEAD, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var variables map[string]string
+	err = json.Unmarshal(data, &variables)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]cipher.AEAD, len(variables))
+	for prefix, variable := range variables {
+		value, found := os.LookupEnv(variable)
+		if !found {
+			return nil, fmt.Errorf("Environment variable %s for %q is not set", variable, prefix)
+		}
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, InvalidEncryptionKey
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, InvalidEncryptionKey
+		}
+		keys[prefix], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// The key a stored value belongs to, which for internal keys is the set they
+// are kept for
+func namespaceKey(key []byte) []byte {
+	if isInternalKey(key) {
+		if i := bytes.IndexByte(key, ':'); i >= 0 {
+			return key[i+1:]
+		}
+	}
+	return key
+}
+
+// Finds the cipher of the longest prefix matching key, if any
+func encryptionFor(key []byte) cipher.AEAD {
+	if len(encryptionKeys) == 0 {
+		return nil
+	}
+	return longestPrefix(encryptionKeys, string(namespaceKey(key)))
+}
+
+// Encrypts a value about to be written to the DB.  The stored key is used as
+// additional data so a value can't be moved to another key.
+func sealValue(key, value []byte) []byte {
+	aead := encryptionFor(key)
+	if aead == nil {
+		return value
+	}
+	sealed := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(value)+aead.Overhead())
+	sealed[0] = encryptedMarker
+	if _, err := rand.Read(sealed[1:]); err != nil {
+		panic(err)
+	}
+	return aead.Seal(sealed, sealed[1:], value, key)
+}
+
+// Decrypts a value read from the DB.  Values that aren't encrypted, eg: those
+// written before their prefix got a key, are returned as they are.
+func openValue(key, value []byte) []byte {
+	aead := encryptionFor(key)
+	if aead == nil || len(value) < 1+aead.NonceSize() || value[0] != encryptedMarker {
+		return value
+	}
+	nonce := value[1 : 1+aead.NonceSize()]
+	opened, err := aead.Open(nil, nonce, value[1+aead.NonceSize():], key)
+	if err != nil {
+		return value
+	}
+	return opened
+}
+
+// Reads a value straight from the DB
+func readValue(database *levigo.DB, ro *levigo.ReadOptions, key []byte) ([]byte, error) {
+	value, err := database.Get(ro, key)
+	if err != nil || len(value) == 0 {
+		return value, err
+	}
+	return openValue(key, value), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	file, _ := ioutil.TempFile("", "encryption")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"_GOTEST_SECRET" : "GOTEST_ENCRYPTION_KEY"}`)
+	file.Close()
+
+	_, err := LoadEncryptionKeys(file.Name())
+	assert.NotEqual(t, err, nil)
+	os.Setenv("GOTEST_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString([]byte("not a key")))
+	_, err = LoadEncryptionKeys(file.Name())
+	assert.Equal(t, err, InvalidEncryptionKey)
+	os.Setenv("GOTEST_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	defer os.Unsetenv("GOTEST_ENCRYPTION_KEY")
+	encryptionKeys, err = LoadEncryptionKeys(file.Name())
+	assert.Equal(t, err, nil)
+	defer func() { encryptionKeys = nil }()
+
+	resultChan := make(chan Result)
+	kmv := kminvalues.NewKMinValues(4)
+	kmv.AddHash(1 << 60)
+	for _, key := range []string{"_GOTEST_SECRET", "_GOTEST_PLAIN"} {
+		dispatcher.Dispatch(SetRequest{Key: key, Kmv: kmv, ResultChan: resultChan})
+		<-resultChan
+		defer func(key string) {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}(key)
+	}
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	raw, _ := dispatcher.database.Get(ro, []byte("_GOTEST_SECRET"))
+	assert.Equal(t, raw[0], byte(encryptedMarker))
+	assert.Equal(t, bytes.Contains(raw, kmv.Bytes()[8:]), false)
+	raw, _ = dispatcher.database.Get(ro, []byte("_GOTEST_PLAIN"))
+	assert.Equal(t, raw, kmv.Bytes())
+
+	// Sets and the values kept for them read back decrypted
+	dispatcher.Dispatch(GetRequest{Key: "_GOTEST_SECRET", ResultChan: resultChan})
+	result := <-resultChan
+	assert.Equal(t, result.Data.Bytes(), kmv.Bytes())
+	assert.Equal(t, encryptionFor(sampleKey("_GOTEST_SECRET")) != nil, true)
+
+	// A value can't be moved to another key
+	sealed := sealValue([]byte("_GOTEST_SECRET"), []byte("value"))
+	assert.Equal(t, openValue([]byte("_GOTEST_SECRET"), sealed), []byte("value"))
+	assert.Equal(t, openValue([]byte("_GOTEST_SECRET2"), sealed), sealed)
+}
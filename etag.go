@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// The version of a set, for ETags.  Every add that changes the answer to a
+// query changes the set's bytes, so they identify it better than a count of
+// writes would, and stay the same across restarts and replicas.  extra is
+// anything else the response depends on.
+func sketchETag(kmv *kminvalues.KMinValues, extra ...[]byte) string {
+	h := fnv.New64a()
+	h.Write(kmv.Bytes())
+	for _, data := range extra {
+		h.Write(data)
+	}
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// The version of a set as stored, for when it isn't deserialized
+func dataVersion(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// Sets the ETag of the response and, if the client already has that version
+// according to If-None-Match, answers 304 and returns true
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			w.WriteHeader(304)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCardinalityETag(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_ETAG"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kminvalues.NewKMinValues(16), ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+	add := func(hash uint64) {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, ResultChan: resultChan})
+		<-resultChan
+	}
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/cardinality?key="+key, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		CardinalityHandler(w, r)
+		return w
+	}
+
+	add(1 << 40)
+	w := get("")
+	assert.Equal(t, w.Code, 200)
+	etag := w.Header().Get("ETag")
+	assert.NotEqual(t, etag, "")
+
+	w = get(etag)
+	assert.Equal(t, w.Code, 304)
+	assert.Equal(t, w.Body.Len(), 0)
+	assert.Equal(t, get(`"other", W/`+etag).Code, 304)
+
+	// adding a hash that is already retained doesn't change the version
+	add(1 << 40)
+	assert.Equal(t, get(etag).Code, 304)
+
+	add(1 << 41)
+	w = get(etag)
+	assert.Equal(t, w.Code, 200)
+	assert.NotEqual(t, w.Header().Get("ETag"), etag)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/sketch?key="+key, nil)
+	SketchHandler(w, r)
+	assert.Equal(t, w.Code, 200)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	SketchHandler(w, r)
+	assert.Equal(t, w.Code, 304)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+var (
+	expirer        *Expirer
+	InvalidTTLRule = errors.New("TTL rules need a tag and a positive ttl")
+)
+
+// Keys with the tag, given as name=value or a name for any value, are deleted
+// once they haven't been written to for TTL, eg: "720h"
+type TTLRule struct {
+	Tag string `json:"tag"`
+	TTL string `json:"ttl"`
+
+	filter tagFilter
+	ttl    time.Duration
+}
+
+func LoadTTLRules(filename string) ([]TTLRule, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []TTLRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rule := &rules[i]
+		filters, err := parseTagFilters([]string{rule.Tag})
+		if err != nil {
+			return nil, InvalidTTLRule
+		}
+		rule.filter = filters[0]
+		rule.ttl, err = time.ParseDuration(rule.TTL)
+		if err != nil || rule.ttl <= 0 {
+			return nil, InvalidTTLRule
+		}
+	}
+	return rules, nil
+}
+
+// Tag giving a key its own TTL, eg: ttl=168h
+const ttlTag = "ttl"
+
+// The shortest TTL of the rules matching tags and of their ttl tag, 0 if
+// there is none
+func ttlFor(rules []TTLRule, tags map[string]string) time.Duration {
+	ttl, err := time.ParseDuration(tags[ttlTag])
+	if err != nil || ttl < 0 {
+		ttl = 0
+	}
+	for _, rule := range rules {
+		if matchTags(tags, []tagFilter{rule.filter}) && (ttl == 0 || rule.ttl < ttl) {
+			ttl = rule.ttl
+		}
+	}
+	return ttl
+}
+
+// Deletes a key, as DeleteRequest does, if it was last written more than TTL
+// before Now.  Keys summarized before summaries had a time are never expired.
+type ExpireRequest struct {
+	Key        string
+	TTL        time.Duration
+	Now        time.Time
+	Expired    *bool
+	ResultChan chan Result
+}
+
+func (er ExpireRequest) RequestKeys() []string { return []string{er.Key} }
+
+func (er ExpireRequest) WriteResult(result Result) {
+	result.Key = er.Key
+	er.ResultChan <- result
+}
+
+func (er ExpireRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	summary, found, err := readSummary(batch, er.Key)
+	if err != nil || !found || summary.Updated.IsZero() || er.Now.Sub(summary.Updated) < er.TTL {
+		return nil, err
+	}
+	if _, err := (DeleteRequest{Key: er.Key}).Execute(batch); err != nil {
+		return nil, err
+	}
+	*er.Expired = true
+	return nil, nil
+}
+
+// Deletes the keys whose tags match a TTL rule once they are past their TTL,
+// checking every key every interval
+type Expirer struct {
+	rules    []TTLRule
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewExpirer(rules []TTLRule, interval time.Duration) *Expirer {
+	return &Expirer{
+		rules:    rules,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (e *Expirer) Start() {
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				e.Expire(now)
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (e *Expirer) Stop() {
+	close(e.stop)
+	<-e.done
+}
+
+// Expires every tagged key past its TTL, returning how many were deleted.
+// Nothing expires while the server is read-only.
+func (e *Expirer) Expire(now time.Time) int {
+	expired := 0
+	resultChan := make(chan Result)
+	err := scanTags(dispatcher.database, nil, nil, func(key []byte, tags map[string]string) bool {
+		if isReadOnly() {
+			return false
+		}
+		ttl := ttlFor(e.rules, tags)
+		if ttl == 0 {
+			return true
+		}
+		deleted := false
+		dispatcher.Dispatch(ExpireRequest{Key: string(key), TTL: ttl, Now: now, Expired: &deleted, ResultChan: resultChan})
+		if result := <-resultChan; result.Error != nil {
+			log.Printf("Could not expire %q: %s", key, result.Error)
+		} else if deleted {
+			expired++
+		}
+		select {
+		case <-e.stop:
+			return false
+		default:
+			return true
+		}
+	})
+	if err != nil {
+		log.Printf("Could not expire every key: %s", err)
+	}
+	if expired != 0 {
+		log.Printf("Expired %d keys past their TTL", expired)
+	}
+	return expired
+}
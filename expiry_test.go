@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadTTLRules(t *testing.T) {
+	file, _ := ioutil.TempFile("", "ttl")
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"tag" : "retention=90d", "ttl" : "2160h"}, {"tag" : "scratch", "ttl" : "24h"}]`)
+	file.Close()
+
+	rules, err := LoadTTLRules(file.Name())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(rules), 2)
+	assert.Equal(t, ttlFor(rules, map[string]string{"retention": "90d"}), 2160*time.Hour)
+	assert.Equal(t, ttlFor(rules, map[string]string{"retention": "90d", "scratch": ""}), 24*time.Hour)
+	assert.Equal(t, ttlFor(rules, map[string]string{"retention": "30d"}), time.Duration(0))
+
+	file, _ = os.Create(file.Name())
+	file.WriteString(`[{"tag" : "scratch", "ttl" : "-1h"}]`)
+	file.Close()
+	_, err = LoadTTLRules(file.Name())
+	assert.Equal(t, err, InvalidTTLRule)
+}
+
+func TestExpirer(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	resultChan := make(chan Result)
+	var tags map[string]string
+	keys := []string{"_GOTEST_EXPIRE_A", "_GOTEST_EXPIRE_B"}
+	for _, key := range keys {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		<-resultChan
+		defer func(key string) {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}(key)
+	}
+	dispatcher.Dispatch(TagRequest{Key: keys[0], Set: map[string]string{"scratch": "yes"}, Tags: &tags, ResultChan: resultChan})
+	<-resultChan
+	dispatcher.Dispatch(TagRequest{Key: keys[1], Set: map[string]string{"retention": "90d"}, Tags: &tags, ResultChan: resultChan})
+	<-resultChan
+
+	e := NewExpirer([]TTLRule{
+		{filter: tagFilter{Name: "scratch", Any: true}, ttl: time.Hour},
+		{filter: tagFilter{Name: "retention", Value: "90d"}, ttl: 2160 * time.Hour},
+	}, time.Hour)
+	assert.Equal(t, e.Expire(time.Now()), 0)
+	setReadOnly(true)
+	assert.Equal(t, e.Expire(time.Now().Add(2*time.Hour)), 0)
+	setReadOnly(false)
+	assert.Equal(t, e.Expire(time.Now().Add(2*time.Hour)), 1)
+
+	var cardinality float64
+	var version uint64
+	dispatcher.Dispatch(CardinalityRequest{Key: keys[0], Cardinality: &cardinality, Version: &version, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, cardinality, 0.0)
+	dispatcher.Dispatch(CardinalityRequest{Key: keys[1], Cardinality: &cardinality, Version: &version, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, cardinality, 1.0)
+	tags, _ = readTags(dispatcher.database, keys[0])
+	assert.Equal(t, len(tags), 0)
+}
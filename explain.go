@@ -0,0 +1,207 @@
+package main
+
+import (
+	"github.com/mynameisfiber/gocountme/algebra"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Reads the summaries of several sets at once into Summaries, in the order of
+// Keys, with a zero summary and Found false for keys that have no set
+type SummariesRequest struct {
+	Keys       []string
+	Summaries  []keySummary
+	Found      []bool
+	ResultChan chan Result
+}
+
+func (sr SummariesRequest) readOnly() {}
+
+func (sr SummariesRequest) WriteResult(result Result) {
+	sr.ResultChan <- result
+}
+
+func (sr SummariesRequest) RequestKeys() []string { return sr.Keys }
+
+func (sr SummariesRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	for i, key := range sr.Keys {
+		summary, found, err := readSummary(batch, key)
+		if err != nil {
+			return nil, err
+		} else if !found {
+			// Sets stored before summaries were written are summarized here
+			data, err := batch.Get([]byte(key))
+			if err != nil {
+				return nil, err
+			} else if len(data) != 0 {
+				kmv, err := kminvalues.KMinValuesFromBytes(data)
+				if err != nil {
+					return nil, err
+				}
+				summary, found = newKeySummary(kmv, data, time.Time{}), true
+			}
+		}
+		sr.Summaries[i], sr.Found[i] = summary, found
+	}
+	return nil, nil
+}
+
+// A sketch a query loads.  Keys without a set load an empty one of the k new
+// sets get.
+type explainedSketch struct {
+	Key         string  `json:"key"`
+	Exists      bool    `json:"exists"`
+	K           int     `json:"k"`
+	Hashes      int     `json:"hashes"`
+	Cardinality float64 `json:"cardinality"`
+}
+
+// A step of a query's plan with the k its operands are brought down to, the
+// hashes it reads and the relative error of what it estimates
+type explainedStep struct {
+	algebra.Step
+	K             int     `json:"k"`
+	Cost          int     `json:"cost"`
+	RelativeError float64 `json:"relative_error"`
+}
+
+type queryExplanation struct {
+	Sketches      []explainedSketch `json:"sketches"`
+	Steps         []explainedStep   `json:"steps"`
+	Cost          int               `json:"cost"`
+	BudgetCost    int               `json:"budget_cost"`
+	RelativeError float64           `json:"relative_error"`
+}
+
+// The k and an upper bound on the hashes of a query's set once evaluated
+type explainedSet struct {
+	k      int
+	hashes int
+}
+
+// The k of the sets new keys get
+func newSetSize(key string) int {
+	if policy := keyPolicies.For(key); policy != nil && policy.K > 0 {
+		return policy.K
+	}
+	return *defaultSize
+}
+
+// Walks the query in the order of its plan's steps, filling in each step
+func (qe *queryExplanation) explain(e *Element, sketches map[string]explainedSketch, steps []algebra.Step) explainedSet {
+	var operands []explainedSet
+	if len(e.Keys) != 0 {
+		for _, key := range e.Keys {
+			sketch := sketches[key]
+			operands = append(operands, explainedSet{sketch.K, sketch.Hashes})
+		}
+	} else {
+		for i := range e.Set {
+			operands = append(operands, qe.explain(&e.Set[i], sketches, steps))
+		}
+	}
+
+	step := explainedStep{Step: steps[len(qe.Steps)], K: math.MaxInt32}
+	result := explainedSet{}
+	anyFull := false
+	for _, operand := range operands {
+		if operand.k < step.K {
+			step.K = operand.k
+		}
+		step.Cost += operand.hashes
+		result.hashes += operand.hashes
+		anyFull = anyFull || operand.hashes >= operand.k
+	}
+	result.k = step.K
+
+	// Unions are full once their operands hold k hashes between them, while
+	// intersections are exact only if no set was full
+	switch e.Method {
+	case "get", "cardinality", "union", "cardinality_union":
+		step.RelativeError = relativeErrorFor(step.K, result.hashes >= step.K)
+	case "correlation":
+		step.Cost *= len(operands) - 1
+		fallthrough
+	default:
+		step.RelativeError = relativeErrorFor(step.K, anyFull)
+	}
+	if result.hashes > result.k {
+		result.hashes = result.k
+	}
+	qe.Steps = append(qe.Steps, step)
+	qe.Cost += step.Cost
+	return result
+}
+
+// Plans a query and reads the summaries of the sets it loads, without loading
+// them.  Intersections are only as accurate as their relative error if the
+// sets share many hashes, which their sample_size tells once evaluated.
+func explainQuery(e *Element) (*queryExplanation, error) {
+	plan, err := algebra.NewPlan(e)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	keys := plan.Keys()
+	resultChan := make(chan Result, 1)
+	request := SummariesRequest{
+		Keys:       keys,
+		Summaries:  make([]keySummary, len(keys)),
+		Found:      make([]bool, len(keys)),
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(request); err != nil {
+		return nil, err
+	}
+	if result := <-resultChan; result.Error != nil {
+		return nil, result.Error
+	}
+
+	explanation := &queryExplanation{
+		Sketches:   make([]explainedSketch, len(keys)),
+		BudgetCost: plan.Cost(*defaultSize),
+	}
+	sketches := make(map[string]explainedSketch, len(keys))
+	for i, key := range keys {
+		sketch := explainedSketch{Key: key, Exists: request.Found[i], K: newSetSize(key)}
+		if request.Found[i] {
+			summary := request.Summaries[i]
+			sketch.K, sketch.Hashes, sketch.Cardinality = summary.K, summary.Hashes, summary.Cardinality
+		}
+		explanation.Sketches[i] = sketch
+		sketches[key] = sketch
+	}
+	explanation.explain(e, sketches, plan.Steps)
+	explanation.RelativeError = explanation.Steps[len(explanation.Steps)-1].RelativeError
+	return explanation, nil
+}
+
+// Explains how `q` would be evaluated, without evaluating it
+func QueryExplainHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	query := reqParams.Get("q")
+	if query == "" {
+		HttpError(w, 500, "MISSING_ARG_Q")
+		return
+	}
+
+	element, err := unmarshalQuery([]byte(query))
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	explanation, err := explainQuery(element)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	HttpResponse(w, 200, explanation)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestQueryExplain(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	resultChan := make(chan Result)
+	for key, n := range map[string]int{"_GOTEST_EXPLAIN:full": 2 * *defaultSize, "_GOTEST_EXPLAIN:small": 10} {
+		hashes := make([]uint64, n)
+		for i := range hashes {
+			hashes[i] = GetRandHash()
+		}
+		dispatcher.Dispatch(ImportRequest{Key: key, Hashes: hashes, ResultChan: resultChan})
+		<-resultChan
+		defer func(key string) {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}(key)
+	}
+
+	explain := func(query string) (int, queryExplanation) {
+		w := httptest.NewRecorder()
+		QueryExplainHandler(w, httptest.NewRequest("GET", "/query/explain?q="+url.QueryEscape(query), nil))
+		var response struct{ Data queryExplanation }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Data
+	}
+
+	k := *defaultSize
+	kError := math.Sqrt(2.0 / (math.Pi * float64(k-2)))
+	code, explanation := explain(`{"method" : "jaccard", "set" : [
+		{"method" : "union", "keys" : ["_GOTEST_EXPLAIN:full", "_GOTEST_EXPLAIN:small"]},
+		{"method" : "get", "keys" : ["_GOTEST_EXPLAIN:missing"]}]}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, len(explanation.Sketches), 3)
+	assert.Equal(t, explanation.Sketches[0].Hashes, k)
+	assert.Equal(t, explanation.Sketches[1].Hashes, 10)
+	assert.Equal(t, explanation.Sketches[2].Exists, false)
+	assert.Equal(t, explanation.Sketches[2].K, k)
+
+	assert.Equal(t, len(explanation.Steps), 3)
+	assert.Equal(t, explanation.Steps[0].Expression, "_GOTEST_EXPLAIN:full u _GOTEST_EXPLAIN:small")
+	assert.Equal(t, explanation.Steps[0].Cost, k+10)
+	assert.Equal(t, explanation.Steps[0].RelativeError, kError)
+	assert.Equal(t, explanation.Steps[1].Cost, 0)
+	assert.Equal(t, explanation.Steps[1].RelativeError, 0.0)
+	assert.Equal(t, explanation.Steps[2].Cost, k)
+	assert.Equal(t, explanation.Cost, 2*k+10)
+	assert.Equal(t, explanation.BudgetCost, 5*k)
+	assert.Equal(t, explanation.RelativeError, kError)
+
+	// sets that aren't full are counted exactly
+	_, explanation = explain(`{"method" : "cardinality", "keys" : ["_GOTEST_EXPLAIN:small"]}`)
+	assert.Equal(t, explanation.RelativeError, 0.0)
+
+	code, _ = explain(`{"method" : "jaccard", "keys" : ["_GOTEST_EXPLAIN:small"]}`)
+	assert.Equal(t, code, 500)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Number of sets written between flushes of an export
+const exportFlushEvery = 256
+
+type exportedSet struct {
+	Key string                       `json:"key"`
+	Set *kminvalues.Base64KMinValues `json:"set"`
+}
+
+// Last line of an export, saying that every set was written or where to
+// resume from
+type exportEnd struct {
+	Done bool   `json:"done"`
+	Next string `json:"next,omitempty"`
+}
+
+// Streams every set, in key order, as newline delimited json of the form
+// {"key" : "key1", "set" : {...}} where set is in the base64 form of /get.
+// Takes an optional `prefix`, `after` and `limit` like /keys.  Sets are
+// read one at a time from a consistent view of the DB, so exporting a store
+// of any size takes no more memory than a page of /keys.  The export ends
+// with {"done" : true}, or with {"next" : "key9"} once `limit` sets were
+// written, and an export that was cut off can be resumed by passing the last
+// key received as `after`.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	limit := 0
+	if limit_raw := reqParams.Get("limit"); limit_raw != "" {
+		limit, err = strconv.Atoi(limit_raw)
+		if err != nil || limit <= 0 {
+			HttpError(w, 500, "INVALID_ARG_LIMIT")
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		HttpError(w, 500, "STREAMING_UNSUPPORTED")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+
+	encoder := json.NewEncoder(w)
+	end := exportEnd{Done: true}
+	written := 0
+	failed := false
+	var last string
+	prefix := []byte(reqParams.Get("prefix"))
+	after := []byte(reqParams.Get("after"))
+	err = scanKeys(dispatcher.database, prefix, after, func(key, data []byte, kmv *kminvalues.KMinValues) bool {
+		if limit > 0 && written == limit {
+			end = exportEnd{Next: last}
+			return false
+		}
+		if encoder.Encode(exportedSet{string(key), &kminvalues.Base64KMinValues{KMinValues: kmv}}) != nil {
+			failed = true
+			return false
+		}
+		last = string(key)
+		written++
+		if written%exportFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return r.Context().Err() == nil
+	})
+	// Without the end line clients know the export was cut off
+	if err != nil || failed || r.Context().Err() != nil {
+		return
+	}
+	encoder.Encode(end)
+}
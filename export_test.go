@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportHandler(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	resultChan := make(chan Result)
+	keys := make([]string, 3)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("_GOTEST_EXPORT%d", i)
+		kmv := kminvalues.NewKMinValues(10)
+		for j := 0; j <= i; j++ {
+			kmv.AddHash(GetRandHash())
+		}
+		dispatcher.Dispatch(SetRequest{Key: keys[i], Kmv: kmv, ResultChan: resultChan})
+		<-resultChan
+	}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	export := func(query string) ([]peerSet, exportEnd) {
+		w := httptest.NewRecorder()
+		ExportHandler(w, httptest.NewRequest("GET", "/export?"+query, nil))
+		assert.Equal(t, w.Code, 200)
+		var sets []peerSet
+		var end exportEnd
+		scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), `{"key"`) {
+				var set peerSet
+				assert.Equal(t, json.Unmarshal(scanner.Bytes(), &set), nil)
+				sets = append(sets, set)
+			} else {
+				assert.Equal(t, json.Unmarshal(scanner.Bytes(), &end), nil)
+			}
+		}
+		return sets, end
+	}
+
+	sets, end := export("prefix=_GOTEST_EXPORT&limit=2")
+	assert.Equal(t, len(sets), 2)
+	assert.Equal(t, sets[0].Key, keys[0])
+	assert.Equal(t, sets[1].Set.Len(), 2)
+	assert.Equal(t, end, exportEnd{Next: keys[1]})
+
+	sets, end = export("prefix=_GOTEST_EXPORT&after=" + end.Next)
+	assert.Equal(t, len(sets), 1)
+	assert.Equal(t, sets[0].Key, keys[2])
+	assert.Equal(t, end, exportEnd{Done: true})
+}
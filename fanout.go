@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+)
+
+// Fan-out rules expand a single event into the keys it should be counted
+// under.  A rule is a list of key templates where `{field}` is replaced by the
+// value of that field in the event, eg:
+//
+//	{"users" : ["users:all", "users:country:{country}", "users:device:{device}"]}
+//
+// turns the event country=US&device=ios into the keys users:all,
+// users:country:US and users:device:ios.
+type FanoutRules map[string][]string
+
+var (
+	fanoutRules     FanoutRules
+	templateField   = regexp.MustCompile(`\{([^{}]+)\}`)
+	EmptyFanoutRule = errors.New("Fan-out rule has no templates")
+)
+
+func LoadFanoutRules(filename string) (FanoutRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := FanoutRules{}
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, templates := range rules {
+		if len(templates) == 0 {
+			return nil, EmptyFanoutRule
+		}
+	}
+	return rules, nil
+}
+
+// Fills in a single key template from the event's fields.  Returns false if
+// the event is missing any of the fields the template uses.
+func expandTemplate(template string, fields url.Values) (string, bool) {
+	ok := true
+	key := templateField.ReplaceAllStringFunc(template, func(match string) string {
+		value := fields.Get(match[1 : len(match)-1])
+		if value == "" {
+			ok = false
+		}
+		return value
+	})
+	return key, ok
+}
+
+// Expands all the templates for an event, skipping templates that use fields
+// the event doesn't have.
+func expandTemplates(templates []string, fields url.Values) []string {
+	keys := make([]string, 0, len(templates))
+	for _, template := range templates {
+		if key, ok := expandTemplate(template, fields); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
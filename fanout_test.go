@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"net/url"
+	"testing"
+)
+
+func TestExpandTemplates(t *testing.T) {
+	fields := url.Values{
+		"value":   []string{"user1"},
+		"country": []string{"US"},
+		"device":  []string{"ios"},
+	}
+
+	key, ok := expandTemplate("users:{country}:{device}", fields)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, key, "users:US:ios")
+
+	_, ok = expandTemplate("users:{campaign}", fields)
+	assert.Equal(t, ok, false)
+
+	keys := expandTemplates([]string{
+		"users:all",
+		"users:country:{country}",
+		"users:campaign:{campaign}",
+		"users:device:{device}",
+	}, fields)
+	assert.Equal(t, keys, []string{"users:all", "users:country:US", "users:device:ios"})
+}
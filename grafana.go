@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Grafana's JSON datasource plugins chart gocountme directly when pointed at
+// /grafana.  A target is either a key, charted from its /history, or a JSON
+// query as taken by /query, eg: {"method" : "jaccard", "keys" : ["a", "b"]},
+// whose current value is returned as a single point.
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+	MaxDataPoints int `json:"maxDataPoints"`
+}
+
+// Points are [value, milliseconds since the epoch]
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+func grafanaPoint(value float64, at time.Time) [2]float64 {
+	return [2]float64{value, float64(at.UnixNano() / int64(time.Millisecond))}
+}
+
+// Keeps at most max evenly spaced points, always keeping the last one
+func downsample(points [][2]float64, max int) [][2]float64 {
+	if max <= 0 || len(points) <= max {
+		return points
+	}
+	kept := make([][2]float64, max)
+	for i := range kept {
+		kept[max-1-i] = points[len(points)-1-i*len(points)/max]
+	}
+	return kept
+}
+
+func grafanaResponse(w http.ResponseWriter, data interface{}) {
+	response, err := json.Marshal(data)
+	if err != nil {
+		HttpError(w, 500, "COULD_NOT_FORMAT_RESULT")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Answers the connection test of the datasource
+func GrafanaHandler(w http.ResponseWriter, r *http.Request) {
+	grafanaResponse(w, "OK")
+}
+
+// Lists up to 100 keys starting with the `target` of a POSTed JSON body, for
+// picking targets in the query editor
+func GrafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		HttpError(w, 405, "METHOD_NOT_ALLOWED")
+		return
+	}
+
+	search := struct {
+		Target string `json:"target"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+		HttpError(w, 500, "INVALID_BODY")
+		return
+	}
+
+	keys := make([]string, 0, defaultKeysLimit)
+	err := scanSummaries(dispatcher.database, []byte(search.Target), nil, func(key []byte, summary keySummary) bool {
+		keys = append(keys, string(key))
+		return len(keys) < defaultKeysLimit
+	})
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	grafanaResponse(w, keys)
+}
+
+// Returns a series for every target of a POSTed Grafana query, with the
+// points in its range and at most its maxDataPoints
+func GrafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		HttpError(w, 405, "METHOD_NOT_ALLOWED")
+		return
+	}
+
+	var query grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		HttpError(w, 500, "INVALID_BODY")
+		return
+	}
+	to := query.Range.To
+	if to.IsZero() || to.After(time.Now()) {
+		to = time.Now()
+	}
+
+	series := make([]grafanaSeries, 0, len(query.Targets))
+	for _, target := range query.Targets {
+		serie := grafanaSeries{Target: target.Target, Datapoints: [][2]float64{}}
+		if strings.HasPrefix(strings.TrimSpace(target.Target), "{") {
+			value, err := grafanaQueryValue(r, target.Target)
+			if err != nil {
+				HttpResultError(w, "", err)
+				return
+			}
+			serie.Datapoints = append(serie.Datapoints, grafanaPoint(value, to))
+		} else {
+			points, err := readHistory(target.Target)
+			if err != nil {
+				HttpResultError(w, target.Target, err)
+				return
+			}
+			for _, point := range points {
+				if !point.Time.Before(query.Range.From) && !point.Time.After(to) {
+					serie.Datapoints = append(serie.Datapoints, grafanaPoint(point.Cardinality, point.Time))
+				}
+			}
+			serie.Datapoints = downsample(serie.Datapoints, query.MaxDataPoints)
+		}
+		series = append(series, serie)
+	}
+	grafanaResponse(w, series)
+}
+
+func grafanaQueryValue(r *http.Request, query_raw string) (float64, error) {
+	element, err := unmarshalQuery([]byte(query_raw))
+	if err != nil {
+		return 0, err
+	}
+	release, err := queryPlanner.Admit(r.Context(), queryCost(element))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	result, err := parseQuery(element)
+	if err != nil {
+		return 0, err
+	}
+	value := result.Value()
+	if result.Kmv != nil {
+		result.Kmv.Release()
+	}
+	return value, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	points := make([][2]float64, 10)
+	for i := range points {
+		points[i] = [2]float64{float64(i), float64(i)}
+	}
+	assert.Equal(t, downsample(points, 20), points)
+	assert.Equal(t, downsample(points, 3), [][2]float64{{3, 3}, {6, 6}, {9, 9}})
+}
+
+func TestGrafana(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_GRAFANA"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	for i := 0; i < 3; i++ {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		<-resultChan
+		dispatcher.Dispatch(RecordHistoryRequest{Key: key, At: start.Add(time.Duration(i) * time.Minute), ResultChan: resultChan})
+		<-resultChan
+	}
+
+	w := httptest.NewRecorder()
+	GrafanaSearchHandler(w, httptest.NewRequest("POST", "/grafana/search", strings.NewReader(`{"target" : "_GOTEST_GRAF"}`)))
+	var keys []string
+	json.Unmarshal(w.Body.Bytes(), &keys)
+	assert.Equal(t, keys, []string{key})
+
+	query := fmt.Sprintf(`{"method" : "cardinality", "keys" : [%q]}`, key)
+	body := fmt.Sprintf(`{"range" : {"from" : %q, "to" : %q}, "maxDataPoints" : 100, "targets" : [{"target" : %q}, {"target" : %q}]}`,
+		start.Add(time.Second).Format(time.RFC3339), time.Now().Add(time.Hour).Format(time.RFC3339), key, query)
+	w = httptest.NewRecorder()
+	GrafanaQueryHandler(w, httptest.NewRequest("POST", "/grafana/query", strings.NewReader(body)))
+	assert.Equal(t, w.Code, 200)
+	var series []grafanaSeries
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &series), nil)
+	assert.Equal(t, len(series), 2)
+	assert.Equal(t, series[0].Datapoints, [][2]float64{
+		grafanaPoint(2, start.Add(time.Minute)),
+		grafanaPoint(3, start.Add(2*time.Minute)),
+	})
+	assert.Equal(t, len(series[1].Datapoints), 1)
+	assert.Equal(t, series[1].Datapoints[0][0], 3.0)
+
+	w = httptest.NewRecorder()
+	GrafanaQueryHandler(w, httptest.NewRequest("GET", "/grafana/query", nil))
+	assert.Equal(t, w.Code, 405)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"github.com/mynameisfiber/gocountme/heavyhitters"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const defaultTopK = 10
+
+type topValues struct {
+	Key    string                 `json:"key"`
+	Total  uint64                 `json:"total"`
+	Values []heavyhitters.Counter `json:"values"`
+}
+
+func heavyHittersKey(key string) []byte {
+	return []byte(internalKeyPrefix + "heavyhitters:" + key)
+}
+
+// Counts Value By times in the heavy hitters sketch stored at Key, creating
+// it with Capacity (or --topk-capacity) counters if it doesn't exist
+type IncrementRequest struct {
+	Key        string
+	Value      string
+	By         uint64
+	Capacity   int
+	ResultChan chan Result
+}
+
+// Reads the heavy hitters sketch stored at Key into Sketch
+type TopKRequest struct {
+	Key        string
+	Sketch     *heavyhitters.SpaceSaving
+	ResultChan chan Result
+}
+
+func (ir IncrementRequest) WriteResult(result Result) {
+	result.Key = ir.Key
+	ir.ResultChan <- result
+}
+func (tr TopKRequest) WriteResult(result Result) {
+	result.Key = tr.Key
+	tr.ResultChan <- result
+}
+
+func (ir IncrementRequest) RequestKeys() []string { return []string{ir.Key} }
+func (tr TopKRequest) RequestKeys() []string      { return []string{tr.Key} }
+
+func getHeavyHitters(batch *Batch, key string, capacity int) (*heavyhitters.SpaceSaving, error) {
+	data, err := batch.Get(heavyHittersKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		if capacity == 0 {
+			capacity = *topKCapacity
+		}
+		return heavyhitters.NewSpaceSaving(capacity)
+	}
+	return heavyhitters.SpaceSavingFromBytes(data)
+}
+
+func (ir IncrementRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if ir.Key == "" {
+		return nil, NoKeySpecified
+	}
+
+	ss, err := getHeavyHitters(batch, ir.Key, ir.Capacity)
+	if err != nil {
+		return nil, err
+	}
+	ss.Increment(ir.Value, ir.By)
+	batch.Put(heavyHittersKey(ir.Key), ss.Bytes())
+	return nil, nil
+}
+
+func (tr TopKRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if tr.Key == "" {
+		return nil, NoKeySpecified
+	}
+
+	ss, err := getHeavyHitters(batch, tr.Key, 0)
+	if err != nil {
+		return nil, err
+	}
+	*tr.Sketch = *ss
+	return nil, nil
+}
+
+// Counts `value` an optional `by` (default 1) times in the heavy hitters
+// sketch of `key`.  New sketches take an optional `capacity` (default
+// --topk-capacity), the number of values they keep counts for.
+func IncrementHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	value := reqParams.Get("value")
+	if value == "" {
+		HttpError(w, 500, "MISSING_ARG_VALUE")
+		return
+	} else if !checkValueLength(w, value) {
+		return
+	}
+	value, err = prepareValue(key, value)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+
+	by := uint64(1)
+	if by_raw := reqParams.Get("by"); by_raw != "" {
+		by, err = strconv.ParseUint(by_raw, 10, 64)
+		if err != nil || by == 0 {
+			HttpError(w, 500, "INVALID_ARG_BY")
+			return
+		}
+	}
+
+	capacity := 0
+	if capacity_raw := reqParams.Get("capacity"); capacity_raw != "" {
+		capacity, err = strconv.Atoi(capacity_raw)
+		if err != nil || capacity <= 0 {
+			HttpError(w, 500, "INVALID_ARG_CAPACITY")
+			return
+		}
+	}
+
+	resultChan := make(chan Result)
+	incrementRequest := IncrementRequest{
+		Key:        key,
+		Value:      value,
+		By:         by,
+		Capacity:   capacity,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(withBatching(incrementRequest, reqParams)); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error == nil {
+		HttpResponse(w, 200, "OK")
+	} else {
+		HttpResultError(w, result.Key, result.Error)
+	}
+}
+
+// Returns the `n` (default 10) most frequent values counted in `key`, each
+// with its count and how much that count may over estimate the true one.
+func TopKHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	n := defaultTopK
+	if n_raw := reqParams.Get("n"); n_raw != "" {
+		n, err = strconv.Atoi(n_raw)
+		if err != nil || n <= 0 {
+			HttpError(w, 500, "INVALID_ARG_N")
+			return
+		}
+	}
+
+	var ss heavyhitters.SpaceSaving
+	resultChan := make(chan Result)
+	topKRequest := TopKRequest{
+		Key:        key,
+		Sketch:     &ss,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(topKRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+		return
+	}
+	HttpResponse(w, 200, topValues{Key: key, Total: ss.Total(), Values: ss.Top(n)})
+}
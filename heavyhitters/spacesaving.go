@@ -0,0 +1,137 @@
+package heavyhitters
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var (
+	InvalidCapacity = errors.New("capacity must be positive")
+	InvalidRaw      = errors.New("could not read heavy hitters sketch")
+)
+
+type Counter struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+	// How much Count may over estimate the true count by
+	Error uint64 `json:"error"`
+}
+
+// A SpaceSaving sketch (Metwally, Agrawal & El Abbadi) finds the most frequent
+// values of a stream with a fixed number of counters.  Values that aren't
+// being counted take over the counter with the smallest count, inheriting it
+// as their error, so any value that makes up more than 1/capacity of the
+// stream is guaranteed to have a counter.
+type SpaceSaving struct {
+	capacity int
+	total    uint64
+	counters []Counter
+}
+
+func NewSpaceSaving(capacity int) (*SpaceSaving, error) {
+	if capacity <= 0 {
+		return nil, InvalidCapacity
+	}
+	return &SpaceSaving{capacity: capacity}, nil
+}
+
+func (ss *SpaceSaving) Capacity() int { return ss.capacity }
+
+// The sum of all increments
+func (ss *SpaceSaving) Total() uint64 { return ss.total }
+
+func (ss *SpaceSaving) Increment(value string, by uint64) {
+	ss.total += by
+	smallest := -1
+	for i := range ss.counters {
+		if ss.counters[i].Value == value {
+			ss.counters[i].Count += by
+			return
+		}
+		if smallest < 0 || ss.counters[i].Count < ss.counters[smallest].Count {
+			smallest = i
+		}
+	}
+	if len(ss.counters) < ss.capacity {
+		ss.counters = append(ss.counters, Counter{value, by, 0})
+		return
+	}
+	min := ss.counters[smallest].Count
+	ss.counters[smallest] = Counter{value, min + by, min}
+}
+
+// Returns the n values with the largest counts, largest first
+func (ss *SpaceSaving) Top(n int) []Counter {
+	top := make([]Counter, len(ss.counters))
+	copy(top, ss.counters)
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Value < top[j].Value
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// The serialized form is the uvarint capacity, total and number of counters
+// followed by every counter as its uvarint value length, value, count and
+// error.
+func (ss *SpaceSaving) Bytes() []byte {
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64+len(ss.counters)*(16+binary.MaxVarintLen64))
+	var scratch [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		buf = append(buf, scratch[:binary.PutUvarint(scratch[:], x)]...)
+	}
+	putUvarint(uint64(ss.capacity))
+	putUvarint(ss.total)
+	putUvarint(uint64(len(ss.counters)))
+	for _, counter := range ss.counters {
+		putUvarint(uint64(len(counter.Value)))
+		buf = append(buf, counter.Value...)
+		putUvarint(counter.Count)
+		putUvarint(counter.Error)
+	}
+	return buf
+}
+
+func SpaceSavingFromBytes(raw []byte) (*SpaceSaving, error) {
+	var err error
+	uvarint := func() uint64 {
+		x, n := binary.Uvarint(raw)
+		if n <= 0 {
+			err = InvalidRaw
+			return 0
+		}
+		raw = raw[n:]
+		return x
+	}
+
+	capacity, total, n := uvarint(), uvarint(), uvarint()
+	if err != nil || n > capacity {
+		return nil, InvalidRaw
+	}
+	ss, err := NewSpaceSaving(int(capacity))
+	if err != nil {
+		return nil, err
+	}
+	ss.total = total
+	ss.counters = make([]Counter, n)
+	for i := range ss.counters {
+		length := uvarint()
+		if err != nil || uint64(len(raw)) < length {
+			return nil, InvalidRaw
+		}
+		ss.counters[i].Value = string(raw[:length])
+		raw = raw[length:]
+		ss.counters[i].Count = uvarint()
+		ss.counters[i].Error = uvarint()
+	}
+	if err != nil || len(raw) != 0 {
+		return nil, InvalidRaw
+	}
+	return ss, nil
+}
@@ -0,0 +1,49 @@
+package heavyhitters
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	ss, err := NewSpaceSaving(10)
+	assert.Equal(t, err, nil)
+
+	// a few heavy values hidden in a long tail of distinct ones
+	counts := make(map[string]uint64)
+	for i := 0; i < 10000; i++ {
+		switch r := rand.Float64(); {
+		case r < 0.2:
+			ss.Increment("heavy1", 1)
+			counts["heavy1"]++
+		case r < 0.35:
+			ss.Increment("heavy2", 1)
+			counts["heavy2"]++
+		default:
+			ss.Increment(fmt.Sprintf("tail%d", i), 1)
+		}
+	}
+	assert.Equal(t, ss.Total(), uint64(10000))
+
+	top := ss.Top(2)
+	assert.Equal(t, top[0].Value, "heavy1")
+	assert.Equal(t, top[1].Value, "heavy2")
+	for _, counter := range top {
+		if counter.Count < counts[counter.Value] || counter.Count-counter.Error > counts[counter.Value] {
+			t.Errorf("Counter %v doesn't bound the true count %d", counter, counts[counter.Value])
+		}
+	}
+	assert.Equal(t, len(ss.Top(100)), 10)
+
+	decoded, err := SpaceSavingFromBytes(ss.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded.Top(10), ss.Top(10))
+	assert.Equal(t, decoded.Total(), ss.Total())
+
+	_, err = SpaceSavingFromBytes(ss.Bytes()[:5])
+	assert.Equal(t, err, InvalidRaw)
+	_, err = NewSpaceSaving(0)
+	assert.Equal(t, err, InvalidCapacity)
+}
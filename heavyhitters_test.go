@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/heavyhitters"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_TOPK"
+	resultChan := make(chan Result)
+	clean := func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}
+	clean()
+	defer clean()
+
+	increment := func(query string) {
+		w := httptest.NewRecorder()
+		IncrementHandler(w, httptest.NewRequest("GET", "/increment?key="+key+"&"+query, nil))
+		assert.Equal(t, w.Code, 200)
+	}
+	increment("value=a&capacity=2")
+	increment("value=b&by=5")
+	increment("value=a")
+	increment("value=c")
+
+	w := httptest.NewRecorder()
+	TopKHandler(w, httptest.NewRequest("GET", "/topk?key="+key, nil))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data topValues `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, response.Data.Total, uint64(8))
+	assert.Equal(t, response.Data.Values, []heavyhitters.Counter{
+		{Value: "b", Count: 5},
+		{Value: "c", Count: 3, Error: 2},
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	historyRecorder *HistoryRecorder
+	CorruptHistory  = errors.New("Could not read stored history")
+)
+
+func historyKey(key string) []byte {
+	return []byte(internalKeyPrefix + "history:" + key)
+}
+
+type historyPoint struct {
+	Time        time.Time `json:"time"`
+	Cardinality float64   `json:"cardinality"`
+}
+
+type history struct {
+	Key      string         `json:"key"`
+	Interval string         `json:"interval"`
+	Points   []historyPoint `json:"points"`
+}
+
+// Points are stored oldest first as the seconds since the previous point and
+// the cardinality rounded to an integer, both varints, so a point usually
+// takes a handful of bytes
+func encodeHistory(points []historyPoint) []byte {
+	buf := make([]byte, 0, len(points)*2*binary.MaxVarintLen64)
+	var varint [binary.MaxVarintLen64]byte
+	previous := int64(0)
+	for _, point := range points {
+		at := point.Time.Unix()
+		buf = append(buf, varint[:binary.PutVarint(varint[:], at-previous)]...)
+		buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(math.Round(point.Cardinality)))]...)
+		previous = at
+	}
+	return buf
+}
+
+func decodeHistory(data []byte) ([]historyPoint, error) {
+	var points []historyPoint
+	previous := int64(0)
+	for len(data) > 0 {
+		delta, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, CorruptHistory
+		}
+		cardinality, m := binary.Uvarint(data[n:])
+		if m <= 0 {
+			return nil, CorruptHistory
+		}
+		data = data[n+m:]
+		previous += delta
+		points = append(points, historyPoint{time.Unix(previous, 0).UTC(), float64(cardinality)})
+	}
+	return points, nil
+}
+
+// Appends the current cardinality of a key, from its summary, to its history
+// and drops the points older than Retention.  Keys that no longer exist are
+// left alone.  Results are only sent if there is a ResultChan.
+type RecordHistoryRequest struct {
+	Key        string
+	At         time.Time
+	Retention  time.Duration
+	ResultChan chan Result
+}
+
+func (hr RecordHistoryRequest) RequestKeys() []string { return []string{hr.Key} }
+
+func (hr RecordHistoryRequest) WriteResult(result Result) {
+	if hr.ResultChan != nil {
+		result.Key = hr.Key
+		hr.ResultChan <- result
+	} else if result.Error != nil {
+		log.Printf("Could not record the history of %q: %s", hr.Key, result.Error)
+	}
+}
+
+func (hr RecordHistoryRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	summary, found, err := readSummary(batch, hr.Key)
+	if err != nil || !found {
+		return nil, err
+	}
+	data, err := batch.Get(historyKey(hr.Key))
+	if err != nil {
+		return nil, err
+	}
+	points, err := decodeHistory(data)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := points[:0]
+	for _, point := range points {
+		if hr.Retention <= 0 || hr.At.Sub(point.Time) < hr.Retention {
+			kept = append(kept, point)
+		}
+	}
+	kept = append(kept, historyPoint{hr.At, summary.Cardinality})
+	batch.Put(historyKey(hr.Key), encodeHistory(kept))
+	return nil, nil
+}
+
+// Records the cardinality of every key every --history-interval
+type HistoryRecorder struct {
+	interval  time.Duration
+	retention time.Duration
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewHistoryRecorder(interval, retention time.Duration) *HistoryRecorder {
+	return &HistoryRecorder{
+		interval:  interval,
+		retention: retention,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (hr *HistoryRecorder) Start() {
+	go func() {
+		defer close(hr.done)
+		ticker := time.NewTicker(hr.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				hr.Record(now)
+			case <-hr.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops recording, waiting for a running round of observations to be queued
+func (hr *HistoryRecorder) Stop() {
+	close(hr.stop)
+	<-hr.done
+}
+
+// Queues an observation of every key, from the summaries of the keys, without
+// waiting for them to be written.  Rounds are skipped while memory is short.
+func (hr *HistoryRecorder) Record(now time.Time) {
+	if memoryGuard.UnderPressure() {
+		return
+	}
+	at := now.Truncate(time.Second)
+	err := scanSummaries(dispatcher.database, nil, nil, func(key []byte, summary keySummary) bool {
+		dispatcher.Dispatch(RecordHistoryRequest{Key: string(key), At: at, Retention: hr.retention})
+		select {
+		case <-hr.stop:
+			return false
+		default:
+			return true
+		}
+	})
+	if err != nil {
+		log.Printf("Could not record the history of every key: %s", err)
+	}
+}
+
+// The points recorded for key, oldest first
+func readHistory(key string) ([]historyPoint, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := readValue(dispatcher.database, ro, historyKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistory(data)
+}
+
+// Returns the cardinality of `key` every --history-interval, optionally only
+// between `from` and `to` (RFC3339).  Points older than --history-retention
+// have been dropped.
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	var from, to time.Time
+	if from_raw := reqParams.Get("from"); from_raw != "" {
+		from, err = time.Parse(time.RFC3339, from_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_FROM")
+			return
+		}
+	}
+	if to_raw := reqParams.Get("to"); to_raw != "" {
+		to, err = time.Parse(time.RFC3339, to_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_TO")
+			return
+		}
+	}
+
+	points, err := readHistory(key)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+
+	result := history{Key: key, Interval: historyInterval.String(), Points: make([]historyPoint, 0, len(points))}
+	for _, point := range points {
+		if point.Time.Before(from) || !to.IsZero() && point.Time.After(to) {
+			continue
+		}
+		result.Points = append(result.Points, point)
+	}
+	HttpResponse(w, 200, result)
+}
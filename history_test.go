@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistoryEncoding(t *testing.T) {
+	start := time.Unix(1500000000, 0).UTC()
+	points := []historyPoint{{start, 12}, {start.Add(time.Minute), 15}, {start.Add(2 * time.Minute), 1e9}}
+	data := encodeHistory(points)
+	assert.Equal(t, len(data) < 20, true)
+	decoded, err := decodeHistory(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded, points)
+
+	_, err = decodeHistory(data[:len(data)-1])
+	assert.Equal(t, err, CorruptHistory)
+}
+
+func TestHistory(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_HISTORY"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	start := time.Unix(1500000000, 0).UTC()
+	for i := 0; i < 4; i++ {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		<-resultChan
+		at := start.Add(time.Duration(i) * time.Hour)
+		dispatcher.Dispatch(RecordHistoryRequest{Key: key, At: at, Retention: 150 * time.Minute, ResultChan: resultChan})
+		assert.Equal(t, (<-resultChan).Error, nil)
+	}
+
+	getHistory := func(query string) history {
+		w := httptest.NewRecorder()
+		HistoryHandler(w, httptest.NewRequest("GET", "/history?key="+key+query, nil))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data history `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	// the first point is past the retention by the time the last is recorded
+	points := getHistory("").Points
+	assert.Equal(t, len(points), 3)
+	assert.Equal(t, points[0], historyPoint{start.Add(time.Hour), 2})
+	assert.Equal(t, points[2].Cardinality, 4.0)
+
+	points = getHistory("&from=" + start.Add(90*time.Minute).Format(time.RFC3339) + "&to=" + start.Add(2*time.Hour).Format(time.RFC3339)).Points
+	assert.Equal(t, points, []historyPoint{{start.Add(2 * time.Hour), 3}})
+
+	// keys that don't exist aren't recorded
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	dispatcher.Dispatch(RecordHistoryRequest{Key: key, At: start, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, len(getHistory("").Points), 0)
+}
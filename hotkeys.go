@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultHotKeys = 20
+
+type keyAccess struct {
+	Key        string    `json:"key"`
+	Reads      float64   `json:"reads"`
+	Writes     float64   `json:"writes"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// Counts accesses to a sample of requests, so that keeping track of them stays
+// cheap.  At most capacity keys are tracked; once full, a newly seen key
+// replaces the least accessed one, so keys that are hot enough to matter stay
+// in the table.
+type KeyTracker struct {
+	sync.Mutex
+	rate     float64
+	capacity int
+	keys     map[string]*keyAccess
+}
+
+var hotKeys = NewKeyTracker(0, 0)
+
+func NewKeyTracker(rate float64, capacity int) *KeyTracker {
+	return &KeyTracker{
+		rate:     rate,
+		capacity: capacity,
+		keys:     make(map[string]*keyAccess),
+	}
+}
+
+// Records an access to keys if this request is part of the sample
+func (kt *KeyTracker) Sample(keys []string, write bool) {
+	if kt.rate <= 0 || kt.capacity <= 0 || rand.Float64() >= kt.rate {
+		return
+	}
+	// Each sampled access stands in for 1/rate of them
+	weight := 1 / kt.rate
+	now := time.Now()
+
+	kt.Lock()
+	defer kt.Unlock()
+	for _, key := range keys {
+		access, found := kt.keys[key]
+		if !found {
+			if len(kt.keys) >= kt.capacity {
+				kt.evict()
+			}
+			access = &keyAccess{Key: key}
+			kt.keys[key] = access
+		}
+		if write {
+			access.Writes += weight
+		} else {
+			access.Reads += weight
+		}
+		access.LastAccess = now
+	}
+}
+
+func (kt *KeyTracker) evict() {
+	var coldest *keyAccess
+	for _, access := range kt.keys {
+		if coldest == nil || access.Reads+access.Writes < coldest.Reads+coldest.Writes {
+			coldest = access
+		}
+	}
+	delete(kt.keys, coldest.Key)
+}
+
+// Returns the n most accessed keys, by reads, writes or both
+func (kt *KeyTracker) Top(n int, by string) []keyAccess {
+	kt.Lock()
+	top := make([]keyAccess, 0, len(kt.keys))
+	for _, access := range kt.keys {
+		top = append(top, *access)
+	}
+	kt.Unlock()
+
+	count := func(access keyAccess) float64 {
+		switch by {
+		case "reads":
+			return access.Reads
+		case "writes":
+			return access.Writes
+		}
+		return access.Reads + access.Writes
+	}
+	sort.Slice(top, func(i, j int) bool { return count(top[i]) > count(top[j]) })
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (kt *KeyTracker) Reset() {
+	kt.Lock()
+	kt.keys = make(map[string]*keyAccess)
+	kt.Unlock()
+}
+
+// Samples the keys touched by a request on its way to the DB workers
+func trackRequest(request RequestCommand) {
+	if flush, ok := request.(FlushRequest); ok {
+		request = flush.RequestCommand
+	} else if durable, ok := request.(DurableRequest); ok {
+		request = durable.RequestCommand
+	}
+	read := false
+	switch request.(type) {
+	case GetRequest, CardinalityRequest, CardinalitiesRequest, SummariesRequest, QuantileRequest, TopKRequest, DryRunRequest:
+		read = true
+	}
+	hotKeys.Sample(request.RequestKeys(), !read)
+}
+
+// Lists the `n` (default 20) most accessed keys, as estimated from the sampled
+// requests, sorted by `by` (`reads`, `writes` or the default `total`).
+// `reset=true` clears the counts afterwards.
+func HotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	n := defaultHotKeys
+	if n_raw := reqParams.Get("n"); n_raw != "" {
+		n, err = strconv.Atoi(n_raw)
+		if err != nil || n <= 0 {
+			HttpError(w, 500, "INVALID_ARG_N")
+			return
+		}
+	}
+
+	by := reqParams.Get("by")
+	if by != "" && by != "reads" && by != "writes" && by != "total" {
+		HttpError(w, 500, "INVALID_ARG_BY")
+		return
+	}
+
+	reset := false
+	if reset_raw := reqParams.Get("reset"); reset_raw != "" {
+		reset, err = strconv.ParseBool(reset_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_RESET")
+			return
+		}
+	}
+
+	top := hotKeys.Top(n, by)
+	if reset {
+		hotKeys.Reset()
+	}
+	HttpResponse(w, 200, top)
+}
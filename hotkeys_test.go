@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestKeyTracker(t *testing.T) {
+	kt := NewKeyTracker(1, 2)
+	for i := 0; i < 5; i++ {
+		kt.Sample([]string{"hot"}, false)
+	}
+	kt.Sample([]string{"hot", "warm"}, true)
+	kt.Sample([]string{"warm"}, true)
+	kt.Sample([]string{"cold"}, false)
+
+	// the table is full, so cold pushes out warm, the least accessed key
+	top := kt.Top(10, "")
+	assert.Equal(t, len(top), 2)
+	assert.Equal(t, top[0].Key, "hot")
+	assert.Equal(t, top[0].Reads, 5.0)
+	assert.Equal(t, top[0].Writes, 1.0)
+	assert.Equal(t, top[1].Key, "cold")
+
+	top = kt.Top(1, "writes")
+	assert.Equal(t, top[0].Key, "hot")
+
+	kt.Reset()
+	assert.Equal(t, len(kt.Top(10, "")), 0)
+
+	// nothing is sampled with a rate of 0
+	kt = NewKeyTracker(0, 2)
+	kt.Sample([]string{"hot"}, false)
+	assert.Equal(t, len(kt.Top(10, "")), 0)
+}
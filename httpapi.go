@@ -4,33 +4,137 @@ import _ "net/http/pprof"
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
 	"github.com/reusee/mmh3"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 )
 
-var RequestChan chan RequestCommand
-
 var (
-	VERSION         = "0.2"
-	showVersion     = flag.Bool("version", false, "print version string")
-	httpAddress     = flag.String("http", ":8080", "HTTP service address (e.g., ':8080')")
-	nWorkers        = flag.Int("nworkers", 1, "Number of workers interacting with the DB")
-	defaultSize     = flag.Int("default-size", 1024, "Default size for KMin Value sets")
-	leveldbLRUCache = flag.Int("lru-cache", 1<<16, "LRU Cache size for LevelDB")
-	dblocation      = flag.String("db", ".", "Database location")
+	VERSION          = "0.2"
+	showVersion      = flag.Bool("version", false, "print version string")
+	httpAddress      = flag.String("http", ":8080", "Comma separated HTTP service addresses, either host:port or unix:/path/to.sock (e.g., '127.0.0.1:8080,unix:/run/gocountme.sock')")
+	socketModeFlag   = flag.String("socket-mode", "0660", "File mode of UNIX domain sockets listened on")
+	sourcesFile      = flag.String("sources", "", "JSON file of the event sources to ingest from, with their parsers and key templates")
+	ingestAddress    = flag.String("ingest-address", "", "Address the binary ingest protocol is served on, host:port or unix:/path/to.sock (empty disables it)")
+	middlewareFlag   = flag.String("middleware", "", "Comma separated middlewares every request passes through, in order (e.g., 'logging')")
+	corsOrigins      = flag.String("cors-origins", "", "Comma separated origins browsers may query the API from, * allows any (e.g., 'https://dash.example.com')")
+	corsMethods      = flag.String("cors-methods", "GET,POST,DELETE", "Comma separated methods allowed in cross origin requests")
+	corsHeaders      = flag.String("cors-headers", "Content-Type", "Comma separated headers allowed in cross origin requests")
+	corsMaxAge       = flag.Duration("cors-max-age", 10*time.Minute, "How long browsers may cache the answer to a CORS preflight request")
+	nWorkers         = flag.Int("nworkers", 1, "Number of workers interacting with the DB, keys are sharded between them")
+	readWorkers      = flag.Int("read-workers", 0, "Number of workers serving reads apart from the --nworkers, so heavy queries can't hold up writes (0 serves reads on the --nworkers)")
+	defaultSize      = flag.Int("default-size", 1024, "Default size for KMin Value sets")
+	defaultHashWidth = flag.Int("default-hash-width", 64, "Default hash width in bits (32, 64 or 128) for new KMin Value sets")
+	compressSketches = flag.Bool("compress-sketches", false, "Store sets with their hashes delta encoded, which is smaller for sets that are filling up (sets are read in either encoding)")
+	hashWorkers      = flag.Int("hash-workers", 1, "Number of goroutines hashing the values of each /import batch")
+	deferDuplicates  = flag.Bool("defer-duplicates", false, "Have /import sort the values it adds to sets that aren't full into them once per write instead of searching the set for each one")
+	leveldbLRUCache  = flag.Int("lru-cache", 1<<16, "LRU Cache size for LevelDB")
+	dblocation       = flag.String("db", ".", "Database location")
+	fanoutRulesFile  = flag.String("fanout-rules", "", "JSON file of named key templates for /fanout")
+	normalizeFile    = flag.String("normalize-rules", "", "JSON file of key prefixes and the normalizers applied to values added to them")
+	keyPoliciesFile  = flag.String("key-policies", "", "JSON file of key prefixes and the k, width, ttl and tags their new keys get")
+	shadowKeysFile   = flag.String("shadow-keys", "", "JSON file of key prefixes and the k and width of the shadow sets the hashes added to them are mirrored to")
+	schemasFile      = flag.String("schemas", "", "JSON file of key prefixes and the schema values added to them must match")
+	changelogSize    = flag.Int("changelog-size", 0, "Number of recent changes to keep for /changes (0 disables the changelog)")
+	fencingFlag      = flag.Bool("fencing", false, "Let producers lease keys with /lease, rejecting writes to leased keys without the lease's token")
+	readOnlyFlag     = flag.Bool("read-only", false, "Refuse all writes (can be changed at runtime with /admin/readonly)")
+	batchMaxSize     = flag.Int("batch-size", 64, "Maximum number of requests written to the DB in one batch")
+	batchMaxLatency  = flag.Duration("batch-latency", 0, "Maximum time to wait for more requests before writing a batch (0 only batches requests that are already queued)")
+	batchMaxBytes    = flag.Int("batch-bytes", 4<<20, "Maximum bytes written to the DB in one batch")
+	flushMode        = flag.String("flush", "batch", "When writes are acknowledged: after their own write (request), after their batch is written (batch) or right away with batches written every --batch-latency (timer)")
+	fsync            = flag.Bool("fsync", false, "Wait for every write to be flushed to disk")
+	hotKeySampleRate = flag.Float64("hotkey-sample-rate", 0.01, "Fraction of requests sampled to find hot keys (0 disables)")
+	hotKeyCapacity   = flag.Int("hotkey-capacity", 1000, "Number of keys tracked to find hot keys")
+	warmupKeys       = flag.Int("warmup-keys", 0, "Number of the hottest keys of the last run to read into the cache before serving (0 disables saving hot keys and warming up)")
+	maxPlausible     = flag.Float64("max-plausible-cardinality", 0, "Cardinality no key should ever reach, hashes too small for it are counted as suspicious (0 disables)")
+	suspiciousHashes = flag.Int("suspicious-hashes", 3, "Number of distinct suspicious hashes after which a key is flagged as possibly poisoned")
+	suspiciousPolicy = flag.String("suspicious-hash-policy", "alert", "What to do with suspicious hashes: count and alert on them (alert) or also refuse them (reject)")
+	suspiciousHook   = flag.String("suspicious-hash-webhook", "", "URL that keys flagged as possibly poisoned are posted to")
+	samplingLimit    = flag.Float64("sampling-threshold", 0, "Adds a second to a key above which only a sample of its adds, sized to this rate, are ingested (0 disables)")
+	sampleSize       = flag.Int("sample-size", 0, "Number of values added with /add to keep as a sample of each key (0 disables sampling)")
+	indexValues      = flag.Bool("index-values", false, "Remember the latest value added for every retained hash so /sketch can show them")
+	trackFirstSeen   = flag.Bool("track-first-seen", false, "Remember when every retained hash was first seen so /arrivals can estimate when distinct values arrived")
+	maxLabels        = flag.Int("max-labels", 64, "Maximum number of labels in the breakdown of a key, further labels are counted as _other (0 is unlimited)")
+	quantileK        = flag.Int("quantile-k", 200, "Default size of new quantile sketches, larger sketches are more accurate")
+	topKCapacity     = flag.Int("topk-capacity", 100, "Default number of values new heavy hitters sketches keep counts for")
+	queueSize        = flag.Int("queue-size", 1024, "Number of requests that can be waiting for each DB worker")
+	maxKeys          = flag.Int("max-keys", 0, "Maximum number of keys in the DB (0 is unlimited)")
+	maxK             = flag.Int("max-k", 0, "Maximum size of newly created KMin Value sets (0 is unlimited)")
+	maxValueLength   = flag.Int("max-value-length", 0, "Maximum length in bytes of values added with /add, /multiadd and /fanout (0 is unlimited)")
+	minCommonHashes  = flag.Int("min-common-hashes", 30, "Intersection estimates based on fewer hashes common to every set are flagged as unreliable")
+	queryBudget      = flag.Int("query-budget", 0, "Estimated cost, in hashes read, above which /query, /correlation and /error requests are refused or queued (0 is unlimited)")
+	budgetPolicy     = flag.String("query-budget-policy", "reject", "What to do with queries over --query-budget: refuse them (reject) or run them one at a time (queue)")
+	intersectCache   = flag.Int("intersection-cache", 0, "Number of Jaccard and intersection results cached for unchanged sets (0 disables the cache)")
+	verifyKeysFlag   = flag.String("verify-keys", "", "Comma separated key prefixes whose values are also counted exactly, to log the error of their estimates")
+	verifyLimit      = flag.Int("verify-limit", 100000, "Maximum number of values counted exactly for each key under --verify-keys")
+	verifyInterval   = flag.Duration("verify-interval", time.Minute, "How often the error of the estimates of keys under --verify-keys is logged")
+	historyInterval  = flag.Duration("history-interval", 0, "How often the cardinality of every key is recorded for /history (0 disables history)")
+	historyRetention = flag.Duration("history-retention", 7*24*time.Hour, "How long the points recorded for /history are kept (0 keeps them forever)")
+	ttlRulesFile     = flag.String("ttl-rules", "", "JSON file of rules deleting keys with a tag once they haven't been written to for a TTL")
+	ttlInterval      = flag.Duration("ttl-interval", 10*time.Minute, "How often tagged keys are checked against --ttl-rules and their ttl tags (0 disables expiry)")
+	sinksFile        = flag.String("sinks", "", "JSON file of the sinks the estimates of keys are pushed to on a schedule, eg: warehouse tables")
+	alertRulesFile   = flag.String("alert-rules", "", "JSON file of alert rules evaluated every --alert-interval")
+	alertInterval    = flag.Duration("alert-interval", time.Minute, "How often alert rules are evaluated")
+	lifecycleWebhook = flag.String("lifecycle-webhook", "", "URL that key lifecycle events are posted to")
+	lifecycleEvents  = flag.String("lifecycle-events", "created,deleted", "Comma separated lifecycle events posted to --lifecycle-webhook")
+	mirrorURL        = flag.String("mirror-url", "", "Base URL of a gocountme instance the writes to a fraction of the keys are replayed to")
+	mirrorRate       = flag.Float64("mirror-rate", 0.01, "Fraction of the keys whose writes are replayed to --mirror-url (can be changed at runtime with /admin/mirror)")
+	peersFlag        = flag.String("peers", "", "Comma separated base URLs of gocountme instances in other datacenters whose changes are merged into ours")
+	peerRetry        = flag.Duration("peer-retry", 5*time.Second, "How long to wait before reconnecting to a peer")
+	antiEntropyEvery = flag.Duration("anti-entropy-interval", 0, "How often sets are compared with every peer to repair changes replication missed (0 disables)")
+	merkleDepth      = flag.Int("merkle-depth", 4, "Depth of the merkle trees compared with peers, which have 16^depth leaves")
+	encryptionFile   = flag.String("encryption-keys", "", "JSON file of key prefixes and the environment variables holding the AES keys their sets are encrypted with")
+	saltsFile        = flag.String("hash-salts", "", "JSON file of key prefixes and the environment variables holding the secret salts their values are hashed with")
+	adminTokenEnv    = flag.String("admin-token-env", "", "Environment variable holding the token required by /admin, /exit and the /debug profiling endpoints")
+	heapDumpDir      = flag.String("heapdump-dir", os.TempDir(), "Directory /admin/heapdump writes heap dumps to")
+	auditLogFile     = flag.String("audit-log", "", "Append only file recording deletes and administrative requests for /admin/audit")
+	memoryLimit      = flag.Int64("memory-limit", 0, "Heap size in bytes above which caches are purged and requests refused until it shrinks (0 is unlimited)")
+	queueTimeout     = flag.Duration("queue-timeout", 0, "How long a request waits for room in a full queue before getting a 503")
 )
 
+type base64Result struct {
+	Key  string                      `json:"key"`
+	Data kminvalues.Base64KMinValues `json:"data"`
+}
+
+type cardinalityEvent struct {
+	Key         string  `json:"key"`
+	Cardinality float64 `json:"cardinality"`
+}
+
+type changeEvent struct {
+	Seq     uint64                       `json:"seq"`
+	Key     string                       `json:"key"`
+	Deleted bool                         `json:"deleted"`
+	Set     *kminvalues.Base64KMinValues `json:"set,omitempty"`
+	Delta   *kminvalues.Base64KMinValues `json:"delta,omitempty"`
+}
+
+type errorEstimate struct {
+	Keys             []string `json:"keys"`
+	Estimate         float64  `json:"estimate"`
+	StdErr           float64  `json:"stderr"`
+	RelativeError    float64  `json:"relative_error"`
+	TheoreticalError float64  `json:"theoretical_error"`
+}
+
 type correlationMatrixElement struct {
-	Keys    [2]string `json:"keys"`
-	Jaccard float64   `json:"jaccard"`
+	Keys       [2]string `json:"keys"`
+	Jaccard    float64   `json:"jaccard"`
+	SampleSize int       `json:"sample_size"`
+	Warning    string    `json:"warning,omitempty"`
 }
 
 func GetHandler(w http.ResponseWriter, r *http.Request) {
@@ -46,15 +150,30 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	encoding := reqParams.Get("encoding")
+	if encoding != "" && encoding != "base64" {
+		HttpError(w, 500, "INVALID_ARG_ENCODING")
+		return
+	}
+
 	resultChan := make(chan Result)
 	getRequest := GetRequest{
 		Key:        key,
 		ResultChan: resultChan,
 	}
-	RequestChan <- getRequest
+	if err := submitRequest(getRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
 	result := <-resultChan
 	close(resultChan)
-	HttpResponse(w, 200, result)
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+	} else if encoding == "base64" {
+		HttpResponse(w, 200, base64Result{result.Key, kminvalues.Base64KMinValues{KMinValues: result.Data}})
+	} else {
+		HttpResponse(w, 200, result)
+	}
 }
 
 func DeleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -70,17 +189,43 @@ func DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isDryRun(reqParams) {
+		HttpDryRun(w, DeleteRequest{Key: key}, reqParams)
+		return
+	}
+
 	resultChan := make(chan Result)
 	deleteRequest := DeleteRequest{
 		Key:        key,
 		ResultChan: resultChan,
 	}
-	RequestChan <- deleteRequest
+	if err := submitRequest(withBatching(deleteRequest, reqParams)); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
 	result := <-resultChan
 	close(resultChan)
-	HttpResponse(w, 200, result)
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+	} else {
+		HttpResponse(w, 200, result)
+	}
+}
+
+// The answer of /cardinality when an `estimator` is asked for
+type estimate struct {
+	Cardinality float64              `json:"cardinality"`
+	Estimator   kminvalues.Estimator `json:"estimator"`
+}
+
+// The answer of /cardinalities when an `estimator` is asked for
+type estimates struct {
+	Cardinalities map[string]float64   `json:"cardinalities"`
+	Estimator     kminvalues.Estimator `json:"estimator"`
 }
 
+// Returns the cardinality of `key` or, when an `estimator` is given, an
+// object of the cardinality and the estimator used
 func CardinalityHandler(w http.ResponseWriter, r *http.Request) {
 	reqParams, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
@@ -94,28 +239,107 @@ func CardinalityHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	estimator, err := kminvalues.ParseEstimator(reqParams.Get("estimator"))
+	if err != nil {
+		HttpError(w, 500, "INVALID_ARG_ESTIMATOR")
+		return
+	}
+
+	var card float64
+	var version uint64
 	resultChan := make(chan Result)
-	getRequest := GetRequest{
-		Key:        key,
-		ResultChan: resultChan,
+	cardinalityRequest := CardinalityRequest{
+		Key:         key,
+		Estimator:   estimator,
+		Cardinality: &card,
+		Version:     &version,
+		ResultChan:  resultChan,
+	}
+	if err := submitRequest(cardinalityRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
 	}
-	RequestChan <- getRequest
 	result := <-resultChan
 	close(resultChan)
 	if result.Error == nil {
-		card := result.Data.Cardinality()
+		if _, asked := reqParams["estimator"]; asked {
+			if notModified(w, r, fmt.Sprintf(`"%016x-%s"`, version, estimator)) {
+				return
+			}
+			HttpResponse(w, 200, estimate{card, estimator})
+			return
+		}
+		if notModified(w, r, fmt.Sprintf(`"%016x"`, version)) {
+			return
+		}
 		HttpResponse(w, 200, card)
 	} else {
-		HttpResponse(w, 500, result.Error)
+		HttpResultError(w, key, result.Error)
 	}
 }
 
-func Hashify(orig []byte) uint64 {
-	h := mmh3.Hash128(orig)
-	return binary.LittleEndian.Uint64(h)
+// The most keys a single /cardinalities request can read
+const maxCardinalitiesKeys = 1000
+
+// Estimates the cardinalities of up to 1000 sets at once, given as `key`
+// parameters in the query string or, for long lists, a POST body.  The sets
+// are read in a single batch and returned as an object of key to cardinality,
+// with keys that don't exist counted as 0.  With an `estimator`, that object
+// is returned along with the estimator used.
+func CardinalitiesHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		HttpError(w, 500, "INVALID_BODY")
+		return
+	}
+
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	} else if len(keys) > maxCardinalitiesKeys {
+		HttpError(w, 500, "TOO_MANY_KEYS")
+		return
+	}
+
+	estimator, err := kminvalues.ParseEstimator(r.Form.Get("estimator"))
+	if err != nil {
+		HttpError(w, 500, "INVALID_ARG_ESTIMATOR")
+		return
+	}
+
+	resultChan := make(chan Result)
+	cardinalitiesRequest := CardinalitiesRequest{
+		Keys:          keys,
+		Estimator:     estimator,
+		Cardinalities: make([]float64, len(keys)),
+		ResultChan:    resultChan,
+	}
+	if err := submitRequest(cardinalitiesRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	close(resultChan)
+	if result.Error != nil {
+		HttpResultError(w, "", result.Error)
+		return
+	}
+	cardinalities := make(map[string]float64, len(keys))
+	for i, key := range keys {
+		cardinalities[key] = cardinalitiesRequest.Cardinalities[i]
+	}
+	if _, asked := r.Form["estimator"]; asked {
+		HttpResponse(w, 200, estimates{cardinalities, estimator})
+		return
+	}
+	HttpResponse(w, 200, cardinalities)
 }
 
-func AddHandler(w http.ResponseWriter, r *http.Request) {
+// Reports whether the hash of `value` is currently one of the retained minima
+// of the set.  A value that isn't found may still have been added, its hash
+// just wasn't small enough to be kept.
+func ContainsHandler(w http.ResponseWriter, r *http.Request) {
 	reqParams, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		HttpError(w, 500, "INVALID_URI")
@@ -124,7 +348,6 @@ func AddHandler(w http.ResponseWriter, r *http.Request) {
 
 	key := reqParams.Get("key")
 	if key == "" {
-		log.Println(r.URL.RawQuery)
 		HttpError(w, 500, "MISSING_ARG_KEY")
 		return
 	}
@@ -134,249 +357,1337 @@ func AddHandler(w http.ResponseWriter, r *http.Request) {
 		HttpError(w, 500, "MISSING_ARG_VALUE")
 		return
 	}
-	hash := Hashify([]byte(value))
+	hash := hashValue(key, normalizeRules.Normalize(key, value))
 
-	result := addHash(key, hash)
+	resultChan := make(chan Result)
+	getRequest := GetRequest{
+		Key:        key,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(getRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	close(resultChan)
 	if result.Error == nil {
-		HttpResponse(w, 200, "OK")
+		found := result.Data.FindHash(hash) >= 0
+		result.Data.Release()
+		HttpResponse(w, 200, found)
 	} else {
-		HttpResponse(w, 500, result.Error.Error())
+		HttpResultError(w, key, result.Error)
 	}
 }
 
-func AddHashHandler(w http.ResponseWriter, r *http.Request) {
+// Streams the cardinality of one or more `key`s as server sent events.  The
+// current value of each key is sent on connect and afterwards whenever it
+// changes by more than the relative `delta` (default 0, every change).
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
 	reqParams, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		HttpError(w, 500, "INVALID_URI")
 		return
 	}
 
-	key := reqParams.Get("key")
-	if key == "" {
+	keys := reqParams["key"]
+	if len(keys) == 0 {
 		HttpError(w, 500, "MISSING_ARG_KEY")
 		return
 	}
 
-	hash_raw := reqParams.Get("hash")
-	if hash_raw == "" {
-		HttpError(w, 500, "MISSING_ARG_HASH")
-		return
+	delta := 0.0
+	if delta_raw := reqParams.Get("delta"); delta_raw != "" {
+		delta, err = strconv.ParseFloat(delta_raw, 64)
+		if err != nil || delta < 0 {
+			HttpError(w, 500, "INVALID_ARG_DELTA")
+			return
+		}
 	}
-	hash, err := strconv.ParseUint(hash_raw, 10, 64)
-	if err != nil {
-		HttpResponse(w, 500, "INVALID_ARG_HASH")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		HttpError(w, 500, "STREAMING_UNSUPPORTED")
 		return
 	}
 
-	result := addHash(key, hash)
-	if result.Error == nil {
-		HttpResponse(w, 200, "OK")
-	} else {
-		HttpResponse(w, 500, result.Error.Error())
+	// We subscribe before fetching the current values so that no change can
+	// slip in between the two
+	updates := changes.Subscribe(keys, 4*len(keys))
+	defer changes.Unsubscribe(updates)
+
+	// Not closed since results of requests queued before a failure can still
+	// come in after we return
+	resultChan := make(chan Result, len(keys))
+	for _, key := range keys {
+		getRequest := GetRequest{
+			Key:        key,
+			ResultChan: resultChan,
+		}
+		if err := submitRequest(getRequest); err != nil {
+			HttpResultError(w, "", err)
+			return
+		}
 	}
-}
 
-func addHash(key string, hash uint64) Result {
-	resultChan := make(chan Result)
-	defer close(resultChan)
-	addHashRequest := AddHashRequest{
-		Key:        key,
-		Hash:       hash,
-		ResultChan: resultChan,
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	last := make(map[string]float64, len(keys))
+	for i := 0; i < len(keys); i++ {
+		result := <-resultChan
+		if result.Error != nil {
+			log.Printf("Could not get %s for subscription: %s", result.Key, result.Error)
+			continue
+		}
+		last[result.Key] = result.Data.Cardinality()
+		writeEvent(w, "cardinality", cardinalityEvent{result.Key, last[result.Key]})
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case change := <-updates:
+			card := 0.0
+			if change.Kmv != nil {
+				card = change.Kmv.Cardinality()
+			}
+			if prev, found := last[change.Key]; found && !cardinalityChanged(prev, card, delta) {
+				continue
+			}
+			last[change.Key] = card
+			writeEvent(w, "cardinality", cardinalityEvent{change.Key, card})
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
 	}
-	RequestChan <- addHashRequest
-	return <-resultChan
 }
 
-func JaccardHandler(w http.ResponseWriter, r *http.Request) {
+// Streams every change to the database as newline delimited json.  Each change
+// has a `seq` number and a client that gets disconnected can resume by passing
+// the last `seq` it saw as `since`.  Without `since` only new changes are
+// streamed.  With `format=delta`, changes that only inserted hashes carry just
+// those hashes rather than the whole set.
+func ChangesHandler(w http.ResponseWriter, r *http.Request) {
 	reqParams, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		HttpError(w, 500, "INVALID_URI")
 		return
 	}
 
-	if len(reqParams["key"]) != 2 {
-		HttpError(w, 500, "MUST_PROVIDE_2_KEYS")
+	format := reqParams.Get("format")
+	if format != "" && format != "full" && format != "delta" {
+		HttpError(w, 500, "INVALID_ARG_FORMAT")
 		return
 	}
 
-	key1 := reqParams["key"][0]
-	if key1 == "" {
-		HttpError(w, 500, "MISSING_ARG_KEY")
+	since := uint64(math.MaxUint64)
+	if since_raw := reqParams.Get("since"); since_raw != "" {
+		since, err = strconv.ParseUint(since_raw, 10, 64)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_SINCE")
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		HttpError(w, 500, "STREAMING_UNSUPPORTED")
 		return
 	}
 
-	key2 := reqParams["key"][1]
-	if key2 == "" {
-		HttpError(w, 500, "MISSING_ARG_KEY")
+	backlog, updates, err := changes.Follow(since, 1024)
+	if err != nil {
+		HttpResultError(w, "", err)
 		return
 	}
+	defer changes.Unsubscribe(updates)
 
-	resultChan := make(chan Result, 2)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
 
-	getRequest1 := GetRequest{
-		Key:        key1,
-		ResultChan: resultChan,
+	encoder := json.NewEncoder(w)
+	writeChange := func(change Change) error {
+		event := changeEvent{Seq: change.Seq, Key: change.Key, Deleted: change.Kmv == nil}
+		if format == "delta" && change.Delta != nil {
+			event.Delta = &kminvalues.Base64KMinValues{KMinValues: change.Delta}
+		} else if change.Kmv != nil {
+			event.Set = &kminvalues.Base64KMinValues{KMinValues: change.Kmv}
+		}
+		return encoder.Encode(event)
 	}
-	RequestChan <- getRequest1
-	result1 := <-resultChan
 
-	getRequest2 := GetRequest{
-		Key:        key2,
-		ResultChan: resultChan,
+	for _, change := range backlog {
+		if writeChange(change) != nil {
+			return
+		}
 	}
-	RequestChan <- getRequest2
-	result2 := <-resultChan
+	flusher.Flush()
 
-	if result1.Error != nil {
-		HttpResponse(w, 500, result1.Error.Error())
-	} else if result2.Error != nil {
-		HttpResponse(w, 500, result2.Error.Error())
-	} else {
-		jac := result1.Data.Jaccard(result2.Data)
-		HttpResponse(w, 200, QueryResult{Num: jac})
+	for {
+		select {
+		case change, ok := <-updates:
+			if !ok {
+				return
+			}
+			if writeChange(change) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
 	}
 }
 
-func CorrelationMatrixHandler(w http.ResponseWriter, r *http.Request) {
+func Hashify(orig []byte) uint64 {
+	h := mmh3.Hash128(orig)
+	return binary.LittleEndian.Uint64(h)
+}
+
+// The full murmur3 hash of orig, whose high half is Hashify(orig)
+func Hashify128(orig []byte) (high, low uint64) {
+	h := mmh3.Hash128(orig)
+	return binary.LittleEndian.Uint64(h), binary.LittleEndian.Uint64(h[8:])
+}
+
+func AddHandler(w http.ResponseWriter, r *http.Request) {
 	reqParams, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		HttpError(w, 500, "INVALID_URI")
 		return
 	}
 
-	if _, found := reqParams["key"]; !found {
+	key := reqParams.Get("key")
+	if key == "" {
+		log.Println(r.URL.RawQuery)
 		HttpError(w, 500, "MISSING_ARG_KEY")
 		return
 	}
 
-	N := len(reqParams["key"])
-	if N < 2 {
-		HttpError(w, 500, "MUST_PROVIDE_2+_KEYS")
+	value := reqParams.Get("value")
+	if value == "" {
+		HttpError(w, 500, "MISSING_ARG_VALUE")
+		return
+	} else if !checkValueLength(w, value) {
 		return
 	}
-
-	resultChan := make(chan Result, N)
-	defer close(resultChan)
-	kmvs := make([]*Result, N)
-	for _, key := range reqParams["key"] {
-		getRequest := GetRequest{
-			Key:        key,
-			ResultChan: resultChan,
-		}
-		RequestChan <- getRequest
-	}
-
-	for i := 0; i < N; i++ {
-		result := <-resultChan
-		if result.Error != nil {
-			HttpError(w, 500, result.Error.Error())
-			return
-		}
-		kmvs[i] = &result
+	value, err = prepareValue(key, value)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
 	}
+	hash, low := hashValue128(key, value)
 
-	matrix := make([]correlationMatrixElement, 0, N*(N-1)/2)
-	for i, r1 := range kmvs[:N-1] {
-		for _, r2 := range kmvs[i+1:] {
-			key := [2]string{r1.Key, r2.Key}
-			j := r1.Data.Jaccard(r2.Data)
-			matrix = append(matrix, correlationMatrixElement{key, j})
-		}
+	width, err := parseHashWidth(reqParams)
+	if err != nil {
+		HttpError(w, 500, "INVALID_ARG_WIDTH")
+		return
 	}
 
-	HttpResponse(w, 200, matrix)
+	addHash(w, key, hash, low, []byte(value), width, reqParams)
 }
 
-func QueryHandler(w http.ResponseWriter, r *http.Request) {
+func AddHashHandler(w http.ResponseWriter, r *http.Request) {
 	reqParams, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		HttpError(w, 500, "INVALID_URI")
 		return
 	}
 
-	query := reqParams.Get("q")
-	if query == "" {
-		HttpError(w, 500, "MISSING_ARG_Q")
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
 		return
 	}
 
-	result, err := ParseQuery([]byte(query))
+	hash_raw := reqParams.Get("hash")
+	if hash_raw == "" {
+		HttpError(w, 500, "MISSING_ARG_HASH")
+		return
+	}
+	hash, err := strconv.ParseUint(hash_raw, 10, 64)
 	if err != nil {
-		HttpResponse(w, 500, err.Error())
+		HttpError(w, 500, "INVALID_ARG_HASH")
 		return
-	} else {
-		HttpResponse(w, 200, result)
+	}
+
+	width, err := parseHashWidth(reqParams)
+	if err != nil {
+		HttpError(w, 500, "INVALID_ARG_WIDTH")
 		return
 	}
-	HttpResponse(w, 500, "SERVER_ERROR")
-}
 
-func ExitHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "OK")
-	Exit()
+	addHash(w, key, hash, 0, nil, width, reqParams)
 }
 
-func Exit() {
-	close(RequestChan)
+// Parses the optional `width` parameter used to pick the hash width of newly
+// created keys.  A missing width returns 0 so the default is used.
+func parseHashWidth(reqParams url.Values) (int, error) {
+	width_raw := reqParams.Get("width")
+	if width_raw == "" {
+		return 0, nil
+	}
+	width, err := strconv.Atoi(width_raw)
+	if err != nil {
+		return 0, err
+	}
+	if width != 32 && width != 64 && width != 128 {
+		return 0, kminvalues.InvalidHashWidth
+	}
+	return width, nil
 }
 
-func main() {
-	flag.Parse()
-
-	if *showVersion {
-		fmt.Printf("gocountme: v%s\n", VERSION)
+// Adds a single value to several keys at once.  Takes a `value` and one or
+// more `key` parameters in a POST body and either updates every key or none of
+// them.
+func MultiAddHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		HttpError(w, 405, "METHOD_NOT_ALLOWED")
 		return
 	}
 
-	if *defaultSize <= 0 {
-		fmt.Printf("--default-size must be greater than 0\n")
+	err := r.ParseForm()
+	if err != nil {
+		HttpError(w, 500, "INVALID_BODY")
 		return
 	}
 
-	if _, err := os.Stat(*dblocation); err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("Database location does not exist:", *dblocation)
-			return
-		}
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
 	}
 
-	log.Println("Opening levelDB")
-	opts := levigo.NewOptions()
-	opts.SetCache(levigo.NewLRUCache(*leveldbLRUCache))
-	opts.SetCreateIfMissing(true)
-	db, err := levigo.Open(*dblocation, opts)
-	defer db.Close()
+	value := r.Form.Get("value")
+	if value == "" {
+		HttpError(w, 500, "MISSING_ARG_VALUE")
+		return
+	} else if !checkValueLength(w, value) {
+		return
+	}
 
+	width, err := parseHashWidth(r.Form)
 	if err != nil {
-		log.Panicln(err)
+		HttpError(w, 500, "INVALID_ARG_WIDTH")
+		return
 	}
 
-	RequestChan = make(chan RequestCommand, *nWorkers)
-	workerWaitGroup := sync.WaitGroup{}
-	log.Printf("Starting %d workers", *nWorkers)
-	for i := 0; i < *nWorkers; i++ {
-		go func(id int) {
-			workerWaitGroup.Add(1)
-			levelDBWorker(db, RequestChan)
-			workerWaitGroup.Done()
-		}(i)
-	}
-
-	http.HandleFunc("/get", GetHandler)
-	http.HandleFunc("/delete", DeleteHandler)
-	http.HandleFunc("/cardinality", CardinalityHandler)
-	http.HandleFunc("/jaccard", JaccardHandler)
-	http.HandleFunc("/correlation", CorrelationMatrixHandler)
-	http.HandleFunc("/add", AddHandler)
-	http.HandleFunc("/addhash", AddHashHandler)
-	http.HandleFunc("/query", QueryHandler)
-	http.HandleFunc("/exit", ExitHandler)
-
-	log.Printf("Starting gocountme HTTP server on %s", *httpAddress)
-	go func() {
-		log.Fatal(http.ListenAndServe(*httpAddress, nil))
-	}()
+	resultChan := make(chan Result)
+	defer close(resultChan)
+	multiAddHashRequest, err := newMultiAddRequest(keys, value, width, resultChan)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	if err := poisonGuard.CheckMulti(multiAddHashRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	multiAddHashRequest, admitted := keySampler.filter(multiAddHashRequest)
+	if isDryRun(r.Form) {
+		httpDryRunAdmitted(w, multiAddHashRequest, admitted, r.Form)
+		return
+	} else if !admitted {
+		HttpResponse(w, 200, "OK")
+		return
+	}
+	if err := submitRequest(withBatching(multiAddHashRequest, r.Form)); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error == nil {
+		HttpResponse(w, 200, "OK")
+	} else {
+		HttpResultError(w, result.Key, result.Error)
+	}
+}
+
+// Adds `value` to every key generated by expanding key templates with the
+// other fields of the request.  Templates either come from a configured
+// `rule` or are given directly with one or more `template` parameters.
+func FanoutHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		HttpError(w, 500, "INVALID_BODY")
+		return
+	}
+
+	value := r.Form.Get("value")
+	if value == "" {
+		HttpError(w, 500, "MISSING_ARG_VALUE")
+		return
+	} else if !checkValueLength(w, value) {
+		return
+	}
+
+	width, err := parseHashWidth(r.Form)
+	if err != nil {
+		HttpError(w, 500, "INVALID_ARG_WIDTH")
+		return
+	}
+
+	templates := r.Form["template"]
+	if rule := r.Form.Get("rule"); rule != "" {
+		var found bool
+		templates, found = fanoutRules[rule]
+		if !found {
+			HttpError(w, 500, "UNKNOWN_RULE")
+			return
+		}
+	}
+	if len(templates) == 0 {
+		HttpError(w, 500, "MISSING_ARG_TEMPLATE")
+		return
+	}
+
+	keys := expandTemplates(templates, r.Form)
+	if len(keys) == 0 {
+		HttpError(w, 500, "NO_KEYS_EXPANDED")
+		return
+	}
+
+	resultChan := make(chan Result)
+	defer close(resultChan)
+	multiAddHashRequest, err := newMultiAddRequest(keys, value, width, resultChan)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	if err := poisonGuard.CheckMulti(multiAddHashRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	multiAddHashRequest, admitted := keySampler.filter(multiAddHashRequest)
+	if isDryRun(r.Form) {
+		httpDryRunAdmitted(w, multiAddHashRequest, admitted, r.Form)
+		return
+	} else if !admitted {
+		HttpResponse(w, 200, keys)
+		return
+	}
+	if err := submitRequest(withBatching(multiAddHashRequest, r.Form)); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error == nil {
+		HttpResponse(w, 200, keys)
+	} else {
+		HttpResultError(w, result.Key, result.Error)
+	}
+}
+
+// Mutations with `nobatch=true` are written to the DB as soon as they are
+// executed instead of waiting for the rest of their batch.  Mutations are
+// also fenced by their `token`, see withFencing.
+func withBatching(request RequestCommand, reqParams url.Values) RequestCommand {
+	request = withFencing(request, reqParams)
+	if nobatch, _ := strconv.ParseBool(reqParams.Get("nobatch")); nobatch {
+		return FlushRequest{request}
+	}
+	return request
+}
+
+// Adds hash to key for /add and /addhash and responds with the result, or with
+// what the add would change for dry runs
+func addHash(w http.ResponseWriter, key string, hash, low uint64, value []byte, width int, reqParams url.Values) {
+	if err := poisonGuard.Check(key, hash); err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	resultChan := make(chan Result)
+	defer close(resultChan)
+	addHashRequest := AddHashRequest{
+		Key:        key,
+		Hash:       hash,
+		Low:        low,
+		HashWidth:  width,
+		Value:      value,
+		Label:      reqParams.Get("label"),
+		ResultChan: resultChan,
+	}
+	admitted := keySampler.Admit(key, hash)
+	if isDryRun(reqParams) {
+		httpDryRunAdmitted(w, addHashRequest, admitted, reqParams)
+		return
+	} else if !admitted {
+		HttpResponse(w, 200, "OK")
+		return
+	}
+
+	if err := submitRequest(withBatching(addHashRequest, reqParams)); err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	result := <-resultChan
+	if result.Error == nil {
+		HttpResponse(w, 200, "OK")
+	} else {
+		HttpResultError(w, result.Key, result.Error)
+	}
+}
+
+// Unions all the `from` keys into `key`, keeping whatever was already stored
+// at `key`.  Keys that don't exist are skipped rather than being treated as
+// empty sets of the default size so they can't shrink the result's k.  With
+// `job` the union is tracked as that job, see runUnionJob.
+func UnionHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	sources := reqParams["from"]
+	if len(sources) == 0 {
+		HttpError(w, 500, "MISSING_ARG_FROM")
+		return
+	}
+
+	if id := reqParams.Get("job"); id != "" && !isDryRun(reqParams) {
+		runUnionJob(w, id, key, sources, reqParams)
+		return
+	}
+
+	union, err := readUnion(sources)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	if isDryRun(reqParams) {
+		if union == nil {
+			HttpResponse(w, 200, []dryRunChange{})
+		} else {
+			HttpDryRun(w, MergeRequest{Key: key, Kmv: union}, reqParams)
+		}
+		return
+	}
+	if err := mergeUnion(key, union, nil, reqParams); err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	HttpResponse(w, 200, "OK")
+}
+
+// Runs a union as job id and responds with the job.  A job that is already
+// done isn't run again, so retrying a union job that timed out or whose
+// server restarted is safe and cheap.
+func runUnionJob(w http.ResponseWriter, id, key string, sources []string, reqParams url.Values) {
+	job, run, err := startJob(dispatcher.database, id, key, sources)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	if !run {
+		HttpResponse(w, 200, job)
+		return
+	}
+
+	union, err := readUnion(sources)
+	if err == nil {
+		saveJob(dispatcher.database, job, jobRunning)
+		err = mergeUnion(key, union, job, reqParams)
+	}
+	finishJob(dispatcher.database, job, err)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	HttpResponse(w, 200, job)
+}
+
+// Reads the sets of sources and unions them, nil if none of them exist
+func readUnion(sources []string) (*kminvalues.KMinValues, error) {
+	resultChan := make(chan Result, len(sources))
+	for _, source := range sources {
+		getRequest := GetRequest{
+			Key:        source,
+			ResultChan: resultChan,
+		}
+		if err := submitRequest(getRequest); err != nil {
+			return nil, err
+		}
+	}
+
+	var union *kminvalues.KMinValues
+	var err error
+	for i := 0; i < len(sources); i++ {
+		result := <-resultChan
+		if result.Error != nil {
+			err = result.Error
+		} else if result.Data.Len() == 0 {
+			continue
+		} else if union == nil {
+			union = result.Data
+		} else {
+			union.Merge(result.Data)
+		}
+	}
+	return union, err
+}
+
+// Merges union into key, marking job done along with it if there is one
+func mergeUnion(key string, union *kminvalues.KMinValues, job *unionJob, reqParams url.Values) error {
+	if union == nil {
+		return nil
+	}
+	resultChan := make(chan Result, 1)
+	mergeRequest := MergeRequest{
+		Key:        key,
+		Kmv:        union,
+		Job:        job,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(withBatching(mergeRequest, reqParams)); err != nil {
+		return err
+	}
+	return (<-resultChan).Error
+}
+
+func JaccardHandler(w http.ResponseWriter, r *http.Request) {
+	pairHandler(w, r, func(a, b *kminvalues.KMinValues, intersection kminvalues.Intersection) float64 {
+		return intersection.Jaccard
+	})
+}
+
+// Returns the fraction of the values of the first `key` which are also in the
+// second, eg: how much of a campaign's audience is already in a segment.
+func ContainmentHandler(w http.ResponseWriter, r *http.Request) {
+	pairHandler(w, r, func(a, b *kminvalues.KMinValues, intersection kminvalues.Intersection) float64 {
+		return fraction(intersection.Cardinality, a.Cardinality())
+	})
+}
+
+// Returns the size of the intersection of the two `key`s relative to the
+// smaller of them, which is 1 whenever one set contains the other.
+func OverlapHandler(w http.ResponseWriter, r *http.Request) {
+	pairHandler(w, r, func(a, b *kminvalues.KMinValues, intersection kminvalues.Intersection) float64 {
+		return fraction(intersection.Cardinality, math.Min(a.Cardinality(), b.Cardinality()))
+	})
+}
+
+func fraction(part, whole float64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return math.Min(part/whole, 1)
+}
+
+// Computes a metric of the intersection of the two sets given as `key`
+// parameters
+func pairHandler(w http.ResponseWriter, r *http.Request, metric func(a, b *kminvalues.KMinValues, intersection kminvalues.Intersection) float64) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	if len(reqParams["key"]) != 2 {
+		HttpError(w, 500, "MUST_PROVIDE_2_KEYS")
+		return
+	}
+
+	key1 := reqParams["key"][0]
+	if key1 == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	key2 := reqParams["key"][1]
+	if key2 == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	resultChan := make(chan Result, 2)
+
+	getRequest1 := GetRequest{
+		Key:        key1,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(getRequest1); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result1 := <-resultChan
+
+	getRequest2 := GetRequest{
+		Key:        key2,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(getRequest2); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result2 := <-resultChan
+
+	if result1.Error != nil {
+		HttpResultError(w, key1, result1.Error)
+	} else if result2.Error != nil {
+		HttpResultError(w, key2, result2.Error)
+	} else {
+		intersection := intersections.Intersect(result1.Data, result2.Data)
+		num := metric(result1.Data, result2.Data, intersection)
+		result1.Data.Release()
+		result2.Data.Release()
+		HttpResponse(w, 200, intersectionResult("", num, intersection.Common))
+	}
+}
+
+func CorrelationMatrixHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	if _, found := reqParams["key"]; !found {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	N := len(reqParams["key"])
+	if N < 2 {
+		HttpError(w, 500, "MUST_PROVIDE_2+_KEYS")
+		return
+	}
+
+	release, err := queryPlanner.Admit(r.Context(), correlationCost(N))
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	defer release()
+
+	resultChan := make(chan Result, N)
+	kmvs := make([]*Result, N)
+	for _, key := range reqParams["key"] {
+		getRequest := GetRequest{
+			Key:        key,
+			ResultChan: resultChan,
+		}
+		if err := submitRequest(getRequest); err != nil {
+			HttpResultError(w, "", err)
+			return
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		result := <-resultChan
+		if result.Error != nil {
+			HttpResultError(w, result.Key, result.Error)
+			return
+		}
+		kmvs[i] = &result
+	}
+
+	sets := make([]*kminvalues.KMinValues, N)
+	for i, r := range kmvs {
+		sets[i] = r.Data
+	}
+	matrix := make([]correlationMatrixElement, 0, N*(N-1)/2)
+	intersections.Correlate(sets, func(i, j int, intersection kminvalues.Intersection) {
+		key := [2]string{kmvs[i].Key, kmvs[j].Key}
+		matrix = append(matrix, correlationMatrixElement{key, intersection.Jaccard, intersection.Common, intersectionWarning(intersection.Common)})
+	})
+	for _, r := range kmvs {
+		r.Data.Release()
+	}
+
+	HttpResponse(w, 200, matrix)
+}
+
+// Estimates the cardinality of a single `key`, or of the intersection of
+// several, along with its jackknife standard error.  The theoretical error
+// only depends on k, while the jackknife error shows how much an intersection
+// estimate can be trusted given how few hashes the sets share.
+func ErrorHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	keys := reqParams["key"]
+	if len(keys) == 0 {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	release, err := queryPlanner.Admit(r.Context(), sketchesCost(len(keys)))
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	defer release()
+
+	resultChan := make(chan Result, len(keys))
+	for _, key := range keys {
+		getRequest := GetRequest{
+			Key:        key,
+			ResultChan: resultChan,
+		}
+		if err := submitRequest(getRequest); err != nil {
+			HttpResultError(w, "", err)
+			return
+		}
+	}
+
+	kmvs := make([]*kminvalues.KMinValues, 0, len(keys))
+	defer func() {
+		for _, kmv := range kmvs {
+			kmv.Release()
+		}
+	}()
+	for range keys {
+		result := <-resultChan
+		if result.Error != nil {
+			HttpResultError(w, result.Key, result.Error)
+			return
+		}
+		kmvs = append(kmvs, result.Data)
+	}
+
+	estimate := errorEstimate{Keys: keys}
+	estimate.Estimate, estimate.StdErr = kminvalues.Jackknife(kmvs...)
+	if estimate.Estimate != 0 {
+		estimate.RelativeError = estimate.StdErr / estimate.Estimate
+	}
+	estimate.TheoreticalError = kmvs[0].RelativeError()
+	for _, kmv := range kmvs[1:] {
+		estimate.TheoreticalError = math.Max(estimate.TheoreticalError, kmv.RelativeError())
+	}
+	HttpResponse(w, 200, estimate)
+}
+
+func QueryHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	query := reqParams.Get("q")
+	if query == "" {
+		HttpError(w, 500, "MISSING_ARG_Q")
+		return
+	}
+
+	element, err := unmarshalQuery([]byte(query))
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	release, err := queryPlanner.Admit(r.Context(), queryCost(element))
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	defer release()
+
+	result, err := parseQuery(element)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	HttpResponse(w, 200, result)
+}
+
+func ExitHandler(w http.ResponseWriter, r *http.Request) {
+	// Recorded up front since the server stops once the DB is closed
+	recordAudit("exit", r, 200)
+	fmt.Fprintf(w, "OK")
+	Exit()
+}
+
+func Exit() {
+	if replicator != nil {
+		replicator.Stop()
+	}
+	if alerter != nil {
+		alerter.Stop()
+	}
+	if historyRecorder != nil {
+		historyRecorder.Stop()
+	}
+	if expirer != nil {
+		expirer.Stop()
+	}
+	if hotKeysSaver != nil {
+		hotKeysSaver.Stop()
+	}
+	if sinks != nil {
+		sinks.Stop()
+	}
+	if *verifyKeysFlag != "" {
+		verifier.Stop()
+	}
+	if ingestServer != nil {
+		ingestServer.Stop()
+	}
+	if eventSources != nil {
+		eventSources.Stop()
+	}
+	dispatcher.Close()
+	if *memoryLimit > 0 {
+		memoryGuard.Stop()
+	}
+	if lifecycleHooks != nil {
+		lifecycleHooks.Stop()
+	}
+	if mirror != nil {
+		mirror.Stop()
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("gocountme: v%s\n", VERSION)
+		return
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			fmt.Printf("Could not migrate: %s\n", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "query" {
+		if err := runQuery(flag.Args()[1:], os.Stdout); err != nil {
+			fmt.Printf("Could not evaluate query: %s\n", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "test-vectors" {
+		if err := writeTestVectors(os.Stdout); err != nil {
+			fmt.Printf("Could not write test vectors: %s\n", err)
+		}
+		return
+	}
+
+	if *defaultSize <= 0 {
+		fmt.Printf("--default-size must be greater than 0\n")
+		return
+	}
+
+	if *maxK > 0 && *defaultSize > *maxK {
+		fmt.Printf("--default-size can't be larger than --max-k\n")
+		return
+	}
+
+	if *defaultHashWidth != 32 && *defaultHashWidth != 64 && *defaultHashWidth != 128 {
+		fmt.Printf("--default-hash-width must be 32, 64 or 128\n")
+		return
+	}
+
+	if *changelogSize < 0 {
+		fmt.Printf("--changelog-size must be 0 or greater\n")
+		return
+	}
+	changes = NewChangeFeed(*changelogSize)
+	setReadOnly(*readOnlyFlag)
+
+	socketMode, err := strconv.ParseUint(*socketModeFlag, 8, 32)
+	if err != nil {
+		fmt.Printf("--socket-mode must be an octal file mode\n")
+		return
+	}
+
+	if *adminTokenEnv != "" {
+		adminToken = os.Getenv(*adminTokenEnv)
+		if adminToken == "" {
+			fmt.Printf("--admin-token-env: %s is not set\n", *adminTokenEnv)
+			return
+		}
+	}
+
+	middlewareNames := *middlewareFlag
+	if *corsOrigins != "" {
+		corsPolicy = NewCORSPolicy(*corsOrigins, *corsMethods, *corsHeaders, *corsMaxAge)
+		// Preflight requests carry no credentials, so unless placed
+		// explicitly CORS comes before any other middleware
+		if !containsString(splitList(middlewareNames), "cors") {
+			middlewareNames = "cors," + middlewareNames
+		}
+	}
+	handler, err := withMiddleware(middlewareNames, adminAuthHandler(http.DefaultServeMux))
+	if err != nil {
+		fmt.Printf("--middleware: %s\n", err)
+		return
+	}
+
+	if *budgetPolicy != "reject" && *budgetPolicy != "queue" {
+		fmt.Printf("--query-budget-policy must be reject or queue\n")
+		return
+	}
+	queryPlanner = NewQueryPlanner(*queryBudget, *budgetPolicy == "queue")
+
+	if *memoryLimit < 0 {
+		fmt.Printf("--memory-limit must be 0 or greater\n")
+		return
+	}
+
+	if *readWorkers < 0 {
+		fmt.Printf("--read-workers must be 0 or greater\n")
+		return
+	}
+
+	if *intersectCache < 0 {
+		fmt.Printf("--intersection-cache must be 0 or greater\n")
+		return
+	}
+	intersections = NewIntersectionCache(*intersectCache)
+
+	if *topKCapacity <= 0 {
+		fmt.Printf("--topk-capacity must be positive\n")
+		return
+	}
+	if *quantileK < 8 {
+		fmt.Printf("--quantile-k must be at least 8\n")
+		return
+	}
+	if *merkleDepth < 1 || *merkleDepth > 6 {
+		fmt.Printf("--merkle-depth must be between 1 and 6\n")
+		return
+	}
+	if *hotKeySampleRate < 0 || *hotKeySampleRate > 1 {
+		fmt.Printf("--hotkey-sample-rate must be between 0 and 1\n")
+		return
+	}
+	hotKeys = NewKeyTracker(*hotKeySampleRate, *hotKeyCapacity)
+	keySampler = NewKeySampler(*samplingLimit)
+	if *suspiciousPolicy != "alert" && *suspiciousPolicy != "reject" {
+		fmt.Printf("--suspicious-hash-policy must be alert or reject\n")
+		return
+	}
+	if *suspiciousHashes <= 0 {
+		fmt.Printf("--suspicious-hashes must be positive\n")
+		return
+	}
+	poisonGuard = NewPoisonGuard(*maxPlausible, *suspiciousHashes, *suspiciousPolicy == "reject", *suspiciousHook)
+
+	policy := BatchPolicy{
+		MaxSize:    *batchMaxSize,
+		MaxLatency: *batchMaxLatency,
+		MaxBytes:   *batchMaxBytes,
+		Flush:      FlushMode(*flushMode),
+		Sync:       *fsync,
+	}
+	if err := policy.validate(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	setBatchPolicy(policy)
+
+	if *fanoutRulesFile != "" {
+		rules, err := LoadFanoutRules(*fanoutRulesFile)
+		if err != nil {
+			fmt.Println("Could not load fan-out rules:", err)
+			return
+		}
+		fanoutRules = rules
+	}
+
+	if *normalizeFile != "" {
+		rules, err := LoadNormalizeRules(*normalizeFile)
+		if err != nil {
+			fmt.Println("Could not load normalization rules:", err)
+			return
+		}
+		normalizeRules = rules
+	}
+
+	if *keyPoliciesFile != "" {
+		loaded, err := LoadKeyPolicies(*keyPoliciesFile)
+		if err != nil {
+			fmt.Println("Could not load key policies:", err)
+			return
+		}
+		keyPolicies = loaded
+	}
+
+	if *shadowKeysFile != "" {
+		loaded, err := LoadShadowRules(*shadowKeysFile)
+		if err != nil {
+			fmt.Println("Could not load shadow keys:", err)
+			return
+		}
+		shadowRules = loaded
+	}
+
+	if *schemasFile != "" {
+		loaded, err := LoadSchemas(*schemasFile)
+		if err != nil {
+			fmt.Println("Could not load schemas:", err)
+			return
+		}
+		schemas = loaded
+	}
+
+	if *encryptionFile != "" {
+		keys, err := LoadEncryptionKeys(*encryptionFile)
+		if err != nil {
+			fmt.Println("Could not load encryption keys:", err)
+			return
+		}
+		encryptionKeys = keys
+	}
+
+	if *saltsFile != "" {
+		salts, err := LoadHashSalts(*saltsFile)
+		if err != nil {
+			fmt.Println("Could not load hash salts:", err)
+			return
+		}
+		hashSalts = salts
+	}
+
+	if *lifecycleWebhook != "" {
+		events, err := parseLifecycleEvents(*lifecycleEvents)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		lifecycleHooks = NewLifecycleHooks(*lifecycleWebhook, events)
+	}
+
+	if *sourcesFile != "" {
+		configs, err := LoadSources(*sourcesFile)
+		if err == nil {
+			eventSources, err = NewEventSources(configs)
+		}
+		if err != nil {
+			fmt.Println("Could not load sources:", err)
+			return
+		}
+	}
+
+	if *sinksFile != "" {
+		configs, err := LoadSinks(*sinksFile)
+		if err == nil {
+			sinks, err = NewSinks(configs)
+		}
+		if err != nil {
+			fmt.Println("Could not load sinks:", err)
+			return
+		}
+	}
+
+	if *mirrorURL != "" {
+		if *mirrorRate < 0 || *mirrorRate > 1 {
+			fmt.Printf("--mirror-rate must be between 0 and 1\n")
+			return
+		}
+		mirror = NewMirror(*mirrorURL, *mirrorRate)
+	}
+
+	if *auditLogFile != "" {
+		opened, err := OpenAuditLog(*auditLogFile)
+		if err != nil {
+			fmt.Println("Could not open audit log:", err)
+			return
+		}
+		defer opened.Close()
+		auditLog = opened
+	}
+
+	var alertRules []AlertRule
+	if *alertRulesFile != "" {
+		if *alertInterval <= 0 {
+			fmt.Printf("--alert-interval must be positive\n")
+			return
+		}
+		rules, err := LoadAlertRules(*alertRulesFile)
+		if err != nil {
+			fmt.Println("Could not load alert rules:", err)
+			return
+		}
+		alertRules = rules
+	}
+
+	var ttlRules []TTLRule
+	if *ttlRulesFile != "" {
+		if *ttlInterval <= 0 {
+			fmt.Printf("--ttl-interval must be positive with --ttl-rules\n")
+			return
+		}
+		rules, err := LoadTTLRules(*ttlRulesFile)
+		if err != nil {
+			fmt.Println("Could not load TTL rules:", err)
+			return
+		}
+		ttlRules = rules
+	}
+
+	if _, err := os.Stat(*dblocation); err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("Database location does not exist:", *dblocation)
+			return
+		}
+	}
+
+	log.Println("Opening levelDB")
+	opts := levigo.NewOptions()
+	opts.SetCache(levigo.NewLRUCache(*leveldbLRUCache))
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(*dblocation, opts)
+	defer db.Close()
+
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	if *nWorkers <= 0 {
+		fmt.Printf("--nworkers must be greater than 0\n")
+		return
+	}
+
+	if *queueSize < 0 {
+		fmt.Printf("--queue-size must be 0 or greater\n")
+		return
+	}
+	if err := backfillSummaries(db); err != nil {
+		log.Panicln(err)
+	}
+	if keyLimitEnabled() {
+		keyCount = countKeys(db)
+		log.Printf("Found %d of at most %d keys", keyCount, *maxKeys)
+	}
+
+	if *memoryLimit > 0 {
+		memoryGuard = NewMemoryGuard(*memoryLimit)
+		log.Printf("Limiting the heap to %d bytes", *memoryLimit)
+		memoryGuard.Start()
+	}
+
+	dispatcher = NewDispatcher(db, *nWorkers, *queueSize)
+	if *readWorkers > 0 {
+		dispatcher.SetReadPool(*readWorkers, *readWorkers**queueSize)
+		log.Printf("Starting %d read workers", *readWorkers)
+	}
+	log.Printf("Starting %d workers", *nWorkers)
+	dispatcher.Start()
+
+	if lifecycleHooks != nil {
+		log.Printf("Sending lifecycle events to %s", *lifecycleWebhook)
+		lifecycleHooks.Start()
+	}
+
+	if mirror != nil {
+		log.Printf("Mirroring writes to %s", *mirrorURL)
+		mirror.Start()
+	}
+
+	if peers := parsePeers(*peersFlag); len(peers) != 0 {
+		if *peerRetry <= 0 {
+			fmt.Printf("--peer-retry must be positive\n")
+			return
+		}
+		replicator = NewReplicator(peers, *peerRetry, *antiEntropyEvery)
+		log.Printf("Replicating from %s", strings.Join(peers, ", "))
+		replicator.Start()
+	}
+
+	if sinks != nil {
+		log.Printf("Pushing aggregates to %d sinks", len(sinks.sinks))
+		sinks.Start()
+	}
+
+	if len(alertRules) != 0 {
+		alerter = NewAlerter(alertRules, *alertInterval)
+		log.Printf("Evaluating %d alert rules every %s", len(alertRules), *alertInterval)
+		alerter.Start()
+	}
+
+	if prefixes := splitList(*verifyKeysFlag); len(prefixes) != 0 {
+		if *verifyLimit <= 0 || *verifyInterval <= 0 {
+			fmt.Printf("--verify-limit and --verify-interval must be positive\n")
+			return
+		}
+		verifier = NewExactVerifier(prefixes, *verifyLimit)
+		log.Printf("Counting the values of keys starting with %s exactly", strings.Join(prefixes, ", "))
+		verifier.Start(*verifyInterval)
+	}
+
+	if *historyInterval > 0 {
+		historyRecorder = NewHistoryRecorder(*historyInterval, *historyRetention)
+		log.Printf("Recording the cardinality of every key every %s", *historyInterval)
+		historyRecorder.Start()
+	}
+
+	if *ttlInterval > 0 {
+		expirer = NewExpirer(ttlRules, *ttlInterval)
+		expirer.Start()
+	}
+
+	if *warmupKeys > 0 {
+		if *hotKeySampleRate == 0 {
+			log.Printf("--warmup-keys needs --hotkey-sample-rate to find the hot keys")
+		}
+		accesses, err := loadHotKeys(db)
+		if err != nil {
+			log.Printf("Could not load the hot keys of the last run: %s", err)
+		}
+		hotKeys.Restore(accesses)
+		start := time.Now()
+		warmed := warmUp(db, accesses, *warmupKeys)
+		log.Printf("Warmed up %d hot keys in %s", warmed, time.Since(start))
+		hotKeysSaver = NewHotKeysSaver(db)
+		hotKeysSaver.Start()
+	}
+
+	for _, route := range apiRoutes() {
+		http.HandleFunc(route.Path, route.Handler)
+	}
+	http.HandleFunc("/openapi.json", OpenAPIHandler)
+
+	addresses := parseListenAddresses(*httpAddress)
+	listeners, err := listenAll(addresses, os.FileMode(socketMode))
+	if err != nil {
+		log.Fatalf("Could not listen: %s", err)
+	}
+	for _, listener := range listeners {
+		log.Printf("Starting gocountme HTTP server on %s", listener.Addr())
+		go func(listener net.Listener) {
+			log.Fatal(http.Serve(listener, handler))
+		}(listener)
+	}
+	if *ingestAddress != "" {
+		ingestAddresses := parseListenAddresses(*ingestAddress)
+		if len(ingestAddresses) != 1 {
+			log.Fatalf("--ingest-address takes a single address")
+		}
+		ingestListeners, err := listenAll(ingestAddresses, os.FileMode(socketMode))
+		if err != nil {
+			log.Fatalf("Could not listen for ingestion: %s", err)
+		}
+		log.Printf("Starting gocountme ingest server on %s", ingestListeners[0].Addr())
+		ingestServer = NewIngestServer(ingestListeners[0])
+		ingestServer.Start()
+		addresses = append(addresses, ingestAddresses...)
+	}
+	if eventSources != nil {
+		log.Printf("Ingesting from %d sources", len(eventSources.sources))
+		eventSources.Start()
+	}
 
-	workerWaitGroup.Wait()
+	dispatcher.Wait()
+	removeSockets(addresses)
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContainmentAndOverlap(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	campaign, segment := "_GOTEST_CAMPAIGN", "_GOTEST_SEGMENT"
+	resultChan := make(chan Result)
+	clean := func() {
+		for _, key := range []string{campaign, segment} {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}
+	clean()
+	defer clean()
+
+	// a quarter of the campaign is in the segment, which is 5 times larger
+	for i := 0; i < 100; i++ {
+		hash := Hashify([]byte(fmt.Sprintf("%d", i)))
+		dispatcher.Dispatch(AddHashRequest{Key: campaign, Hash: hash, ResultChan: resultChan})
+		<-resultChan
+	}
+	for i := 75; i < 575; i++ {
+		hash := Hashify([]byte(fmt.Sprintf("%d", i)))
+		dispatcher.Dispatch(AddHashRequest{Key: segment, Hash: hash, ResultChan: resultChan})
+		<-resultChan
+	}
+
+	metric := func(handler http.HandlerFunc, first, second string) float64 {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/?key="+first+"&key="+second, nil))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data QueryResult `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(t, *response.Data.SampleSize, 25)
+		return response.Data.Num
+	}
+	assert.Equal(t, metric(ContainmentHandler, campaign, segment), 0.25)
+	assert.Equal(t, metric(ContainmentHandler, segment, campaign), 0.05)
+	assert.Equal(t, metric(OverlapHandler, segment, campaign), 0.25)
+	assert.Equal(t, metric(JaccardHandler, segment, campaign), 25.0/575)
+}
+
+func TestCardinalityEstimator(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_ESTIMATOR"
+	kmv := kminvalues.NewKMinValues(64)
+	for i := 0; i < 1000; i++ {
+		kmv.AddHash(Hashify([]byte(fmt.Sprintf("%d", i))))
+	}
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kmv, ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	getEstimate := func(query string) (estimate, string) {
+		w := httptest.NewRecorder()
+		CardinalityHandler(w, httptest.NewRequest("GET", "/cardinality?key="+key+query, nil))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data estimate `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data, w.Header().Get("ETag")
+	}
+
+	classic, classicETag := getEstimate("&estimator=")
+	assert.Equal(t, classic, estimate{kmv.Cardinality(), kminvalues.Classic})
+	mle, mleETag := getEstimate("&estimator=mle")
+	assert.Equal(t, mle, estimate{kmv.Estimate(kminvalues.MaximumLikelihood), kminvalues.MaximumLikelihood})
+	assert.NotEqual(t, classicETag, mleETag)
+	corrected, _ := getEstimate("&estimator=bias_corrected")
+	assert.Equal(t, corrected.Estimator, kminvalues.BiasCorrected)
+
+	w := httptest.NewRecorder()
+	CardinalitiesHandler(w, httptest.NewRequest("GET", "/cardinalities?estimator=mle&key="+key, nil))
+	response := struct {
+		Data estimates `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, response.Data, estimates{map[string]float64{key: mle.Cardinality}, kminvalues.MaximumLikelihood})
+
+	w = httptest.NewRecorder()
+	CardinalityHandler(w, httptest.NewRequest("GET", "/cardinality?estimator=median&key="+key, nil))
+	assert.Equal(t, decodeError(t, w).Error.Code, "INVALID_ARG_ESTIMATOR")
+}
+
+func TestCardinalitiesHandler(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	resultChan := make(chan Result)
+	keys := []string{"_GOTEST_CARDINALITIES0", "_GOTEST_CARDINALITIES1", "_GOTEST_CARDINALITIES2"}
+	for i, key := range keys[:2] {
+		for j := 0; j <= i; j++ {
+			dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+			<-resultChan
+		}
+	}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	query := "key=" + strings.Join(keys, "&key=")
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/cardinalities?"+query, nil),
+		httptest.NewRequest("POST", "/cardinalities", strings.NewReader(query)),
+	} {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		CardinalitiesHandler(w, r)
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data map[string]float64 `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(t, response.Data, map[string]float64{keys[0]: 1, keys[1]: 2, keys[2]: 0})
+	}
+
+	w := httptest.NewRecorder()
+	CardinalitiesHandler(w, httptest.NewRequest("GET", "/cardinalities", nil))
+	assert.Equal(t, decodeError(t, w).Error.Code, "MISSING_ARG_KEY")
+
+	w = httptest.NewRecorder()
+	tooMany := strings.Repeat("key=a&", maxCardinalitiesKeys+1)
+	CardinalitiesHandler(w, httptest.NewRequest("GET", "/cardinalities?"+tooMany, nil))
+	assert.Equal(t, decodeError(t, w).Error.Code, "TOO_MANY_KEYS")
+}
@@ -5,25 +5,89 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 )
 
 type HttpResponseJson struct {
 	StatusCode int         `json:"status_code"`
 	StatusTxt  string      `json:"status_txt"`
 	Data       interface{} `json:"data"`
+	Error      *APIError   `json:"error,omitempty"`
+}
+
+// An error as returned to clients.  Code is what clients should match on,
+// Key is the key the error is about, if any, and Retryable says whether the
+// same request may succeed later.
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Key       string `json:"key,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+func NewAPIError(status int, code, message string, retryable bool) *APIError {
+	return &APIError{Status: status, Code: code, Message: message, Retryable: retryable}
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Returns a copy of the error about key
+func (e *APIError) ForKey(key string) *APIError {
+	if key == "" {
+		return e
+	}
+	keyed := *e
+	keyed.Key = key
+	return &keyed
 }
 
 var (
 	ERROR_RESPONSE = `{"status_code": 500,"data": null,"status_txt": "COULD_NOT_FORMAT_RESULT"}`
 )
 
+// Describes an error code for the errors that aren't typed, eg:
+// MISSING_ARG_KEY is "Missing key parameter"
+func errorMessage(code string) string {
+	if arg := strings.TrimPrefix(code, "MISSING_ARG_"); arg != code {
+		return "Missing " + strings.ToLower(arg) + " parameter"
+	} else if arg := strings.TrimPrefix(code, "INVALID_ARG_"); arg != code {
+		return "Invalid " + strings.ToLower(arg) + " parameter"
+	}
+	message := strings.ToLower(strings.Replace(code, "_", " ", -1))
+	if message == "" {
+		return ""
+	}
+	return strings.ToUpper(message[:1]) + message[1:]
+}
+
 func HttpError(w http.ResponseWriter, statusCode int, statusTxt string) bool {
-	w.WriteHeader(statusCode)
+	return writeAPIError(w, NewAPIError(statusCode, statusTxt, errorMessage(statusTxt), statusCode == 503))
+}
+
+// Responds with the error of a failed request about key.  Typed errors get
+// their own status and code and any other error is a 500 INTERNAL_ERROR.
+func HttpResultError(w http.ResponseWriter, key string, err error) bool {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		apiErr = NewAPIError(500, "INTERNAL_ERROR", err.Error(), false)
+	}
+	// Tells the client to back off and try again later
+	if apiErr.Status == 503 && apiErr.Retryable {
+		setRetryAfter(w)
+	}
+	return writeAPIError(w, apiErr.ForKey(key))
+}
+
+func writeAPIError(w http.ResponseWriter, apiErr *APIError) bool {
+	w.WriteHeader(apiErr.Status)
 
-	response := HttpResponseJson{StatusCode: statusCode, StatusTxt: statusTxt}
+	response := HttpResponseJson{StatusCode: apiErr.Status, StatusTxt: apiErr.Code, Error: apiErr}
 	j, err := json.Marshal(response)
 	if err != nil {
-		fmt.Fprintf(w, ERROR_RESPONSE)
+		fmt.Fprint(w, ERROR_RESPONSE)
 		log.Printf("Could not format response: %s", err)
 		return false
 	}
@@ -31,13 +95,23 @@ func HttpError(w http.ResponseWriter, statusCode int, statusTxt string) bool {
 	return true
 }
 
+func writeEvent(w http.ResponseWriter, event string, data interface{}) bool {
+	j, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Could not format event: %s", err)
+		return false
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, j)
+	return true
+}
+
 func HttpResponse(w http.ResponseWriter, statusCode int, data interface{}) bool {
 	w.WriteHeader(statusCode)
 
 	response := HttpResponseJson{StatusCode: statusCode, Data: data}
 	j, err := json.Marshal(response)
 	if err != nil {
-		fmt.Fprintf(w, ERROR_RESPONSE)
+		fmt.Fprint(w, ERROR_RESPONSE)
 		log.Printf("Could not format response: %s", err)
 		return false
 	}
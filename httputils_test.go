@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) HttpResponseJson {
+	var response HttpResponseJson
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &response), nil)
+	assert.Equal(t, response.StatusCode, w.Code)
+	assert.Equal(t, response.StatusTxt, response.Error.Code)
+	return response
+}
+
+func TestHttpError(t *testing.T) {
+	w := httptest.NewRecorder()
+	HttpError(w, 500, "MISSING_ARG_KEY")
+	response := decodeError(t, w)
+	assert.Equal(t, w.Code, 500)
+	assert.Equal(t, *response.Error, APIError{Code: "MISSING_ARG_KEY", Message: "Missing key parameter"})
+
+	w = httptest.NewRecorder()
+	HttpError(w, 500, "STREAMING_UNSUPPORTED")
+	assert.Equal(t, decodeError(t, w).Error.Message, "Streaming unsupported")
+}
+
+func TestHttpResultError(t *testing.T) {
+	w := httptest.NewRecorder()
+	HttpResultError(w, "key1", KeyLimitReached)
+	response := decodeError(t, w)
+	assert.Equal(t, w.Code, 403)
+	assert.Equal(t, response.Error.Code, "KEY_LIMIT_REACHED")
+	assert.Equal(t, response.Error.Key, "key1")
+	assert.Equal(t, response.Error.Retryable, false)
+	// the shared error isn't changed by being about a key
+	assert.Equal(t, KeyLimitReached.Key, "")
+
+	w = httptest.NewRecorder()
+	HttpResultError(w, "", QueueFull)
+	response = decodeError(t, w)
+	assert.Equal(t, w.Code, 503)
+	assert.Equal(t, response.Error.Retryable, true)
+	assert.NotEqual(t, w.Header().Get("Retry-After"), "")
+
+	w = httptest.NewRecorder()
+	HttpResultError(w, "key1", errors.New("disk on fire"))
+	response = decodeError(t, w)
+	assert.Equal(t, w.Code, 500)
+	assert.Equal(t, *response.Error, APIError{Code: "INTERNAL_ERROR", Message: "disk on fire", Key: "key1"})
+}
+
+// Errors of requests keep their status and code through the handlers
+func TestHandlerResultError(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	*fencingFlag = true
+	defer func() { *fencingFlag = false }()
+
+	key := "_GOTEST_RESULT_ERROR"
+	resultChan := make(chan Result, 1)
+	dispatcher.Dispatch(LeaseRequest{Key: key, TTL: time.Hour, Lease: &lease{}, ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		wo := levigo.NewWriteOptions()
+		defer wo.Close()
+		dispatcher.database.Delete(wo, leaseKey(key))
+	}()
+
+	w := httptest.NewRecorder()
+	DeleteHandler(w, httptest.NewRequest("GET", "/delete?key="+key, nil))
+	response := decodeError(t, w)
+	assert.Equal(t, w.Code, 409)
+	assert.Equal(t, response.Error.Code, "KEY_LEASED")
+	assert.Equal(t, response.Error.Key, key)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/csv"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Hashes added to a set per write by /import
+const importBatchSize = 10000
+
+type importResult struct {
+	Key         string  `json:"key"`
+	Rows        int     `json:"rows"`
+	Skipped     int     `json:"skipped"`
+	Cardinality float64 `json:"cardinality"`
+}
+
+// Adds many hashes to a set in one write
+type ImportRequest struct {
+	Key        string
+	Hashes     []uint64
+	Lows       []uint64 // the low halves of the 128bit hashes of Hashes
+	HashWidth  int
+	ResultChan chan Result
+}
+
+func (ir ImportRequest) RequestKeys() []string { return []string{ir.Key} }
+
+func (ir ImportRequest) WriteResult(result Result) {
+	result.Key = ir.Key
+	ir.ResultChan <- result
+}
+
+func (ir ImportRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if ir.Key == "" {
+		return nil, NoKeySpecified
+	}
+
+	keyBytes := []byte(ir.Key)
+	kmv, err := getOrCreate(batch, keyBytes, ir.HashWidth)
+	if err != nil {
+		return nil, err
+	}
+	if *deferDuplicates {
+		kmv.SetDuplicatePolicy(kminvalues.DeferDuplicates)
+	}
+	batch.ObserveExact(ir.Key, kmv.Len() == 0, ir.Hashes...)
+	delta, err := kmv.AddMany(ir.Hashes, ir.Lows)
+	if err != nil {
+		return nil, err
+	}
+	if err := mirrorShadow(batch, ir.Key, kmv, ir.Hashes, ir.Lows); err != nil {
+		return nil, err
+	}
+	if delta.Len() == 0 {
+		return kmv, nil
+	}
+	if err := batch.PutSketch(keyBytes, kmv); err != nil {
+		return nil, err
+	}
+	batch.Publish(ir.Key, kmv, delta)
+	return kmv, nil
+}
+
+// Seeds `key` with the distinct values of a column of a CSV POST body, eg:
+// the output of SELECT DISTINCT user_id.  `column` is the index of the column
+// (default 0) or, with `header=true`, its name.  Values are hashed as /add
+// would, a batch at a time by hashValues, and written importBatchSize at a
+// time, so a body of any size is streamed, and importing the same values twice
+// leaves the set as it was.
+// Values that are empty or don't match the key's schema are skipped.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		HttpError(w, 405, "METHOD_NOT_ALLOWED")
+		return
+	}
+
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	width, err := parseHashWidth(reqParams)
+	if err != nil {
+		HttpError(w, 500, "INVALID_ARG_WIDTH")
+		return
+	}
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	column := 0
+	column_raw := reqParams.Get("column")
+	if reqParams.Get("header") == "true" {
+		header, err := reader.Read()
+		if err != nil {
+			HttpError(w, 500, "INVALID_BODY")
+			return
+		}
+		column = -1
+		for i, name := range header {
+			if name == column_raw || column_raw == "" && i == 0 {
+				column = i
+				break
+			}
+		}
+	} else if column_raw != "" {
+		column, err = strconv.Atoi(column_raw)
+		if err != nil {
+			column = -1
+		}
+	}
+	if column < 0 {
+		HttpError(w, 500, "INVALID_ARG_COLUMN")
+		return
+	}
+
+	result := importResult{Key: key}
+	resultChan := make(chan Result)
+	defer close(resultChan)
+	values := make([]string, 0, importBatchSize)
+	// The last batch is always sent, even if it is empty, for the cardinality
+	flush := func() bool {
+		hashes, lows := hashValues(key, values)
+		request := ImportRequest{Key: key, Hashes: hashes, Lows: lows, HashWidth: width, ResultChan: resultChan}
+		if err := submitRequest(withFencing(request, reqParams)); err != nil {
+			HttpResultError(w, key, err)
+			return false
+		}
+		imported := <-resultChan
+		if imported.Error != nil {
+			HttpResultError(w, key, imported.Error)
+			return false
+		}
+		result.Cardinality = imported.Data.Cardinality()
+		values = values[:0]
+		return true
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			HttpError(w, 500, "INVALID_BODY")
+			return
+		}
+		result.Rows++
+
+		var value string
+		if column < len(record) {
+			value = record[column]
+		}
+		if *maxValueLength > 0 && len(value) > *maxValueLength {
+			result.Skipped++
+			continue
+		}
+		value, err = prepareValue(key, value)
+		if err != nil {
+			result.Skipped++
+			continue
+		}
+		values = append(values, value)
+		if len(values) == importBatchSize && !flush() {
+			return
+		}
+	}
+	if !flush() {
+		return
+	}
+	HttpResponse(w, 200, result)
+}
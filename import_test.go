@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImportHandler(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_IMPORT"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	var body strings.Builder
+	body.WriteString("id,user_id\n")
+	for i := 0; i < 150; i++ {
+		fmt.Fprintf(&body, "%d,\"user %d\"\n", i, i%100)
+	}
+	body.WriteString("150,\n")
+
+	importCSV := func(query, body string) importResult {
+		w := httptest.NewRecorder()
+		ImportHandler(w, httptest.NewRequest("POST", "/import?key="+key+"&"+query, strings.NewReader(body)))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data importResult `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	result := importCSV("header=true&column=user_id", body.String())
+	assert.Equal(t, result.Rows, 151)
+	assert.Equal(t, result.Skipped, 1)
+	assert.Equal(t, result.Cardinality, 100.0)
+
+	// values are hashed as /add would
+	w := httptest.NewRecorder()
+	ContainsHandler(w, httptest.NewRequest("GET", "/contains?key="+key+"&value=user+42", nil))
+	assert.Equal(t, strings.Contains(w.Body.String(), "true"), true)
+
+	result = importCSV("column=1", "x,user 42\ny,user 100\n")
+	assert.Equal(t, result.Cardinality, 101.0)
+
+	w = httptest.NewRecorder()
+	ImportHandler(w, httptest.NewRequest("POST", "/import?key="+key+"&header=true&column=email", strings.NewReader(body.String())))
+	assert.Equal(t, decodeError(t, w).Error.Code, "INVALID_ARG_COLUMN")
+}
+
+func TestImportDeferDuplicates(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	*deferDuplicates = true
+	defer func() { *deferDuplicates = false }()
+
+	resultChan := make(chan Result)
+	var body strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&body, "user %d\n", i%2000)
+	}
+	for _, key := range []string{"_GOTEST_IMPORT_DEFERRED", "_GOTEST_IMPORT_CHECKED"} {
+		w := httptest.NewRecorder()
+		ImportHandler(w, httptest.NewRequest("POST", "/import?key="+key, strings.NewReader(body.String())))
+		assert.Equal(t, w.Code, 200)
+		defer func(key string) {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}(key)
+		*deferDuplicates = false
+	}
+
+	// the deferred set is the same as the one imported with every value checked
+	var sets [][]byte
+	for _, key := range []string{"_GOTEST_IMPORT_DEFERRED", "_GOTEST_IMPORT_CHECKED"} {
+		dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+		result := <-resultChan
+		assert.Equal(t, result.Error, nil)
+		sets = append(sets, result.Data.Bytes())
+	}
+	assert.Equal(t, sets[0], sets[1])
+}
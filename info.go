@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+)
+
+type serverInfo struct {
+	Version  string      `json:"version"`
+	ReadOnly bool        `json:"read_only"`
+	Queue    queueStats  `json:"queue"`
+	Batching BatchPolicy `json:"batching"`
+
+	// Keys ingesting only a sample of their adds and the fraction kept
+	SampledKeys map[string]float64 `json:"sampled_keys"`
+
+	IntersectionCache resultCacheStats `json:"intersection_cache"`
+	Memory            memoryUsage      `json:"memory"`
+}
+
+// Reports the state of the server, including gauges for the request queue so
+// that producers can tell how close it is to shedding load.
+func InfoHandler(w http.ResponseWriter, r *http.Request) {
+	HttpResponse(w, 200, serverInfo{
+		Version:     VERSION,
+		ReadOnly:    isReadOnly(),
+		Queue:       getQueueStats(),
+		Batching:    getBatchPolicy(),
+		SampledKeys: keySampler.Rates(),
+
+		IntersectionCache: intersections.Stats(),
+		Memory:            memoryGuard.Usage(),
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Longest key or value a record of the ingest protocol may hold
+const ingestMaxField = 1 << 16
+
+// Records of a connection that may be in flight before it stops being read
+const ingestWindow = 10000
+
+// Records acknowledged at least once every this many records
+const ingestAckEvery = 1000
+
+var (
+	IngestFieldTooLong = errors.New("ingest record key or value is too long")
+	ReadOnly           = NewAPIError(403, "READ_ONLY", "Server is read-only", false)
+	ValueTooLong       = NewAPIError(413, "VALUE_TOO_LONG", "Value is longer than --max-value-length", false)
+)
+
+var ingestServer *IngestServer
+
+// Serves the binary ingest protocol: a client streams records of a uvarint key
+// length, the key, a uvarint value length and the value over one connection
+// and each is added as /add would.  The server answers with acks of two big
+// endian uint64s, the number of records handled so far and how many of those
+// were rejected.  Records are acknowledged in order, so every record up to
+// the count of an ack has been written or rejected, even when flushing on a
+// timer.
+type IngestServer struct {
+	sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	stopped  bool
+	wg       sync.WaitGroup
+}
+
+func NewIngestServer(listener net.Listener) *IngestServer {
+	return &IngestServer{
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+func (is *IngestServer) Start() {
+	is.wg.Add(1)
+	go func() {
+		defer is.wg.Done()
+		for {
+			conn, err := is.listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Ingest listener failed: %s", err)
+				}
+				return
+			}
+			is.Lock()
+			if is.stopped {
+				is.Unlock()
+				conn.Close()
+				return
+			}
+			is.conns[conn] = struct{}{}
+			is.wg.Add(1)
+			is.Unlock()
+			go is.serve(conn)
+		}
+	}()
+}
+
+// Stops accepting connections and reading records, and waits for the records
+// read so far to be written and acknowledged
+func (is *IngestServer) Stop() {
+	is.listener.Close()
+	is.Lock()
+	is.stopped = true
+	for conn := range is.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	is.Unlock()
+	is.wg.Wait()
+}
+
+func (is *IngestServer) serve(conn net.Conn) {
+	defer is.wg.Done()
+	defer func() {
+		is.Lock()
+		delete(is.conns, conn)
+		is.Unlock()
+		conn.Close()
+	}()
+
+	// Each record's result in the order the records were read, bounded so a
+	// client can't queue up more than a window of records
+	pending := make(chan chan Result, ingestWindow)
+	acked := make(chan struct{})
+	go acknowledge(conn, pending, acked)
+
+	reader := bufio.NewReader(conn)
+	for {
+		key, value, err := readIngestRecord(reader)
+		if err != nil {
+			var netErr net.Error
+			if err != io.EOF && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				log.Printf("Dropping ingest connection from %s: %s", conn.RemoteAddr(), err)
+			}
+			break
+		}
+		pending <- ingestRecord(key, value)
+	}
+	close(pending)
+	<-acked
+}
+
+// Waits for the result of each pending record in turn, acking every
+// ingestAckEvery records and whenever the records in flight were all handled
+func acknowledge(w io.Writer, pending chan chan Result, acked chan struct{}) {
+	defer close(acked)
+	writer := bufio.NewWriter(w)
+	var ack [16]byte
+	var handled, rejected uint64
+	for resultChan := range pending {
+		if result := <-resultChan; result.Error != nil {
+			rejected++
+		}
+		handled++
+		if handled%ingestAckEvery == 0 || len(pending) == 0 {
+			binary.BigEndian.PutUint64(ack[:8], handled)
+			binary.BigEndian.PutUint64(ack[8:], rejected)
+			writer.Write(ack[:])
+			writer.Flush()
+		}
+	}
+}
+
+func readIngestRecord(reader *bufio.Reader) (key, value string, err error) {
+	if key, err = readIngestField(reader); err != nil {
+		return
+	}
+	if value, err = readIngestField(reader); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func readIngestField(reader *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	if length > ingestMaxField {
+		return "", IngestFieldTooLong
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(reader, field); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(field), nil
+}
+
+// Checks and hashes a record as /add would and queues it, returning the channel
+// its result is sent on.  Full queues hold the connection up rather than
+// rejecting the record, so the client is pushed back on through TCP.  Records
+// only get their result once written, whatever the flush mode, since they are
+// acknowledged to the client.
+func ingestRecord(key, value string) chan Result {
+	resultChan := make(chan Result, 1)
+	reject := func(err error) chan Result {
+		resultChan <- Result{Key: key, Error: err}
+		return resultChan
+	}
+
+	if isReadOnly() {
+		return reject(ReadOnly)
+	}
+	if *maxValueLength > 0 && len(value) > *maxValueLength {
+		return reject(ValueTooLong)
+	}
+	value, err := prepareValue(key, value)
+	if err != nil {
+		return reject(err)
+	}
+	hash, low := hashValue128(key, value)
+	if err := poisonGuard.Check(key, hash); err != nil {
+		return reject(err)
+	}
+	if !keySampler.Admit(key, hash) {
+		resultChan <- Result{Key: key}
+		return resultChan
+	}
+
+	request := AddHashRequest{Key: key, Hash: hash, Low: low, Value: []byte(value), ResultChan: resultChan}
+	trackRequest(request)
+	if memoryGuard.UnderPressure() {
+		atomic.AddUint64(&rejectedRequests, 1)
+		return reject(MemoryPressure)
+	}
+	dispatcher.Dispatch(DurableRequest{withFencing(request, nil)})
+	if mirror != nil {
+		return mirror.record(key, value, resultChan)
+	}
+	return resultChan
+}
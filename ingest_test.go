@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func appendIngestRecord(buf []byte, key, value string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func TestIngestServer(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	server := NewIngestServer(listener)
+	server.Start()
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	key := "_GOTEST_INGEST"
+	var records []byte
+	for i := 0; i < 2500; i++ {
+		records = appendIngestRecord(records, key, fmt.Sprintf("%d", i%100))
+	}
+	records = appendIngestRecord(records, key, "")
+	go func() {
+		conn.Write(records)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	// acks count up to every record, in order, with the empty value rejected
+	var acks [][2]uint64
+	var ack [16]byte
+	for {
+		if _, err := io.ReadFull(conn, ack[:]); err != nil {
+			assert.Equal(t, err, io.EOF)
+			break
+		}
+		acks = append(acks, [2]uint64{binary.BigEndian.Uint64(ack[:8]), binary.BigEndian.Uint64(ack[8:])})
+	}
+	assert.Equal(t, len(acks) >= 3, true)
+	assert.Equal(t, acks[0][0] <= 1000, true)
+	assert.Equal(t, acks[len(acks)-1], [2]uint64{2501, 1})
+
+	resultChan := make(chan Result)
+	var cardinality float64
+	var version uint64
+	dispatcher.Dispatch(CardinalityRequest{Key: key, Cardinality: &cardinality, Version: &version, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, cardinality, 100.0)
+
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+}
+
+// Records are only acked once written, even when results are otherwise given
+// back before batches are written
+func TestIngestServerFlushOnTimer(t *testing.T) {
+	oldPolicy := getBatchPolicy()
+	defer setBatchPolicy(oldPolicy)
+	setBatchPolicy(BatchPolicy{MaxSize: 100, MaxBytes: 1 << 20, MaxLatency: 200 * time.Millisecond, Flush: FlushOnTimer})
+
+	SetupDB()
+	defer CloseDB()
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	server := NewIngestServer(listener)
+	server.Start()
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	key := "_GOTEST_INGEST_TIMER"
+	conn.Write(appendIngestRecord(nil, key, "a"))
+	var ack [16]byte
+	_, err = io.ReadFull(conn, ack[:])
+	assert.Equal(t, err, nil)
+	assert.Equal(t, binary.BigEndian.Uint64(ack[:8]), uint64(1))
+	data, _ := dispatcher.database.Get(ro, []byte(key))
+	assert.NotEqual(t, len(data), 0)
+
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(FlushRequest{DeleteRequest{Key: key, ResultChan: resultChan}})
+	<-resultChan
+}
+
+func TestReadIngestRecord(t *testing.T) {
+	records := appendIngestRecord(nil, "key", "value")
+	records = appendIngestRecord(records, "key", "")
+	reader := bufio.NewReader(bytes.NewReader(records))
+	key, value, err := readIngestRecord(reader)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, key, "key")
+	assert.Equal(t, value, "value")
+	_, value, err = readIngestRecord(reader)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, value, "")
+	_, _, err = readIngestRecord(reader)
+	assert.Equal(t, err, io.EOF)
+
+	reader = bufio.NewReader(bytes.NewReader(records[:7]))
+	_, _, err = readIngestRecord(reader)
+	assert.Equal(t, err, io.ErrUnexpectedEOF)
+
+	reader = bufio.NewReader(bytes.NewReader(binary.AppendUvarint(nil, ingestMaxField+1)))
+	_, _, err = readIngestRecord(reader)
+	assert.Equal(t, err, IngestFieldTooLong)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jmhodges/levigo"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// States of a union job.  Jobs found pending or running when they are
+// started again were interrupted, eg: by a restart, and are run again.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+var (
+	JobRunning  = NewAPIError(409, "JOB_RUNNING", "Job is already running", true)
+	JobMismatch = NewAPIError(409, "JOB_MISMATCH", "Job was started with a different key or from keys", false)
+)
+
+var runningJobs = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: make(map[string]bool)}
+
+type unionJob struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	From    []string  `json:"from"`
+	State   string    `json:"state"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func jobKey(id string) []byte {
+	return []byte(internalKeyPrefix + "job:" + id)
+}
+
+func (job *unionJob) encode(state string) []byte {
+	job.State = state
+	job.Updated = time.Now()
+	data, _ := json.Marshal(job)
+	return data
+}
+
+func loadJob(database *levigo.DB, id string) (*unionJob, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := readValue(database, ro, jobKey(id))
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var job unionJob
+	err = json.Unmarshal(data, &job)
+	return &job, err
+}
+
+func saveJob(database *levigo.DB, job *unionJob, state string) error {
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	return database.Put(wo, jobKey(job.ID), job.encode(state))
+}
+
+// Claims the job id for a union of from into key, recording it as pending.
+// Returns the stored job and false if it is already done, in which case
+// running it again would be a no-op.
+func startJob(database *levigo.DB, id, key string, from []string) (*unionJob, bool, error) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	if runningJobs.ids[id] {
+		return nil, false, JobRunning
+	}
+	job, err := loadJob(database, id)
+	if err != nil {
+		return nil, false, err
+	}
+	if job == nil {
+		job = &unionJob{ID: id, Key: key, From: from, Created: time.Now()}
+	} else if job.Key != key || !reflect.DeepEqual(job.From, from) {
+		return nil, false, JobMismatch
+	} else if job.State == jobDone {
+		return job, false, nil
+	}
+	job.Error = ""
+	if err := saveJob(database, job, jobPending); err != nil {
+		return nil, false, err
+	}
+	runningJobs.ids[id] = true
+	return job, true, nil
+}
+
+// Records how a job that was started ended, unless it is done, which the
+// merge writes along with the union
+func finishJob(database *levigo.DB, job *unionJob, err error) {
+	if err != nil {
+		job.Error = err.Error()
+		saveJob(database, job, jobFailed)
+	} else if job.State != jobDone {
+		saveJob(database, job, jobDone)
+	}
+	runningJobs.Lock()
+	delete(runningJobs.ids, job.ID)
+	runningJobs.Unlock()
+}
+
+func listJobs(database *levigo.DB) ([]unionJob, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+
+	it := database.NewIterator(ro)
+	defer it.Close()
+	jobs := []unionJob{}
+	prefix := jobKey("")
+	for it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		var job unionJob
+		if err := json.Unmarshal(openValue(it.Key(), it.Value()), &job); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+	return jobs, it.GetError()
+}
+
+// Lists the union jobs, oldest first, optionally only those in `state`
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	jobs, err := listJobs(dispatcher.database)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	if state := reqParams.Get("state"); state != "" {
+		matching := jobs[:0]
+		for _, job := range jobs {
+			if job.State == state {
+				matching = append(matching, job)
+			}
+		}
+		jobs = matching
+	}
+	HttpResponse(w, 200, jobs)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnionJobs(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	defer dispatcher.database.Delete(wo, jobKey("_GOTEST_JOB"))
+
+	resultChan := make(chan Result)
+	add := func(key string, from, to int) {
+		for i := from; i < to; i++ {
+			dispatcher.Dispatch(AddHashRequest{Key: key, Hash: Hashify([]byte(fmt.Sprintf("%d", i))), ResultChan: resultChan})
+			<-resultChan
+		}
+	}
+	cardinality := func(key string) float64 {
+		result := make(chan Result)
+		var cardinality float64
+		var version uint64
+		dispatcher.Dispatch(CardinalityRequest{Key: key, Cardinality: &cardinality, Version: &version, ResultChan: result})
+		<-result
+		return cardinality
+	}
+	union := func(query string) (int, unionJob) {
+		w := httptest.NewRecorder()
+		UnionHandler(w, httptest.NewRequest("GET", "/union?"+query, nil))
+		var response struct{ Data unionJob }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Data
+	}
+	keys := []string{"_GOTEST_JOB_A", "_GOTEST_JOB_B", "_GOTEST_JOB_UNION"}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+	add(keys[0], 0, 20)
+	add(keys[1], 10, 30)
+
+	query := "key=_GOTEST_JOB_UNION&from=_GOTEST_JOB_A&from=_GOTEST_JOB_B&job=_GOTEST_JOB"
+	code, job := union(query)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, job.ID, "_GOTEST_JOB")
+	assert.Equal(t, job.State, jobDone)
+	assert.Equal(t, job.From, []string{"_GOTEST_JOB_A", "_GOTEST_JOB_B"})
+	assert.Equal(t, cardinality(keys[2]), 30.0)
+
+	// running a done job again leaves the sets alone
+	add(keys[0], 30, 40)
+	code, job = union(query)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, job.State, jobDone)
+	assert.Equal(t, cardinality(keys[2]), 30.0)
+
+	code, _ = union("key=_GOTEST_JOB_UNION&from=_GOTEST_JOB_A&job=_GOTEST_JOB")
+	assert.Equal(t, code, 409)
+
+	// a job interrupted while running is run again
+	stored, _ := loadJob(dispatcher.database, "_GOTEST_JOB")
+	saveJob(dispatcher.database, stored, jobRunning)
+	runningJobs.ids["_GOTEST_JOB"] = true
+	code, _ = union(query)
+	assert.Equal(t, code, 409)
+	delete(runningJobs.ids, "_GOTEST_JOB")
+	code, job = union(query)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, job.State, jobDone)
+	assert.Equal(t, cardinality(keys[2]), 40.0)
+
+	w := httptest.NewRecorder()
+	JobsHandler(w, httptest.NewRequest("GET", "/admin/jobs?state=done", nil))
+	var response struct{ Data []unionJob }
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, len(response.Data), 1)
+	assert.Equal(t, response.Data[0].Key, keys[2])
+
+	w = httptest.NewRecorder()
+	JobsHandler(w, httptest.NewRequest("GET", "/admin/jobs?state=failed", nil))
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, len(response.Data), 0)
+}
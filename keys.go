@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+// The value of the longest prefix of key in byPrefix, or the zero value if no
+// prefix matches, for the settings configured per key prefix
+func longestPrefix[T any](byPrefix map[string]T, key string) T {
+	var value T
+	longest := -1
+	for prefix, candidate := range byPrefix {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			value, longest = candidate, len(prefix)
+		}
+	}
+	return value
+}
+
+type keyInfo struct {
+	Key         string            `json:"key"`
+	Cardinality float64           `json:"cardinality"`
+	K           int               `json:"k"`
+	Width       int               `json:"width"`
+	Hashes      int               `json:"hashes"`
+	Bytes       int               `json:"bytes"`
+	MinHash     uint64            `json:"min_hash"`
+	MaxHash     uint64            `json:"max_hash"`
+	Version     string            `json:"version"`
+	Updated     *time.Time        `json:"updated,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+type keysPage struct {
+	Keys []keyInfo `json:"keys"`
+	Next string    `json:"next,omitempty"`
+}
+
+func newKeyInfo(key []byte, summary keySummary) keyInfo {
+	info := keyInfo{
+		Key:         string(key),
+		Cardinality: summary.Cardinality,
+		K:           summary.K,
+		Width:       summary.Width,
+		Hashes:      summary.Hashes,
+		Bytes:       summary.Bytes,
+		MinHash:     summary.Min,
+		MaxHash:     summary.Max,
+		Version:     fmt.Sprintf("%016x", summary.Version),
+	}
+	if !summary.Updated.IsZero() {
+		info.Updated = &summary.Updated
+	}
+	return info
+}
+
+// Calls visit with every stored set whose key starts with prefix, in key
+// order, starting after the key `after`.  Iteration stops as soon as visit
+// returns false.  Sets that can't be read are logged and skipped.
+func scanKeys(database *levigo.DB, prefix, after []byte, visit func(key, data []byte, kmv *kminvalues.KMinValues) bool) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+
+	it := database.NewIterator(ro)
+	defer it.Close()
+
+	if bytes.Compare(after, prefix) >= 0 {
+		it.Seek(after)
+		if it.Valid() && bytes.Equal(it.Key(), after) {
+			it.Next()
+		}
+	} else {
+		it.Seek(prefix)
+	}
+
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if isInternalKey(key) {
+			continue
+		}
+		data := openValue(key, it.Value())
+		kmv, err := kminvalues.KMinValuesFromBytes(data)
+		if err != nil {
+			log.Printf("Skipping unreadable set %q: %s", key, err)
+			continue
+		}
+		if !visit(key, data, kmv) {
+			break
+		}
+	}
+	return it.GetError()
+}
+
+// Returns a page of keys, in key order, along with some stats about their
+// sets.  Takes an optional `prefix`, `min_cardinality`, `tag` filters and
+// `limit` (default 100, at most 1000).  When there are more keys, `next` is returned and
+// passing it as `after` fetches the following page.  Only sets that have been
+// written to the DB are listed, from their summaries.
+func KeysHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	limit := defaultKeysLimit
+	if limit_raw := reqParams.Get("limit"); limit_raw != "" {
+		limit, err = strconv.Atoi(limit_raw)
+		if err != nil || limit <= 0 || limit > maxKeysLimit {
+			HttpError(w, 500, "INVALID_ARG_LIMIT")
+			return
+		}
+	}
+
+	minCardinality := 0.0
+	if minCardinality_raw := reqParams.Get("min_cardinality"); minCardinality_raw != "" {
+		minCardinality, err = strconv.ParseFloat(minCardinality_raw, 64)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_MIN_CARDINALITY")
+			return
+		}
+	}
+
+	filters, err := parseTagFilters(reqParams["tag"])
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+
+	page := keysPage{Keys: make([]keyInfo, 0, limit)}
+	prefix := []byte(reqParams.Get("prefix"))
+	after := []byte(reqParams.Get("after"))
+	visit := func(key []byte, tags map[string]string, summary keySummary) bool {
+		if summary.Cardinality < minCardinality {
+			return true
+		}
+		if len(page.Keys) == limit {
+			page.Next = page.Keys[limit-1].Key
+			return false
+		}
+		info := newKeyInfo(key, summary)
+		info.Tags = tags
+		page.Keys = append(page.Keys, info)
+		return true
+	}
+	// Only tagged keys can match filters, so their tags are scanned instead
+	if len(filters) != 0 {
+		err = scanTaggedSummaries(dispatcher.database, prefix, after, filters, visit)
+	} else {
+		err = scanSummaries(dispatcher.database, prefix, after, func(key []byte, summary keySummary) bool {
+			return visit(key, nil, summary)
+		})
+	}
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	HttpResponse(w, 200, page)
+}
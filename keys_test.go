@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeysHandler(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	resultChan := make(chan Result)
+	keys := make([]string, 5)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("_GOTEST_KEYS%d", i)
+		kmv := kminvalues.NewKMinValues(10)
+		for j := 0; j <= i; j++ {
+			kmv.AddHash(GetRandHash())
+		}
+		dispatcher.Dispatch(SetRequest{Key: keys[i], Kmv: kmv, ResultChan: resultChan})
+		<-resultChan
+	}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	getPage := func(query string) keysPage {
+		w := httptest.NewRecorder()
+		KeysHandler(w, httptest.NewRequest("GET", "/keys?"+query, nil))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data keysPage `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	page := getPage("prefix=_GOTEST_KEYS&limit=3")
+	assert.Equal(t, len(page.Keys), 3)
+	assert.Equal(t, page.Keys[0].Key, keys[0])
+	assert.Equal(t, page.Keys[2].Hashes, 3)
+	assert.Equal(t, page.Next, keys[2])
+
+	page = getPage("prefix=_GOTEST_KEYS&limit=3&after=" + page.Next)
+	assert.Equal(t, len(page.Keys), 2)
+	assert.Equal(t, page.Keys[0].Key, keys[3])
+	assert.Equal(t, page.Next, "")
+
+	page = getPage("prefix=_GOTEST_KEYS&min_cardinality=4")
+	assert.Equal(t, len(page.Keys), 2)
+	assert.Equal(t, page.Keys[0].Cardinality, 4.0)
+}
@@ -0,0 +1,114 @@
+package kminvalues
+
+import "sync/atomic"
+
+// Lookups a sketch answers by binary search before it builds a filter, since
+// building one costs about as much as k searches' worth of comparisons
+const filterLookups = 16
+
+// Bits of filter per retained hash and probes per hash, for a false positive
+// rate of about 3%
+const filterBitsPerHash = 8
+const filterProbes = 3
+
+// A bloom filter of the retained hashes of a sketch, so that looking up a
+// hash that isn't retained, by far the most common lookup, usually takes no
+// comparisons at all.  Hashes added to the sketch are added to the filter.
+// Hashes evicted from it can't be taken out, which only makes the filter
+// answer "maybe" more often, so it is rebuilt once a quarter of the hashes it
+// was built from are gone.  Lookups build the filter and count themselves
+// atomically, so a sketch can still be searched from several goroutines at
+// once as long as nothing writes to it.
+type hashFilter struct {
+	bits    []uint64
+	removed int
+	limit   int
+}
+
+// The filter key of a hash is its stored representation as a uint64, with
+// wider hashes truncated to 64 bits so that 64bit lookups in 128bit sketches
+// find the same bits.  Retained hashes are the smallest ones, so their high
+// bits are all zeros and the key is mixed before picking bits.
+func (kmv *KMinValues) filterKey(hash []byte) uint64 {
+	if len(hash) > kmv.hashSize {
+		hash = hash[:kmv.hashSize]
+	}
+	return hashBytesToUint64(hash)
+}
+
+func (f *hashFilter) probe(key uint64, i int) (int, uint64) {
+	mixed := (key ^ key>>31) * (0x9e3779b97f4a7c15 + 2*uint64(i))
+	bit := (mixed >> 32) % uint64(len(f.bits)*64)
+	return int(bit / 64), 1 << (bit % 64)
+}
+
+func (f *hashFilter) add(key uint64) {
+	for i := 0; i < filterProbes; i++ {
+		word, mask := f.probe(key, i)
+		f.bits[word] |= mask
+	}
+}
+
+func (f *hashFilter) mayContain(key uint64) bool {
+	for i := 0; i < filterProbes; i++ {
+		word, mask := f.probe(key, i)
+		if f.bits[word]&mask == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (kmv *KMinValues) buildFilter() {
+	n := kmv.maxSize
+	if n < 1 {
+		n = 1
+	}
+	f := &hashFilter{bits: make([]uint64, (n*filterBitsPerHash+63)/64), limit: kmv.Len()/4 + 1}
+	for i := 0; i < kmv.Len(); i++ {
+		f.add(kmv.filterKey(kmv.getHashBytes(i)))
+	}
+	kmv.filter.CompareAndSwap(nil, f)
+}
+
+// Whether hash is certainly not retained, building the filter once the
+// sketch has been searched enough times to be worth it.  Hashes narrower than
+// the filter keys, which match every retained hash they are a prefix of, are
+// always searched for.
+func (kmv *KMinValues) filterRejects(hash []byte) bool {
+	kmv.settle()
+	if len(hash) < kmv.hashSize && len(hash) < bytesUint64 {
+		return false
+	}
+	f := kmv.filter.Load()
+	if f == nil {
+		if atomic.AddInt32(&kmv.lookups, 1) < filterLookups {
+			return false
+		}
+		kmv.buildFilter()
+		f = kmv.filter.Load()
+	}
+	return !f.mayContain(kmv.filterKey(hash))
+}
+
+func (kmv *KMinValues) filterAdd(hash []byte) {
+	if f := kmv.filter.Load(); f != nil {
+		f.add(kmv.filterKey(hash))
+	}
+}
+
+// Notes that a retained hash is gone, dropping the filter once too many are
+func (kmv *KMinValues) filterRemove() {
+	if f := kmv.filter.Load(); f != nil {
+		if f.removed++; f.removed >= f.limit {
+			kmv.dropFilter()
+		}
+	}
+}
+
+// Drops the filter after the retained hashes were rewritten wholesale, to be
+// built again when lookups call for it
+func (kmv *KMinValues) dropFilter() {
+	kmv.filter.Store(nil)
+	atomic.StoreInt32(&kmv.lookups, 0)
+}
@@ -0,0 +1,93 @@
+package kminvalues
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Set in the header of sketches whose hashes are delta encoded
+const headerCompressed = 1 << 55
+
+var CompressedHashesError = errors.New("error reading compressed hashes")
+
+// Hashes as unsigned integers of their stored width, so that the deltas of
+// narrow hashes stay small
+func (kmv *KMinValues) hashValue(i int) uint64 {
+	return kmv.GetHash(i) >> uint(64-8*kmv.hashSize)
+}
+
+// Same as Bytes but the hashes, which are sorted, are stored as the largest
+// one followed by the difference to the next one as varints.  As a sketch
+// fills up its hashes get closer together, so the deltas take fewer bytes
+// than the hashes.  The plain encoding is returned when it is as small, and
+// always for 128bit hashes, whose deltas don't fit in a varint.
+func (kmv *KMinValues) CompressedBytes() []byte {
+	return kmv.appendCompressedBytes(make([]byte, 0, bytesUint64+len(kmv.raw)))
+}
+
+// Same as CompressedBytes but the result comes from the buffer pool, see
+// PooledBytes
+func (kmv *KMinValues) PooledCompressedBytes() []byte {
+	return kmv.appendCompressedBytes(GetBuffer(bytesUint64 + kmv.maxSize*kmv.hashSize))
+}
+
+func (kmv *KMinValues) appendCompressedBytes(buf []byte) []byte {
+	kmv.settle()
+	if kmv.hashSize > bytesUint64 {
+		return kmv.appendBytes(buf)
+	}
+	start := len(buf)
+	plainSize := bytesUint64 + len(kmv.raw)
+	buf = appendHeader(buf, kmv.header()|headerCompressed)
+
+	var varint [binary.MaxVarintLen64]byte
+	previous := uint64(0)
+	for i := 0; i < kmv.Len(); i++ {
+		value := kmv.hashValue(i)
+		delta := value
+		if i > 0 {
+			delta = previous - value
+		}
+		previous = value
+		n := binary.PutUvarint(varint[:], delta)
+		if len(buf)-start+n >= plainSize {
+			return kmv.appendBytes(buf[:start])
+		}
+		buf = append(buf, varint[:n]...)
+	}
+	return buf
+}
+
+// Decodes the hashes following the header of a compressed sketch into a
+// pooled buffer
+func decompressHashes(data []byte, maxSize, hashSize int) ([]byte, error) {
+	raw := GetBuffer(maxSize * hashSize)
+	shift := uint(64 - 8*hashSize)
+	previous := uint64(0)
+	var hash [bytesUint64]byte
+	for i := 0; len(data) > 0; i++ {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 || i == maxSize {
+			PutBuffer(raw)
+			return nil, CompressedHashesError
+		}
+		data = data[n:]
+
+		value := delta
+		if i > 0 {
+			// hashes are distinct and sorted largest first
+			if delta == 0 || delta > previous {
+				PutBuffer(raw)
+				return nil, CompressedHashesError
+			}
+			value = previous - delta
+		} else if shift > 0 && value>>(64-shift) != 0 {
+			PutBuffer(raw)
+			return nil, CompressedHashesError
+		}
+		previous = value
+		binary.BigEndian.PutUint64(hash[:], value<<shift)
+		raw = append(raw, hash[:hashSize]...)
+	}
+	return raw, nil
+}
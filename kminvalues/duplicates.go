@@ -0,0 +1,79 @@
+package kminvalues
+
+import (
+	"bytes"
+	"sort"
+)
+
+// How AddHashBytes deals with hashes a sketch may already hold
+type DuplicatePolicy int
+
+const (
+	// Search the retained hashes for every hash added, the default
+	CheckDuplicates DuplicatePolicy = iota
+	// Sketches that aren't full set hashes aside without searching for them,
+	// and sort them in, dropping duplicates, the next time the sketch is
+	// read, merged or serialized.  Adding many hashes in a row to a sketch
+	// that isn't full then costs a single sort rather than a search and an
+	// insert per hash.  The estimates are exactly the same, but AddHash
+	// reports every hash set aside as added, duplicates included.
+	DeferDuplicates
+)
+
+// Sets how hashes added from now on are checked for duplicates.  A sketch
+// with deferred hashes must not be read concurrently, since reading it sorts
+// them in.
+func (kmv *KMinValues) SetDuplicatePolicy(policy DuplicatePolicy) {
+	if policy == CheckDuplicates {
+		kmv.settle()
+	}
+	kmv.policy = policy
+}
+
+// Sets hash aside, unless the sketch could be full with it, in which case it
+// has to be compared with the largest retained hash.  Returns whether the
+// hash was set aside.
+func (kmv *KMinValues) deferHash(hash []byte) bool {
+	if (len(kmv.raw)+len(kmv.deferred))/kmv.hashSize >= kmv.maxSize {
+		return false
+	}
+	kmv.deferred = append(kmv.deferred, hash...)
+	return true
+}
+
+// Sorts the deferred hashes into the sketch, dropping duplicates
+func (kmv *KMinValues) settle() {
+	if len(kmv.deferred) == 0 {
+		return
+	}
+	deferred := packedHashes{raw: kmv.deferred, size: kmv.hashSize, swap: make([]byte, kmv.hashSize)}
+	kmv.deferred = nil
+	sort.Sort(deferred)
+
+	unique := deferred.raw[:0]
+	for i := 0; i < deferred.Len(); i++ {
+		hash := deferred.hash(i)
+		if len(unique) == 0 || !bytes.Equal(unique[len(unique)-kmv.hashSize:], hash) {
+			unique = append(unique, hash...)
+		}
+	}
+	kmv.Merge(&KMinValues{raw: unique, maxSize: kmv.maxSize, hashSize: kmv.hashSize})
+}
+
+// Hashes packed in a byte slice, sorted largest first like a sketch's
+type packedHashes struct {
+	raw  []byte
+	size int
+	swap []byte
+}
+
+func (p packedHashes) hash(i int) []byte { return p.raw[i*p.size : (i+1)*p.size] }
+func (p packedHashes) Len() int          { return len(p.raw) / p.size }
+func (p packedHashes) Less(i, j int) bool {
+	return bytes.Compare(p.hash(i), p.hash(j)) > 0
+}
+func (p packedHashes) Swap(i, j int) {
+	copy(p.swap, p.hash(i))
+	copy(p.hash(i), p.hash(j))
+	copy(p.hash(j), p.swap)
+}
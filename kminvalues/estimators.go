@@ -0,0 +1,119 @@
+package kminvalues
+
+import (
+	"errors"
+	"math"
+)
+
+// How a cardinality is estimated from the k'th smallest hash U(k) of a set
+type Estimator string
+
+const (
+	// (k-1)/U(k), the unbiased estimator Cardinality uses
+	Classic Estimator = "classic"
+	// Classic corrected for the values lost to hash collisions, which only
+	// matters once sets get near the size of the hash space, ie: billions of
+	// values with 32bit hashes
+	BiasCorrected Estimator = "bias_corrected"
+	// The cardinality under which U(k) is the most likely, slightly larger
+	// than classic and with a slightly smaller variance
+	MaximumLikelihood Estimator = "mle"
+)
+
+var InvalidEstimator = errors.New("estimator must be classic, bias_corrected or mle")
+
+func ParseEstimator(name string) (Estimator, error) {
+	switch estimator := Estimator(name); estimator {
+	case Classic, BiasCorrected, MaximumLikelihood:
+		return estimator, nil
+	case "":
+		return Classic, nil
+	}
+	return "", InvalidEstimator
+}
+
+func (kmv *KMinValues) Estimate(estimator Estimator) float64 {
+	var largest float64
+	if kmv.Len() > 0 {
+		largest = kmv.largestHash()
+	}
+	return estimate(estimator, kmv.maxSize, kmv.Len(), kmv.HashWidth(), largest)
+}
+
+// Estimates the cardinality of a set of n hashes of width bits out of at most
+// maxSize from its largest retained hash, as returned by GetHash(0), so sets
+// can be estimated from a summary of them.  Sets that aren't full hold every
+// hash and are counted exactly but for collisions.
+func Estimate(estimator Estimator, maxSize, n, width int, largest uint64) float64 {
+	hashSize, err := hashSizeFromWidth(width)
+	if err != nil {
+		return 0
+	}
+	kmv := &KMinValues{maxSize: maxSize, hashSize: hashSize}
+	return estimate(estimator, maxSize, n, width, float64(largest)+kmv.truncatedHashOffset())
+}
+
+func estimate(estimator Estimator, maxSize, n, width int, largest float64) float64 {
+	u := largest / hashMax
+
+	switch estimator {
+	case BiasCorrected:
+		distinct := float64(n)
+		if n >= maxSize {
+			distinct = cardinality(maxSize, u*hashMax)
+		}
+		return uncollide(distinct, width)
+	case MaximumLikelihood:
+		if n < maxSize {
+			return float64(n)
+		}
+		return maximumLikelihood(maxSize, u)
+	}
+	if n < maxSize {
+		return float64(n)
+	}
+	return cardinality(maxSize, u*hashMax)
+}
+
+// Hashing m values into a space of h hashes leaves h(1 - (1-1/h)^m) distinct
+// hashes on average, so that is inverted for the m that gives distinct
+func uncollide(distinct float64, width int) float64 {
+	space := math.Ldexp(1, width)
+	if distinct >= space {
+		return math.Inf(1)
+	}
+	return math.Log1p(-distinct/space) / math.Log1p(-1/space)
+}
+
+// The likelihood of the k smallest of n uniform hashes having U(k) = u is
+// proportional to n!/(n-k)! (1-u)^(n-k), which peaks where the sum of 1/(n-i)
+// for i below k reaches -log(1-u).  That sum only falls as n grows, so the n
+// is found by bisection.
+func maximumLikelihood(k int, u float64) float64 {
+	target := -math.Log1p(-u)
+	slope := func(n float64) float64 {
+		sum := 0.0
+		for i := 0; i < k; i++ {
+			sum += 1 / (n - float64(i))
+		}
+		return sum
+	}
+
+	low := float64(k)
+	if slope(low) <= target {
+		return low
+	}
+	high := 2 * float64(k) / u
+	for slope(high) > target {
+		low, high = high, 2*high
+	}
+	for i := 0; i < 100 && high-low > 1e-9*high; i++ {
+		middle := (low + high) / 2
+		if slope(middle) > target {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+	return (low + high) / 2
+}
@@ -0,0 +1,71 @@
+package kminvalues
+
+import (
+	"math"
+)
+
+// Estimates the cardinality of the intersection of the sets, or of a single
+// set's cardinality when given one, along with the standard error of that
+// estimate from jackknife resampling.  The estimate is recomputed leaving out
+// each of the hashes of the sets' union in turn and the spread of those
+// estimates gives the error.  Unlike RelativeError, which only depends on k,
+// this reflects how few hashes the sets actually have in common, which is
+// what makes the estimates of small overlaps so noisy.
+func Jackknife(others ...*KMinValues) (estimate, stderr float64) {
+	X, n := DirectSum(others...)
+	defer X.Release()
+
+	N := X.Len()
+	if N == 0 {
+		return 0, 0
+	}
+	estimate = intersectionFraction(X, n) * X.Cardinality()
+	// The union holds every hash of the sets, so the count is exact
+	if N < X.maxSize || N < 3 {
+		return estimate, 0
+	}
+
+	resized := make([]*KMinValues, len(others))
+	for i, other := range others {
+		resized[i] = other.withK(X.maxSize)
+	}
+	inAll := make([]bool, N)
+	for i := range inAll {
+		inAll[i] = true
+		for _, other := range resized {
+			if other.FindHashBytes(X.getHashBytes(i)) < 0 {
+				inAll[i] = false
+				break
+			}
+		}
+	}
+
+	// Leaving out any hash but the largest keeps the same k'th minimum, and
+	// leaving out the largest makes the next one the k'th minimum
+	offset := X.truncatedHashOffset()
+	cardWithKmin := cardinality(N-1, float64(X.GetHash(0))+offset)
+	cardWithout0 := cardinality(N-1, float64(X.GetHash(1))+offset)
+
+	estimates := make([]float64, N)
+	mean := 0.0
+	for i := range estimates {
+		m := n
+		if inAll[i] {
+			m--
+		}
+		card := cardWithKmin
+		if i == 0 {
+			card = cardWithout0
+		}
+		estimates[i] = float64(m) / float64(N-1) * card
+		mean += estimates[i]
+	}
+	mean /= float64(N)
+
+	variance := 0.0
+	for _, e := range estimates {
+		variance += (e - mean) * (e - mean)
+	}
+	variance *= float64(N-1) / float64(N)
+	return estimate, math.Sqrt(variance)
+}
@@ -0,0 +1,109 @@
+package kminvalues
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var InvalidJSONEncoding = errors.New("unrecognized sketch encoding")
+
+// The JSON form of a sketch.  Hashes are either given as a list of integers in
+// `hashes` or, with `"encoding":"base64"`, as the base64 encoding of their
+// big endian bytes in `data`.  Clients that can't represent a full uint64
+// (eg: javascript) should use the base64 form.
+type jsonKMinValues struct {
+	K        int      `json:"k"`
+	Width    int      `json:"width"`
+	Encoding string   `json:"encoding,omitempty"`
+	Hashes   []uint64 `json:"hashes,omitempty"`
+	Data     string   `json:"data,omitempty"`
+}
+
+// 128bit hashes don't fit in the integers of `hashes`, so 128bit sketches are
+// always given in the base64 form.
+func (kmv *KMinValues) MarshalJSON() ([]byte, error) {
+	if kmv.hashSize > bytesUint64 {
+		return Base64KMinValues{kmv}.MarshalJSON()
+	}
+	var buffer bytes.Buffer
+	N := kmv.Len()
+	fmt.Fprintf(&buffer, `{"k":%d,"width":%d,"hashes":[`, kmv.maxSize, kmv.HashWidth())
+	for n := 0; n < N; n++ {
+		if n != 0 {
+			buffer.WriteByte(',')
+		}
+		fmt.Fprintf(&buffer, "%d", kmv.GetHash(n))
+	}
+	buffer.WriteString("]}")
+	return buffer.Bytes(), nil
+}
+
+// Accepts either JSON encoding of a sketch.  The hashes don't need to be in
+// any particular order since they are re-added to a new sketch, which only
+// takes room for the hashes given rather than for k of them, so a large k
+// doesn't cost anything until the sketch holds that many.
+func (kmv *KMinValues) UnmarshalJSON(data []byte) error {
+	var j jsonKMinValues
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.K <= 0 {
+		return errors.New("sketch must have a positive k")
+	}
+	if j.Width == 0 {
+		j.Width = 64
+	}
+	hashSize, err := hashSizeFromWidth(j.Width)
+	if err != nil {
+		return err
+	}
+
+	var raw []byte
+	n := len(j.Hashes)
+	switch j.Encoding {
+	case "":
+	case "base64":
+		raw, err = base64.StdEncoding.DecodeString(j.Data)
+		if err != nil {
+			return err
+		}
+		if len(raw)%hashSize != 0 {
+			return errors.New("error reading hashes")
+		}
+		n = len(raw) / hashSize
+	default:
+		return InvalidJSONEncoding
+	}
+	if n > j.K {
+		n = j.K
+	}
+
+	kmv.raw, kmv.maxSize, kmv.hashSize, kmv.pooled = GetBuffer(n*hashSize), j.K, hashSize, true
+	kmv.policy, kmv.deferred = CheckDuplicates, nil
+	kmv.dropFilter()
+	for _, hash := range j.Hashes {
+		kmv.AddHash(hash)
+	}
+	for i := 0; i < len(raw); i += hashSize {
+		kmv.AddHashBytes(raw[i : i+hashSize])
+	}
+	return nil
+}
+
+// Wraps a sketch so that it marshals to the base64 JSON encoding
+type Base64KMinValues struct {
+	*KMinValues
+}
+
+func (b Base64KMinValues) MarshalJSON() ([]byte, error) {
+	b.settle()
+	return json.Marshal(jsonKMinValues{
+		K:        b.maxSize,
+		Width:    b.HashWidth(),
+		Encoding: "base64",
+		Data:     base64.StdEncoding.EncodeToString(b.raw),
+	})
+}
@@ -4,75 +4,117 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"math"
 	"sort"
+	"sync/atomic"
 )
 
+const bytesUint128 = 16
 const bytesUint64 = 8
+const bytesUint32 = 4
 const hashMax = float64(1<<64 - 1)
 
+// The serialized header is a single uint64 holding the sketch size.  For
+// sketches that don't use the default 64bit hashes, the top byte of the header
+// holds the hash width in bytes.  Legacy sketches always have a zero top byte.
+// The bit below it is set when the hashes are compressed.
+const headerWidthShift = 56
+const headerSizeMask = headerCompressed - 1
+
+var InvalidHashWidth = errors.New("hash width must be 32, 64 or 128 bits")
+var MismatchedLows = errors.New("lows must be empty or as many as the hashes")
+
 func hashUint64ToBytes(hash uint64) []byte {
 	hashBytes := new(bytes.Buffer)
 	binary.Write(hashBytes, binary.BigEndian, hash)
 	return hashBytes.Bytes()
 }
 
+// The big endian bytes of a 128bit hash, whose first 8 bytes are the same as
+// those of its high half on its own, so 128bit hashes truncate to 64bit ones
+func Hash128Bytes(high, low uint64) []byte {
+	hashBytes := make([]byte, bytesUint128)
+	binary.BigEndian.PutUint64(hashBytes, high)
+	binary.BigEndian.PutUint64(hashBytes[bytesUint64:], low)
+	return hashBytes
+}
+
+// Hashes narrower than 64bits are treated as the most significant bytes of a
+// uint64 so that truncated and full width hashes order the same way.  Wider
+// hashes are truncated to their 64 most significant bits.
 func hashBytesToUint64(hashBytes []byte) uint64 {
-	// TODO: error checking here
-	var hash uint64
-	hashReader := bytes.NewBuffer(hashBytes)
-	binary.Read(hashReader, binary.BigEndian, &hash)
-	return hash
+	var buf [bytesUint64]byte
+	copy(buf[:], hashBytes)
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// Compares two hashes of possibly different widths by their common prefix.
+// Since hashes are stored big endian, this is the same as comparing the wider
+// hash after truncating it to the narrower width.
+func compareHashBytes(a, b []byte) int {
+	if len(a) > len(b) {
+		a = a[:len(b)]
+	} else if len(b) > len(a) {
+		b = b[:len(a)]
+	}
+	return bytes.Compare(a, b)
+}
+
+func hashSizeFromWidth(width int) (int, error) {
+	switch width {
+	case 64:
+		return bytesUint64, nil
+	case 32:
+		return bytesUint32, nil
+	case 128:
+		return bytesUint128, nil
+	}
+	return 0, InvalidHashWidth
 }
 
 func Union(others ...*KMinValues) *KMinValues {
 	maxsize := smallestK(others...)
-	maxlen := 0
-	idxs := make([]int, len(others))
-	for i, other := range others {
-		if maxlen < other.Len() {
-			maxlen = other.Len()
-		}
-		idxs[i] = other.Len() - 1
-	}
+	hashsize := smallestHashSize(others...)
 
-	// We directly create a kminvalues object here so that we can have raw be
-	// pre-initialized with nil values
 	newkmv := &KMinValues{
-		raw:     make([]byte, maxlen*bytesUint64, maxsize*bytesUint64),
-		maxSize: maxsize,
+		raw:      GetBuffer(maxsize * hashsize),
+		maxSize:  maxsize,
+		hashSize: hashsize,
+		pooled:   true,
 	}
-
-	var kmin, kminTmp []byte
-	jmin := make([]int, 0, len(others))
-	for i := maxlen - 1; i >= 0; i-- {
-		kmin = nil
-		jmin = jmin[:0]
-		for j, other := range others {
-			kminTmp = other.getHashBytes(idxs[j])
-			if kminTmp != nil {
-				if kmin == nil || kminTmp != nil && bytes.Compare(kmin, kminTmp) > 0 {
-					kmin = kminTmp
-					jmin = jmin[:0]
-					jmin = append(jmin, j)
-				} else if kmin != nil && bytes.Equal(kmin, kminTmp) {
-					jmin = append(jmin, j)
-				}
-			}
-		}
-		for _, j := range jmin {
-			idxs[j]--
-		}
-		if kmin != nil {
-			newkmv.SetHash(i, kmin)
-		}
+	for _, other := range others {
+		newkmv.Merge(other)
 	}
 	return newkmv
 }
 
-func cardinality(maxSize int, kMin uint64) float64 {
-	return float64(maxSize-1.0) * hashMax / float64(kMin)
+// Merges two sketches into a new one holding their union.  Sketches of the
+// same hash width form a state based CRDT under Merge: it is commutative,
+// associative and idempotent, so replicas that exchange sketches in any order,
+// any number of times, end up with identical bytes.  This is what makes a
+// union safe to retry.  The result takes the smaller k and narrower hash
+// width, so an empty sketch is only an identity if its k and width are at
+// least those of the other side.  A nil sketch is treated as an identity.
+//
+// Merge stays commutative and idempotent across widths but isn't associative:
+// hashes that are distinct at one width can collide once narrowed, so merging
+// a narrower sketch last can leave fewer than k hashes where merging it first
+// wouldn't have.  Union narrows all of its sketches at once, so it gives the
+// same bytes whatever the order of sketches of mixed widths.
+func Merge(a, b *KMinValues) *KMinValues {
+	if a == nil {
+		a, b = b, a
+	}
+	if a == nil {
+		return nil
+	} else if b == nil {
+		return Union(a)
+	}
+	return Union(a, b)
+}
+
+func cardinality(maxSize int, kMin float64) float64 {
+	return float64(maxSize-1.0) * hashMax / kMin
 }
 
 func smallestK(others ...*KMinValues) int {
@@ -85,55 +127,144 @@ func smallestK(others ...*KMinValues) int {
 	return minsize
 }
 
-type KMinValues struct {
-	raw     []byte
-	maxSize int
-}
-
-func (kmv *KMinValues) MarshalJSON() ([]byte, error) {
-	var buffer bytes.Buffer
-	N := kmv.Len()
-	fmt.Fprintf(&buffer, `{"k":%d, "data":[`, kmv.maxSize)
-	for n := 0; n < N; n++ {
-		if n == N-1 {
-			fmt.Fprintf(&buffer, "%d]}", kmv.GetHash(n))
-		} else {
-			fmt.Fprintf(&buffer, "%d,", kmv.GetHash(n))
+func smallestHashSize(others ...*KMinValues) int {
+	minsize := others[0].hashSize
+	for _, other := range others[1:] {
+		if minsize > other.hashSize {
+			minsize = other.hashSize
 		}
 	}
-	return buffer.Bytes(), nil
+	return minsize
+}
+
+type KMinValues struct {
+	raw      []byte
+	maxSize  int
+	hashSize int
+	pooled   bool // raw came from the buffer pool and isn't shared
+	policy   DuplicatePolicy
+	deferred []byte // hashes set aside by DeferDuplicates, not yet in raw
+	filter   atomic.Pointer[hashFilter]
+	lookups  int32 // lookups since the filter was dropped
 }
 
 func NewKMinValues(capacity int) *KMinValues {
 	return &KMinValues{
-		raw:     make([]byte, 0, capacity*bytesUint64),
-		maxSize: capacity,
+		raw:      GetBuffer(capacity * bytesUint64),
+		maxSize:  capacity,
+		hashSize: bytesUint64,
+		pooled:   true,
 	}
 }
 
-func KMinValuesFromBytes(raw []byte) (*KMinValues, error) {
-	if len(raw) == 0 {
-		return nil, errors.New("error reading data")
+// Creates a KMinValues that stores hashes truncated to the given width in
+// bits.  32bit hashes halve the size of the sketch at the cost of collisions
+// once the retained minima get close together.  128bit hashes double it so
+// that even sets of tens of billions of values have no collisions to speak
+// of, as long as they are given 128bit hashes with AddHash128.
+func NewKMinValuesWidth(capacity, width int) (*KMinValues, error) {
+	hashSize, err := hashSizeFromWidth(width)
+	if err != nil {
+		return nil, err
 	}
-	buf := bytes.NewBuffer(raw)
+	return &KMinValues{
+		raw:      GetBuffer(capacity * hashSize),
+		maxSize:  capacity,
+		hashSize: hashSize,
+		pooled:   true,
+	}, nil
+}
 
-	var maxSizeTmp uint64
-	var maxSize int
-	err := binary.Read(buf, binary.BigEndian, &maxSizeTmp)
+func KMinValuesFromBytes(raw []byte) (*KMinValues, error) {
+	maxSize, hashSize, compressed, err := readHeader(raw)
 	if err != nil {
-		return nil, errors.New("error reading size")
+		return nil, err
+	}
+
+	if compressed {
+		raw, err := decompressHashes(raw[bytesUint64:], maxSize, hashSize)
+		if err != nil {
+			return nil, err
+		}
+		return &KMinValues{raw: raw, maxSize: maxSize, hashSize: hashSize, pooled: true}, nil
+	}
+	if (len(raw)-bytesUint64)%hashSize != 0 {
+		return nil, errors.New("error reading hashes")
 	}
-	maxSize = int(maxSizeTmp)
 
 	kmv := &KMinValues{
-		raw:     raw[bytesUint64:],
-		maxSize: maxSize,
+		raw:      raw[bytesUint64:],
+		maxSize:  maxSize,
+		hashSize: hashSize,
 	}
 	return kmv, nil
 }
 
+func readHeader(raw []byte) (maxSize, hashSize int, compressed bool, err error) {
+	if len(raw) == 0 {
+		return 0, 0, false, errors.New("error reading data")
+	}
+	if len(raw) < bytesUint64 {
+		return 0, 0, false, errors.New("error reading size")
+	}
+	header := binary.BigEndian.Uint64(raw)
+	maxSize = int(header & headerSizeMask)
+
+	hashSize = int(header >> headerWidthShift)
+	if hashSize == 0 {
+		hashSize = bytesUint64
+	} else if hashSize != bytesUint32 && hashSize != bytesUint128 {
+		return 0, 0, false, errors.New("error reading hash width")
+	}
+	compressed = header&headerCompressed != 0
+	if compressed && hashSize > bytesUint64 {
+		return 0, 0, false, CompressedHashesError
+	}
+	return maxSize, hashSize, compressed, nil
+}
+
+// Same as KMinValuesFromBytes(raw).Cardinality() but only reads the header
+// and the largest hash, which comes first in either encoding, so a cardinality
+// can be had without going through the whole set.  Compressed sets are only
+// scanned for the number of varints they hold.
+func CardinalityFromBytes(raw []byte) (float64, error) {
+	maxSize, hashSize, compressed, err := readHeader(raw)
+	if err != nil {
+		return 0, err
+	}
+	hashes := raw[bytesUint64:]
+	kmv := &KMinValues{maxSize: maxSize, hashSize: hashSize}
+
+	if !compressed {
+		if len(hashes)%hashSize != 0 {
+			return 0, errors.New("error reading hashes")
+		}
+		kmv.raw = hashes
+		return kmv.Cardinality(), nil
+	}
+
+	n := 0
+	for _, b := range hashes {
+		if b < 0x80 {
+			n++
+		}
+	}
+	if n < maxSize {
+		return float64(n), nil
+	}
+	largest, read := binary.Uvarint(hashes)
+	if read <= 0 {
+		return 0, CompressedHashesError
+	}
+	kMin := float64(largest<<uint(64-8*hashSize)) + kmv.truncatedHashOffset()
+	return cardinality(maxSize, kMin), nil
+}
+
+// Returns the i'th largest retained hash.  Truncated hashes are returned in
+// the most significant bits of the uint64 and 128bit hashes are truncated.
 func (kmv *KMinValues) GetHash(i int) uint64 {
-	hashBytes := kmv.raw[i*bytesUint64 : (i+1)*bytesUint64]
+	kmv.settle()
+	hashBytes := kmv.raw[i*kmv.hashSize : (i+1)*kmv.hashSize]
 	return hashBytesToUint64(hashBytes)
 }
 
@@ -141,29 +272,69 @@ func (kmv *KMinValues) getHashBytes(i int) []byte {
 	if i < 0 || i >= kmv.Len() {
 		return nil
 	}
-	return kmv.raw[i*bytesUint64 : (i+1)*bytesUint64]
+	return kmv.raw[i*kmv.hashSize : (i+1)*kmv.hashSize]
+}
+
+// Converts a full width hash into the representation stored in this sketch.
+// 128bit sketches store 64bit hashes padded with zeros.
+func (kmv *KMinValues) hashBytes(hash uint64) []byte {
+	hashBytes := hashUint64ToBytes(hash)
+	if kmv.hashSize > len(hashBytes) {
+		hashBytes = append(hashBytes, make([]byte, kmv.hashSize-len(hashBytes))...)
+	}
+	return hashBytes[:kmv.hashSize]
 }
 
 func (kmv *KMinValues) Bytes() []byte {
-	sizeBytes := make([]byte, bytesUint64, bytesUint64+len(kmv.raw))
-	binary.BigEndian.PutUint64(sizeBytes, uint64(kmv.maxSize))
-	result := append(sizeBytes, kmv.raw...)
-	return result
+	return kmv.appendBytes(make([]byte, 0, bytesUint64+len(kmv.raw)))
 }
 
-func (kmv *KMinValues) Len() int { return len(kmv.raw) / bytesUint64 }
+func (kmv *KMinValues) header() uint64 {
+	header := uint64(kmv.maxSize)
+	if kmv.hashSize != bytesUint64 {
+		header |= uint64(kmv.hashSize) << headerWidthShift
+	}
+	return header
+}
+
+func (kmv *KMinValues) appendBytes(buf []byte) []byte {
+	kmv.settle()
+	return append(appendHeader(buf, kmv.header()), kmv.raw...)
+}
+
+func appendHeader(buf []byte, header uint64) []byte {
+	var sizeBytes [bytesUint64]byte
+	binary.BigEndian.PutUint64(sizeBytes[:], header)
+	return append(buf, sizeBytes[:]...)
+}
+
+func (kmv *KMinValues) Len() int {
+	kmv.settle()
+	return len(kmv.raw) / kmv.hashSize
+}
+
+// Returns k, the number of minimum hashes the sketch keeps
+func (kmv *KMinValues) MaxSize() int { return kmv.maxSize }
+
+// Returns the width, in bits, of the hashes stored in the sketch
+func (kmv *KMinValues) HashWidth() int { return kmv.hashSize * 8 }
 
 func (kmv *KMinValues) SetHash(i int, hash []byte) {
-	ib := i * bytesUint64
-	copy(kmv.raw[ib:], hash)
+	kmv.dropFilter()
+	ib := i * kmv.hashSize
+	copy(kmv.raw[ib:ib+kmv.hashSize], hash)
 }
 
+// Finds a hash by its 64 most significant bits, so that the hashes of 128bit
+// sketches can be found from the hashes of 64bit ones
 func (kmv *KMinValues) FindHash(hash uint64) int {
-	hashBytes := hashUint64ToBytes(hash)
-	return kmv.FindHashBytes(hashBytes)
+	return kmv.FindHashBytes(hashUint64ToBytes(hash))
 }
 
 func (kmv *KMinValues) FindHashBytes(hash []byte) int {
+	if kmv.filterRejects(hash) {
+		return -1
+	}
 	idx, found := kmv.LocateHashBytes(hash)
 	if found {
 		return idx
@@ -172,29 +343,90 @@ func (kmv *KMinValues) FindHashBytes(hash []byte) int {
 }
 
 func (kmv *KMinValues) LocateHashBytes(hash []byte) (int, bool) {
-	found := sort.Search(kmv.Len(), func(i int) bool { return bytes.Compare(kmv.getHashBytes(i), hash) <= 0 })
-	if found < kmv.Len() && bytes.Equal(kmv.getHashBytes(found), hash) {
+	found := sort.Search(kmv.Len(), func(i int) bool { return compareHashBytes(kmv.getHashBytes(i), hash) <= 0 })
+	if found < kmv.Len() && compareHashBytes(kmv.getHashBytes(found), hash) == 0 {
 		return found, true
 	}
 	return found, false
 }
 
-func (kmv *KMinValues) AddHash(hash uint64) bool {
+// Removes a retained hash, returning whether it was there.  The remaining
+// hashes of a full sketch are exactly the k-1 smallest of what is left, since
+// the next smallest hash was thrown away long ago, so a full sketch loses one
+// from its k and keeps estimating without bias, only less precisely.
+func (kmv *KMinValues) RemoveHash(hash uint64) bool {
 	hashBytes := hashUint64ToBytes(hash)
-	return kmv.AddHashBytes(hashBytes)
+	if kmv.filterRejects(hashBytes) {
+		return false
+	}
+	idx, found := kmv.LocateHashBytes(hashBytes)
+	if !found {
+		return false
+	}
+	kmv.filterRemove()
+	full := kmv.Len() >= kmv.maxSize
+	ib := idx * kmv.hashSize
+	copy(kmv.raw[ib:], kmv.raw[ib+kmv.hashSize:])
+	kmv.raw = kmv.raw[:len(kmv.raw)-kmv.hashSize]
+	if full && kmv.maxSize > 1 {
+		kmv.maxSize--
+	}
+	return true
+}
+
+func (kmv *KMinValues) AddHash(hash uint64) bool {
+	return kmv.AddHashBytes(kmv.hashBytes(hash))
+}
+
+// Adds a 128bit hash, which narrower sketches truncate to its high half, so
+// AddHash128(high, low) is the same as AddHash(high) for them
+func (kmv *KMinValues) AddHash128(high, low uint64) bool {
+	return kmv.AddHashBytes(Hash128Bytes(high, low))
+}
+
+// Adds a batch of hashes, the high halves of 128bit hashes along with their
+// low halves, or no lows for 64bit hashes, and returns the delta of the
+// hashes that were retained, as given by Diff.  Hashes are added without
+// being converted one by one, and under DeferDuplicates a batch costs a
+// single sort.  Nothing is added if lows and highs don't match up.
+func (kmv *KMinValues) AddMany(highs, lows []uint64) (*KMinValues, error) {
+	if len(lows) != 0 && len(lows) != len(highs) {
+		return nil, MismatchedLows
+	}
+	kmv.settle()
+	previous := &KMinValues{
+		raw:      append([]byte(nil), kmv.raw...),
+		maxSize:  kmv.maxSize,
+		hashSize: kmv.hashSize,
+	}
+	var hash [bytesUint128]byte
+	for i, high := range highs {
+		binary.BigEndian.PutUint64(hash[:], high)
+		if len(lows) != 0 {
+			binary.BigEndian.PutUint64(hash[bytesUint64:], lows[i])
+		}
+		kmv.AddHashBytes(hash[:])
+	}
+	return Diff(previous, kmv), nil
 }
 
 func (kmv *KMinValues) popSet(idx int, hash []byte) {
-	ib := idx * bytesUint64
-	copy(kmv.raw[:ib-bytesUint64], kmv.raw[bytesUint64:ib])
-	copy(kmv.raw[ib-bytesUint64:], hash)
+	kmv.filterRemove()
+	kmv.filterAdd(hash)
+	ib := idx * kmv.hashSize
+	copy(kmv.raw[:ib-kmv.hashSize], kmv.raw[kmv.hashSize:ib])
+	copy(kmv.raw[ib-kmv.hashSize:ib], hash)
 }
 
 func (kmv *KMinValues) insert(idx int, hash []byte) {
-	ib := idx * bytesUint64
-	kmv.raw = append(kmv.raw, make([]byte, bytesUint64)...)
-	copy(kmv.raw[ib+bytesUint64:], kmv.raw[ib:])
-	copy(kmv.raw[ib:], hash)
+	kmv.filterAdd(hash)
+	ib := idx * kmv.hashSize
+	if len(kmv.raw)+kmv.hashSize > cap(kmv.raw) {
+		kmv.increaseCapacity(kmv.maxSize * kmv.hashSize)
+	}
+	kmv.raw = kmv.raw[:len(kmv.raw)+kmv.hashSize]
+	copy(kmv.raw[ib+kmv.hashSize:], kmv.raw[ib:])
+	copy(kmv.raw[ib:ib+kmv.hashSize], hash)
 }
 
 // Adds a hash to the KMV and maintains the sorting of the values.
@@ -203,6 +435,14 @@ func (kmv *KMinValues) insert(idx int, hash []byte) {
 // because it is computationally expensive so we attempt to throw away the hash
 // in every way possible before performing it.
 func (kmv *KMinValues) AddHashBytes(hash []byte) bool {
+	if len(hash) != kmv.hashSize {
+		var buf [bytesUint128]byte
+		copy(buf[:], hash)
+		hash = buf[:kmv.hashSize]
+	}
+	if kmv.policy == DeferDuplicates && kmv.deferHash(hash) {
+		return true
+	}
 	n := kmv.Len()
 	if n >= kmv.maxSize {
 		if bytes.Compare(kmv.getHashBytes(0), hash) < 0 {
@@ -234,15 +474,17 @@ func (kmv *KMinValues) increaseCapacity(newcap int) error {
 	if newcap < N {
 		return errors.New("already at that capacity")
 	}
-	if newcap/bytesUint64 > kmv.maxSize {
-		if N == kmv.maxSize*bytesUint64 {
+	if newcap/kmv.hashSize > kmv.maxSize {
+		if N == kmv.maxSize*kmv.hashSize {
 			return errors.New("at max capacity")
 		}
-		newcap = kmv.maxSize * bytesUint64
+		newcap = kmv.maxSize * kmv.hashSize
 	}
-	newarray := make([]byte, len(kmv.raw), newcap)
-	copy(newarray[:len(kmv.raw)], kmv.raw)
+	newarray := GetBuffer(newcap)[:len(kmv.raw)]
+	copy(newarray, kmv.raw)
+	kmv.recycle()
 	kmv.raw = newarray
+	kmv.pooled = true
 	return nil
 }
 
@@ -250,12 +492,33 @@ func (kmv *KMinValues) Cardinality() float64 {
 	if kmv.Len() < kmv.maxSize {
 		return float64(kmv.Len())
 	}
-	return cardinality(kmv.maxSize, kmv.GetHash(0))
+	return cardinality(kmv.maxSize, kmv.largestHash())
+}
+
+// The largest retained hash scaled to a 64bit hash.  The low half of 128bit
+// hashes is kept as a fraction, which starts to count once the retained
+// hashes are all below 2^-11, ie: past a few million values for k of 1024.
+func (kmv *KMinValues) largestHash() float64 {
+	largest := float64(kmv.GetHash(0)) + kmv.truncatedHashOffset()
+	if kmv.hashSize > bytesUint64 {
+		low := binary.BigEndian.Uint64(kmv.raw[bytesUint64:bytesUint128])
+		largest += math.Ldexp(float64(low), -64)
+	}
+	return largest
+}
+
+// Truncated hashes always under estimate the true hash value, so we add back
+// the expected value of the bits that were thrown away.
+func (kmv *KMinValues) truncatedHashOffset() float64 {
+	if kmv.hashSize >= bytesUint64 {
+		return 0
+	}
+	return float64(uint64(1)<<uint(8*(bytesUint64-kmv.hashSize))) / 2.0
 }
 
 func (kmv *KMinValues) CardinalityIntersection(others ...*KMinValues) float64 {
 	X, n := DirectSum(append(others, kmv)...)
-	return float64(n) / float64(X.maxSize) * X.Cardinality()
+	return intersectionFraction(X, n) * X.Cardinality()
 
 }
 
@@ -267,7 +530,44 @@ func (kmv *KMinValues) CardinalityUnion(others ...*KMinValues) float64 {
 
 func (kmv *KMinValues) Jaccard(others ...*KMinValues) float64 {
 	X, n := DirectSum(append(others, kmv)...)
-	return float64(n) / float64(X.maxSize)
+	return intersectionFraction(X, n)
+}
+
+// Estimates of the intersection of several sets along with the number of
+// hashes they are based on.  With few Common hashes the estimates are mostly
+// noise, whatever the sets' k.
+type Intersection struct {
+	Jaccard     float64
+	Cardinality float64
+	Common      int
+}
+
+func Intersect(others ...*KMinValues) Intersection {
+	return IntersectAtLeast(len(others), others...)
+}
+
+// Estimates the number of values found in at least m of the sets, eg: the
+// users active on at least 3 of the last 7 days.  m of 1 gives the union and
+// m of len(others) the intersection.
+func IntersectAtLeast(m int, others ...*KMinValues) Intersection {
+	X, n := directSumAtLeast(m, others...)
+	defer X.Release()
+	jaccard := intersectionFraction(X, n)
+	return Intersection{
+		Jaccard:     jaccard,
+		Cardinality: jaccard * X.Cardinality(),
+		Common:      n,
+	}
+}
+
+// The fraction of the union's retained hashes which are in every set.  We
+// divide by the number of hashes actually in the union rather than k since
+// the union of small sets won't be full.
+func intersectionFraction(X *KMinValues, n int) float64 {
+	if X.Len() == 0 {
+		return 0
+	}
+	return float64(n) / float64(X.Len())
 }
 
 // Returns a new KMinValues object is the union between the current and the
@@ -276,25 +576,255 @@ func (kmv *KMinValues) Union(others ...*KMinValues) *KMinValues {
 	return Union(append(others, kmv)...)
 }
 
+var MergeNilSketch = errors.New("cannot merge a nil sketch")
+
+// Merges other into the current KMinValues in place so that it holds the union
+// of both sketches.  As with Union, the result takes the smaller k and the
+// narrower hash width of the two.  Both arrays are sorted, so after a first
+// pass over their tails to find how many hashes from each survive the merge,
+// the result is written front to back in a single pass.  We only allocate if
+// the current buffer can't hold the result.
+func (kmv *KMinValues) Merge(other *KMinValues) error {
+	if other == nil {
+		return MergeNilSketch
+	} else if other == kmv {
+		return nil
+	}
+	kmv.settle()
+	other.settle()
+	kmv.dropFilter()
+	if other.hashSize < kmv.hashSize {
+		kmv.narrow(other.hashSize)
+	}
+	if other.maxSize < kmv.maxSize {
+		kmv.truncate(other.maxSize)
+		kmv.maxSize = other.maxSize
+	}
+
+	w := kmv.hashSize
+	k := kmv.maxSize
+	n := kmv.Len()
+	m := other.Len()
+
+	// Find the smallest k distinct hashes between the two sketches, which
+	// are kmv's hashes from i0 on and other's hashes from j0 on.
+	i, j, L := n-1, m-1, 0
+	for L < k && (i >= 0 || j >= 0) {
+		c := 1
+		if i < 0 {
+			c = -1
+		} else if j >= 0 {
+			c = compareHashBytes(other.getHashBytes(j), kmv.getHashBytes(i))
+		}
+		if c >= 0 {
+			i--
+		}
+		if c <= 0 {
+			j = other.skipDuplicates(j, w)
+		}
+		L++
+	}
+	i0, j0 := i+1, j+1
+	na := n - i0
+
+	// Move the surviving part of kmv to the end of the result so the merge
+	// below never overwrites a hash it hasn't read yet.
+	if cap(kmv.raw) < L*w {
+		buf := GetBuffer(k * w)[:L*w]
+		copy(buf[(L-na)*w:], kmv.raw[i0*w:n*w])
+		kmv.recycle()
+		kmv.raw = buf
+		kmv.pooled = true
+	} else {
+		buf := kmv.raw[:L*w]
+		copy(buf[(L-na)*w:], kmv.raw[i0*w:n*w])
+		kmv.raw = buf
+	}
+
+	ia := L - na
+	for p := 0; p < L; p++ {
+		c := -1
+		if ia >= L {
+			c = 1
+		} else if j0 < m {
+			c = compareHashBytes(other.getHashBytes(j0), kmv.getHashBytes(ia))
+		}
+		if c > 0 {
+			kmv.SetHash(p, other.getHashBytes(j0)[:w])
+		} else {
+			if p != ia {
+				kmv.SetHash(p, kmv.getHashBytes(ia))
+			}
+			ia++
+		}
+		if c >= 0 {
+			// skip any of other's hashes that match the one we just used
+			// once they are truncated to our width
+			j0++
+			for j0 < m && compareHashBytes(other.getHashBytes(j0), other.getHashBytes(j0 - 1)[:w]) == 0 {
+				j0++
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the index of the next hash before j that is different from hash j
+// when compared at the given width.  Wider sketches can hold several hashes
+// that are equal once truncated.
+func (kmv *KMinValues) skipDuplicates(j, width int) int {
+	hash := kmv.getHashBytes(j)[:width]
+	j--
+	for j >= 0 && compareHashBytes(kmv.getHashBytes(j), hash) == 0 {
+		j--
+	}
+	return j
+}
+
+// Truncates hashes to a narrower width, in place, removing any hashes which
+// become duplicates.
+func (kmv *KMinValues) narrow(hashSize int) {
+	n := kmv.Len()
+	p := 0
+	for i := 0; i < n; i++ {
+		hash := kmv.raw[i*kmv.hashSize : i*kmv.hashSize+hashSize]
+		if p > 0 && bytes.Equal(kmv.raw[(p-1)*hashSize:p*hashSize], hash) {
+			continue
+		}
+		copy(kmv.raw[p*hashSize:(p+1)*hashSize], hash)
+		p++
+	}
+	kmv.raw = kmv.raw[:p*hashSize]
+	kmv.hashSize = hashSize
+}
+
+// Throws away the largest hashes so that at most k remain
+func (kmv *KMinValues) truncate(k int) {
+	n := kmv.Len()
+	if n <= k {
+		return
+	}
+	copy(kmv.raw, kmv.raw[(n-k)*kmv.hashSize:])
+	kmv.raw = kmv.raw[:k*kmv.hashSize]
+}
+
+// Returns a copy of the sketch keeping only its k smallest hashes so it can be
+// compared against sketches with a smaller k.  Sketches can't be upsized since
+// the hashes that would be needed have already been thrown away.
+func (kmv *KMinValues) Downsize(k int) (*KMinValues, error) {
+	if k <= 0 || k > kmv.maxSize {
+		return nil, errors.New("can only downsize to a smaller k")
+	}
+	view := kmv.withK(k)
+	resized := &KMinValues{
+		raw:      GetBuffer(k * kmv.hashSize)[:len(view.raw)],
+		maxSize:  k,
+		hashSize: kmv.hashSize,
+		pooled:   true,
+	}
+	copy(resized.raw, view.raw)
+	return resized, nil
+}
+
+// Same as Downsize but the result shares its hashes with the current sketch,
+// so it must not be modified.
+func (kmv *KMinValues) withK(k int) *KMinValues {
+	kmv.settle()
+	if k >= kmv.maxSize {
+		return kmv
+	}
+	raw := kmv.raw
+	if n := kmv.Len(); n > k {
+		raw = raw[(n-k)*kmv.hashSize:]
+	}
+	return &KMinValues{
+		raw:      raw,
+		maxSize:  k,
+		hashSize: kmv.hashSize,
+	}
+}
+
+// Returns a delta holding the hashes of current that aren't in previous.  As
+// long as current was built from previous by adding hashes or merging in
+// other sketches, merging the delta into previous gives back current.  Deltas
+// can be compacted by merging them together, so a replica only ever needs to
+// be sent the hashes that were inserted since it was last in sync.
+func Diff(previous, current *KMinValues) *KMinValues {
+	delta := &KMinValues{
+		raw:      make([]byte, 0, current.Len()*current.hashSize),
+		maxSize:  current.maxSize,
+		hashSize: current.hashSize,
+	}
+
+	// both sketches are sorted so we walk them together from their largest
+	// hashes
+	j, m := 0, previous.Len()
+	for i := 0; i < current.Len(); i++ {
+		hash := current.getHashBytes(i)
+		for j < m && compareHashBytes(previous.getHashBytes(j), hash) > 0 {
+			j++
+		}
+		if j >= m || compareHashBytes(previous.getHashBytes(j), hash) != 0 {
+			delta.raw = append(delta.raw, hash...)
+		}
+	}
+	return delta
+}
+
+// Returns the delta for adding a single hash to the sketch, as if it were
+// given by Diff.  Only meaningful if AddHash reported that hash was retained.
+func (kmv *KMinValues) HashDelta(hash uint64) *KMinValues {
+	return &KMinValues{
+		raw:      kmv.hashBytes(hash),
+		maxSize:  kmv.maxSize,
+		hashSize: kmv.hashSize,
+	}
+}
+
+// Same as HashDelta for a hash added with AddHash128
+func (kmv *KMinValues) HashDelta128(high, low uint64) *KMinValues {
+	return &KMinValues{
+		raw:      Hash128Bytes(high, low)[:kmv.hashSize],
+		maxSize:  kmv.maxSize,
+		hashSize: kmv.hashSize,
+	}
+}
+
 func (kmv *KMinValues) RelativeError() float64 {
 	return math.Sqrt(2.0 / (math.Pi * float64(kmv.maxSize-2)))
 }
 
 func DirectSum(others ...*KMinValues) (*KMinValues, int) {
+	return directSumAtLeast(len(others), others...)
+}
+
+// Same as DirectSum but counts the hashes of the union found in at least m of
+// the sets
+func directSumAtLeast(m int, others ...*KMinValues) (*KMinValues, int) {
+	// Bring every sketch to the common k first so that we only count hashes
+	// that every sketch could have retained
+	k := smallestK(others...)
+	resized := make([]*KMinValues, len(others))
+	for i, other := range others {
+		resized[i] = other.withK(k)
+	}
+	others = resized
+
 	n := 0
 	X := Union(others...)
 	// TODO: can we optimize this loop somehow?
-	var found bool
 	for i := 0; i < X.Len(); i++ {
 		xHash := X.getHashBytes(i)
-		found = true
-		for _, other := range others {
-			if other.FindHashBytes(xHash) < 0 {
-				found = false
+		found := 0
+		for j, other := range others {
+			if other.FindHashBytes(xHash) >= 0 {
+				found++
+			}
+			if found >= m || found+len(others)-j-1 < m {
 				break
 			}
 		}
-		if found {
+		if found >= m {
 			n += 1
 		}
 	}
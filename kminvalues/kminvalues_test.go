@@ -2,11 +2,13 @@ package kminvalues
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"github.com/bmizerany/assert"
 	"github.com/reusee/mmh3"
 	"math"
 	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -215,3 +217,832 @@ func TestKMinValuesJaccard(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestKMinValues32BitBytes(t *testing.T) {
+	kmv, err := NewKMinValuesWidth(1000, 32)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, kmv.HashWidth(), 32)
+
+	for i := 0; i < 5000; i++ {
+		kmv.AddHash(GetRandHash())
+	}
+	assert.Equal(t, len(kmv.raw), 1000*bytesUint32)
+
+	bkmv := kmv.Bytes()
+	assert.Equal(t, len(bkmv), bytesUint64+1000*bytesUint32)
+	kmv2, err := KMinValuesFromBytes(bkmv)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, kmv2.maxSize, 1000)
+	assert.Equal(t, kmv2.HashWidth(), 32)
+	for i := 0; i < kmv.Len(); i++ {
+		assert.Equal(t, kmv.GetHash(i), kmv2.GetHash(i))
+	}
+
+	_, err = NewKMinValuesWidth(1000, 16)
+	assert.Equal(t, err, InvalidHashWidth)
+}
+
+func TestKMinValues32BitTruncation(t *testing.T) {
+	kmv, _ := NewKMinValuesWidth(5, 32)
+
+	kmv.AddHash(0x0000000100000001)
+	kmv.AddHash(0x0000000100000002)
+	assert.Equal(t, kmv.Len(), 1)
+	assert.Equal(t, kmv.GetHash(0), uint64(0x0000000100000000))
+	assert.Equal(t, kmv.FindHash(0x00000001ffffffff), 0)
+	assert.Equal(t, kmv.FindHash(0x0000000200000000), -1)
+}
+
+func TestKMinValues32BitCardinality(t *testing.T) {
+	kmv, _ := NewKMinValuesWidth(1000, 32)
+
+	for i := 0; i < 50000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv.AddHash(hash)
+	}
+
+	card := kmv.Cardinality()
+	relError := math.Abs(card-50000.0) / 50000.0
+	theoryError := kmv.RelativeError()
+	if relError > 2*theoryError {
+		t.Errorf("Relative error too high: %f instead of %f", relError, theoryError)
+		t.FailNow()
+	}
+}
+
+func TestKMinValuesMixedWidthJaccard(t *testing.T) {
+	kmv1 := NewKMinValues(512)
+	kmv2, _ := NewKMinValuesWidth(512, 32)
+
+	for i := 0; i < 4000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv1.AddHash(hash)
+	}
+	for i := 1000; i < 5000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv2.AddHash(hash)
+	}
+
+	assert.Equal(t, kmv1.Union(kmv2).HashWidth(), 32)
+
+	jaccard := kmv1.Jaccard(kmv2)
+	relError := kmv1.RelativeError()
+	obsError := 1.0 - jaccard*5.0/3.0
+	if math.Abs(obsError) > relError {
+		t.Errorf("Jaccard error too large... got value of %f and needed value of %f (%0.2f%% error)", jaccard, 3.0/5.0, obsError*100.0)
+		t.FailNow()
+	}
+}
+
+func TestKMinValuesMerge(t *testing.T) {
+	kmv1 := NewKMinValues(1000)
+	kmv2 := NewKMinValues(1000)
+
+	for i := 0; i < 1500; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv1.AddHash(hash)
+	}
+	for i := 1000; i < 3000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv2.AddHash(hash)
+	}
+
+	union := kmv1.Union(kmv2)
+	err := kmv1.Merge(kmv2)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, kmv1.Len(), union.Len())
+	for i := 0; i < kmv1.Len(); i++ {
+		assert.Equal(t, kmv1.GetHash(i), union.GetHash(i))
+	}
+	for i := 1; i < kmv1.Len(); i++ {
+		if kmv1.GetHash(i-1) <= kmv1.GetHash(i) {
+			t.Errorf("Merge broke ordering on index %d", i)
+			t.FailNow()
+		}
+	}
+}
+
+func TestKMinValuesMergePartial(t *testing.T) {
+	kmv1 := NewKMinValues(1000)
+	kmv2 := NewKMinValues(1000)
+
+	for i := 0; i < 300; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv1.AddHash(hash)
+	}
+	for i := 200; i < 500; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv2.AddHash(hash)
+	}
+
+	assert.Equal(t, kmv1.Union(kmv2).Cardinality(), 500.0)
+
+	kmv1.Merge(kmv2)
+	assert.Equal(t, kmv1.Len(), 500)
+	assert.Equal(t, kmv1.Cardinality(), 500.0)
+
+	// merging is idempotent
+	kmv1.Merge(kmv2)
+	kmv1.Merge(kmv1)
+	assert.Equal(t, kmv1.Len(), 500)
+}
+
+func TestKMinValuesMergeSmallerK(t *testing.T) {
+	kmv1 := NewKMinValues(5)
+	kmv2 := NewKMinValues(3)
+
+	for _, h := range []uint64{9, 7, 5, 3, 1} {
+		kmv1.AddHash(h)
+	}
+	for _, h := range []uint64{8, 4, 2} {
+		kmv2.AddHash(h)
+	}
+
+	kmv1.Merge(kmv2)
+	assert.Equal(t, kmv1.maxSize, 3)
+	for i, k := range []uint64{3, 2, 1} {
+		assert.Equal(t, kmv1.GetHash(i), k)
+	}
+}
+
+func TestKMinValuesMergeNarrower(t *testing.T) {
+	kmv1 := NewKMinValues(5)
+	kmv2, _ := NewKMinValuesWidth(5, 32)
+
+	kmv1.AddHash(0x0000000300000001)
+	kmv1.AddHash(0x0000000100000002)
+	kmv1.AddHash(0x0000000100000001)
+	kmv2.AddHash(0x0000000200000000)
+
+	kmv1.Merge(kmv2)
+	assert.Equal(t, kmv1.HashWidth(), 32)
+	for i, k := range []uint64{0x0000000300000000, 0x0000000200000000, 0x0000000100000000} {
+		assert.Equal(t, kmv1.GetHash(i), k)
+	}
+}
+
+func TestKMinValuesMergeAllocs(t *testing.T) {
+	kmv1 := NewKMinValues(1000)
+	kmv2 := NewKMinValues(1000)
+	for i := 0; i < 5000; i++ {
+		kmv1.AddHash(GetRandHash())
+		kmv2.AddHash(GetRandHash())
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		kmv1.Merge(kmv2)
+	})
+	assert.Equal(t, allocs, 0.0)
+}
+
+func TestKMinValuesDownsize(t *testing.T) {
+	kmv := NewKMinValues(5)
+	for _, h := range []uint64{9, 7, 5, 3, 1} {
+		kmv.AddHash(h)
+	}
+
+	small, err := kmv.Downsize(3)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, small.maxSize, 3)
+	for i, k := range []uint64{5, 3, 1} {
+		assert.Equal(t, small.GetHash(i), k)
+	}
+
+	small.AddHash(0)
+	assert.Equal(t, kmv.Len(), 5)
+	assert.Equal(t, kmv.GetHash(4), uint64(1))
+
+	_, err = kmv.Downsize(10)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestKMinValuesJaccardHeterogeneousK(t *testing.T) {
+	kmv1 := NewKMinValues(2048)
+	kmv2 := NewKMinValues(512)
+
+	for i := 0; i < 4000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv1.AddHash(hash)
+	}
+	for i := 1000; i < 5000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv2.AddHash(hash)
+	}
+
+	for _, jaccard := range []float64{kmv1.Jaccard(kmv2), kmv2.Jaccard(kmv1)} {
+		relError := kmv2.RelativeError()
+		obsError := 1.0 - jaccard*5.0/3.0
+		if math.Abs(obsError) > relError {
+			t.Errorf("Jaccard error too large... got value of %f and needed value of %f (%0.2f%% error)", jaccard, 3.0/5.0, obsError*100.0)
+			t.FailNow()
+		}
+	}
+
+	card := kmv1.CardinalityIntersection(kmv2)
+	relError := math.Abs(card-3000.0) / 3000.0
+	if relError > kmv2.RelativeError() {
+		t.Errorf("Relative error too high: %f instead of %f", relError, kmv2.RelativeError())
+		t.FailNow()
+	}
+}
+
+func TestKMinValuesJaccardSmallSets(t *testing.T) {
+	kmv1 := NewKMinValues(1000)
+	kmv2 := NewKMinValues(100)
+
+	for i := 0; i < 10; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv1.AddHash(hash)
+		kmv2.AddHash(hash)
+	}
+
+	assert.Equal(t, kmv1.Jaccard(kmv2), 1.0)
+	assert.Equal(t, kmv1.CardinalityIntersection(kmv2), 10.0)
+	assert.Equal(t, NewKMinValues(10).Jaccard(NewKMinValues(10)), 0.0)
+}
+
+func TestKMinValuesJSON(t *testing.T) {
+	kmv, _ := NewKMinValuesWidth(5, 32)
+	empty, err := json.Marshal(kmv)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(empty), `{"k":5,"width":32,"hashes":[]}`)
+
+	for _, h := range []uint64{3 << 32, 1 << 32, 2 << 32} {
+		kmv.AddHash(h)
+	}
+	data, err := json.Marshal(kmv)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(data), `{"k":5,"width":32,"hashes":[12884901888,8589934592,4294967296]}`)
+
+	b64, err := json.Marshal(Base64KMinValues{kmv})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(b64), `{"k":5,"width":32,"encoding":"base64","data":"AAAAAwAAAAIAAAAB"}`)
+
+	for _, encoded := range [][]byte{data, b64} {
+		kmv2 := &KMinValues{}
+		err = json.Unmarshal(encoded, kmv2)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, kmv2.Bytes(), kmv.Bytes())
+	}
+
+	err = json.Unmarshal([]byte(`{"k":5,"encoding":"hex","data":"00"}`), &KMinValues{})
+	assert.Equal(t, err, InvalidJSONEncoding)
+
+	// only the hashes given are allocated, whatever k is asked for
+	huge := &KMinValues{}
+	err = json.Unmarshal([]byte(`{"k":1099511627776,"hashes":[1,2]}`), huge)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, huge.MaxSize(), 1<<40)
+	assert.Equal(t, cap(huge.raw), 2*bytesUint64)
+}
+
+func TestKMinValuesDiff(t *testing.T) {
+	kmv := NewKMinValues(100)
+	for i := 0; i < 500; i++ {
+		kmv.AddHash(GetRandHash())
+	}
+	previous, _ := KMinValuesFromBytes(kmv.Bytes())
+
+	compacted := NewKMinValues(100)
+	for n := 0; n < 5; n++ {
+		before, _ := KMinValuesFromBytes(kmv.Bytes())
+		for i := 0; i < 50; i++ {
+			kmv.AddHash(GetRandHash())
+		}
+		delta := Diff(before, kmv)
+		if delta.Len() == 0 || delta.Len() > 50 {
+			t.Errorf("Delta has %d hashes for 50 additions", delta.Len())
+			t.FailNow()
+		}
+		compacted.Merge(delta)
+	}
+
+	assert.Equal(t, Diff(kmv, kmv).Len(), 0)
+
+	previous.Merge(compacted)
+	assert.Equal(t, previous.Bytes(), kmv.Bytes())
+}
+
+func TestKMinValuesPool(t *testing.T) {
+	buf := GetBuffer(1024)
+	assert.Equal(t, len(buf), 0)
+	assert.Equal(t, cap(buf), 1024)
+	PutBuffer(buf)
+	assert.Equal(t, cap(GetBuffer(1024)), 1024)
+
+	kmv := NewKMinValues(100)
+	for i := 0; i < 50; i++ {
+		kmv.AddHash(GetRandHash())
+	}
+	pooled := kmv.PooledBytes()
+	assert.Equal(t, pooled, kmv.Bytes())
+	assert.Equal(t, cap(pooled), bytesUint64+100*bytesUint64)
+	PutBuffer(pooled)
+
+	// sketches read from bytes don't own them, so they grow into a pooled
+	// buffer and leave the original alone
+	data := kmv.Bytes()
+	loaded, _ := KMinValuesFromBytes(data)
+	for i := 0; i < 10; i++ {
+		loaded.AddHash(GetRandHash())
+	}
+	assert.Equal(t, loaded.pooled, true)
+	assert.Equal(t, data, kmv.Bytes())
+
+	kmv.Release()
+	assert.Equal(t, kmv.Len(), 0)
+}
+
+func TestKMinValuesJackknife(t *testing.T) {
+	kmv1 := NewKMinValues(1000)
+	kmv2 := NewKMinValues(1000)
+	kmv3 := NewKMinValues(1000)
+
+	for i := 0; i < 10000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv1.AddHash(hash)
+		if i >= 9800 {
+			kmv2.AddHash(hash)
+		}
+		if i >= 9000 {
+			kmv3.AddHash(hash)
+		}
+	}
+	for i := 10000; i < 20000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv2.AddHash(hash)
+		kmv3.AddHash(hash)
+	}
+
+	estimate, stderr := Jackknife(kmv1)
+	if estimate != kmv1.Cardinality() {
+		t.Errorf("Jackknife estimate %f differs from the cardinality %f", estimate, kmv1.Cardinality())
+	}
+	if math.Abs(stderr/estimate-kmv1.RelativeError()) > kmv1.RelativeError() {
+		t.Errorf("Jackknife error %f is far from the theoretical error %f", stderr/estimate, kmv1.RelativeError())
+	}
+
+	// a small overlap is much noisier than a large one
+	small, smallErr := Jackknife(kmv1, kmv2)
+	large, largeErr := Jackknife(kmv1, kmv3)
+	if smallErr/small <= largeErr/large {
+		t.Errorf("Small overlap error %f isn't larger than large overlap error %f", smallErr/small, largeErr/large)
+	}
+	if math.Abs(small-200) > 3*smallErr {
+		t.Errorf("Small overlap %f is more than 3 standard errors (%f) from 200", small, smallErr)
+	}
+
+	exact := NewKMinValues(10)
+	exact.AddHash(1)
+	exact.AddHash(2)
+	estimate, stderr = Jackknife(exact)
+	if estimate != 2 || stderr != 0 {
+		t.Errorf("Expected an exact count of 2 but got %f +- %f", estimate, stderr)
+	}
+}
+
+func TestKMinValuesIntersect(t *testing.T) {
+	kmv1 := NewKMinValues(512)
+	kmv2 := NewKMinValues(512)
+
+	for i := 0; i < 1000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv1.AddHash(hash)
+	}
+	for i := 900; i < 1500; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		kmv2.AddHash(hash)
+	}
+
+	intersection := Intersect(kmv1, kmv2)
+	assert.Equal(t, intersection.Jaccard, kmv1.Jaccard(kmv2))
+	assert.Equal(t, intersection.Cardinality, kmv1.CardinalityIntersection(kmv2))
+	assert.Equal(t, intersection.Common, int(intersection.Jaccard*512+0.5))
+}
+
+func TestKMinValuesIntersectAtLeast(t *testing.T) {
+	// value i is in the sets j <= i % 4, so a quarter of the values are in
+	// each of 1, 2, 3 and 4 of the sets
+	kmvs := make([]*KMinValues, 4)
+	for j := range kmvs {
+		kmvs[j] = NewKMinValues(1024)
+	}
+	for i := 0; i < 20000; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		for j := 0; j <= i%4; j++ {
+			kmvs[j].AddHash(hash)
+		}
+	}
+
+	assert.Equal(t, IntersectAtLeast(4, kmvs...), Intersect(kmvs...))
+	assert.Equal(t, IntersectAtLeast(1, kmvs...).Cardinality, kmvs[0].CardinalityUnion(kmvs[1:]...))
+	for m := 1; m <= 4; m++ {
+		expected := float64(20000 * (5 - m) / 4)
+		card := IntersectAtLeast(m, kmvs...).Cardinality
+		if relError := math.Abs(card-expected) / expected; relError > 3*kmvs[0].RelativeError() {
+			t.Errorf("Values in at least %d sets estimated at %f instead of %f", m, card, expected)
+		}
+	}
+}
+
+func TestKMinValuesMergeCRDT(t *testing.T) {
+	sketches := make([]*KMinValues, 0, 6)
+	for _, width := range []int{32, 64} {
+		for _, k := range []int{16, 32, 64} {
+			kmv, _ := NewKMinValuesWidth(k, width)
+			for i := 0; i < 50; i++ {
+				kmv.AddHash(GetRandHash())
+			}
+			// Some hashes in common with every other sketch
+			for i := uint64(1); i <= 10; i++ {
+				kmv.AddHash(i << 50)
+			}
+			sketches = append(sketches, kmv)
+		}
+	}
+
+	for _, a := range sketches {
+		assert.Equal(t, Merge(a, a).Bytes(), a.Bytes())
+		assert.Equal(t, Merge(a, nil).Bytes(), a.Bytes())
+		assert.Equal(t, Merge(nil, a).Bytes(), a.Bytes())
+		for _, b := range sketches {
+			ab := Merge(a, b)
+			assert.Equal(t, ab.Bytes(), Merge(b, a).Bytes())
+			assert.Equal(t, Merge(ab, b).Bytes(), ab.Bytes())
+			for _, c := range sketches {
+				assert.Equal(t, Merge(ab, c).Bytes(), Merge(a, Merge(b, c)).Bytes())
+			}
+		}
+	}
+	assert.Equal(t, Merge(nil, nil) == nil, true)
+}
+
+// Hashes that only collide once narrowed make merges of mixed widths depend on
+// their grouping, though not on the order of a single Union
+func TestKMinValuesMergeMixedWidths(t *testing.T) {
+	a, _ := NewKMinValuesWidth(3, 64)
+	for _, hash := range []uint64{1<<32 | 1, 1<<32 | 2, 2 << 32} {
+		a.AddHash(hash)
+	}
+	b, _ := NewKMinValuesWidth(2, 64)
+	c, _ := NewKMinValuesWidth(3, 32)
+
+	assert.Equal(t, Merge(Merge(a, b), c).Len(), 1)
+	assert.Equal(t, Merge(a, Merge(b, c)).Len(), 2)
+	union := Union(a, b, c).Bytes()
+	for _, order := range [][]*KMinValues{{a, c, b}, {b, a, c}, {b, c, a}, {c, a, b}, {c, b, a}} {
+		assert.Equal(t, Union(order...).Bytes(), union)
+	}
+}
+
+func TestKMinValuesRemoveHash(t *testing.T) {
+	kmv := NewKMinValues(4)
+	for i := uint64(1); i <= 3; i++ {
+		kmv.AddHash(i << 60)
+	}
+	assert.Equal(t, kmv.RemoveHash(5<<60), false)
+	assert.Equal(t, kmv.RemoveHash(2<<60), true)
+	assert.Equal(t, kmv.Cardinality(), 2.0)
+	assert.Equal(t, kmv.MaxSize(), 4)
+
+	// A full sketch keeps estimating from its k-1 smallest hashes
+	full := NewKMinValues(100)
+	for i := 0; i < 10000; i++ {
+		full.AddHash(GetRandHash())
+	}
+	removed := full.GetHash(50)
+	assert.Equal(t, full.RemoveHash(removed), true)
+	assert.Equal(t, full.FindHash(removed), -1)
+	assert.Equal(t, full.MaxSize(), 99)
+	assert.Equal(t, full.Len(), 99)
+	assert.Equal(t, math.Abs(full.Cardinality()-10000) < 3000, true)
+}
+
+func TestKMinValuesCompressedBytes(t *testing.T) {
+	// hashes of 100000 values are about 2^64/100000 apart, which takes 7
+	// bytes, or 3 of 4 bytes for 32bit hashes
+	for width, ratio := range map[int]float64{64: 0.9, 32: 0.8} {
+		kmv, _ := NewKMinValuesWidth(1000, width)
+		for i := 0; i < 100000; i++ {
+			kmv.AddHash(GetRandHash())
+		}
+
+		plain := kmv.Bytes()
+		compressed := kmv.CompressedBytes()
+		assert.Equal(t, binary.BigEndian.Uint64(compressed)&headerCompressed != 0, true)
+		assert.Equal(t, float64(len(compressed)) < float64(len(plain))*ratio, true)
+
+		decoded, err := KMinValuesFromBytes(compressed)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, decoded.Bytes(), plain)
+		assert.Equal(t, decoded.MaxSize(), 1000)
+		assert.Equal(t, decoded.HashWidth(), width)
+		assert.Equal(t, kmv.PooledCompressedBytes(), compressed)
+
+		// corrupt deltas are caught instead of giving unsorted hashes
+		corrupt := append([]byte{}, compressed[:bytesUint64]...)
+		corrupt = append(corrupt, 1, 5)
+		_, err = KMinValuesFromBytes(corrupt)
+		assert.Equal(t, err, CompressedHashesError)
+		corrupt = append(corrupt[:bytesUint64], 0x80)
+		_, err = KMinValuesFromBytes(corrupt)
+		assert.Equal(t, err, CompressedHashesError)
+	}
+
+	// sets whose hashes are far apart stay in the plain encoding
+	kmv := NewKMinValues(10)
+	kmv.AddHash(1 << 63)
+	kmv.AddHash(1)
+	assert.Equal(t, kmv.CompressedBytes(), kmv.Bytes())
+
+	// more hashes than k
+	single := NewKMinValues(1)
+	single.AddHash(5)
+	_, err := KMinValuesFromBytes(append(single.CompressedBytes(), 1))
+	assert.Equal(t, err, CompressedHashesError)
+}
+
+func TestKMinValuesCardinalityFromBytes(t *testing.T) {
+	for _, width := range []int{64, 32} {
+		for _, n := range []int{0, 10, 100000} {
+			kmv, _ := NewKMinValuesWidth(100, width)
+			for i := 0; i < n; i++ {
+				if n == 10 {
+					// close together so that they do get compressed
+					kmv.AddHash(uint64(i+1) << 40)
+				} else {
+					kmv.AddHash(GetRandHash())
+				}
+			}
+			if n > 0 {
+				compressed := kmv.CompressedBytes()
+				assert.Equal(t, binary.BigEndian.Uint64(compressed)&headerCompressed != 0, true)
+			}
+			for _, raw := range [][]byte{kmv.Bytes(), kmv.CompressedBytes()} {
+				cardinality, err := CardinalityFromBytes(raw)
+				assert.Equal(t, err, nil)
+				assert.Equal(t, cardinality, kmv.Cardinality())
+			}
+		}
+	}
+
+	_, err := CardinalityFromBytes([]byte{0, 0, 0})
+	assert.NotEqual(t, err, nil)
+	_, err = CardinalityFromBytes(nil)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestKMinValuesEstimators(t *testing.T) {
+	kmv := NewKMinValues(1000)
+	for i := 0; i < 50000; i++ {
+		kmv.AddHash(GetHash([]byte(fmt.Sprintf("%d", i))))
+	}
+
+	assert.Equal(t, kmv.Estimate(Classic), kmv.Cardinality())
+	for _, estimator := range []Estimator{Classic, BiasCorrected, MaximumLikelihood} {
+		card := kmv.Estimate(estimator)
+		relError := math.Abs(card-50000.0) / 50000.0
+		if relError > 2*kmv.RelativeError() {
+			t.Errorf("Relative error of %s too high: %f instead of %f", estimator, relError, kmv.RelativeError())
+		}
+		assert.Equal(t, Estimate(estimator, 1000, kmv.Len(), 64, kmv.GetHash(0)), card)
+	}
+	// the likelihood peaks at about k/U(k), just above (k-1)/U(k)
+	ratio := kmv.Estimate(MaximumLikelihood) / kmv.Estimate(Classic)
+	assert.T(t, ratio > 1 && ratio < 1.002, ratio)
+
+	small := NewKMinValues(1000)
+	for i := 0; i < 500; i++ {
+		small.AddHash(GetHash([]byte(fmt.Sprintf("%d", i))))
+	}
+	assert.Equal(t, small.Estimate(MaximumLikelihood), 500.0)
+	assert.Equal(t, math.Round(small.Estimate(BiasCorrected)), 500.0)
+
+	// half of a 32bit hash space holds the hashes of about 0.69 * 2^32 values
+	assert.Equal(t, math.Round(uncollide(1<<31, 32)/1e6), math.Round(math.Ln2*(1<<32)/1e6))
+
+	estimator, err := ParseEstimator("")
+	assert.Equal(t, estimator, Classic)
+	_, err = ParseEstimator("median")
+	assert.Equal(t, err, InvalidEstimator)
+}
+
+func TestKMinValues128Bit(t *testing.T) {
+	kmv, err := NewKMinValuesWidth(1000, 128)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, kmv.HashWidth(), 128)
+
+	for i := 0; i < 5000; i++ {
+		kmv.AddHash128(GetRandHash(), GetRandHash())
+	}
+	assert.Equal(t, len(kmv.raw), 1000*bytesUint128)
+
+	// 128bit hashes are never compressed, whose deltas don't fit a varint
+	assert.Equal(t, kmv.CompressedBytes(), kmv.Bytes())
+	kmv2, err := KMinValuesFromBytes(kmv.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, kmv2.HashWidth(), 128)
+	assert.Equal(t, kmv2.raw, kmv.raw)
+	card, err := CardinalityFromBytes(kmv.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, card, kmv.Cardinality())
+
+	data, err := json.Marshal(kmv)
+	assert.Equal(t, err, nil)
+	kmv3 := &KMinValues{}
+	assert.Equal(t, json.Unmarshal(data, kmv3), nil)
+	assert.Equal(t, kmv3.raw, kmv.raw)
+}
+
+func TestKMinValues128BitCollisions(t *testing.T) {
+	wide, _ := NewKMinValuesWidth(5, 128)
+	narrow := NewKMinValues(5)
+	for _, kmv := range []*KMinValues{wide, narrow} {
+		kmv.AddHash128(0x0000000100000000, 2)
+		kmv.AddHash128(0x0000000100000000, 1)
+		kmv.AddHash128(0x0000000200000000, 0)
+	}
+	// the 64bit hashes collide but the 128bit ones don't
+	assert.Equal(t, narrow.Len(), 2)
+	assert.Equal(t, wide.Len(), 3)
+	assert.Equal(t, wide.Cardinality(), 3.0)
+	assert.Equal(t, wide.GetHash(1), uint64(0x0000000100000000))
+	assert.Equal(t, wide.HashDelta128(3, 4).raw, Hash128Bytes(3, 4))
+	assert.Equal(t, narrow.HashDelta128(3, 4).raw, Hash128Bytes(3, 0)[:bytesUint64])
+
+	// 64bit hashes find and remove the 128bit hashes they are the top of
+	assert.T(t, wide.FindHash(0x0000000100000000) >= 0)
+	assert.Equal(t, wide.FindHash(0x0000000300000000), -1)
+	assert.Equal(t, wide.RemoveHash(0x0000000200000000), true)
+	assert.Equal(t, wide.Len(), 2)
+
+	wide.Merge(narrow)
+	assert.Equal(t, wide.HashWidth(), 64)
+	assert.Equal(t, wide.Len(), 2)
+}
+
+func TestKMinValues128BitCardinality(t *testing.T) {
+	kmv, _ := NewKMinValuesWidth(1000, 128)
+	for i := 0; i < 50000; i++ {
+		h := mmh3.Hash128([]byte(fmt.Sprintf("%d", i)))
+		kmv.AddHash128(binary.LittleEndian.Uint64(h), binary.LittleEndian.Uint64(h[8:]))
+	}
+
+	card := kmv.Cardinality()
+	relError := math.Abs(card-50000.0) / 50000.0
+	if relError > 2*kmv.RelativeError() {
+		t.Errorf("Relative error too high: %f instead of %f", relError, kmv.RelativeError())
+	}
+	assert.Equal(t, kmv.Estimate(Classic), card)
+}
+
+func TestKMinValuesDeferDuplicates(t *testing.T) {
+	// every value is added three times, so a third of the adds are
+	// duplicates of hashes the sketch retains
+	for _, n := range []int{100, 1000, 50000} {
+		checked := NewKMinValues(1000)
+		deferred := NewKMinValues(1000)
+		deferred.SetDuplicatePolicy(DeferDuplicates)
+		checkedAdds, deferredAdds := 0, 0
+		for i := 0; i < 3*n; i++ {
+			hash := GetHash([]byte(fmt.Sprintf("%d", i%n)))
+			if checked.AddHash(hash) {
+				checkedAdds++
+			}
+			if deferred.AddHash(hash) {
+				deferredAdds++
+			}
+		}
+
+		// the sketches, and so the estimates, are identical; only AddHash
+		// over reports what it added
+		assert.Equal(t, deferred.Bytes(), checked.Bytes())
+		assert.Equal(t, deferred.Cardinality(), checked.Cardinality())
+		assert.T(t, deferredAdds >= checkedAdds, n)
+	}
+
+	kmv := NewKMinValues(10)
+	kmv.SetDuplicatePolicy(DeferDuplicates)
+	kmv.AddHash(3)
+	kmv.AddHash(3)
+	kmv.AddHash(1)
+	assert.Equal(t, len(kmv.deferred), 3*bytesUint64)
+	assert.Equal(t, kmv.Len(), 2)
+	assert.Equal(t, len(kmv.deferred), 0)
+	kmv.AddHash(2)
+	assert.Equal(t, kmv.FindHash(2), 1)
+
+	other := NewKMinValues(10)
+	other.SetDuplicatePolicy(DeferDuplicates)
+	other.AddHash(4)
+	kmv.Merge(other)
+	assert.Equal(t, kmv.Len(), 4)
+	assert.Equal(t, kmv.GetHash(0), uint64(4))
+}
+
+func TestKMinValuesFilter(t *testing.T) {
+	kmv := NewKMinValues(1000)
+	for i := 0; i < 5000; i++ {
+		kmv.AddHash(GetHash([]byte(fmt.Sprintf("%d", i))))
+	}
+	for i := 0; i < filterLookups; i++ {
+		kmv.FindHash(GetRandHash())
+	}
+	assert.NotEqual(t, kmv.filter.Load(), (*hashFilter)(nil))
+
+	// every retained hash is found, and most others are rejected without a
+	// search
+	for i := 0; i < kmv.Len(); i++ {
+		assert.Equal(t, kmv.FindHash(kmv.GetHash(i)), i)
+	}
+	rejected := 0
+	for i := 0; i < 10000; i++ {
+		if kmv.filterRejects(hashUint64ToBytes(GetRandHash() >> 12)) {
+			rejected++
+		}
+	}
+	assert.T(t, rejected > 9000, rejected)
+
+	// hashes added after the filter was built are found, and removed ones
+	// aren't
+	for i := 5000; i < 5300; i++ {
+		hash := GetHash([]byte(fmt.Sprintf("%d", i)))
+		if kmv.AddHash(hash) {
+			assert.T(t, kmv.FindHash(hash) >= 0)
+		}
+	}
+	removed := kmv.GetHash(kmv.Len() - 1)
+	assert.Equal(t, kmv.RemoveHash(removed), true)
+	assert.Equal(t, kmv.FindHash(removed), -1)
+
+	// 64bit lookups find the hashes of 128bit sketches
+	wide, _ := NewKMinValuesWidth(10, 128)
+	wide.AddHash128(1<<40, 7)
+	for i := 0; i < filterLookups; i++ {
+		wide.FindHash(GetRandHash())
+	}
+	assert.Equal(t, wide.FindHash(1<<40), 0)
+}
+
+// Sketches that nothing writes to can be searched from several goroutines at
+// once, even while the lookups build the filter, which -race checks
+func TestKMinValuesConcurrentLookups(t *testing.T) {
+	kmv := NewKMinValues(1000)
+	for i := 0; i < 5000; i++ {
+		kmv.AddHash(GetHash([]byte(fmt.Sprintf("%d", i))))
+	}
+	var wg sync.WaitGroup
+	found := make([]int, 8)
+	for g := range found {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 4*filterLookups; i++ {
+				if kmv.FindHash(kmv.GetHash(i)) == i {
+					found[g]++
+				}
+				kmv.FindHash(GetRandHash())
+			}
+		}(g)
+	}
+	wg.Wait()
+	for _, n := range found {
+		assert.Equal(t, n, 4*filterLookups)
+	}
+	assert.NotEqual(t, kmv.filter.Load(), (*hashFilter)(nil))
+}
+
+func TestKMinValuesAddMany(t *testing.T) {
+	for _, width := range []int{32, 64, 128} {
+		one, _ := NewKMinValuesWidth(100, width)
+		many, _ := NewKMinValuesWidth(100, width)
+		highs := make([]uint64, 500)
+		lows := make([]uint64, 500)
+		for i := range highs {
+			highs[i], lows[i] = GetRandHash(), GetRandHash()
+			one.AddHash128(highs[i], lows[i])
+		}
+
+		half, err := many.AddMany(highs[:250], lows[:250])
+		assert.Equal(t, err, nil)
+		assert.Equal(t, half.Len(), many.Len())
+		previous := Union(many)
+		delta, _ := many.AddMany(highs[250:], lows[250:])
+		assert.Equal(t, many.Bytes(), one.Bytes())
+		assert.Equal(t, Merge(previous, delta).Bytes(), many.Bytes())
+		again, _ := many.AddMany(highs, lows)
+		assert.Equal(t, again.Len(), 0)
+
+		// lows that don't match the hashes are refused
+		_, err = many.AddMany(highs, lows[:10])
+		assert.Equal(t, err, MismatchedLows)
+		assert.Equal(t, many.Bytes(), one.Bytes())
+	}
+
+	kmv := NewKMinValues(10)
+	kmv.AddMany([]uint64{3, 1, 2, 3}, nil)
+	assert.Equal(t, kmv.Len(), 3)
+	assert.Equal(t, kmv.GetHash(0), uint64(3))
+}
@@ -0,0 +1,66 @@
+package kminvalues
+
+import (
+	"sync"
+)
+
+// Buffers smaller than this aren't worth pooling
+const minPooledSize = 64
+
+// One pool per buffer capacity.  Sketches always size their buffers for a
+// full set of hashes, so there are only as many size classes as there are
+// different k and hash width combinations in use.
+var bufferPools sync.Map
+
+func bufferPool(size int) *sync.Pool {
+	if pool, found := bufferPools.Load(size); found {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{})
+	return pool.(*sync.Pool)
+}
+
+// Returns an empty buffer with a capacity of exactly size bytes, reusing one
+// given back with PutBuffer if there is one.
+func GetBuffer(size int) []byte {
+	if size < minPooledSize {
+		return make([]byte, 0, size)
+	}
+	if buf, ok := bufferPool(size).Get().([]byte); ok {
+		return buf[:0]
+	}
+	return make([]byte, 0, size)
+}
+
+// Gives a buffer back to be reused.  Nothing may hold on to the buffer
+// afterwards.
+func PutBuffer(buf []byte) {
+	if cap(buf) < minPooledSize {
+		return
+	}
+	bufferPool(cap(buf)).Put(buf[:0])
+}
+
+// Gives the buffer holding the hashes back to the pool if the sketch owns it
+func (kmv *KMinValues) recycle() {
+	if kmv.pooled {
+		PutBuffer(kmv.raw)
+	}
+	kmv.raw = nil
+	kmv.pooled = false
+}
+
+// Hands the memory of a sketch that is no longer needed back to be reused by
+// new sketches.  The sketch is empty afterwards.
+func (kmv *KMinValues) Release() {
+	kmv.recycle()
+	kmv.deferred = nil
+	kmv.dropFilter()
+}
+
+// Same as Bytes but the result comes from the buffer pool, sized for a full
+// sketch, and can be given back with PutBuffer once it's no longer needed.
+func (kmv *KMinValues) PooledBytes() []byte {
+	buf := GetBuffer(bytesUint64 + kmv.maxSize*kmv.hashSize)
+	return kmv.appendBytes(buf)
+}
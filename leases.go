@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Longest a lease lasts without being renewed
+const maxLeaseTTL = 24 * time.Hour
+
+var (
+	KeyLeased       = NewAPIError(409, "KEY_LEASED", "Key is leased to another producer", false)
+	StaleToken      = NewAPIError(409, "STALE_TOKEN", "Fencing token is not the key's current token", false)
+	InvalidToken    = NewAPIError(400, "INVALID_ARG_TOKEN", "Fencing tokens are positive integers", false)
+	FencingDisabled = NewAPIError(400, "FENCING_DISABLED", "Keys can only be leased with --fencing", false)
+)
+
+func leaseKey(key string) []byte {
+	return []byte(internalKeyPrefix + "lease:" + key)
+}
+
+// The lease of a key.  Tokens only grow, every producer acquiring the key
+// gets the next one, and records outlive the sets so deleting a key can't
+// hand out a token twice.
+type lease struct {
+	Key     string    `json:"key"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l lease) active(now time.Time) bool {
+	return l.Token != 0 && now.Before(l.Expires)
+}
+
+func readLease(batch *Batch, key string) (lease, error) {
+	data, err := batch.Get(leaseKey(key))
+	if err != nil || len(data) == 0 {
+		return lease{Key: key}, err
+	}
+	var l lease
+	err = json.Unmarshal(data, &l)
+	return l, err
+}
+
+// A write that is rejected if any of its keys is leased with a token other
+// than Token.  Writes given the token of an earlier lease are rejected even
+// once the lease lapsed, so a producer that lost its key can't write to it.
+type FencedRequest struct {
+	RequestCommand
+	Token   uint64
+	invalid bool
+}
+
+func (fr FencedRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if fr.invalid {
+		return nil, InvalidToken
+	}
+	now := time.Now()
+	for _, key := range fr.RequestKeys() {
+		l, err := readLease(batch, key)
+		if err != nil {
+			return nil, err
+		}
+		if fr.Token == 0 && l.active(now) {
+			return nil, KeyLeased
+		} else if fr.Token != 0 && fr.Token != l.Token {
+			return nil, StaleToken
+		}
+	}
+	return fr.RequestCommand.Execute(batch)
+}
+
+// Fences a write with its `token` parameter when --fencing is on
+func withFencing(request RequestCommand, reqParams url.Values) RequestCommand {
+	if !*fencingFlag {
+		return request
+	}
+	fenced := FencedRequest{RequestCommand: request}
+	if token_raw := reqParams.Get("token"); token_raw != "" {
+		token, err := strconv.ParseUint(token_raw, 10, 64)
+		fenced.Token, fenced.invalid = token, err != nil || token == 0
+	}
+	return fenced
+}
+
+// Acquires, renews or releases the lease of a key, storing it in Lease.  A
+// producer without a Token acquires the key unless it is leased, and one
+// with the key's current token renews its lease, or releases it.
+type LeaseRequest struct {
+	Key        string
+	TTL        time.Duration
+	Token      uint64
+	Release    bool
+	Lease      *lease
+	ResultChan chan Result
+}
+
+func (lr LeaseRequest) RequestKeys() []string { return []string{lr.Key} }
+
+func (lr LeaseRequest) WriteResult(result Result) {
+	result.Key = lr.Key
+	lr.ResultChan <- result
+}
+
+func (lr LeaseRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if lr.Key == "" {
+		return nil, NoKeySpecified
+	} else if isInternalKey([]byte(lr.Key)) {
+		return nil, InvalidKey
+	}
+	now := time.Now()
+	l, err := readLease(batch, lr.Key)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case lr.Token == 0 && l.active(now):
+		return nil, KeyLeased
+	case lr.Token == 0:
+		l.Token++
+		l.Expires = now.Add(lr.TTL)
+	case lr.Token != l.Token:
+		return nil, StaleToken
+	case lr.Release:
+		l.Expires = now
+	default:
+		l.Expires = now.Add(lr.TTL)
+	}
+	data, _ := json.Marshal(l)
+	batch.Put(leaseKey(lr.Key), data)
+	*lr.Lease = l
+	return nil, nil
+}
+
+// Leases `key` for `ttl` (default 1m, at most 24h) and returns its fencing
+// token.  With the `token` of the lease, the lease is renewed for another
+// `ttl`, or given up with `release=true`.
+func LeaseHandler(w http.ResponseWriter, r *http.Request) {
+	if !*fencingFlag {
+		HttpResultError(w, "", FencingDisabled)
+		return
+	}
+
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	ttl := time.Minute
+	if ttl_raw := reqParams.Get("ttl"); ttl_raw != "" {
+		ttl, err = time.ParseDuration(ttl_raw)
+		if err != nil || ttl <= 0 || ttl > maxLeaseTTL {
+			HttpError(w, 500, "INVALID_ARG_TTL")
+			return
+		}
+	}
+
+	var token uint64
+	if token_raw := reqParams.Get("token"); token_raw != "" {
+		token, err = strconv.ParseUint(token_raw, 10, 64)
+		if err != nil || token == 0 {
+			HttpResultError(w, key, InvalidToken)
+			return
+		}
+	}
+
+	release := false
+	if release_raw := reqParams.Get("release"); release_raw != "" {
+		release, err = strconv.ParseBool(release_raw)
+		if err != nil || release && token == 0 {
+			HttpError(w, 500, "INVALID_ARG_RELEASE")
+			return
+		}
+	}
+
+	var l lease
+	resultChan := make(chan Result, 1)
+	leaseRequest := LeaseRequest{
+		Key:        key,
+		TTL:        ttl,
+		Token:      token,
+		Release:    release,
+		Lease:      &l,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(FlushRequest{leaseRequest}); err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	if result := <-resultChan; result.Error != nil {
+		HttpResultError(w, key, result.Error)
+		return
+	}
+	HttpResponse(w, 200, l)
+}
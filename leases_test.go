@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLeases(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	*fencingFlag = true
+	defer func() { *fencingFlag = false }()
+
+	key := "_GOTEST_LEASE"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+		wo := levigo.NewWriteOptions()
+		defer wo.Close()
+		dispatcher.database.Delete(wo, leaseKey(key))
+	}()
+
+	acquire := func(query string) (int, lease) {
+		w := httptest.NewRecorder()
+		LeaseHandler(w, httptest.NewRequest("GET", "/lease?key="+key+query, nil))
+		var response struct{ Data lease }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Data
+	}
+	add := func(value, query string) int {
+		w := httptest.NewRecorder()
+		AddHandler(w, httptest.NewRequest("GET", "/add?key="+key+"&value="+value+query, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, add("a", ""), 200)
+	code, first := acquire("&ttl=1h")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, first.Token, uint64(1))
+	code, _ = acquire("")
+	assert.Equal(t, code, 409)
+
+	assert.Equal(t, add("b", ""), 409)
+	assert.Equal(t, add("b", fmt.Sprintf("&token=%d", first.Token)), 200)
+	assert.Equal(t, add("b", "&token=5"), 409)
+	assert.Equal(t, add("b", "&token=x"), 400)
+
+	code, renewed := acquire(fmt.Sprintf("&token=%d&ttl=2h", first.Token))
+	assert.Equal(t, code, 200)
+	assert.Equal(t, renewed.Token, first.Token)
+	assert.Equal(t, renewed.Expires.After(first.Expires), true)
+	code, _ = acquire(fmt.Sprintf("&token=%d&release=true", first.Token))
+	assert.Equal(t, code, 200)
+	assert.Equal(t, add("c", ""), 200)
+
+	// the old producer is fenced off once the key is leased again
+	code, second := acquire("")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, second.Token, uint64(2))
+	assert.Equal(t, add("d", fmt.Sprintf("&token=%d", first.Token)), 409)
+	assert.Equal(t, add("d", fmt.Sprintf("&token=%d", second.Token)), 200)
+
+	// the lease itself can't be deleted to get around it
+	w := httptest.NewRecorder()
+	DeleteHandler(w, httptest.NewRequest("DELETE", "/delete?key=%00lease:"+key, nil))
+	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, add("e", ""), 409)
+
+	var cardinality float64
+	var version uint64
+	dispatcher.Dispatch(CardinalityRequest{Key: key, Cardinality: &cardinality, Version: &version, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, cardinality, 4.0)
+}
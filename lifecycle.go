@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	lifecycleHooks *LifecycleHooks
+	UnknownEvent   = errors.New("Lifecycle events must be created or deleted")
+)
+
+type lifecycleEvent struct {
+	Event       string    `json:"event"`
+	Key         string    `json:"key"`
+	Seq         uint64    `json:"seq"`
+	Cardinality float64   `json:"cardinality"`
+	Time        time.Time `json:"time"`
+}
+
+// Posts an event to a webhook every time a key is created or deleted so that
+// catalogs of the keys can follow along.  Events are sent in order from a
+// subscription to the changes, so a webhook that falls too far behind misses
+// events rather than slowing down writes.
+type LifecycleHooks struct {
+	url     string
+	events  map[string]bool
+	updates chan Change
+	done    chan struct{}
+}
+
+// Parses a comma separated list of the events to send
+func parseLifecycleEvents(events_raw string) (map[string]bool, error) {
+	events := make(map[string]bool)
+	for _, event := range strings.Split(events_raw, ",") {
+		event = strings.TrimSpace(event)
+		if event != "created" && event != "deleted" {
+			return nil, UnknownEvent
+		}
+		events[event] = true
+	}
+	return events, nil
+}
+
+func NewLifecycleHooks(url string, events map[string]bool) *LifecycleHooks {
+	return &LifecycleHooks{
+		url:    url,
+		events: events,
+		done:   make(chan struct{}),
+	}
+}
+
+func (lh *LifecycleHooks) Start() {
+	lh.updates = changes.SubscribeAll(1024)
+	go func() {
+		defer close(lh.done)
+		for change := range lh.updates {
+			event := lifecycleEvent{Key: change.Key, Seq: change.Seq, Time: time.Now()}
+			if change.Kmv != nil && !change.Existed {
+				event.Event = "created"
+				event.Cardinality = change.Kmv.Cardinality()
+			} else if change.Kmv == nil && change.Existed {
+				event.Event = "deleted"
+			}
+			if !lh.events[event.Event] {
+				continue
+			}
+			if err := lh.send(event); err != nil {
+				log.Printf("Could not send %s event for %s: %s", event.Event, event.Key, err)
+			}
+		}
+	}()
+}
+
+// Stops listening for changes once the events already queued have been sent
+func (lh *LifecycleHooks) Stop() {
+	changes.Unsubscribe(lh.updates)
+	<-lh.done
+}
+
+func (lh *LifecycleHooks) send(event lifecycleEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(lh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLifecycleHooks(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	received := make(chan lifecycleEvent, 8)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event lifecycleEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer webhook.Close()
+
+	events, err := parseLifecycleEvents("created, deleted")
+	assert.Equal(t, err, nil)
+	_, err = parseLifecycleEvents("created,expired")
+	assert.Equal(t, err, UnknownEvent)
+
+	hooks := NewLifecycleHooks(webhook.URL, events)
+	hooks.Start()
+
+	key := "_GOTEST_LIFECYCLE"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kminvalues.NewKMinValues(4), ResultChan: resultChan})
+	<-resultChan
+	dispatcher.Dispatch(AddHashRequest{Key: key, Hash: 1 << 60, ResultChan: resultChan})
+	<-resultChan
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	hooks.Stop()
+
+	// Deleting a missing key and updating an existing one send nothing
+	assert.Equal(t, len(received), 2)
+	created, deleted := <-received, <-received
+	assert.Equal(t, created.Event, "created")
+	assert.Equal(t, created.Key, key)
+	assert.Equal(t, deleted.Event, "deleted")
+	assert.Equal(t, deleted.Seq > created.Seq, true)
+}
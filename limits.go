@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/jmhodges/levigo"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	KeyLimitReached = NewAPIError(403, "KEY_LIMIT_REACHED", "Maximum number of keys reached", false)
+	SketchTooLarge  = NewAPIError(400, "K_TOO_LARGE", "Set size is larger than the maximum k", false)
+)
+
+// Number of keys in the DB, including keys created by batches that are still
+// being built.  Only kept up to date while --max-keys is set.
+var keyCount int64
+
+func keyLimitEnabled() bool {
+	return *maxKeys > 0
+}
+
+// Takes one of the --max-keys slots for a new key
+func reserveKey() error {
+	if atomic.AddInt64(&keyCount, 1) > int64(*maxKeys) {
+		atomic.AddInt64(&keyCount, -1)
+		return KeyLimitReached
+	}
+	return nil
+}
+
+func releaseKeys(n int) {
+	if n != 0 {
+		atomic.AddInt64(&keyCount, -int64(n))
+	}
+}
+
+// Counts the keys already in the DB so the key limit can be enforced
+func countKeys(database *levigo.DB) int64 {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+
+	it := database.NewIterator(ro)
+	defer it.Close()
+
+	var n int64
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !isInternalKey(it.Key()) {
+			n++
+		}
+	}
+	return n
+}
+
+// Responds to a value that is too long to add and returns false, or returns
+// true if the value is fine
+func checkValueLength(w http.ResponseWriter, value string) bool {
+	if *maxValueLength > 0 && len(value) > *maxValueLength {
+		HttpError(w, 413, "VALUE_TOO_LONG")
+		return false
+	}
+	return true
+}
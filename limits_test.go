@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	keys := make([]string, 3)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("_GOTEST_LIMITS%d", i)
+	}
+	resultChan := make(chan Result)
+	clean := func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}
+	clean()
+	defer clean()
+
+	*maxKeys, *maxK, *maxValueLength = 2, 2048, 5
+	keyCount = 0
+	defer func() { *maxKeys, *maxK, *maxValueLength = 0, 0, 0 }()
+
+	add := func(key string) error {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		return (<-resultChan).Error
+	}
+	assert.Equal(t, add(keys[0]), nil)
+	assert.Equal(t, add(keys[0]), nil)
+	assert.Equal(t, add(keys[1]), nil)
+	assert.Equal(t, add(keys[2]), KeyLimitReached)
+	assert.Equal(t, keyCount, int64(2))
+
+	// a multi key add that fails half way gives back the keys it reserved
+	dispatcher.Dispatch(MultiAddHashRequest{Keys: []string{keys[0], keys[2]}, Hash: 1, ResultChan: resultChan})
+	assert.Equal(t, (<-resultChan).Error, KeyLimitReached)
+	assert.Equal(t, keyCount, int64(2))
+
+	// as does an add whose key policy fails before anything was written
+	keyPolicies = KeyPolicies{keys[2]: {Tags: map[string]string{"team": "growth"}}}
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	dispatcher.database.Put(wo, tagsKey(keys[2]), []byte("corrupt"))
+	dispatcher.Dispatch(DeleteRequest{Key: keys[1], ResultChan: resultChan})
+	<-resultChan
+	assert.NotEqual(t, add(keys[2]), nil)
+	keyPolicies = nil
+	dispatcher.database.Delete(wo, tagsKey(keys[2]))
+	assert.Equal(t, keyCount, int64(1))
+	assert.Equal(t, add(keys[2]), nil)
+
+	dispatcher.Dispatch(SetRequest{Key: keys[1], Kmv: kminvalues.NewKMinValues(4096), ResultChan: resultChan})
+	assert.Equal(t, (<-resultChan).Error, SketchTooLarge)
+
+	w := httptest.NewRecorder()
+	AddHandler(w, httptest.NewRequest("GET", "/add?key=foo&value=toolong", nil))
+	assert.Equal(t, w.Code, 413)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Prefix of listen addresses that are UNIX domain sockets
+const unixPrefix = "unix:"
+
+type listenAddress struct {
+	Network string
+	Address string
+}
+
+// Parses a comma separated list of listen addresses, eg:
+// 127.0.0.1:8080,unix:/run/gocountme.sock, into the network and address of
+// each
+func parseListenAddresses(addresses_raw string) []listenAddress {
+	var addresses []listenAddress
+	for _, address := range strings.Split(addresses_raw, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if path := strings.TrimPrefix(address, unixPrefix); path != address {
+			addresses = append(addresses, listenAddress{"unix", path})
+		} else {
+			addresses = append(addresses, listenAddress{"tcp", address})
+		}
+	}
+	return addresses
+}
+
+// Listens on every address.  A socket file left behind by a previous run is
+// replaced and new socket files get mode.  If any address can't be listened
+// on, the listeners already opened are closed.
+func listenAll(addresses []listenAddress, mode os.FileMode) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := listen(address.Network, address.Address, mode)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func listen(network, address string, mode os.FileMode) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Removes the socket files of the UNIX addresses, once the server is done
+// with them
+func removeSockets(addresses []listenAddress) {
+	for _, address := range addresses {
+		if address.Network == "unix" {
+			os.Remove(address.Address)
+		}
+	}
+}
+
+// Closing a UNIX listener also removes its socket file
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
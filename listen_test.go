@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenAddresses(t *testing.T) {
+	addresses := parseListenAddresses(" 127.0.0.1:8080, unix:/run/gocountme.sock,,:9090")
+	assert.Equal(t, addresses, []listenAddress{
+		{"tcp", "127.0.0.1:8080"},
+		{"unix", "/run/gocountme.sock"},
+		{"tcp", ":9090"},
+	})
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocountme")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gocountme.sock")
+
+	// a socket file left behind is replaced
+	stale, err := net.Listen("unix", path)
+	assert.Equal(t, err, nil)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	addresses := []listenAddress{{"unix", path}}
+	listeners, err := listenAll(addresses, 0600)
+	assert.Equal(t, err, nil)
+	info, err := os.Stat(path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) { HttpResponse(w, 200, "OK") })
+	go http.Serve(listeners[0], mux)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://gocountme/info")
+	assert.Equal(t, err, nil)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+
+	removeSockets(addresses)
+	_, err = os.Stat(path)
+	assert.Equal(t, os.IsNotExist(err), true)
+	closeListeners(listeners)
+}
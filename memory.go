@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// How often the heap is checked against --memory-limit
+const memoryCheckInterval = time.Second
+
+var (
+	memoryGuard    = NewMemoryGuard(0)
+	MemoryPressure = NewAPIError(503, "MEMORY_PRESSURE", "Server is low on memory", true)
+)
+
+type memoryUsage struct {
+	Limit         int64            `json:"limit"`
+	Heap          int64            `json:"heap"`
+	UnderPressure bool             `json:"under_pressure"`
+	Pressured     uint64           `json:"pressured"`
+	Components    map[string]int64 `json:"components"`
+}
+
+// Keeps the heap under a ceiling.  Once the heap grows past the limit caches
+// are purged and new requests are refused with MemoryPressure, which clients
+// retry, until it is back under 90% of the limit.  That way the server sheds
+// load well before the OOM killer gets involved.
+type MemoryGuard struct {
+	limit     int64
+	pressure  int32
+	pressured uint64
+	stop      chan struct{}
+}
+
+func NewMemoryGuard(limit int64) *MemoryGuard {
+	return &MemoryGuard{limit: limit, stop: make(chan struct{})}
+}
+
+func (mg *MemoryGuard) Start() {
+	go func() {
+		ticker := time.NewTicker(memoryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mg.check(heapBytes())
+			case <-mg.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (mg *MemoryGuard) Stop() {
+	close(mg.stop)
+}
+
+func (mg *MemoryGuard) UnderPressure() bool {
+	return atomic.LoadInt32(&mg.pressure) != 0
+}
+
+func (mg *MemoryGuard) check(heap int64) {
+	if mg.limit <= 0 {
+		return
+	}
+	if heap > mg.limit && !mg.UnderPressure() {
+		atomic.StoreInt32(&mg.pressure, 1)
+		atomic.AddUint64(&mg.pressured, 1)
+		log.Printf("Heap of %d bytes is over the memory limit of %d, shedding load", heap, mg.limit)
+		intersections.Purge()
+		runtime.GC()
+	} else if heap < mg.limit/10*9 && mg.UnderPressure() {
+		atomic.StoreInt32(&mg.pressure, 0)
+		log.Printf("Heap of %d bytes is back under the memory limit", heap)
+	}
+}
+
+func heapBytes() int64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+// Approximate bytes of the hashes of a set
+func sketchMemory(kmv *kminvalues.KMinValues) int64 {
+	if kmv == nil {
+		return 0
+	}
+	return int64(kmv.Len() * kmv.HashWidth() / 8)
+}
+
+// Breaks the heap down into what the caches, changelog and queued requests
+// hold, each queued request being counted as a set of --default-size since it
+// is about to read one.  The rest, including the sets of requests being
+// executed, is other.
+func (mg *MemoryGuard) Usage() memoryUsage {
+	usage := memoryUsage{
+		Limit:         mg.limit,
+		Heap:          heapBytes(),
+		UnderPressure: mg.UnderPressure(),
+		Pressured:     atomic.LoadUint64(&mg.pressured),
+		Components:    make(map[string]int64),
+	}
+	queues := getQueueStats()
+	usage.Components["intersection_cache"] = intersections.memoryBytes()
+	usage.Components["changelog"] = changes.memoryBytes()
+	usage.Components["queued_requests"] = int64((queues.Depth + queues.ReadDepth) * *defaultSize * 8)
+	other := usage.Heap
+	for _, bytes := range usage.Components {
+		other -= bytes
+	}
+	if other < 0 {
+		other = 0
+	}
+	usage.Components["other"] = other
+	return usage
+}
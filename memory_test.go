@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMemoryGuard(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	defer func(cache *IntersectionCache) { intersections = cache }(intersections)
+	defer func() { memoryGuard = NewMemoryGuard(0) }()
+
+	intersections = NewIntersectionCache(10)
+	a, b := cacheTestSet(0, 100), cacheTestSet(50, 100)
+	intersections.Intersect(a, b)
+	assert.Equal(t, intersections.memoryBytes() > 0, true)
+
+	memoryGuard = NewMemoryGuard(1000)
+	memoryGuard.check(999)
+	assert.Equal(t, memoryGuard.UnderPressure(), false)
+
+	memoryGuard.check(1001)
+	assert.Equal(t, memoryGuard.UnderPressure(), true)
+	assert.Equal(t, intersections.Stats().Entries, 0)
+	assert.Equal(t, intersections.Stats().Evictions, uint64(1))
+
+	w := httptest.NewRecorder()
+	CardinalityHandler(w, httptest.NewRequest("GET", "/cardinality?key=_GOTEST_MEMORY", nil))
+	assert.Equal(t, w.Code, 503)
+	assert.Equal(t, decodeError(t, w).Error.Code, "MEMORY_PRESSURE")
+	assert.NotEqual(t, w.Header().Get("Retry-After"), "")
+
+	// pressure only lets up well under the limit
+	memoryGuard.check(950)
+	assert.Equal(t, memoryGuard.UnderPressure(), true)
+	memoryGuard.check(899)
+	assert.Equal(t, memoryGuard.UnderPressure(), false)
+
+	usage := memoryGuard.Usage()
+	assert.Equal(t, usage.Pressured, uint64(1))
+	assert.Equal(t, usage.Limit, int64(1000))
+	assert.Equal(t, usage.Heap > 0, true)
+}
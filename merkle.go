@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	merkleFanout = 16
+
+	// Trees are rebuilt at most this often so that a peer descending one sees
+	// the same tree at every level
+	merkleTreeMaxAge = 30 * time.Second
+
+	// Number of nodes or leaves asked of a peer in one request
+	merkleBatch = 256
+)
+
+var (
+	merkleCache     *merkleTree
+	merkleCacheLock sync.Mutex
+	DepthMismatch   = errors.New("Peer's merkle tree has a different depth")
+)
+
+type merkleNodes struct {
+	Depth    int                 `json:"depth"`
+	Level    int                 `json:"level"`
+	Children map[string][]uint64 `json:"children"`
+}
+
+type merkleSet struct {
+	Key string                       `json:"key"`
+	Set *kminvalues.Base64KMinValues `json:"set"`
+}
+
+// A set as read back from the /merkle/sets of a peer
+type peerSet struct {
+	Key string                 `json:"key"`
+	Set *kminvalues.KMinValues `json:"set"`
+}
+
+// Summarizes the sets as a tree each of whose nodes hashes its merkleFanout
+// children.  Keys are spread over the merkleFanout^depth leaves by the hash of
+// the key and each leaf is the XOR of the hashes of its keys and their sets,
+// so the tree can be built in a single unordered scan.  Two instances holding
+// the same sets have the same tree, and comparing trees from the root down
+// finds the leaves that differ by exchanging only the nodes along the way.
+type merkleTree struct {
+	depth  int
+	levels [][]uint64 // levels[0] is the root, levels[depth] the leaves
+	built  time.Time
+}
+
+func merkleLeaf(key []byte, depth int) int {
+	leaves := 1
+	for i := 0; i < depth; i++ {
+		leaves *= merkleFanout
+	}
+	return int(Hashify(key) % uint64(leaves))
+}
+
+func buildMerkleTree(database *levigo.DB, depth int) (*merkleTree, error) {
+	tree := &merkleTree{depth: depth, levels: make([][]uint64, depth+1), built: time.Now()}
+	width := 1
+	for level := range tree.levels {
+		tree.levels[level] = make([]uint64, width)
+		width *= merkleFanout
+	}
+
+	leaves := tree.levels[depth]
+	h := fnv.New64a()
+	err := scanKeys(database, nil, nil, func(key, data []byte, kmv *kminvalues.KMinValues) bool {
+		h.Reset()
+		h.Write(key)
+		h.Write([]byte{0})
+		// Peers may store their sets compressed or not
+		h.Write(kmv.Bytes())
+		leaves[merkleLeaf(key, depth)] ^= h.Sum64()
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf [8]byte
+	for level := depth - 1; level >= 0; level-- {
+		for i := range tree.levels[level] {
+			h.Reset()
+			for _, child := range tree.levels[level+1][i*merkleFanout : (i+1)*merkleFanout] {
+				binary.BigEndian.PutUint64(buf[:], child)
+				h.Write(buf[:])
+			}
+			tree.levels[level][i] = h.Sum64()
+		}
+	}
+	return tree, nil
+}
+
+// Returns the latest tree, building a new one if it's older than
+// merkleTreeMaxAge
+func currentMerkleTree(database *levigo.DB) (*merkleTree, error) {
+	merkleCacheLock.Lock()
+	defer merkleCacheLock.Unlock()
+	if merkleCache == nil || merkleCache.depth != *merkleDepth || time.Since(merkleCache.built) > merkleTreeMaxAge {
+		tree, err := buildMerkleTree(database, *merkleDepth)
+		if err != nil {
+			return nil, err
+		}
+		merkleCache = tree
+	}
+	return merkleCache, nil
+}
+
+func (tree *merkleTree) children(level, node int) []uint64 {
+	return tree.levels[level+1][node*merkleFanout : (node+1)*merkleFanout]
+}
+
+// Finds the leaves where the peer's tree differs from ours and merges the
+// peer's sets in those leaves into ours.  Returns the number of leaves that
+// differed and the number of sets merged.
+func (pf *peerFollower) repair(ctx context.Context, database *levigo.DB) (int, int, error) {
+	tree, err := currentMerkleTree(database)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	nodes := []int{0}
+	for level := 0; level < tree.depth && len(nodes) != 0; level++ {
+		var differing []int
+		for _, batch := range batches(nodes) {
+			theirs, err := pf.merkleChildren(level, batch)
+			if err != nil {
+				return 0, 0, err
+			}
+			if theirs.Depth != tree.depth {
+				return 0, 0, DepthMismatch
+			}
+			for _, node := range batch {
+				children := theirs.Children[strconv.Itoa(node)]
+				ours := tree.children(level, node)
+				for i := range ours {
+					if i >= len(children) || children[i] != ours[i] {
+						differing = append(differing, node*merkleFanout+i)
+					}
+				}
+			}
+			if ctx.Err() != nil {
+				return 0, 0, ctx.Err()
+			}
+		}
+		nodes = differing
+	}
+
+	merged := 0
+	resultChan := make(chan Result)
+	for _, batch := range batches(nodes) {
+		sets, err := pf.merkleSets(batch)
+		if err != nil {
+			return len(nodes), merged, err
+		}
+		for _, set := range sets {
+			dispatcher.Dispatch(MergeRequest{
+				Key:           set.Key,
+				Kmv:           set.Set,
+				SkipUnchanged: true,
+				ResultChan:    resultChan,
+			})
+			if result := <-resultChan; result.Error != nil {
+				return len(nodes), merged, fmt.Errorf("could not merge %s: %s", set.Key, result.Error)
+			}
+			merged++
+		}
+		if ctx.Err() != nil {
+			return len(nodes), merged, ctx.Err()
+		}
+	}
+	return len(nodes), merged, nil
+}
+
+// Splits nodes into batches of at most merkleBatch
+func batches(nodes []int) [][]int {
+	var split [][]int
+	for len(nodes) > merkleBatch {
+		split = append(split, nodes[:merkleBatch])
+		nodes = nodes[merkleBatch:]
+	}
+	if len(nodes) != 0 {
+		split = append(split, nodes)
+	}
+	return split
+}
+
+func (pf *peerFollower) merkleChildren(level int, nodes []int) (*merkleNodes, error) {
+	query := url.Values{"level": {strconv.Itoa(level)}}
+	for _, node := range nodes {
+		query.Add("node", strconv.Itoa(node))
+	}
+	var theirs merkleNodes
+	err := pf.getJSON("/merkle?"+query.Encode(), &theirs)
+	return &theirs, err
+}
+
+func (pf *peerFollower) merkleSets(leaves []int) ([]peerSet, error) {
+	query := url.Values{}
+	for _, leaf := range leaves {
+		query.Add("leaf", strconv.Itoa(leaf))
+	}
+	var sets []peerSet
+	err := pf.getJSON("/merkle/sets?"+query.Encode(), &sets)
+	return sets, err
+}
+
+func (pf *peerFollower) getJSON(path string, v interface{}) error {
+	resp, err := notifyClient.Get(pf.url + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	response := struct {
+		Data interface{} `json:"data"`
+	}{v}
+	return json.NewDecoder(resp.Body).Decode(&response)
+}
+
+// Returns the hashes of the children of every `node` at `level` of the tree,
+// level 0 being the root
+func MerkleHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	tree, err := currentMerkleTree(dispatcher.database)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+
+	level, err := strconv.Atoi(reqParams.Get("level"))
+	if err != nil || level < 0 || level >= tree.depth {
+		HttpError(w, 500, "INVALID_ARG_LEVEL")
+		return
+	}
+
+	response := merkleNodes{
+		Depth:    tree.depth,
+		Level:    level,
+		Children: make(map[string][]uint64, len(reqParams["node"])),
+	}
+	for _, node_raw := range reqParams["node"] {
+		node, err := strconv.Atoi(node_raw)
+		if err != nil || node < 0 || node >= len(tree.levels[level]) {
+			HttpError(w, 500, "INVALID_ARG_NODE")
+			return
+		}
+		response.Children[strconv.Itoa(node)] = tree.children(level, node)
+	}
+	HttpResponse(w, 200, response)
+}
+
+// Returns the key and set of everything stored under every `leaf` of the tree
+func MerkleSetsHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	tree, err := currentMerkleTree(dispatcher.database)
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+
+	leaves := make(map[int]bool, len(reqParams["leaf"]))
+	for _, leaf_raw := range reqParams["leaf"] {
+		leaf, err := strconv.Atoi(leaf_raw)
+		if err != nil || leaf < 0 || leaf >= len(tree.levels[tree.depth]) {
+			HttpError(w, 500, "INVALID_ARG_LEAF")
+			return
+		}
+		leaves[leaf] = true
+	}
+
+	sets := make([]merkleSet, 0)
+	if len(leaves) != 0 {
+		err = scanKeys(dispatcher.database, nil, nil, func(key, data []byte, kmv *kminvalues.KMinValues) bool {
+			if leaves[merkleLeaf(key, tree.depth)] {
+				sets = append(sets, merkleSet{string(key), &kminvalues.Base64KMinValues{KMinValues: kmv}})
+			}
+			return true
+		})
+		if err != nil {
+			HttpResultError(w, "", err)
+			return
+		}
+	}
+	HttpResponse(w, 200, sets)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestMerkleRepair(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	defer func() { merkleCache = nil }()
+
+	keys := []string{"_GOTEST_MERKLE_A", "_GOTEST_MERKLE_B"}
+	resultChan := make(chan Result)
+	set := func(key string, hashes ...uint64) *kminvalues.KMinValues {
+		kmv := kminvalues.NewKMinValues(16)
+		for _, hash := range hashes {
+			kmv.AddHash(hash)
+		}
+		dispatcher.Dispatch(SetRequest{Key: key, Kmv: kmv, ResultChan: resultChan})
+		<-resultChan
+		return kmv
+	}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	// The peer has a hash in B that we are missing
+	set(keys[0], 1<<60)
+	peerB := set(keys[1], 1<<60, 2<<60)
+	peerTree, err := buildMerkleTree(dispatcher.database, *merkleDepth)
+	assert.Equal(t, err, nil)
+	set(keys[1], 1<<60)
+	ourTree, _ := buildMerkleTree(dispatcher.database, *merkleDepth)
+	for level := 0; level < *merkleDepth; level++ {
+		differing := 0
+		for i := range ourTree.levels[level] {
+			if ourTree.levels[level][i] != peerTree.levels[level][i] {
+				differing++
+			}
+		}
+		assert.Equal(t, differing, 1)
+	}
+
+	var leavesAsked []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := url.ParseQuery(r.URL.RawQuery)
+		if r.URL.Path == "/merkle/sets" {
+			leavesAsked = append(leavesAsked, query["leaf"]...)
+			HttpResponse(w, 200, []merkleSet{{keys[1], &kminvalues.Base64KMinValues{KMinValues: peerB}}})
+			return
+		}
+		level, _ := strconv.Atoi(query.Get("level"))
+		response := merkleNodes{Depth: peerTree.depth, Level: level, Children: map[string][]uint64{}}
+		for _, node_raw := range query["node"] {
+			node, _ := strconv.Atoi(node_raw)
+			response.Children[node_raw] = peerTree.children(level, node)
+		}
+		HttpResponse(w, 200, response)
+	}))
+	defer peer.Close()
+
+	pf := NewReplicator([]string{peer.URL}, 0, 0).peers[0]
+	merkleCache = nil
+	leaves, merged, err := pf.repair(context.Background(), dispatcher.database)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, leaves, 1)
+	assert.Equal(t, merged, 1)
+	assert.Equal(t, leavesAsked, []string{strconv.Itoa(merkleLeaf([]byte(keys[1]), *merkleDepth))})
+
+	dispatcher.Dispatch(GetRequest{Key: keys[1], ResultChan: resultChan})
+	result := <-resultChan
+	assert.Equal(t, result.Data.Bytes(), peerB.Bytes())
+
+	// Once repaired the trees agree
+	merkleCache = nil
+	ourTree, _ = currentMerkleTree(dispatcher.database)
+	assert.Equal(t, ourTree.levels[0], peerTree.levels[0])
+}
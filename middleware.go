@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wraps the handling of every request, eg: to authenticate or log it
+type Middleware func(http.Handler) http.Handler
+
+var (
+	middlewareLock sync.Mutex
+	middlewares    = map[string]Middleware{
+		"cors":    corsMiddleware,
+		"logging": loggingMiddleware,
+	}
+)
+
+// Makes a middleware available to --middleware under name.  Deployments can
+// add their own by dropping a file calling this from init() into the build.
+func RegisterMiddleware(name string, middleware Middleware) {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+	middlewares[name] = middleware
+}
+
+// Wraps handler in the comma separated middlewares, the first listed being
+// the first to see requests
+func withMiddleware(names_raw string, handler http.Handler) (http.Handler, error) {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+
+	var chain []Middleware
+	for _, name := range strings.Split(names_raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		middleware, found := middlewares[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown middleware %q", name)
+		}
+		chain = append(chain, middleware)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler, nil
+}
+
+// Logs every request with its status and how long it took
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(recorder, r)
+		log.Printf("%s %s %s %d %s", r.RemoteAddr, r.Method, r.URL.RequestURI(), recorder.status, time.Since(start))
+	})
+}
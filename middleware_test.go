@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	RegisterMiddleware("test-first", tag("first"))
+	RegisterMiddleware("test-second", tag("second"))
+
+	handler, err := withMiddleware("test-second, test-first,logging", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+		w.WriteHeader(204)
+		w.(http.Flusher).Flush()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/cardinality?key=a", nil))
+
+	if len(order) != 3 || order[0] != "second" || order[1] != "first" || order[2] != "handler" {
+		t.Errorf("Wrong middleware order: %v", order)
+	}
+	if w.Code != 204 || !w.Flushed {
+		t.Errorf("Response not passed through: %d flushed=%v", w.Code, w.Flushed)
+	}
+}
+
+func TestMiddlewareUnknown(t *testing.T) {
+	if _, err := withMiddleware("logging,nope", http.DefaultServeMux); err == nil {
+		t.Error("Unknown middleware accepted")
+	}
+	handler, err := withMiddleware("", http.DefaultServeMux)
+	if err != nil || handler != http.DefaultServeMux {
+		t.Error("No middleware should leave the handler alone")
+	}
+}
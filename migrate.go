@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"log"
+	"os"
+)
+
+// Records copied per write by migrateStore
+const migrateBatchSize = 1000
+
+// The storage engines stores can be migrated between.  LevelDB is the only
+// one gocountme is built with, so for now a migration rewrites a store into a
+// fresh LevelDB, eg: to drop the garbage of a store that has seen many
+// deletes, and leaves room for other engines.
+var migrationBackends = map[string]bool{"leveldb": true}
+
+type migrationStats struct {
+	Records int
+	Bytes   int
+}
+
+// Copies every record, internal records included, from a snapshot of source
+// into target and checks that target holds the same value for every key.
+// Values are copied as stored, so encrypted sets stay encrypted.
+func migrateStore(source, target *levigo.DB) (migrationStats, error) {
+	var stats migrationStats
+	snapshot := source.NewSnapshot()
+	defer source.ReleaseSnapshot(snapshot)
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snapshot)
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+
+	it := source.NewIterator(ro)
+	defer it.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	batched := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		value := it.Value()
+		wb.Put(it.Key(), value)
+		stats.Records++
+		stats.Bytes += len(value)
+		if batched++; batched == migrateBatchSize {
+			if err := target.Write(wo, wb); err != nil {
+				return stats, err
+			}
+			wb.Clear()
+			batched = 0
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return stats, err
+	}
+	if err := target.Write(wo, wb); err != nil {
+		return stats, err
+	}
+	return stats, verifyMigration(source, target, ro)
+}
+
+// Compares the checksum of every record of source, as read with ro, with the
+// same record in target
+func verifyMigration(source, target *levigo.DB, ro *levigo.ReadOptions) error {
+	targetRo := levigo.NewReadOptions()
+	defer targetRo.Close()
+	targetRo.SetFillCache(false)
+
+	it := source.NewIterator(ro)
+	defer it.Close()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		copied, err := target.Get(targetRo, it.Key())
+		if err != nil {
+			return err
+		}
+		if copied == nil || dataVersion(copied) != dataVersion(it.Value()) {
+			return fmt.Errorf("Migrated store differs from the original at %q", it.Key())
+		}
+	}
+	return it.GetError()
+}
+
+// Moves the migrated store at to into the place of the store at from, which
+// is kept next to it with a .pre-migration suffix
+func cutover(from, to string) error {
+	backup := from + ".pre-migration"
+	if err := os.Rename(from, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(to, from); err != nil {
+		os.Rename(backup, from)
+		return err
+	}
+	log.Printf("Moved %s to %s and %s to %s", from, backup, to, from)
+	return nil
+}
+
+// `gocountme migrate --from-db old --to-db new` copies a store into a new one
+// and, with --cutover, swaps them once the copy is verified.  The server must
+// not have either store open.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.String("from", "leveldb", "Storage engine of the store migrated from")
+	to := flags.String("to", "leveldb", "Storage engine of the store migrated to")
+	fromDB := flags.String("from-db", "", "Location of the store migrated from")
+	toDB := flags.String("to-db", "", "Location of the new store, which must not exist yet")
+	swap := flags.Bool("cutover", false, "Move the new store into the place of the old one once verified")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	for _, backend := range []string{*from, *to} {
+		if !migrationBackends[backend] {
+			return fmt.Errorf("Unknown storage engine %q, only leveldb is built in", backend)
+		}
+	}
+	if *fromDB == "" || *toDB == "" {
+		return fmt.Errorf("--from-db and --to-db are required")
+	}
+
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	source, err := levigo.Open(*fromDB, opts)
+	if err != nil {
+		return err
+	}
+
+	targetOpts := levigo.NewOptions()
+	defer targetOpts.Close()
+	targetOpts.SetCreateIfMissing(true)
+	targetOpts.SetErrorIfExists(true)
+	target, err := levigo.Open(*toDB, targetOpts)
+	if err != nil {
+		source.Close()
+		return err
+	}
+	stats, err := migrateStore(source, target)
+	target.Close()
+	source.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated and verified %d records (%d bytes) from %s to %s", stats.Records, stats.Bytes, *fromDB, *toDB)
+
+	if *swap {
+		return cutover(*fromDB, *toDB)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateStore(t *testing.T) {
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	source, err := levigo.Open("./db/migrate-source", opts)
+	assert.Equal(t, err, nil)
+	target, err := levigo.Open("./db/migrate-target", opts)
+	assert.Equal(t, err, nil)
+	defer func() {
+		source.Close()
+		target.Close()
+		levigo.DestroyDatabase("./db/migrate-source", opts)
+		levigo.DestroyDatabase("./db/migrate-target", opts)
+	}()
+
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	records := map[string]string{"a": "1", "b": "22", string(summaryKey("a")): "333"}
+	for key, value := range records {
+		source.Put(wo, []byte(key), []byte(value))
+	}
+
+	stats, err := migrateStore(source, target)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, stats, migrationStats{Records: 3, Bytes: 6})
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	for key, value := range records {
+		copied, _ := target.Get(ro, []byte(key))
+		assert.Equal(t, string(copied), value)
+	}
+
+	target.Put(wo, []byte("b"), []byte("changed"))
+	assert.NotEqual(t, verifyMigration(source, target, ro), nil)
+	target.Delete(wo, []byte("b"))
+	assert.NotEqual(t, verifyMigration(source, target, ro), nil)
+}
+
+func TestMigrateCutover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocountme-migrate")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+	from, to := filepath.Join(dir, "db"), filepath.Join(dir, "db.new")
+	os.Mkdir(from, 0755)
+	os.Mkdir(to, 0755)
+	ioutil.WriteFile(filepath.Join(to, "CURRENT"), []byte("new"), 0644)
+
+	assert.Equal(t, cutover(from, to), nil)
+	data, _ := ioutil.ReadFile(filepath.Join(from, "CURRENT"))
+	assert.Equal(t, string(data), "new")
+	_, err = os.Stat(from + ".pre-migration")
+	assert.Equal(t, err, nil)
+
+	assert.NotEqual(t, runMigrate([]string{"--to", "badger", "--from-db", from, "--to-db", to}), nil)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Largest body a mirrored request can have, bigger ones aren't mirrored
+	mirrorMaxBody = 8 << 20
+	// Mirrored requests waiting to be sent before new ones are dropped
+	mirrorQueueSize = 1024
+)
+
+var (
+	mirror         *Mirror
+	mirrorClient   = &http.Client{Timeout: 10 * time.Second}
+	MirrorDisabled = NewAPIError(400, "MIRROR_DISABLED", "Writes are only mirrored with --mirror-url", false)
+)
+
+type mirroredRequest struct {
+	method      string
+	uri         string
+	contentType string
+	body        []byte
+}
+
+type mirrorStatus struct {
+	URL      string  `json:"url"`
+	Rate     float64 `json:"rate"`
+	Mirrored uint64  `json:"mirrored"`
+	Dropped  uint64  `json:"dropped"`
+	Failed   uint64  `json:"failed"`
+}
+
+// Replays a fraction of the writes to another instance, eg: a new version or
+// configuration being validated against production traffic.  Writes are
+// picked by their key, so every write to a mirrored key is replayed and its
+// sets can be compared between the two instances, and sent in order by a
+// single goroutine.  A secondary that falls too far behind misses writes
+// rather than slowing them down.
+type Mirror struct {
+	sync.Mutex
+	url      string
+	rate     uint64 // the bits of the float64 fraction mirrored
+	requests chan mirroredRequest
+	done     chan struct{}
+	stopped  bool
+
+	mirrored uint64
+	dropped  uint64
+	failed   uint64
+}
+
+func NewMirror(url string, rate float64) *Mirror {
+	m := &Mirror{
+		url:      strings.TrimSuffix(url, "/"),
+		requests: make(chan mirroredRequest, mirrorQueueSize),
+		done:     make(chan struct{}),
+	}
+	m.SetRate(rate)
+	return m
+}
+
+func (m *Mirror) Rate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&m.rate))
+}
+
+func (m *Mirror) SetRate(rate float64) {
+	atomic.StoreUint64(&m.rate, math.Float64bits(rate))
+}
+
+// Whether the writes to key are mirrored.  Writes without a key, eg: to
+// several keys at once, are picked at random.
+func (m *Mirror) picks(key string) bool {
+	rate := m.Rate()
+	if rate <= 0 {
+		return false
+	} else if rate >= 1 {
+		return true
+	}
+	if key == "" {
+		return rand.Float64() < rate
+	}
+	return float64(Hashify([]byte(key))) < rate*math.MaxUint64
+}
+
+func (m *Mirror) Start() {
+	go func() {
+		defer close(m.done)
+		for request := range m.requests {
+			if err := m.send(request); err != nil {
+				atomic.AddUint64(&m.failed, 1)
+				log.Printf("Could not mirror %s %s: %s", request.method, request.uri, err)
+			} else {
+				atomic.AddUint64(&m.mirrored, 1)
+			}
+		}
+	}()
+}
+
+// Stops once the requests already queued have been sent
+func (m *Mirror) Stop() {
+	m.Lock()
+	m.stopped = true
+	close(m.requests)
+	m.Unlock()
+	<-m.done
+}
+
+func (m *Mirror) send(request mirroredRequest) error {
+	req, err := http.NewRequest(request.method, m.url+request.uri, bytes.NewReader(request.body))
+	if err != nil {
+		return err
+	}
+	if request.contentType != "" {
+		req.Header.Set("Content-Type", request.contentType)
+	}
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("mirror returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Queues request to be replayed, dropping it if the queue is full
+func (m *Mirror) enqueue(request mirroredRequest) {
+	m.Lock()
+	defer m.Unlock()
+	if m.stopped {
+		atomic.AddUint64(&m.dropped, 1)
+		return
+	}
+	select {
+	case m.requests <- request:
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+	}
+}
+
+func (m *Mirror) Status() mirrorStatus {
+	return mirrorStatus{
+		URL:      m.url,
+		Rate:     m.Rate(),
+		Mirrored: atomic.LoadUint64(&m.mirrored),
+		Dropped:  atomic.LoadUint64(&m.dropped),
+		Failed:   atomic.LoadUint64(&m.failed),
+	}
+}
+
+// Runs handler and, if the write is picked and succeeds, mirrors it.  The
+// body is kept for the mirror as the handler reads it, up to mirrorMaxBody.
+func (m *Mirror) serve(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	reqParams, _ := url.ParseQuery(r.URL.RawQuery)
+	if !m.picks(reqParams.Get("key")) {
+		handler(w, r)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, mirrorMaxBody+1))
+		if err != nil {
+			HttpError(w, 500, "INVALID_BODY")
+			return
+		}
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: 200}
+	handler(recorder, r)
+	if recorder.status >= 300 {
+		return
+	} else if len(body) > mirrorMaxBody {
+		atomic.AddUint64(&m.dropped, 1)
+		return
+	}
+	m.enqueue(mirroredRequest{
+		method:      r.Method,
+		uri:         r.URL.RequestURI(),
+		contentType: r.Header.Get("Content-Type"),
+		body:        body,
+	})
+}
+
+// Mirrors a record added outside of HTTP, eg: by binary ingestion or an
+// event source, as an /add of its key and value once it was added.  Returns
+// the channel the record's result is passed on to.
+func (m *Mirror) record(key, value string, resultChan chan Result) chan Result {
+	if !m.picks(key) {
+		return resultChan
+	}
+	mirrored := make(chan Result, 1)
+	go func() {
+		result := <-resultChan
+		if result.Error == nil {
+			m.enqueue(mirroredRequest{
+				method: "GET",
+				uri:    "/add?" + url.Values{"key": {key}, "value": {value}}.Encode(),
+			})
+		}
+		mirrored <- result
+	}()
+	return mirrored
+}
+
+// Returns how many writes were mirrored, dropped and failed.  Passing `rate`
+// changes the fraction of the keys that are mirrored, eg: to ramp up a canary.
+func MirrorHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	if mirror == nil {
+		HttpResultError(w, "", MirrorDisabled)
+		return
+	}
+	if rate_raw := reqParams.Get("rate"); rate_raw != "" {
+		rate, err := strconv.ParseFloat(rate_raw, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			HttpError(w, 500, "INVALID_ARG_RATE")
+			return
+		}
+		mirror.SetRate(rate)
+	}
+	HttpResponse(w, 200, mirror.Status())
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMirrorPicks(t *testing.T) {
+	m := NewMirror("http://localhost", 0.5)
+	picked := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if m.picks(key) {
+			picked++
+		}
+		// keys are always or never picked
+		assert.Equal(t, m.picks(key), m.picks(key))
+	}
+	assert.Equal(t, picked > 400 && picked < 600, true)
+
+	m.SetRate(0)
+	assert.Equal(t, m.picks("key"), false)
+	m.SetRate(1)
+	assert.Equal(t, m.picks("key"), true)
+}
+
+func TestMirror(t *testing.T) {
+	received := make(chan string, 10)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.Method + " " + r.URL.RequestURI() + " " + string(body)
+	}))
+	defer secondary.Close()
+
+	mirror = NewMirror(secondary.URL+"/", 1)
+	mirror.Start()
+	defer func() { mirror = nil }()
+
+	handler := mutationHandler(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) == "fail" {
+			HttpError(w, 500, "FAILED")
+			return
+		}
+		HttpResponse(w, 200, string(body))
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/import?key=a", strings.NewReader("1\n2\n")))
+	assert.Equal(t, w.Body.String() != "", true)
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/import?key=a", strings.NewReader("fail")))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/add?key=b&value=c", nil))
+	mirror.Stop()
+
+	assert.Equal(t, <-received, "POST /import?key=a 1\n2\n")
+	assert.Equal(t, <-received, "GET /add?key=b&value=c ")
+	assert.Equal(t, len(received), 0)
+	status := mirror.Status()
+	assert.Equal(t, status.Mirrored, uint64(2))
+	assert.Equal(t, status.Failed, uint64(0))
+}
+
+// Records added by binary ingestion and event sources are mirrored as adds
+func TestMirrorRecords(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	received := make(chan string, 10)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Method + " " + r.URL.RequestURI()
+	}))
+	defer secondary.Close()
+
+	mirror = NewMirror(secondary.URL, 1)
+	mirror.Start()
+	defer func() { mirror = nil }()
+
+	key := "_GOTEST_MIRROR_RECORD"
+	result := <-ingestRecord(key, "a b")
+	assert.Equal(t, result.Error, nil)
+	setReadOnly(true)
+	result = <-ingestRecord(key, "c")
+	setReadOnly(false)
+	assert.Equal(t, result.Error, ReadOnly)
+	mirror.Stop()
+
+	assert.Equal(t, <-received, "GET /add?key=_GOTEST_MIRROR_RECORD&value=a+b")
+	assert.Equal(t, len(received), 0)
+
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+}
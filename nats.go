@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natsDialTimeout = 10 * time.Second
+	// How long the server holds a pull for messages before answering with a
+	// 408, and how long to wait before reconnecting after an error
+	natsPullExpires = 5 * time.Second
+	natsRetry       = 5 * time.Second
+	// Largest message read, servers default to 1MB
+	natsMaxPayload = 64 << 20
+)
+
+var NATSProtocolError = errors.New("Unexpected message from NATS server")
+
+// An error answered by the JetStream API, eg: for a stream that doesn't exist
+type jetStreamError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+func (e *jetStreamError) Error() string {
+	return fmt.Sprintf("JetStream error %d: %s", e.Code, e.Description)
+}
+
+// Pulls messages, one record each, from a durable JetStream consumer.  A
+// pull of up to `batch` messages is added as a whole and every message is
+// only acked once its adds were written, or nak'ed to be redelivered if they
+// were rejected for now, so a restart or crash at any point only redelivers
+// messages that were already counted, which adding again leaves as they are.
+//
+// Options are the `url` of the server (default nats://127.0.0.1:4222, with
+// an optional user:password), the `stream`, the `consumer`'s durable name, an
+// optional `token`, and `batch` (default 100).  The consumer is created with
+// explicit acks, filtered on `subject` if given, unless `create=false`.
+type natsSource struct {
+	address  string
+	user     string
+	password string
+	token    string
+	stream   string
+	consumer string
+	subject  string
+	batch    int
+	create   bool
+	parse    sourceParser
+}
+
+func newNATSSource(config *SourceConfig) (Source, error) {
+	ns := &natsSource{
+		stream:   config.Options["stream"],
+		consumer: config.Options["consumer"],
+		subject:  config.Options["subject"],
+		token:    config.Options["token"],
+		batch:    100,
+		create:   true,
+		parse:    config.parse,
+	}
+	if ns.stream == "" || ns.consumer == "" {
+		return nil, fmt.Errorf("No stream or consumer for nats source %q", config.Name)
+	}
+
+	address := config.Options["url"]
+	if address == "" {
+		address = "nats://127.0.0.1:4222"
+	}
+	parsed, err := url.Parse(address)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("Invalid url for nats source %q", config.Name)
+	}
+	ns.address = parsed.Host
+	if parsed.Port() == "" {
+		ns.address = net.JoinHostPort(parsed.Hostname(), "4222")
+	}
+	if parsed.User != nil {
+		ns.user = parsed.User.Username()
+		ns.password, _ = parsed.User.Password()
+	}
+
+	if batch_raw := config.Options["batch"]; batch_raw != "" {
+		if ns.batch, err = strconv.Atoi(batch_raw); err != nil || ns.batch <= 0 {
+			return nil, fmt.Errorf("Invalid batch for nats source %q", config.Name)
+		}
+	}
+	if create_raw := config.Options["create"]; create_raw != "" {
+		if ns.create, err = strconv.ParseBool(create_raw); err != nil {
+			return nil, fmt.Errorf("Invalid create for nats source %q", config.Name)
+		}
+	}
+	return ns, nil
+}
+
+// Consumes until stopped, reconnecting after errors other than those of the
+// JetStream API, which won't go away by themselves
+func (ns *natsSource) Run(stop <-chan struct{}, emit func(fields url.Values) error) error {
+	for {
+		err := ns.consume(stop, emit)
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if _, ok := err.(*jetStreamError); ok {
+			return err
+		}
+		log.Printf("Lost NATS consumer %s on %s, reconnecting: %s", ns.consumer, ns.stream, err)
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(natsRetry):
+		}
+	}
+}
+
+func (ns *natsSource) consume(stop <-chan struct{}, emit func(fields url.Values) error) error {
+	conn, err := net.DialTimeout("tcp", ns.address, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	nc := &natsConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := nc.handshake(ns.user, ns.password, ns.token); err != nil {
+		return err
+	}
+	inbox := "_INBOX.gocountme." + natsInbox()
+	if err := nc.write("SUB %s.* 1\r\n", inbox); err != nil {
+		return err
+	}
+	if ns.create {
+		if err := ns.createConsumer(nc, inbox+".api"); err != nil {
+			return err
+		}
+	}
+
+	next := fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", ns.stream, ns.consumer)
+	pull, _ := json.Marshal(map[string]int64{"batch": int64(ns.batch), "expires": int64(natsPullExpires)})
+	for {
+		if err := nc.publish(next, inbox+".pull", pull); err != nil {
+			return err
+		}
+		messages, err := nc.pull(ns.batch)
+		if err != nil {
+			return err
+		}
+		if err := ns.add(nc, messages, emit); err != nil {
+			return err
+		}
+	}
+}
+
+func (ns *natsSource) createConsumer(nc *natsConn, reply string) error {
+	config := map[string]interface{}{
+		"durable_name": ns.consumer,
+		"ack_policy":   "explicit",
+	}
+	if ns.subject != "" {
+		config["filter_subject"] = ns.subject
+	}
+	request, _ := json.Marshal(map[string]interface{}{"stream_name": ns.stream, "config": config})
+	subject := fmt.Sprintf("$JS.API.CONSUMER.DURABLE.CREATE.%s.%s", ns.stream, ns.consumer)
+	if err := nc.publish(subject, reply, request); err != nil {
+		return err
+	}
+	for {
+		msg, err := nc.next()
+		if err != nil {
+			return err
+		} else if msg.subject != reply {
+			continue
+		}
+		var response struct {
+			Error *jetStreamError `json:"error"`
+		}
+		if err := json.Unmarshal(msg.data, &response); err != nil {
+			return err
+		} else if response.Error != nil {
+			return response.Error
+		}
+		return nil
+	}
+}
+
+// Adds a pull's messages concurrently, then acks those that were added and
+// naks those to be redelivered after natsRetry
+func (ns *natsSource) add(nc *natsConn, messages []natsMsg, emit func(fields url.Values) error) error {
+	errs := make([]error, len(messages))
+	var wg sync.WaitGroup
+	for i, msg := range messages {
+		wg.Add(1)
+		go func(i int, msg natsMsg) {
+			defer wg.Done()
+			errs[i] = emitRecord(msg.data, ns.parse, emit)
+		}(i, msg)
+	}
+	wg.Wait()
+	for i, msg := range messages {
+		ack := []byte("+ACK")
+		if errs[i] != nil {
+			ack = []byte(fmt.Sprintf(`-NAK {"delay":%d}`, natsRetry))
+		}
+		if err := nc.publish(msg.reply, "", ack); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func natsInbox() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+type natsMsg struct {
+	subject string
+	reply   string
+	status  string // the status code of a message without data, eg: 404
+	data    []byte
+}
+
+// The client side of the NATS protocol, as much as consuming needs
+type natsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (nc *natsConn) write(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(nc.conn, format, args...)
+	return err
+}
+
+func (nc *natsConn) publish(subject, reply string, data []byte) error {
+	if reply != "" {
+		subject += " " + reply
+	}
+	return nc.write("PUB %s %d\r\n%s\r\n", subject, len(data), data)
+}
+
+func (nc *natsConn) handshake(user, password, token string) error {
+	line, err := nc.readLine()
+	if err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO ") {
+		return NATSProtocolError
+	}
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"lang":          "go",
+		"name":          "gocountme",
+		"version":       VERSION,
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+	}
+	for name, value := range map[string]string{"user": user, "pass": password, "auth_token": token} {
+		if value != "" {
+			options[name] = value
+		}
+	}
+	connect, _ := json.Marshal(options)
+	if err := nc.write("CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return err
+	}
+	for {
+		line, err := nc.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server refused connection: %s", line)
+		}
+	}
+}
+
+func (nc *natsConn) readLine() (string, error) {
+	line, err := nc.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Reads the next message, answering pings along the way
+func (nc *natsConn) next() (natsMsg, error) {
+	for {
+		line, err := nc.readLine()
+		if err != nil {
+			return natsMsg{}, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			if err := nc.write("PONG\r\n"); err != nil {
+				return natsMsg{}, err
+			}
+		case "PONG", "+OK", "INFO":
+		case "-ERR":
+			return natsMsg{}, fmt.Errorf("NATS server error: %s", line)
+		case "MSG":
+			return nc.readMsg(fields[1:], false)
+		case "HMSG":
+			return nc.readMsg(fields[1:], true)
+		default:
+			return natsMsg{}, NATSProtocolError
+		}
+	}
+}
+
+// Reads the payload of a MSG, `subject sid [reply] size`, or a HMSG,
+// `subject sid [reply] header_size size`
+func (nc *natsConn) readMsg(args []string, headers bool) (natsMsg, error) {
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(args) != 2+sizes && len(args) != 3+sizes {
+		return natsMsg{}, NATSProtocolError
+	}
+	msg := natsMsg{subject: args[0]}
+	if len(args) == 3+sizes {
+		msg.reply = args[2]
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || size < 0 || size > natsMaxPayload {
+		return natsMsg{}, NATSProtocolError
+	}
+	headerSize := 0
+	if headers {
+		headerSize, err = strconv.Atoi(args[len(args)-2])
+		if err != nil || headerSize < 0 || headerSize > size {
+			return natsMsg{}, NATSProtocolError
+		}
+	}
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(nc.reader, payload); err != nil {
+		return natsMsg{}, err
+	}
+	msg.data = payload[headerSize:size]
+
+	// Headers start with NATS/1.0, followed by a status for status messages
+	if headers {
+		status := strings.Fields(strings.SplitN(string(payload[:headerSize]), "\r\n", 2)[0])
+		if len(status) > 1 && len(msg.data) == 0 {
+			msg.status = status[1]
+		}
+	}
+	return msg, nil
+}
+
+// Reads the messages answering a pull, until there are batch of them or the
+// server answers with a status, eg: 408 once the pull expired.  Messages keep
+// the subject they were published to and are told apart by their ack reply.
+func (nc *natsConn) pull(batch int) ([]natsMsg, error) {
+	var messages []natsMsg
+	for len(messages) < batch {
+		msg, err := nc.next()
+		if err != nil {
+			return nil, err
+		} else if msg.status != "" {
+			break
+		} else if strings.HasPrefix(msg.reply, "$JS.ACK.") {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// Normalization rules clean up values before they are hashed so that values
+// producers write differently are still counted once.  A rule maps a key
+// prefix to the normalizers applied, in order, to values added to keys
+// starting with it, eg:
+//
+//	{"users:" : ["trim", "email"], "pages:" : ["url"]}
+//
+// When several prefixes match a key the longest one wins, and "" applies to
+// every key no other rule matches.
+type NormalizeRules map[string][]string
+
+type Normalizer func(string) string
+
+var (
+	normalizeRules     NormalizeRules
+	UnknownNormalizer  = errors.New("Unknown normalizer")
+	EmptyNormalizeRule = errors.New("Normalization rule has no normalizers")
+)
+
+var normalizers = map[string]Normalizer{
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	"url":   canonicalURL,
+	"email": canonicalEmail,
+}
+
+func LoadNormalizeRules(filename string) (NormalizeRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := NormalizeRules{}
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for prefix, names := range rules {
+		if len(names) == 0 {
+			return nil, EmptyNormalizeRule
+		}
+		for _, name := range names {
+			if _, found := normalizers[name]; !found {
+				return nil, fmt.Errorf("%s %q for prefix %q", UnknownNormalizer, name, prefix)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Returns value as it should be counted under key
+func (rules NormalizeRules) Normalize(key, value string) string {
+	for _, name := range longestPrefix(rules, key) {
+		value = normalizers[name](value)
+	}
+	return value
+}
+
+// Lowercases the scheme and host, drops default ports and the fragment and
+// sorts the query parameters.  Values that aren't absolute URLs are left as
+// they are.
+func canonicalURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); port == "80" && u.Scheme == "http" || port == "443" && u.Scheme == "https" {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+	return u.String()
+}
+
+// Lowercases the address and drops any +tag from the local part, so
+// User+news@Example.com becomes user@example.com
+func canonicalEmail(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	at := strings.LastIndex(value, "@")
+	if at <= 0 {
+		return value
+	}
+	local, domain := value[:at], value[at:]
+	if plus := strings.Index(local, "+"); plus > 0 {
+		local = local[:plus]
+	}
+	return local + domain
+}
+
+// Builds the request that adds value to every one of keys, normalizing,
+// checking and hashing it for each key
+func newMultiAddRequest(keys []string, value string, width int, resultChan chan Result) (MultiAddHashRequest, error) {
+	request := MultiAddHashRequest{
+		Keys:       keys,
+		HashWidth:  width,
+		ResultChan: resultChan,
+	}
+	if normalizeRules == nil && schemas == nil && hashSalts == nil {
+		request.Hash, request.Low = Hashify128([]byte(value))
+		request.Value = []byte(value)
+		return request, nil
+	}
+
+	request.Hashes = make([]uint64, len(keys))
+	request.Lows = make([]uint64, len(keys))
+	request.Values = make([][]byte, len(keys))
+	for i, key := range keys {
+		prepared, err := prepareValue(key, value)
+		if err != nil {
+			return request, err
+		}
+		request.Hashes[i], request.Lows[i] = hashValue128(key, prepared)
+		request.Values[i] = []byte(prepared)
+	}
+	return request, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	rules := NormalizeRules{
+		"":        []string{"trim"},
+		"users:":  []string{"email"},
+		"pages:":  []string{"trim", "url"},
+		"pages:x": []string{"lower"},
+	}
+	assert.Equal(t, rules.Normalize("other", " Foo "), "Foo")
+	assert.Equal(t, rules.Normalize("users:all", " User+news@Example.com"), "user@example.com")
+	assert.Equal(t, rules.Normalize("pages:all", "HTTP://Example.com:80?b=2&a=1#top"), "http://example.com/?a=1&b=2")
+	assert.Equal(t, rules.Normalize("pages:all", "https://example.com:8443/A"), "https://example.com:8443/A")
+	assert.Equal(t, rules.Normalize("pages:all", "not a url"), "not a url")
+	assert.Equal(t, rules.Normalize("pages:x", " ABC "), " abc ")
+	assert.Equal(t, NormalizeRules(nil).Normalize("users:all", " Foo "), " Foo ")
+
+	normalizeRules = rules
+	defer func() { normalizeRules = nil }()
+	request, err := newMultiAddRequest([]string{"other", "users:all"}, "Foo@Bar.com ", 0, nil)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, request.Hashes, []uint64{Hashify([]byte("Foo@Bar.com")), Hashify([]byte("foo@bar.com"))})
+	hash, low, value := request.hashFor(1)
+	high, wantLow := Hashify128([]byte("foo@bar.com"))
+	assert.Equal(t, hash, high)
+	assert.Equal(t, low, wantLow)
+	assert.Equal(t, string(value), "foo@bar.com")
+
+	_, err = newMultiAddRequest([]string{"other"}, "  ", 0, nil)
+	assert.Equal(t, err, EmptyValue)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mynameisfiber/gocountme/algebra"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"io"
+	"log"
+	"os"
+)
+
+// Longest line of an /export read, a set of a few million hashes
+const exportMaxLine = 64 << 20
+
+// A line of an /export, either a set or the line ending it
+type exportLine struct {
+	Key  string                 `json:"key"`
+	Set  *kminvalues.KMinValues `json:"set"`
+	Next string                 `json:"next"`
+}
+
+// Reads the sets of an /export
+func readExport(r io.Reader) (map[string]*kminvalues.KMinValues, error) {
+	sets := make(map[string]*kminvalues.KMinValues)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, exportMaxLine)
+	for scanner.Scan() {
+		var line exportLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, err
+		}
+		if line.Set != nil {
+			sets[line.Key] = line.Set
+		} else if line.Next != "" {
+			log.Printf("Export was cut off after %s, later keys are empty sets", line.Next)
+		}
+	}
+	return sets, scanner.Err()
+}
+
+// `gocountme query --sets export.ndjson '{"method" : ...}'` evaluates a query
+// over the sets of an /export the way /query evaluates it over the DB, eg: to
+// query a snapshot without running a server.  Keys the export doesn't have
+// are empty sets of --default-size.
+func runQuery(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	setsFile := flags.String("sets", "-", "File of the sets, as /export streams them, or - for stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Expected a single query")
+	}
+	query, err := algebra.Parse([]byte(flags.Arg(0)))
+	if err != nil {
+		return err
+	}
+
+	input := io.Reader(os.Stdin)
+	if *setsFile != "-" {
+		file, err := os.Open(*setsFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+	sets, err := readExport(input)
+	if err != nil {
+		return err
+	}
+
+	evaluator := algebra.Evaluator{
+		Provider:        &algebra.MapProvider{Sets: sets, K: *defaultSize, Width: *defaultHashWidth},
+		MinCommonHashes: *minCommonHashes,
+	}
+	result, err := evaluator.Evaluate(query)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
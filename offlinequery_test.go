@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRunQuery(t *testing.T) {
+	file, _ := ioutil.TempFile("", "export")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"key":"a","set":{"k":1024,"width":64,"hashes":[1,2,3]}}` + "\n")
+	file.WriteString(`{"key":"b","set":{"k":1024,"width":64,"hashes":[2,3,4]}}` + "\n")
+	file.WriteString(`{"done":true}` + "\n")
+	file.Close()
+
+	var out bytes.Buffer
+	err := runQuery([]string{"--sets", file.Name(), `{"method" : "cardinality_union", "keys" : ["a", "b", "c"]}`}, &out)
+	assert.Equal(t, err, nil)
+	var result QueryResult
+	assert.Equal(t, json.Unmarshal(out.Bytes(), &result), nil)
+	assert.Equal(t, result.Key, "||a u b u c||")
+	assert.Equal(t, result.Num, 4.0)
+
+	err = runQuery([]string{"--sets", file.Name(), `{"method" : "jaccard", "keys" : ["a"]}`}, &out)
+	assert.Equal(t, err.Error(), MethodSetSize.Error())
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// A query parameter of an endpoint.  Type is the OpenAPI type of its value:
+// string, integer, number or boolean.
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+	Repeated    bool
+}
+
+func param(name, typ, description string) apiParam {
+	return apiParam{Name: name, Type: typ, Description: description}
+}
+
+func (p apiParam) required() apiParam {
+	p.Required = true
+	return p
+}
+
+func (p apiParam) repeated() apiParam {
+	p.Repeated = true
+	return p
+}
+
+// An endpoint of the HTTP interface.  Response is a value of the type returned
+// as the `data` of the response, or nil for endpoints that stream Stream
+// instead.
+type apiRoute struct {
+	Path     string
+	Method   string
+	Summary  string
+	Handler  http.HandlerFunc
+	Params   []apiParam
+	Response interface{}
+	Stream   string
+}
+
+var (
+	keyParam       = param("key", "string", "Key of the set").required()
+	keysParam      = param("key", "string", "Keys of the sets").required().repeated()
+	dryRunParam    = param("dryrun", "boolean", "Report what would change, as a list of changes, without writing anything")
+	noBatchParam   = param("nobatch", "boolean", "Write the batch out as soon as this request has run")
+	tokenParam     = param("token", "integer", "Fencing token of the keys' leases, with --fencing")
+	widthParam     = param("width", "integer", "Hash width (32 or 64) if the key doesn't exist yet")
+	labelParam     = param("label", "string", "Label to also count the value under in the key's breakdown")
+	estimatorParam = param("estimator", "string", "classic, bias_corrected or mle, to return the cardinality along with the estimator used")
+)
+
+// Every endpoint the server serves.  main registers their handlers and
+// /openapi.json describes them, so the description can't drift from what is
+// served.
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{Path: "/get", Summary: "Returns a set", Handler: GetHandler, Response: Result{},
+			Params: []apiParam{keyParam, param("encoding", "string", "base64 to return the hashes as base64 encoded bytes")}},
+		{Path: "/delete", Summary: "Deletes a set", Handler: auditHandler("delete", mutationHandler(DeleteHandler)), Response: Result{},
+			Params: []apiParam{keyParam, dryRunParam, noBatchParam, tokenParam}},
+		{Path: "/value", Method: "DELETE", Summary: "Removes values from a set, best effort", Handler: auditHandler("remove_value", mutationHandler(RemoveValueHandler)), Response: removal{},
+			Params: []apiParam{keyParam, param("value", "string", "Value to remove, more can be given one per line in the body").repeated(), tokenParam}},
+		{Path: "/cardinality", Summary: "Estimates the cardinality of a set", Handler: CardinalityHandler, Response: float64(0),
+			Params: []apiParam{keyParam, estimatorParam}},
+		{Path: "/cardinalities", Summary: "Estimates the cardinalities of several sets at once", Handler: CardinalitiesHandler, Response: map[string]float64{},
+			Params: []apiParam{keysParam, estimatorParam}},
+		{Path: "/contains", Summary: "Returns whether the hash of a value is retained by a set", Handler: ContainsHandler, Response: false,
+			Params: []apiParam{keyParam, param("value", "string", "Value to look up").required()}},
+		{Path: "/sample", Summary: "Returns a uniform sample of the values added to a set", Handler: SampleHandler, Response: []string{},
+			Params: []apiParam{keyParam, param("n", "integer", "Number of values, default 10")}},
+		{Path: "/sketch", Summary: "Returns the hashes retained by a set with their values", Handler: SketchHandler, Response: sketchView{},
+			Params: []apiParam{keyParam}},
+		{Path: "/arrivals", Summary: "Estimates when the distinct values of a set first arrived", Handler: ArrivalsHandler, Response: arrivals{},
+			Params: []apiParam{keyParam, param("interval", "string", "Bucket width, eg: 1h, default 24h")}},
+		{Path: "/breakdown", Summary: "Estimates the cardinality of every label of a set", Handler: BreakdownHandler, Response: breakdown{},
+			Params: []apiParam{keyParam}},
+		{Path: "/subscribe", Summary: "Streams the cardinality of sets as they change", Handler: SubscribeHandler, Stream: "text/event-stream",
+			Params: []apiParam{keysParam, param("delta", "number", "Fraction the cardinality must change by to be sent again")}},
+		{Path: "/changes", Summary: "Streams every change to the database", Handler: ChangesHandler, Stream: "application/x-ndjson",
+			Params: []apiParam{param("since", "integer", "Last seq seen, to resume the stream from"), param("format", "string", "delta to send insertions as deltas")}},
+		{Path: "/jaccard", Summary: "Estimates the jaccard index of two sets", Handler: JaccardHandler, Response: QueryResult{},
+			Params: []apiParam{keysParam}},
+		{Path: "/containment", Summary: "Estimates the fraction of the first set found in the second", Handler: ContainmentHandler, Response: QueryResult{},
+			Params: []apiParam{keysParam}},
+		{Path: "/overlap", Summary: "Estimates the overlap coefficient of two sets", Handler: OverlapHandler, Response: QueryResult{},
+			Params: []apiParam{keysParam}},
+		{Path: "/error", Summary: "Estimates the cardinality of the intersection of sets and its standard error", Handler: ErrorHandler, Response: errorEstimate{},
+			Params: []apiParam{keysParam}},
+		{Path: "/correlation", Summary: "Estimates the jaccard index of every pair of sets", Handler: CorrelationMatrixHandler, Response: []correlationMatrixElement{},
+			Params: []apiParam{keysParam}},
+		{Path: "/add", Summary: "Adds a value to a set", Handler: mutationHandler(AddHandler), Response: "OK",
+			Params: []apiParam{keyParam, param("value", "string", "Value to add").required(), widthParam, labelParam, dryRunParam, noBatchParam, tokenParam}},
+		{Path: "/addhash", Summary: "Adds a hash to a set", Handler: mutationHandler(AddHashHandler), Response: "OK",
+			Params: []apiParam{keyParam, param("hash", "integer", "uint64 hash to add").required(), widthParam, labelParam, dryRunParam, noBatchParam, tokenParam}},
+		{Path: "/multiadd", Method: "POST", Summary: "Adds a value to several sets in a single write", Handler: mutationHandler(MultiAddHandler), Response: "OK",
+			Params: []apiParam{keysParam, param("value", "string", "Value to add").required(), widthParam, dryRunParam, noBatchParam, tokenParam}},
+		{Path: "/fanout", Summary: "Adds a value to the keys generated from templates", Handler: mutationHandler(FanoutHandler), Response: []string{},
+			Params: []apiParam{
+				param("value", "string", "Value to add").required(),
+				param("rule", "string", "Name of a rule from --fanout-rules"),
+				param("template", "string", "Key template, where {field} is replaced by the field parameter").repeated(),
+				widthParam, dryRunParam, noBatchParam, tokenParam,
+			}},
+		{Path: "/import", Method: "POST", Summary: "Adds the values of a column of a CSV body to a set", Handler: mutationHandler(ImportHandler), Response: importResult{},
+			Params: []apiParam{
+				keyParam,
+				param("column", "string", "Index of the column of values, default 0, or its name with header=true"),
+				param("header", "boolean", "Whether the first row names the columns"),
+				widthParam, tokenParam,
+			}},
+		{Path: "/union", Summary: "Unions sets into a set", Handler: mutationHandler(UnionHandler), Response: "OK",
+			Params: []apiParam{keyParam, param("from", "string", "Keys of the sets to union into key").required().repeated(), param("job", "string", "ID the union is tracked as, a done job isn't run again"), dryRunParam, noBatchParam, tokenParam}},
+		{Path: "/record", Summary: "Records a value in the quantile sketch of a key", Handler: mutationHandler(RecordHandler), Response: "OK",
+			Params: []apiParam{keyParam, param("value", "number", "Value to record").required(), param("k", "integer", "Size of a new quantile sketch"), noBatchParam, tokenParam}},
+		{Path: "/quantile", Summary: "Estimates quantiles of the values recorded in a key", Handler: QuantileHandler, Response: quantileSummary{},
+			Params: []apiParam{keyParam, param("q", "number", "Quantile, default 0.5, 0.9 and 0.99").repeated()}},
+		{Path: "/increment", Summary: "Counts a value in the heavy hitters sketch of a key", Handler: mutationHandler(IncrementHandler), Response: "OK",
+			Params: []apiParam{keyParam, param("value", "string", "Value to count").required(), param("by", "integer", "Amount to count, default 1"), param("capacity", "integer", "Capacity of a new heavy hitters sketch"), noBatchParam, tokenParam}},
+		{Path: "/topk", Summary: "Returns the most frequent values counted in a key", Handler: TopKHandler, Response: topValues{},
+			Params: []apiParam{keyParam, param("n", "integer", "Number of values, default 10")}},
+		{Path: "/query", Summary: "Evaluates a query over sets", Handler: QueryHandler, Response: QueryResult{},
+			Params: []apiParam{param("q", "string", "JSON query").required()}},
+		{Path: "/query/explain", Summary: "Explains the plan, cost and error of a query without evaluating it", Handler: QueryExplainHandler, Response: queryExplanation{},
+			Params: []apiParam{param("q", "string", "JSON query").required()}},
+		{Path: "/keys", Summary: "Pages through the stored keys", Handler: KeysHandler, Response: keysPage{},
+			Params: []apiParam{
+				param("prefix", "string", "Only return keys starting with prefix"),
+				param("min_cardinality", "number", "Only return keys with at least this cardinality"),
+				param("tag", "string", "Only return keys with this tag, name=value or a name for any value").repeated(),
+				param("limit", "integer", "Number of keys, default 100, at most 1000"),
+				param("after", "string", "next of the previous page"),
+			}},
+		{Path: "/lease", Summary: "Leases a key to a producer, returning its fencing token", Handler: mutationHandler(LeaseHandler), Response: lease{},
+			Params: []apiParam{
+				keyParam,
+				param("ttl", "string", "How long the lease lasts, default 1m, at most 24h"),
+				param("token", "integer", "Token of the lease to renew or release"),
+				param("release", "boolean", "Give the lease up"),
+			}},
+		{Path: "/tag", Summary: "Sets and removes tags of a key", Handler: mutationHandler(TagHandler), Response: map[string]string{},
+			Params: []apiParam{keyParam, param("tag", "string", "Tag to set, name=value").repeated(), param("untag", "string", "Name of a tag to remove").repeated(), noBatchParam, tokenParam}},
+		{Path: "/tags", Summary: "Returns the tags of a key", Handler: TagsHandler, Response: map[string]string{},
+			Params: []apiParam{keyParam}},
+		{Path: "/tags/report", Summary: "Aggregates the keys with tags", Handler: TagReportHandler, Response: tagReport{},
+			Params: []apiParam{
+				param("tag", "string", "Only keys with this tag, name=value or a name for any value").repeated(),
+				param("group_by", "string", "Tag whose values the keys are grouped by"),
+				param("union", "boolean", "Union the sets of each group instead of summing their cardinalities"),
+			}},
+		{Path: "/export", Summary: "Streams every set", Handler: ExportHandler, Stream: "application/x-ndjson",
+			Params: []apiParam{
+				param("prefix", "string", "Only export keys starting with prefix"),
+				param("after", "string", "Last key received, to resume the export from"),
+				param("limit", "integer", "Number of sets to export before ending with next"),
+			}},
+		{Path: "/history", Summary: "Returns the recorded cardinalities of a set over time", Handler: HistoryHandler, Response: history{},
+			Params: []apiParam{keyParam, param("from", "string", "RFC3339 time of the first point"), param("to", "string", "RFC3339 time of the last point")}},
+		{Path: "/grafana/", Summary: "Answers the connection test of Grafana JSON datasources", Handler: GrafanaHandler, Response: "OK"},
+		{Path: "/grafana/search", Method: "POST", Summary: "Lists keys for Grafana JSON datasources", Handler: GrafanaSearchHandler, Response: []string{}},
+		{Path: "/grafana/query", Method: "POST", Summary: "Returns the series of Grafana JSON datasource queries", Handler: GrafanaQueryHandler, Response: []grafanaSeries{}},
+		{Path: "/report", Summary: "Groups the keys matching a pattern by its dimensions", Handler: ReportHandler, Response: report{},
+			Params: []apiParam{
+				param("pattern", "string", "Key pattern where {dimension} captures part of the key").required(),
+				param("group_by", "string", "Comma separated dimensions to group by, default all of them"),
+				param("union", "string", "Dimension to union the sets across instead of summing"),
+			}},
+		{Path: "/stats", Summary: "Summarizes the keyspace", Handler: StatsHandler, Response: keyspaceStats{},
+			Params: []apiParam{param("prefix", "string", "Only count keys starting with prefix"), param("top", "integer", "Number of largest sets, default 10")}},
+		{Path: "/info", Summary: "Reports the state of the server", Handler: InfoHandler, Response: serverInfo{}},
+		{Path: "/admin/readonly", Summary: "Returns or switches read-only mode", Handler: auditHandler("readonly", ReadOnlyHandler, "enabled"), Response: false,
+			Params: []apiParam{param("enabled", "boolean", "Switch read-only mode on or off")}},
+		{Path: "/admin/batching", Summary: "Returns or changes the write batching policy", Handler: auditHandler("batching", BatchingHandler, "max_size", "max_latency", "max_bytes", "flush", "sync"), Response: BatchPolicy{},
+			Params: []apiParam{
+				param("max_size", "integer", "Maximum number of requests in a batch"),
+				param("max_latency", "string", "Maximum time to wait for more requests, eg: 5ms"),
+				param("max_bytes", "integer", "Maximum bytes in a batch"),
+				param("flush", "string", "request, batch or timer"),
+				param("sync", "boolean", "Wait for writes to reach the disk"),
+			}},
+		{Path: "/admin/hotkeys", Summary: "Returns the most accessed keys", Handler: auditHandler("hotkeys_reset", HotKeysHandler, "reset"), Response: []keyAccess{},
+			Params: []apiParam{param("n", "integer", "Number of keys, default 20"), param("by", "string", "reads, writes or total"), param("reset", "boolean", "Clear the counts")}},
+		{Path: "/admin/audit", Summary: "Returns entries of the audit log", Handler: AuditHandler, Response: []auditEntry{},
+			Params: []apiParam{
+				param("key", "string", "Only entries for this key"),
+				param("operation", "string", "Only entries for this operation"),
+				param("since", "string", "Only entries after this RFC3339 time"),
+				param("limit", "integer", "Number of entries, default 100"),
+			}},
+		{Path: "/admin/verification", Summary: "Compares the estimates of verified keys with their exact counts", Handler: VerificationHandler, Response: []verification{}},
+		{Path: "/admin/shadows", Summary: "Compares shadowed keys with their shadows", Handler: ShadowsHandler, Response: []shadowComparison{},
+			Params: []apiParam{param("key", "string", "Only compare this key"), param("prefix", "string", "Only compare keys starting with this prefix")}},
+		{Path: "/admin/jobs", Summary: "Lists the union jobs", Handler: JobsHandler, Response: []unionJob{},
+			Params: []apiParam{param("state", "string", "Only jobs that are pending, running, done or failed")}},
+		{Path: "/admin/alerts", Summary: "Lists the alert rules and whether they are firing", Handler: AlertsHandler, Response: []alertStatus{}},
+		{Path: "/admin/sinks", Summary: "Lists the sinks aggregates are pushed to and when they run", Handler: SinksHandler, Response: []sinkStatus{}},
+		{Path: "/admin/sources", Summary: "Lists the event sources and how many of their events were added", Handler: SourcesHandler, Response: []sourceStatus{}},
+		{Path: "/admin/mirror", Summary: "Returns how many writes were mirrored, optionally changing the fraction of keys mirrored", Handler: auditHandler("mirror", MirrorHandler, "rate"), Response: mirrorStatus{},
+			Params: []apiParam{param("rate", "number", "Fraction of the keys whose writes are mirrored")}},
+		{Path: "/admin/replication", Summary: "Lists the peers replicated from", Handler: ReplicationHandler, Response: []peerStatus{}},
+		{Path: "/admin/poisoning", Summary: "Lists the keys that got suspicious hashes", Handler: PoisoningHandler, Response: []suspectKey{}},
+		{Path: "/admin/heapdump", Summary: "Writes a dump of the heap to a file", Handler: auditHandler("heapdump", HeapDumpHandler), Response: heapDump{}},
+		{Path: "/merkle", Summary: "Returns nodes of the merkle tree of the sets", Handler: MerkleHandler, Response: merkleNodes{},
+			Params: []apiParam{param("level", "integer", "Level of the nodes, 0 being the root").required(), param("node", "integer", "Node whose children are returned").repeated()}},
+		{Path: "/merkle/sets", Summary: "Returns the sets under leaves of the merkle tree", Handler: MerkleSetsHandler, Response: []merkleSet{},
+			Params: []apiParam{param("leaf", "integer", "Leaf whose sets are returned").repeated()}},
+		{Path: "/exit", Summary: "Stops the server", Handler: ExitHandler, Stream: "text/plain"},
+	}
+}
+
+const openAPIVersion = "3.0.3"
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	durationType  = reflect.TypeOf(time.Duration(0))
+	kmvType       = reflect.TypeOf(kminvalues.KMinValues{})
+	base64KmvType = reflect.TypeOf(kminvalues.Base64KMinValues{})
+)
+
+// Schemas of the types that marshal themselves, and of the error responses
+func baseSchemas() map[string]interface{} {
+	return map[string]interface{}{
+		"Sketch": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"k":      map[string]interface{}{"type": "integer"},
+				"width":  map[string]interface{}{"type": "integer"},
+				"hashes": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer", "format": "uint64"}},
+			},
+		},
+		"Base64Sketch": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"k":        map[string]interface{}{"type": "integer"},
+				"width":    map[string]interface{}{"type": "integer"},
+				"encoding": map[string]interface{}{"type": "string", "enum": []string{"base64"}},
+				"data":     map[string]interface{}{"type": "string", "format": "byte"},
+			},
+		},
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"status_code": map[string]interface{}{"type": "integer"},
+				"status_txt":  map[string]interface{}{"type": "string", "description": "Error code, eg: MISSING_ARG_KEY"},
+				"data":        map[string]interface{}{"nullable": true},
+				"error":       schemaRef("APIError"),
+			},
+		},
+	}
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// Builds the schema of a type from its JSON encoding, adding the schema of
+// every struct it uses to schemas
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	case kmvType:
+		return schemaRef("Sketch")
+	case base64KmvType:
+		return schemaRef("Base64Sketch")
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "uint64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := t.Name()
+		if _, found := schemas[name]; !found {
+			// Reserved first so that recursive types, eg: QueryResult, refer
+			// to themselves instead of recursing forever
+			schemas[name] = nil
+			schemas[name] = structSchema(t, schemas)
+		}
+		return schemaRef(name)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, schemas)
+		if len(tag) == 1 || tag[1] != "omitempty" {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Builds the OpenAPI 3 description of every endpoint.  Responses wrap their
+// data as {"status_code" : 200, "status_txt" : "", "data" : ...} and errors
+// are described in error.
+func openAPISpec() map[string]interface{} {
+	schemas := baseSchemas()
+	schemaOf(reflect.TypeOf(APIError{}), schemas)
+	paths := make(map[string]interface{})
+	for _, route := range apiRoutes() {
+		var parameters []interface{}
+		for _, p := range route.Params {
+			schema := map[string]interface{}{"type": p.Type}
+			if p.Repeated {
+				schema = map[string]interface{}{"type": "array", "items": schema}
+			}
+			parameters = append(parameters, map[string]interface{}{
+				"name":        p.Name,
+				"in":          "query",
+				"description": p.Description,
+				"required":    p.Required,
+				"schema":      schema,
+				"explode":     true,
+			})
+		}
+
+		var content map[string]interface{}
+		if route.Response != nil {
+			content = map[string]interface{}{"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"status_code": map[string]interface{}{"type": "integer"},
+						"status_txt":  map[string]interface{}{"type": "string"},
+						"data":        schemaOf(reflect.TypeOf(route.Response), schemas),
+					},
+				},
+			}}
+		} else {
+			content = map[string]interface{}{route.Stream: map[string]interface{}{}}
+		}
+
+		method := route.Method
+		if method == "" {
+			method = "GET"
+		}
+		operation := map[string]interface{}{
+			"summary":     route.Summary,
+			"operationId": strings.Trim(strings.Replace(route.Path, "/", "_", -1), "_"),
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "OK", "content": content},
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef("Error")}},
+				},
+			},
+		}
+		if len(parameters) != 0 {
+			operation["parameters"] = parameters
+		}
+		paths[route.Path] = map[string]interface{}{strings.ToLower(method): operation}
+	}
+
+	return map[string]interface{}{
+		"openapi":    openAPIVersion,
+		"info":       map[string]interface{}{"title": "gocountme", "version": VERSION},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// Serves the OpenAPI description of the HTTP interface as is, rather than
+// wrapped like other responses, so that tools can read it directly
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	spec, err := json.Marshal(openAPISpec())
+	if err != nil {
+		HttpError(w, 500, "COULD_NOT_FORMAT_RESULT")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/openapi.json", nil)
+	OpenAPIHandler(w, r)
+	assert.Equal(t, w.Code, 200)
+
+	var spec struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &spec), nil)
+	assert.Equal(t, spec.OpenAPI, openAPIVersion)
+
+	// every route is described, once
+	routes := apiRoutes()
+	assert.Equal(t, len(spec.Paths), len(routes))
+	for _, route := range routes {
+		assert.NotEqual(t, spec.Paths[route.Path], nil)
+	}
+	assert.NotEqual(t, spec.Paths["/multiadd"]["post"], nil)
+	assert.NotEqual(t, spec.Paths["/value"]["delete"], nil)
+
+	// response types are described from their JSON encoding, including
+	// recursive ones
+	info := spec.Components.Schemas["serverInfo"]["properties"].(map[string]interface{})
+	assert.NotEqual(t, info["sampled_keys"], nil)
+	query := spec.Components.Schemas["QueryResult"]["properties"].(map[string]interface{})
+	assert.Equal(t, query["multi_result"], map[string]interface{}{
+		"type":  "array",
+		"items": map[string]interface{}{"$ref": "#/components/schemas/QueryResult"},
+	})
+	assert.Equal(t, query["set"], map[string]interface{}{"$ref": "#/components/schemas/Sketch"})
+}
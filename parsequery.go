@@ -48,165 +48,117 @@ package main
 //            },
 //        ]
 //    }
+//    ============================================
+//
+//    in order to request the number of values in at least 3 of 7 keys:
+//
+//        Card( >= 3 of (day1, day2, ..., day7) )
+//
+//    we request:
+//
+//    {
+//        "method" : "at_least",
+//        "m" : 3,
+//        "keys" : ["day1", "day2", "day3", "day4", "day5", "day6", "day7"]
+//    }
 //////////////////////////////////////////////////////////////////////
 
 import (
-	"encoding/json"
-	"errors"
-	"fmt"
+	"github.com/mynameisfiber/gocountme/algebra"
 	"github.com/mynameisfiber/gocountme/kminvalues"
-	"strings"
 )
 
 var (
-	KeysAndSetError            = errors.New("Both keys and set are specified in query")
-	CardinalitySingleTermError = errors.New("Method 'cardinality' can only take in one data source")
-	GetSingleTermError         = errors.New("Method 'get' can only take in one data source")
-	SetNeedsKMV                = errors.New("Set specified with float output")
-	InvalidMethod              = errors.New("Unrecognized method")
-	MethodSetSize              = errors.New("Method requires 2+ sets or keys")
+	KeysAndSetError            = NewAPIError(500, "INVALID_QUERY", "Both keys and set are specified in query", false)
+	CardinalitySingleTermError = NewAPIError(500, "INVALID_QUERY", "Method 'cardinality' can only take in one data source", false)
+	GetSingleTermError         = NewAPIError(500, "INVALID_QUERY", "Method 'get' can only take in one data source", false)
+	SetNeedsKMV                = NewAPIError(500, "INVALID_QUERY", "Set specified with float output", false)
+	InvalidMethod              = NewAPIError(500, "INVALID_QUERY", "Unrecognized method", false)
+	MethodSetSize              = NewAPIError(500, "INVALID_QUERY", "Method requires 2+ sets or keys", false)
+	InvalidM                   = NewAPIError(500, "INVALID_QUERY", "Method 'at_least' needs an m between 1 and the number of sets", false)
 )
 
-type Element struct {
-	Method string    `json:"method"`
-	Set    []Element `json:"set,omitempty"`
-	Keys   []string  `json:"keys,omitempty"`
+// The API errors of the errors the algebra package checks queries with
+var queryErrors = map[error]*APIError{
+	algebra.KeysAndSetError:            KeysAndSetError,
+	algebra.CardinalitySingleTermError: CardinalitySingleTermError,
+	algebra.SetNeedsKMV:                SetNeedsKMV,
+	algebra.InvalidMethod:              InvalidMethod,
+	algebra.MethodSetSize:              MethodSetSize,
+	algebra.InvalidM:                   InvalidM,
 }
 
-type QueryResult struct {
-	Key   string                 `json:"key"`
-	Kmv   *kminvalues.KMinValues `json:"set"`
-	Num   float64                `json:"result"`
-	Multi []*QueryResult         `json:"multi_result,omitempty"`
-}
+// Queries are parsed and evaluated by the algebra package, which embedders
+// and `gocountme query` share with the server
+type Element = algebra.Element
+type QueryResult = algebra.QueryResult
 
-func ParseQuery(query_raw []byte) (*QueryResult, error) {
-	query := Element{}
-	err := json.Unmarshal(query_raw, &query)
-	if err != nil {
-		return nil, err
-	}
+func intersectionResult(key string, num float64, common int) *QueryResult {
+	return algebra.IntersectionResult(key, num, common, *minCommonHashes)
+}
 
-	return parseQuery(&query)
+func intersectionWarning(common int) string {
+	return algebra.IntersectionWarning(common, *minCommonHashes)
 }
 
-func parseQuery(e *Element) (*QueryResult, error) {
-	if len(e.Keys) != 0 && len(e.Set) != 0 {
-		return nil, KeysAndSetError
+func queryError(err error) error {
+	if apiErr, found := queryErrors[err]; found {
+		return apiErr
 	}
+	return err
+}
 
-	var data []*kminvalues.KMinValues
-	var keys []string
+// Provides the sketches of queries from the DB, getting every key
+// concurrently
+type storedSketches struct{}
 
-	if len(e.Keys) != 0 {
-		data = make([]*kminvalues.KMinValues, len(e.Keys))
-		resultChan := make(chan Result, len(e.Keys)+1)
-		for _, key := range e.Keys {
-			getRequest := GetRequest{
-				Key:        key,
-				ResultChan: resultChan,
-			}
-			RequestChan <- getRequest
-		}
-		i := 1
-		for result := range resultChan {
-			if result.Key == e.Keys[0] {
-				data[0] = result.Data
-			} else {
-				data[i] = result.Data
-				i++
-			}
-			if i == len(e.Keys) && &data[0] != nil {
-				close(resultChan)
-			}
+func (storedSketches) Sketches(keys []string) ([]*kminvalues.KMinValues, error) {
+	results := make([]chan Result, len(keys))
+	for i, key := range keys {
+		results[i] = make(chan Result, 1)
+		if err := submitRequest(GetRequest{Key: key, ResultChan: results[i]}); err != nil {
+			return nil, err
 		}
-		keys = e.Keys
-	} else if len(e.Set) != 0 {
-		data = make([]*kminvalues.KMinValues, len(e.Set))
-		keys = make([]string, len(e.Set))
-		for i := 0; i < len(e.Set); i++ {
-			tmp, err := parseQuery(&e.Set[i])
-			if err != nil {
-				return nil, err
-			} else if tmp.Kmv == nil {
-				return nil, SetNeedsKMV
-			}
-			data[i] = tmp.Kmv
-			keys[i] = tmp.Key
+	}
+	data := make([]*kminvalues.KMinValues, len(keys))
+	for i, resultChan := range results {
+		result := <-resultChan
+		if result.Error != nil {
+			return nil, result.Error
 		}
+		data[i] = result.Data
 	}
+	return data, nil
+}
 
-	if e.Method == "cardinality" {
-		if len(data) != 1 {
-			return nil, CardinalitySingleTermError
-		}
-		return &QueryResult{
-			Key: fmt.Sprintf("||%s||", keys[0]),
-			Num: data[0].Cardinality(),
-		}, nil
-	} else if e.Method == "get" {
-		if len(data) != 1 {
-			return nil, CardinalitySingleTermError
-		}
-		return &QueryResult{
-			Key: keys[0],
-			Kmv: data[0],
-		}, nil
-	} else if e.Method == "union" {
-		if len(data) < 2 {
-			return nil, MethodSetSize
-		}
-		tmp := data[0].Union(data[1:]...)
-		return &QueryResult{
-			Key: strings.Join(keys, " u "),
-			Kmv: tmp,
-		}, nil
-	} else if e.Method == "jaccard" {
-		if len(data) < 2 {
-			return nil, MethodSetSize
-		}
-		tmp := data[0].Jaccard(data[1:]...)
-		return &QueryResult{
-			Key: fmt.Sprintf("Jaccard(%s)", strings.Join(keys, ", ")),
-			Num: tmp,
-		}, nil
-	} else if e.Method == "cardinality_intersection" {
-		if len(data) < 2 {
-			return nil, MethodSetSize
-		}
-		tmp := data[0].CardinalityIntersection(data[1:]...)
-		return &QueryResult{
-			Key: fmt.Sprintf("||%s||", strings.Join(keys, " n ")),
-			Num: tmp,
-		}, nil
-	} else if e.Method == "cardinality_union" {
-		if len(data) < 2 {
-			return nil, MethodSetSize
-		}
-		tmp := data[0].CardinalityUnion(data[1:]...)
-		return &QueryResult{
-			Key: fmt.Sprintf("||%s||", strings.Join(keys, " u ")),
-			Num: tmp,
-		}, nil
-	} else if e.Method == "correlation" {
-		if len(data) < 2 {
-			return nil, MethodSetSize
-		}
+func ParseQuery(query_raw []byte) (*QueryResult, error) {
+	query, err := unmarshalQuery(query_raw)
+	if err != nil {
+		return nil, err
+	}
 
-		N := len(data)
-		correlation := make([]*QueryResult, 0, N*(N-1)/2)
-		for i, r1 := range data[:N-1] {
-			for j, r2 := range data[i+1:] {
-				correlation = append(correlation, &QueryResult{
-					Key: fmt.Sprintf("Jaccard(%s, %s)", keys[i], keys[j+i+1]),
-					Num: r1.Jaccard(r2),
-				})
-			}
-		}
-		return &QueryResult{
-			Key:   fmt.Sprintf("Corr(%s)", strings.Join(keys, ", ")),
-			Multi: correlation,
-		}, nil
+	return parseQuery(query)
+}
+
+func unmarshalQuery(query_raw []byte) (*Element, error) {
+	query, err := algebra.Parse(query_raw)
+	if apiErr, found := queryErrors[err]; found {
+		return nil, apiErr
+	} else if err != nil {
+		return nil, NewAPIError(500, "INVALID_QUERY", err.Error(), false)
+	}
+	return query, nil
+}
+
+func parseQuery(e *Element) (*QueryResult, error) {
+	evaluator := algebra.Evaluator{
+		Provider:        storedSketches{},
+		Intersector:     intersections,
+		MinCommonHashes: *minCommonHashes,
+	}
+	result, err := evaluator.Evaluate(e)
+	if err != nil {
+		return nil, queryError(err)
 	}
-	return nil, InvalidMethod
+	return result, nil
 }
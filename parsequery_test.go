@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/bmizerany/assert"
 	"log"
 	"testing"
 )
@@ -25,3 +26,12 @@ func TestParseQuery(t *testing.T) {
 	log.Println(ParseQuery([]byte(query)))
 	CloseDB()
 }
+
+func TestIntersectionWarning(t *testing.T) {
+	result := intersectionResult("||a n b||", 12.5, 3)
+	assert.Equal(t, *result.SampleSize, 3)
+	assert.Equal(t, result.Warning, "FEW_COMMON_HASHES")
+
+	result = intersectionResult("||a n b||", 1250, *minCommonHashes)
+	assert.Equal(t, result.Warning, "")
+}
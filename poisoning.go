@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	poisonGuard    = NewPoisonGuard(0, 0, false, "")
+	SuspiciousHash = NewAPIError(422, "SUSPICIOUS_HASH", "Hash is too small to be likely for any plausible cardinality", false)
+)
+
+type suspectKey struct {
+	Key        string    `json:"key"`
+	Suspicious int       `json:"suspicious"`
+	Flagged    bool      `json:"flagged"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// Watches for keys being poisoned with tiny hashes.  A set estimates its
+// cardinality from how small its hashes are, so a producer adding hashes close
+// to 0 through /addhash or values chosen for their hash can make the estimate
+// as large as it likes.  Of n distinct values we expect n/maxCardinality to
+// hash below the floor of math.MaxUint64/maxCardinality, so a key with
+// threshold distinct hashes under it is flagged, logged and posted to the
+// webhook.  When reject is set hashes under the floor are refused outright.
+type PoisonGuard struct {
+	sync.Mutex
+	floor     uint64
+	threshold int
+	reject    bool
+	webhook   string
+	hashes    map[string]map[uint64]bool
+	keys      map[string]*suspectKey
+}
+
+func NewPoisonGuard(maxCardinality float64, threshold int, reject bool, webhook string) *PoisonGuard {
+	pg := &PoisonGuard{
+		threshold: threshold,
+		reject:    reject,
+		webhook:   webhook,
+		hashes:    make(map[string]map[uint64]bool),
+		keys:      make(map[string]*suspectKey),
+	}
+	if maxCardinality > 0 {
+		pg.floor = uint64(math.MaxUint64 / maxCardinality)
+	}
+	return pg
+}
+
+// Records an add of hash to key, returning SuspiciousHash if it should be
+// refused
+func (pg *PoisonGuard) Check(key string, hash uint64) error {
+	if hash >= pg.floor {
+		return nil
+	}
+
+	pg.Lock()
+	defer pg.Unlock()
+	suspect, found := pg.keys[key]
+	if !found {
+		suspect = &suspectKey{Key: key}
+		pg.keys[key] = suspect
+		pg.hashes[key] = make(map[uint64]bool)
+	}
+	suspect.LastSeen = time.Now()
+	// Only distinct hashes are counted, since a popular value legitimately
+	// under the floor is added over and over
+	if seen := pg.hashes[key]; !seen[hash] && !suspect.Flagged {
+		seen[hash] = true
+		suspect.Suspicious = len(seen)
+		if suspect.Suspicious >= pg.threshold {
+			suspect.Flagged = true
+			delete(pg.hashes, key)
+			pg.raise(*suspect)
+		}
+	}
+
+	if pg.reject {
+		return SuspiciousHash
+	}
+	return nil
+}
+
+func (pg *PoisonGuard) raise(suspect suspectKey) {
+	message := fmt.Sprintf("%s got %d hashes below %d, it may be being poisoned", suspect.Key, suspect.Suspicious, pg.floor)
+	log.Printf("Suspicious hashes: %s", message)
+	if pg.webhook == "" {
+		return
+	}
+	notification := &alert{
+		Rule:    "suspicious_hashes",
+		Query:   suspect.Key,
+		Value:   float64(suspect.Suspicious),
+		Message: message,
+		Time:    suspect.LastSeen,
+	}
+	go func() {
+		if err := notify(AlertSink{Type: "webhook", URL: pg.webhook}, notification); err != nil {
+			log.Printf("Could not post suspicious hashes of %s: %s", suspect.Key, err)
+		}
+	}()
+}
+
+// Checks every hash of a multi key add
+func (pg *PoisonGuard) CheckMulti(request MultiAddHashRequest) error {
+	for i, key := range request.Keys {
+		hash, _, _ := request.hashFor(i)
+		if err := pg.Check(key, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns every key that got a hash below the floor, the flagged ones first
+func (pg *PoisonGuard) Suspects() []suspectKey {
+	pg.Lock()
+	defer pg.Unlock()
+	suspects := make([]suspectKey, 0, len(pg.keys))
+	for _, suspect := range pg.keys {
+		suspects = append(suspects, *suspect)
+	}
+	sort.Slice(suspects, func(i, j int) bool {
+		if suspects[i].Flagged != suspects[j].Flagged {
+			return suspects[i].Flagged
+		}
+		return suspects[i].Key < suspects[j].Key
+	})
+	return suspects
+}
+
+// Lists the keys that got improbably small hashes
+func PoisoningHandler(w http.ResponseWriter, r *http.Request) {
+	HttpResponse(w, 200, poisonGuard.Suspects())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPoisonGuard(t *testing.T) {
+	pg := NewPoisonGuard(1e6, 2, false, "")
+	assert.Equal(t, pg.Check("key", math.MaxUint64), nil)
+	assert.Equal(t, len(pg.Suspects()), 0)
+
+	// a repeated hash is only counted once
+	assert.Equal(t, pg.Check("key", 1), nil)
+	assert.Equal(t, pg.Check("key", 1), nil)
+	suspects := pg.Suspects()
+	assert.Equal(t, len(suspects), 1)
+	assert.Equal(t, suspects[0].Suspicious, 1)
+	assert.Equal(t, suspects[0].Flagged, false)
+
+	assert.Equal(t, pg.Check("other", 5), nil)
+	assert.Equal(t, pg.Check("key", 2), nil)
+	suspects = pg.Suspects()
+	assert.Equal(t, len(suspects), 2)
+	assert.Equal(t, suspects[0].Key, "key")
+	assert.Equal(t, suspects[0].Suspicious, 2)
+	assert.Equal(t, suspects[0].Flagged, true)
+
+	// nothing is suspicious without a plausible cardinality
+	pg = NewPoisonGuard(0, 2, true, "")
+	assert.Equal(t, pg.Check("key", 0), nil)
+}
+
+func TestSuspiciousHashRejected(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	defer func() { poisonGuard = NewPoisonGuard(0, 0, false, "") }()
+	poisonGuard = NewPoisonGuard(1e6, 3, true, "")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/addhash?key=poisoned&hash=1", nil)
+	AddHashHandler(w, r)
+	assert.Equal(t, w.Code, 422)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/addhash?key=poisoned&hash=18446744073709551615", nil)
+	AddHashHandler(w, r)
+	assert.Equal(t, w.Code, 200)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/admin/poisoning", nil)
+	PoisoningHandler(w, r)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, len(poisonGuard.Suspects()), 1)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// A key policy gives the keys starting with a prefix their settings when
+// they are created, so producers don't have to pass them, eg:
+//
+//	{"tmp:" : {"k" : 256, "ttl" : "168h"}, "users:" : {"width" : 128, "tags" : {"team" : "growth"}}}
+//
+// Sets created by adds get size K and hash Width unless the add asks for a
+// width.  Every new key, however it was created, gets Tags and a `ttl` tag if
+// TTL is set, without overwriting tags it already has.
+type KeyPolicy struct {
+	K     int               `json:"k,omitempty"`
+	Width int               `json:"width,omitempty"`
+	TTL   string            `json:"ttl,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+}
+
+type KeyPolicies map[string]*KeyPolicy
+
+var keyPolicies KeyPolicies
+
+func LoadKeyPolicies(filename string) (KeyPolicies, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := KeyPolicies{}
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return nil, err
+	}
+	for prefix, policy := range loaded {
+		if policy == nil {
+			policy = &KeyPolicy{}
+			loaded[prefix] = policy
+		}
+		if policy.K < 0 {
+			return nil, fmt.Errorf("Invalid k for prefix %q", prefix)
+		} else if *maxK > 0 && policy.K > *maxK {
+			return nil, fmt.Errorf("k for prefix %q is over --max-k", prefix)
+		}
+		if policy.Width != 0 && policy.Width != 32 && policy.Width != 64 && policy.Width != 128 {
+			return nil, fmt.Errorf("Invalid width for prefix %q", prefix)
+		}
+		if policy.TTL != "" {
+			if ttl, err := time.ParseDuration(policy.TTL); err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("Invalid ttl for prefix %q", prefix)
+			}
+		}
+		if len(policy.Tags)+1 > maxKeyTags {
+			return nil, fmt.Errorf("Too many tags for prefix %q", prefix)
+		}
+	}
+	return loaded, nil
+}
+
+// The policy of the longest prefix of key, nil if it has none
+func (p KeyPolicies) For(key string) *KeyPolicy {
+	return longestPrefix(p, key)
+}
+
+// Tags a key that was just created with the tags of its policy
+func applyKeyPolicy(batch *Batch, key string) error {
+	policy := keyPolicies.For(key)
+	if policy == nil || len(policy.Tags) == 0 && policy.TTL == "" {
+		return nil
+	}
+	data, err := batch.Get(tagsKey(key))
+	if err != nil {
+		return err
+	}
+	tags, err := decodeTags(data)
+	if err != nil {
+		return err
+	}
+	for name, value := range policy.Tags {
+		if _, found := tags[name]; !found {
+			tags[name] = value
+		}
+	}
+	if _, found := tags[ttlTag]; !found && policy.TTL != "" {
+		tags[ttlTag] = policy.TTL
+	}
+	data, _ = json.Marshal(tags)
+	batch.Put(tagsKey(key), data)
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyPolicies(t *testing.T) {
+	file, _ := ioutil.TempFile("", "policies")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"_GOTEST_POLICY:" : {"k" : 256, "ttl" : "168h"}, "_GOTEST_POLICY:users:" : {"width" : 128, "tags" : {"team" : "growth"}}}`)
+	file.Close()
+
+	loaded, err := LoadKeyPolicies(file.Name())
+	assert.Equal(t, err, nil)
+	keyPolicies = loaded
+	defer func() { keyPolicies = nil }()
+	assert.Equal(t, keyPolicies.For("_GOTEST_POLICY:tmp").K, 256)
+	assert.Equal(t, keyPolicies.For("_GOTEST_POLICY:users:a").Width, 128)
+	assert.Equal(t, keyPolicies.For("other") == nil, true)
+
+	// policies can't create sets larger than the server allows
+	*maxK = 128
+	_, err = LoadKeyPolicies(file.Name())
+	*maxK = 0
+	assert.NotEqual(t, err, nil)
+
+	SetupDB()
+	defer CloseDB()
+	resultChan := make(chan Result)
+	keys := []string{"_GOTEST_POLICY:tmp", "_GOTEST_POLICY:users:a", "other"}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	// tags given before the key is created are kept
+	var tags map[string]string
+	dispatcher.Dispatch(TagRequest{Key: keys[1], Set: map[string]string{"team": "ads"}, Tags: &tags, ResultChan: resultChan})
+	<-resultChan
+
+	for _, key := range keys {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		<-resultChan
+	}
+	get := func(key string) (int, int, map[string]string) {
+		dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+		kmv := (<-resultChan).Data
+		tags, _ := readTags(dispatcher.database, key)
+		return kmv.MaxSize(), kmv.HashWidth(), tags
+	}
+
+	k, width, tags := get(keys[0])
+	assert.Equal(t, k, 256)
+	assert.Equal(t, width, 64)
+	assert.Equal(t, tags, map[string]string{"ttl": "168h"})
+
+	k, width, tags = get(keys[1])
+	assert.Equal(t, k, *defaultSize)
+	assert.Equal(t, width, 128)
+	assert.Equal(t, tags, map[string]string{"team": "ads"})
+
+	k, _, tags = get(keys[2])
+	assert.Equal(t, k, *defaultSize)
+	assert.Equal(t, len(tags), 0)
+
+	assert.Equal(t, NewExpirer(nil, 0).Expire(time.Now().Add(169*time.Hour)), 1)
+}
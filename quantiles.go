@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"github.com/mynameisfiber/gocountme/quantiles"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type quantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type quantileSummary struct {
+	Key       string          `json:"key"`
+	Count     uint64          `json:"count"`
+	Min       float64         `json:"min"`
+	Max       float64         `json:"max"`
+	Quantiles []quantileValue `json:"quantiles"`
+}
+
+// Quantile sketches live next to the sets, so a key can hold both a distinct
+// count and, eg: the latency percentiles of the same events
+func quantileKey(key string) []byte {
+	return []byte(internalKeyPrefix + "quantiles:" + key)
+}
+
+// Adds Value to the quantile sketch stored at Key, creating it with size K
+// (or --quantile-k) if it doesn't exist
+type RecordRequest struct {
+	Key        string
+	Value      float64
+	K          int
+	ResultChan chan Result
+}
+
+// Reads the quantile sketch stored at Key into Sketch
+type QuantileRequest struct {
+	Key        string
+	Sketch     *quantiles.KLL
+	ResultChan chan Result
+}
+
+func (rr RecordRequest) WriteResult(result Result) {
+	result.Key = rr.Key
+	rr.ResultChan <- result
+}
+func (qr QuantileRequest) WriteResult(result Result) {
+	result.Key = qr.Key
+	qr.ResultChan <- result
+}
+
+func (rr RecordRequest) RequestKeys() []string   { return []string{rr.Key} }
+func (qr QuantileRequest) RequestKeys() []string { return []string{qr.Key} }
+
+func getQuantiles(batch *Batch, key string, k int) (*quantiles.KLL, error) {
+	data, err := batch.Get(quantileKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		if k == 0 {
+			k = *quantileK
+		}
+		return quantiles.NewKLL(k)
+	}
+	return quantiles.KLLFromBytes(data)
+}
+
+func (rr RecordRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if rr.Key == "" {
+		return nil, NoKeySpecified
+	}
+
+	kll, err := getQuantiles(batch, rr.Key, rr.K)
+	if err != nil {
+		return nil, err
+	}
+	kll.Update(rr.Value)
+	batch.Put(quantileKey(rr.Key), kll.Bytes())
+	return nil, nil
+}
+
+func (qr QuantileRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if qr.Key == "" {
+		return nil, NoKeySpecified
+	}
+
+	kll, err := getQuantiles(batch, qr.Key, 0)
+	if err != nil {
+		return nil, err
+	}
+	*qr.Sketch = *kll
+	return nil, nil
+}
+
+// Records a numeric `value` in the quantile sketch of `key`.  New sketches
+// take an optional `k` (default --quantile-k), larger values being more
+// accurate.
+func RecordHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	value_raw := reqParams.Get("value")
+	if value_raw == "" {
+		HttpError(w, 500, "MISSING_ARG_VALUE")
+		return
+	}
+	value, err := strconv.ParseFloat(value_raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		HttpError(w, 500, "INVALID_ARG_VALUE")
+		return
+	}
+
+	k := 0
+	if k_raw := reqParams.Get("k"); k_raw != "" {
+		k, err = strconv.Atoi(k_raw)
+		if err != nil || k < 8 {
+			HttpError(w, 500, "INVALID_ARG_K")
+			return
+		}
+	}
+
+	resultChan := make(chan Result)
+	recordRequest := RecordRequest{
+		Key:        key,
+		Value:      value,
+		K:          k,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(withBatching(recordRequest, reqParams)); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error == nil {
+		HttpResponse(w, 200, "OK")
+	} else {
+		HttpResultError(w, result.Key, result.Error)
+	}
+}
+
+// Estimates the values at one or more `q` quantiles (default 0.5, 0.9 and
+// 0.99) of what was recorded in `key`, along with the count, min and max.
+func QuantileHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	qs := []float64{0.5, 0.9, 0.99}
+	if qs_raw := reqParams["q"]; len(qs_raw) != 0 {
+		qs = make([]float64, len(qs_raw))
+		for i, q_raw := range qs_raw {
+			qs[i], err = strconv.ParseFloat(q_raw, 64)
+			if err != nil || qs[i] < 0 || qs[i] > 1 {
+				HttpError(w, 500, "INVALID_ARG_Q")
+				return
+			}
+		}
+	}
+
+	var kll quantiles.KLL
+	resultChan := make(chan Result)
+	quantileRequest := QuantileRequest{
+		Key:        key,
+		Sketch:     &kll,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(quantileRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+		return
+	}
+
+	summary := quantileSummary{
+		Key:       key,
+		Count:     kll.Count(),
+		Quantiles: make([]quantileValue, 0, len(qs)),
+	}
+	if kll.Count() == 0 {
+		HttpResponse(w, 200, summary)
+		return
+	}
+	summary.Min, summary.Max = kll.Min(), kll.Max()
+	for _, q := range qs {
+		value, _ := kll.Quantile(q)
+		summary.Quantiles = append(summary.Quantiles, quantileValue{q, value})
+	}
+	HttpResponse(w, 200, summary)
+}
@@ -0,0 +1,225 @@
+package quantiles
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Every level halves the number of values, so a sketch of a 64bit count never
+// needs more levels than this
+const maxLevels = 64
+
+var (
+	InvalidK        = errors.New("k must be at least 8")
+	InvalidRaw      = errors.New("could not read quantile sketch")
+	InvalidQuantile = errors.New("quantile must be between 0 and 1")
+)
+
+// A KLL sketch (Karnin, Lang & Liberty) summarizes a stream of values in
+// O(k log(n/k)) space so that any quantile can be estimated with a rank error
+// of about 1.7/k.  Values are kept in a stack of compactors where values at
+// level h stand in for 2^h values of the stream.  When a compactor is full it
+// is sorted and every other value is promoted to the level above, picking the
+// odd or even ones at random so the ranks stay unbiased.  Higher levels get
+// exponentially more room, by a factor 3/2, than the ones below them.
+type KLL struct {
+	k          int
+	compactors [][]float64
+	size       int
+	maxSize    int
+	count      uint64
+	min        float64
+	max        float64
+}
+
+func NewKLL(k int) (*KLL, error) {
+	if k < 8 {
+		return nil, InvalidK
+	}
+	kll := &KLL{k: k, min: math.Inf(1), max: math.Inf(-1)}
+	kll.grow()
+	return kll, nil
+}
+
+func (kll *KLL) K() int        { return kll.k }
+func (kll *KLL) Count() uint64 { return kll.count }
+func (kll *KLL) Min() float64  { return kll.min }
+func (kll *KLL) Max() float64  { return kll.max }
+
+func (kll *KLL) capacity(h int) int {
+	depth := len(kll.compactors) - h - 1
+	return int(math.Ceil(float64(kll.k)*math.Pow(2.0/3.0, float64(depth)))) + 1
+}
+
+func (kll *KLL) grow() {
+	kll.compactors = append(kll.compactors, nil)
+	kll.maxSize = 0
+	for h := range kll.compactors {
+		kll.maxSize += kll.capacity(h)
+	}
+}
+
+func (kll *KLL) Update(value float64) {
+	kll.compactors[0] = append(kll.compactors[0], value)
+	kll.size++
+	kll.count++
+	kll.min = math.Min(kll.min, value)
+	kll.max = math.Max(kll.max, value)
+	if kll.size >= kll.maxSize {
+		kll.compress()
+	}
+}
+
+// Compacts the lowest full compactor until the sketch fits again
+func (kll *KLL) compress() {
+	for h := 0; h < len(kll.compactors) && kll.size >= kll.maxSize; h++ {
+		compactor := kll.compactors[h]
+		if len(compactor) < kll.capacity(h) {
+			continue
+		}
+		if h+1 >= len(kll.compactors) {
+			kll.grow()
+		}
+
+		// An odd value out stays where it is
+		var kept []float64
+		if len(compactor)%2 == 1 {
+			kept = []float64{compactor[len(compactor)-1]}
+			compactor = compactor[:len(compactor)-1]
+		}
+		sort.Float64s(compactor)
+		for i := rand.Intn(2); i < len(compactor); i += 2 {
+			kll.compactors[h+1] = append(kll.compactors[h+1], compactor[i])
+		}
+		kll.size -= len(compactor) / 2
+		kll.compactors[h] = kept
+	}
+}
+
+// Merges other into the sketch so that it summarizes both streams.  The
+// result keeps the sketch's k.
+func (kll *KLL) Merge(other *KLL) {
+	if other.count == 0 {
+		return
+	}
+	for len(kll.compactors) < len(other.compactors) {
+		kll.grow()
+	}
+	for h, compactor := range other.compactors {
+		kll.compactors[h] = append(kll.compactors[h], compactor...)
+		kll.size += len(compactor)
+	}
+	kll.count += other.count
+	kll.min = math.Min(kll.min, other.min)
+	kll.max = math.Max(kll.max, other.max)
+	for kll.size >= kll.maxSize {
+		kll.compress()
+	}
+}
+
+type weightedValue struct {
+	value  float64
+	weight uint64
+}
+
+// Estimates the value below which a fraction q of the stream falls
+func (kll *KLL) Quantile(q float64) (float64, error) {
+	if q < 0 || q > 1 {
+		return 0, InvalidQuantile
+	}
+	if kll.count == 0 {
+		return math.NaN(), nil
+	}
+	if q == 0 {
+		return kll.min, nil
+	} else if q == 1 {
+		return kll.max, nil
+	}
+
+	values := make([]weightedValue, 0, kll.size)
+	var total uint64
+	for h, compactor := range kll.compactors {
+		for _, value := range compactor {
+			values = append(values, weightedValue{value, 1 << uint(h)})
+			total += 1 << uint(h)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].value < values[j].value })
+
+	rank := q * float64(total)
+	var cumulative uint64
+	for _, v := range values {
+		cumulative += v.weight
+		if float64(cumulative) >= rank {
+			return v.value, nil
+		}
+	}
+	return kll.max, nil
+}
+
+// The serialized form is the big endian k, count, min and max followed by
+// every compactor as its length and its values.
+func (kll *KLL) Bytes() []byte {
+	buf := make([]byte, 32+4*len(kll.compactors)+8*kll.size)
+	binary.BigEndian.PutUint32(buf, uint32(kll.k))
+	binary.BigEndian.PutUint64(buf[4:], kll.count)
+	binary.BigEndian.PutUint64(buf[12:], math.Float64bits(kll.min))
+	binary.BigEndian.PutUint64(buf[20:], math.Float64bits(kll.max))
+	binary.BigEndian.PutUint32(buf[28:], uint32(len(kll.compactors)))
+	i := 32
+	for _, compactor := range kll.compactors {
+		binary.BigEndian.PutUint32(buf[i:], uint32(len(compactor)))
+		i += 4
+		for _, value := range compactor {
+			binary.BigEndian.PutUint64(buf[i:], math.Float64bits(value))
+			i += 8
+		}
+	}
+	return buf
+}
+
+func KLLFromBytes(raw []byte) (*KLL, error) {
+	if len(raw) < 32 {
+		return nil, InvalidRaw
+	}
+	kll, err := NewKLL(int(binary.BigEndian.Uint32(raw)))
+	if err != nil {
+		return nil, err
+	}
+	kll.count = binary.BigEndian.Uint64(raw[4:])
+	kll.min = math.Float64frombits(binary.BigEndian.Uint64(raw[12:]))
+	kll.max = math.Float64frombits(binary.BigEndian.Uint64(raw[20:]))
+	levels := int(binary.BigEndian.Uint32(raw[28:]))
+	raw = raw[32:]
+	if levels > maxLevels {
+		return nil, InvalidRaw
+	}
+
+	for len(kll.compactors) < levels {
+		kll.grow()
+	}
+	for h := 0; h < levels; h++ {
+		if len(raw) < 4 {
+			return nil, InvalidRaw
+		}
+		n := int(binary.BigEndian.Uint32(raw))
+		raw = raw[4:]
+		if n < 0 || len(raw) < 8*n {
+			return nil, InvalidRaw
+		}
+		compactor := make([]float64, n)
+		for i := range compactor {
+			compactor[i] = math.Float64frombits(binary.BigEndian.Uint64(raw[8*i:]))
+		}
+		kll.compactors[h] = compactor
+		kll.size += n
+		raw = raw[8*n:]
+	}
+	if len(raw) != 0 {
+		return nil, InvalidRaw
+	}
+	return kll, nil
+}
@@ -0,0 +1,65 @@
+package quantiles
+
+import (
+	"github.com/bmizerany/assert"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestKLLQuantiles(t *testing.T) {
+	kll, err := NewKLL(200)
+	assert.Equal(t, err, nil)
+
+	n := 100000
+	for _, i := range rand.Perm(n) {
+		kll.Update(float64(i))
+	}
+	assert.Equal(t, kll.Count(), uint64(n))
+	assert.Equal(t, kll.Min(), 0.0)
+	assert.Equal(t, kll.Max(), float64(n-1))
+	if kll.size > 3*kll.k {
+		t.Errorf("Sketch holds %d values for k=%d", kll.size, kll.k)
+	}
+
+	for _, q := range []float64{0.01, 0.25, 0.5, 0.9, 0.99} {
+		value, err := kll.Quantile(q)
+		assert.Equal(t, err, nil)
+		if rankError := math.Abs(value/float64(n) - q); rankError > 0.02 {
+			t.Errorf("Quantile %f is %f, a rank error of %f", q, value, rankError)
+		}
+	}
+
+	_, err = kll.Quantile(1.5)
+	assert.Equal(t, err, InvalidQuantile)
+	_, err = NewKLL(2)
+	assert.Equal(t, err, InvalidK)
+}
+
+func TestKLLMergeAndBytes(t *testing.T) {
+	kll1, _ := NewKLL(128)
+	kll2, _ := NewKLL(128)
+	for i := 0; i < 50000; i++ {
+		kll1.Update(float64(i))
+		kll2.Update(float64(50000 + i))
+	}
+	kll1.Merge(kll2)
+	assert.Equal(t, kll1.Count(), uint64(100000))
+	median, _ := kll1.Quantile(0.5)
+	if math.Abs(median-50000) > 2000 {
+		t.Errorf("Median of the merged sketch is %f", median)
+	}
+
+	decoded, err := KLLFromBytes(kll1.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded.Bytes(), kll1.Bytes())
+	decodedMedian, _ := decoded.Quantile(0.5)
+	assert.Equal(t, decodedMedian, median)
+
+	_, err = KLLFromBytes(kll1.Bytes()[:40])
+	assert.Equal(t, err, InvalidRaw)
+
+	empty, _ := NewKLL(8)
+	value, _ := empty.Quantile(0.5)
+	assert.Equal(t, math.IsNaN(value), true)
+}
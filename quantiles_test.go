@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQuantiles(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_QUANTILES"
+	resultChan := make(chan Result)
+	clean := func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}
+	clean()
+	defer clean()
+
+	for i := 1; i <= 100; i++ {
+		w := httptest.NewRecorder()
+		RecordHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/record?key=%s&value=%d", key, i), nil))
+		assert.Equal(t, w.Code, 200)
+	}
+	w := httptest.NewRecorder()
+	RecordHandler(w, httptest.NewRequest("GET", "/record?key="+key+"&value=fast", nil))
+	assert.Equal(t, w.Code, 500)
+
+	w = httptest.NewRecorder()
+	QuantileHandler(w, httptest.NewRequest("GET", "/quantile?key="+key+"&q=0.5&q=0.99", nil))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data quantileSummary `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, response.Data.Count, uint64(100))
+	assert.Equal(t, response.Data.Min, 1.0)
+	assert.Equal(t, response.Data.Max, 100.0)
+	assert.Equal(t, response.Data.Quantiles, []quantileValue{{0.5, 50}, {0.99, 99}})
+
+	// the set and the quantile sketch of a key don't interfere
+	dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+	assert.Equal(t, (<-resultChan).Data.Cardinality(), 0.0)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/mynameisfiber/gocountme/algebra"
+)
+
+var (
+	queryPlanner      = NewQueryPlanner(0, false)
+	QueryTooExpensive = NewAPIError(400, "QUERY_TOO_EXPENSIVE", "Query is estimated to cost more than the query budget", false)
+)
+
+// Keeps queries that would read too many hashes from starving ingestion.  The
+// cost of a query is estimated up front as the number of sketches it reads
+// times k, before any set is read.  Queries over the budget are refused or,
+// when queue is set, run one at a time.
+type QueryPlanner struct {
+	budget    int
+	queue     bool
+	expensive chan struct{}
+}
+
+func NewQueryPlanner(budget int, queue bool) *QueryPlanner {
+	return &QueryPlanner{
+		budget:    budget,
+		queue:     queue,
+		expensive: make(chan struct{}, 1),
+	}
+}
+
+// Sets aren't read before planning, so they are assumed to have the k of new
+// sets
+func sketchesCost(sketches int) int {
+	return sketches * *defaultSize
+}
+
+// Every pair is intersected, so each set is read once per other set
+func correlationCost(sketches int) int {
+	return sketchesCost(sketches * (sketches - 1))
+}
+
+// Invalid queries cost nothing, they are refused before reading any set
+func queryCost(e *Element) int {
+	plan, err := algebra.NewPlan(e)
+	if err != nil {
+		return 0
+	}
+	return plan.Cost(*defaultSize)
+}
+
+// Admits a query of the given cost, waiting for its turn if it is over budget
+// and expensive queries are queued.  The returned func must be called once the
+// query is done.
+func (qp *QueryPlanner) Admit(ctx context.Context, cost int) (func(), error) {
+	if qp.budget <= 0 || cost <= qp.budget {
+		return func() {}, nil
+	}
+	if !qp.queue {
+		return nil, QueryTooExpensive
+	}
+	select {
+	case qp.expensive <- struct{}{}:
+		return func() { <-qp.expensive }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
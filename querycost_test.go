@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryCost(t *testing.T) {
+	query, err := unmarshalQuery([]byte(`{"method" : "jaccard", "set" : [{"method" : "union", "keys" : ["a", "b"]}, {"method" : "get", "keys" : ["c"]}]}`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, queryCost(query), sketchesCost(5))
+
+	query, _ = unmarshalQuery([]byte(`{"method" : "correlation", "keys" : ["a", "b", "c"]}`))
+	assert.Equal(t, queryCost(query), 6**defaultSize)
+}
+
+func TestQueryPlanner(t *testing.T) {
+	planner := NewQueryPlanner(100, false)
+	release, err := planner.Admit(context.Background(), 100)
+	assert.Equal(t, err, nil)
+	release()
+	_, err = planner.Admit(context.Background(), 101)
+	assert.Equal(t, err, QueryTooExpensive)
+
+	planner = NewQueryPlanner(100, true)
+	release, err = planner.Admit(context.Background(), 1000)
+	assert.Equal(t, err, nil)
+	// cheap queries don't wait for expensive ones
+	_, err = planner.Admit(context.Background(), 10)
+	assert.Equal(t, err, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = planner.Admit(ctx, 1000)
+	assert.Equal(t, err, context.DeadlineExceeded)
+	release()
+	release, err = planner.Admit(context.Background(), 1000)
+	assert.Equal(t, err, nil)
+	release()
+}
+
+func TestCorrelationOverBudget(t *testing.T) {
+	defer func() { queryPlanner = NewQueryPlanner(0, false) }()
+	queryPlanner = NewQueryPlanner(sketchesCost(5), false)
+
+	w := httptest.NewRecorder()
+	CorrelationMatrixHandler(w, httptest.NewRequest("GET", "/correlation?key=a&key=b&key=c", nil))
+	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, decodeError(t, w).Error.Code, "QUERY_TOO_EXPENSIVE")
+}
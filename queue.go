@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var QueueFull = NewAPIError(503, "QUEUE_FULL", "Request queue is full", true)
+
+// Number of requests turned away because the queue was full or memory ran low
+var rejectedRequests uint64
+
+// Queues a request for the DB workers.  Rather than letting callers pile up
+// behind a full queue, the request is given up on once --queue-timeout has
+// passed without room freeing up, and refused outright while memory is low.
+func submitRequest(request RequestCommand) error {
+	trackRequest(request)
+	var err error = MemoryPressure
+	if !memoryGuard.UnderPressure() {
+		err = dispatcher.Submit(request, *queueTimeout)
+	}
+	if err == QueueFull || err == MemoryPressure {
+		atomic.AddUint64(&rejectedRequests, 1)
+	}
+	return err
+}
+
+// Says how many seconds to back off for in the Retry-After header
+func setRetryAfter(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter().Seconds())))
+}
+
+// Clients are asked to wait at least a second, longer if the batch latency
+// means the queue can't drain any quicker
+func retryAfter() time.Duration {
+	wait := time.Second
+	if latency := getBatchPolicy().MaxLatency; latency > wait {
+		wait = latency.Round(time.Second)
+	}
+	return wait
+}
+
+type queueStats struct {
+	Shards   int    `json:"shards"`
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Rejected uint64 `json:"rejected"`
+
+	// The read pool, if there is one
+	ReadWorkers  int `json:"read_workers"`
+	ReadDepth    int `json:"read_depth"`
+	ReadCapacity int `json:"read_capacity"`
+}
+
+func getQueueStats() queueStats {
+	stats := dispatcher.stats()
+	stats.Rejected = atomic.LoadUint64(&rejectedRequests)
+	return stats
+}
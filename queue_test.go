@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSubmitRequest(t *testing.T) {
+	dispatcher = NewDispatcher(nil, 1, 1)
+	defer func() { dispatcher = nil }()
+	rejected := getQueueStats().Rejected
+
+	err := submitRequest(GetRequest{Key: "foo"})
+	assert.Equal(t, err, nil)
+	err = submitRequest(GetRequest{Key: "bar"})
+	assert.Equal(t, err, QueueFull)
+
+	stats := getQueueStats()
+	assert.Equal(t, stats.Shards, 1)
+	assert.Equal(t, stats.Depth, 1)
+	assert.Equal(t, stats.Capacity, 1)
+	assert.Equal(t, stats.Rejected, rejected+1)
+
+	w := httptest.NewRecorder()
+	GetHandler(w, httptest.NewRequest("GET", "/get?key=foo", nil))
+	assert.Equal(t, w.Code, 503)
+	assert.Equal(t, w.Header().Get("Retry-After"), "1")
+}
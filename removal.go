@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+)
+
+type removal struct {
+	Key         string  `json:"key"`
+	Requested   int     `json:"requested"`
+	Removed     int     `json:"removed"`
+	Cardinality float64 `json:"cardinality"`
+}
+
+// Removes the hashes of values from the set stored at Key, along with the
+// values and timestamps kept for them, and counts how many the set retained
+// in Removed
+type RemoveValuesRequest struct {
+	Key        string
+	Hashes     []uint64
+	Removed    *int
+	ResultChan chan Result
+}
+
+func (rr RemoveValuesRequest) WriteResult(result Result) {
+	result.Key = rr.Key
+	rr.ResultChan <- result
+}
+
+func (rr RemoveValuesRequest) RequestKeys() []string { return []string{rr.Key} }
+
+func (rr RemoveValuesRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if rr.Key == "" {
+		return nil, NoKeySpecified
+	}
+	batch.InvalidateExact(rr.Key)
+
+	keyBytes := []byte(rr.Key)
+	data, err := batch.Get(keyBytes)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	kmv, err := kminvalues.KMinValuesFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := 0
+	for _, hash := range rr.Hashes {
+		if kmv.RemoveHash(hash) {
+			removed++
+		}
+	}
+	*rr.Removed = removed
+
+	// Values are forgotten even if their hash wasn't retained by the set
+	for _, stored := range [][]byte{sampleKey(rr.Key), valueIndexKey(rr.Key), firstSeenKey(rr.Key)} {
+		if err := removeValueEntries(batch, stored, rr.Hashes); err != nil {
+			return nil, err
+		}
+	}
+	if err := removeFromBreakdown(batch, rr.Key, rr.Hashes); err != nil {
+		return nil, err
+	}
+	if err := unmirrorShadow(batch, rr.Key, rr.Hashes); err != nil {
+		return nil, err
+	}
+
+	if removed != 0 {
+		if err := batch.PutSketch(keyBytes, kmv); err != nil {
+			return nil, err
+		}
+		batch.Publish(rr.Key, kmv, nil)
+	}
+	return kmv, nil
+}
+
+func removeValueEntries(batch *Batch, key []byte, hashes []uint64) error {
+	data, err := batch.Get(key)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	entries, err := decodeValues(data)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[uint64]bool, len(hashes))
+	for _, hash := range hashes {
+		remove[hash] = true
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !remove[entry.hash] {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) != len(entries) {
+		batch.Put(key, encodeValues(kept))
+	}
+	return nil
+}
+
+func removeFromBreakdown(batch *Batch, key string, hashes []uint64) error {
+	data, err := batch.Get(breakdownKey(key))
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	labels, err := decodeBreakdown(data)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, sketch := range labels {
+		for _, hash := range hashes {
+			if sketch.RemoveHash(hash) {
+				changed = true
+			}
+		}
+	}
+	if changed {
+		batch.Put(breakdownKey(key), encodeBreakdown(labels))
+	}
+	return nil
+}
+
+// Best effort removal of one or more `value`s from `key`, given as parameters
+// or one per line in the body, for when a value must be forgotten.  Must be
+// sent as a DELETE.
+func RemoveValueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		HttpError(w, 405, "METHOD_NOT_ALLOWED")
+		return
+	}
+
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	values := reqParams["value"]
+	if r.Body != nil {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				values = append(values, line)
+			}
+		}
+		if scanner.Err() != nil {
+			HttpError(w, 500, "INVALID_BODY")
+			return
+		}
+	}
+	if len(values) == 0 {
+		HttpError(w, 500, "MISSING_ARG_VALUE")
+		return
+	}
+
+	hashes := make([]uint64, len(values))
+	for i, value := range values {
+		value, err = prepareValue(key, value)
+		if err != nil {
+			HttpResultError(w, key, err)
+			return
+		}
+		hashes[i] = hashValue(key, value)
+	}
+
+	var removed int
+	resultChan := make(chan Result)
+	removeRequest := RemoveValuesRequest{
+		Key:        key,
+		Hashes:     hashes,
+		Removed:    &removed,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(withFencing(removeRequest, reqParams)); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+		return
+	}
+
+	response := removal{Key: key, Requested: len(values), Removed: removed}
+	if result.Data != nil {
+		response.Cardinality = result.Data.Cardinality()
+	}
+	HttpResponse(w, 200, response)
+}
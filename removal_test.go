@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRemoveValue(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_REMOVE"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kminvalues.NewKMinValues(16), ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	*sampleSize = 16
+	defer func() { *sampleSize = 0 }()
+	for _, value := range []string{"alice", "bob", "carol", "dave"} {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: Hashify([]byte(value)), Value: []byte(value), ResultChan: resultChan})
+		<-resultChan
+	}
+
+	w := httptest.NewRecorder()
+	RemoveValueHandler(w, httptest.NewRequest("GET", "/value?key="+key+"&value=alice", nil))
+	assert.Equal(t, w.Code, 405)
+
+	w = httptest.NewRecorder()
+	body := strings.NewReader("carol\nnobody\n")
+	RemoveValueHandler(w, httptest.NewRequest("DELETE", "/value?key="+key+"&value=alice", body))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data removal `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, response.Data, removal{Key: key, Requested: 3, Removed: 2, Cardinality: 2})
+
+	w = httptest.NewRecorder()
+	SampleHandler(w, httptest.NewRequest("GET", "/sample?key="+key, nil))
+	assert.Equal(t, strings.Contains(w.Body.String(), "alice"), false)
+	assert.Equal(t, strings.Contains(w.Body.String(), "bob"), true)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var replicator *Replicator
+
+// Peers stream their changes for as long as we follow them, so unlike
+// notifications there is no overall timeout
+var replicationClient = &http.Client{}
+
+// A change as read back from the /changes of a peer
+type peerChange struct {
+	Seq     uint64                 `json:"seq"`
+	Key     string                 `json:"key"`
+	Deleted bool                   `json:"deleted"`
+	Set     *kminvalues.KMinValues `json:"set"`
+	Delta   *kminvalues.KMinValues `json:"delta"`
+}
+
+type peerStatus struct {
+	Peer      string    `json:"peer"`
+	Connected bool      `json:"connected"`
+	Seq       uint64    `json:"seq"`
+	Applied   uint64    `json:"applied"`
+	LastError string    `json:"last_error,omitempty"`
+	LastSync  time.Time `json:"last_sync,omitempty"`
+
+	// Results of the last anti-entropy repair
+	LastRepair      time.Time `json:"last_repair,omitempty"`
+	DivergentLeaves int       `json:"divergent_leaves"`
+	Repaired        uint64    `json:"repaired"`
+	RepairError     string    `json:"repair_error,omitempty"`
+}
+
+type peerFollower struct {
+	sync.Mutex
+	url    string
+	status peerStatus
+}
+
+// Replicates between datacenters by following the changes of every peer and
+// merging them into the local sets.  Every datacenter takes writes locally and
+// since merges are commutative and idempotent the sets converge no matter the
+// order changes arrive in.  Merges that don't change a set aren't written, so
+// a change echoed back by its origin stops there.  Deletes aren't replicated,
+// since a set deleted in one datacenter would just be merged back from the
+// others.  Changes missed while a peer couldn't be followed are caught up on
+// by comparing merkle trees of the sets every repairEvery.
+type Replicator struct {
+	peers       []*peerFollower
+	retry       time.Duration
+	repairEvery time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// Parses a comma separated list of peer base URLs, eg: http://dc2:8080
+func parsePeers(peers_raw string) []string {
+	var peers []string
+	for _, peer := range strings.Split(peers_raw, ",") {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func NewReplicator(peers []string, retry, repairEvery time.Duration) *Replicator {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replicator{retry: retry, repairEvery: repairEvery, ctx: ctx, cancel: cancel}
+	for _, peer := range peers {
+		r.peers = append(r.peers, &peerFollower{url: peer, status: peerStatus{Peer: peer}})
+	}
+	return r
+}
+
+func (r *Replicator) Start() {
+	for _, pf := range r.peers {
+		r.wg.Add(1)
+		go func(pf *peerFollower) {
+			defer r.wg.Done()
+			for {
+				err := pf.follow(r.ctx)
+				if r.ctx.Err() != nil {
+					return
+				}
+				log.Printf("Lost replication from %s: %s", pf.url, err)
+				select {
+				case <-time.After(r.retry):
+				case <-r.ctx.Done():
+					return
+				}
+			}
+		}(pf)
+
+		if r.repairEvery > 0 {
+			r.wg.Add(1)
+			go func(pf *peerFollower) {
+				defer r.wg.Done()
+				ticker := time.NewTicker(r.repairEvery)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						pf.runRepair(r.ctx)
+					case <-r.ctx.Done():
+						return
+					}
+				}
+			}(pf)
+		}
+	}
+}
+
+func (pf *peerFollower) runRepair(ctx context.Context) {
+	leaves, merged, err := pf.repair(ctx, dispatcher.database)
+	pf.Lock()
+	defer pf.Unlock()
+	pf.status.LastRepair = time.Now()
+	pf.status.DivergentLeaves = leaves
+	pf.status.Repaired += uint64(merged)
+	pf.status.RepairError = ""
+	if err != nil {
+		log.Printf("Could not repair from %s: %s", pf.url, err)
+		pf.status.RepairError = err.Error()
+	}
+}
+
+// Stops following peers.  Must be called before the dispatcher is closed.
+func (r *Replicator) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *Replicator) Status() []peerStatus {
+	statuses := make([]peerStatus, len(r.peers))
+	for i, pf := range r.peers {
+		pf.Lock()
+		statuses[i] = pf.status
+		pf.Unlock()
+	}
+	return statuses
+}
+
+// Streams the peer's changes from the last one applied and merges them in
+// until the stream ends.  A peer that no longer has the changes since then is
+// followed from its latest change, leaving the changes in between to
+// anti-entropy.
+func (pf *peerFollower) follow(ctx context.Context) error {
+	pf.Lock()
+	since := pf.status.Seq
+	pf.Unlock()
+
+	url := pf.url + "/changes?format=delta"
+	if since > 0 {
+		url += fmt.Sprintf("&since=%d", since)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return pf.fail(err)
+	}
+	resp, err := replicationClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return pf.fail(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 410 {
+		log.Printf("Changes of %s since %d are gone, following from its latest change", pf.url, since)
+		pf.Lock()
+		pf.status.Seq = 0
+		pf.Unlock()
+		return pf.fail(CursorExpired)
+	} else if resp.StatusCode != 200 {
+		return pf.fail(fmt.Errorf("peer returned %s", resp.Status))
+	}
+
+	pf.Lock()
+	pf.status.Connected = true
+	pf.status.LastError = ""
+	pf.Unlock()
+	defer func() {
+		pf.Lock()
+		pf.status.Connected = false
+		pf.Unlock()
+	}()
+
+	decoder := json.NewDecoder(resp.Body)
+	resultChan := make(chan Result)
+	for {
+		var change peerChange
+		if err := decoder.Decode(&change); err != nil {
+			return pf.fail(err)
+		}
+
+		applied := false
+		kmv := change.Delta
+		if kmv == nil {
+			kmv = change.Set
+		}
+		if !change.Deleted && kmv != nil {
+			dispatcher.Dispatch(MergeRequest{
+				Key:           change.Key,
+				Kmv:           kmv,
+				SkipUnchanged: true,
+				ResultChan:    resultChan,
+			})
+			result := <-resultChan
+			if result.Error != nil {
+				return pf.fail(fmt.Errorf("could not merge %s: %s", change.Key, result.Error))
+			}
+			applied = true
+		}
+
+		pf.Lock()
+		pf.status.Seq = change.Seq
+		pf.status.LastSync = time.Now()
+		if applied {
+			pf.status.Applied++
+		}
+		pf.Unlock()
+	}
+}
+
+func (pf *peerFollower) fail(err error) error {
+	pf.Lock()
+	pf.status.LastError = err.Error()
+	pf.Unlock()
+	return err
+}
+
+// Lists every peer we follow, whether we are connected and the last of its
+// changes we applied
+func ReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	if replicator == nil {
+		HttpResponse(w, 200, []peerStatus{})
+		return
+	}
+	HttpResponse(w, 200, replicator.Status())
+}
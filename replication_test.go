@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_REPLICATION"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	kmv := kminvalues.NewKMinValues(16)
+	kmv.AddHash(1 << 60)
+	kmv.AddHash(2 << 60)
+	var since []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since = append(since, r.URL.Query().Get("since"))
+		encoder := json.NewEncoder(w)
+		encoder.Encode(changeEvent{Seq: 7, Key: key, Delta: &kminvalues.Base64KMinValues{KMinValues: kmv}})
+		encoder.Encode(changeEvent{Seq: 8, Key: key, Deleted: true})
+		fmt.Fprint(w, `{"seq" : 9, "key" : "`+key+`", "set" : {"k" : 16, "hashes" : [1152921504606846976]}}`)
+	}))
+	defer peer.Close()
+
+	updates := changes.Subscribe([]string{key}, 8)
+	defer changes.Unsubscribe(updates)
+
+	peers := parsePeers(" " + peer.URL + "/, ")
+	assert.Equal(t, peers, []string{peer.URL})
+	r := NewReplicator(peers, 0, 0)
+	pf := r.peers[0]
+
+	// Changes are applied until the stream ends and followed from the last
+	pf.follow(context.Background())
+	pf.follow(context.Background())
+	assert.Equal(t, since, []string{"", "9"})
+	status := r.Status()[0]
+	assert.Equal(t, status.Seq, uint64(9))
+	assert.Equal(t, status.Applied, uint64(4))
+	assert.Equal(t, status.Connected, false)
+
+	// Only the first merge changed the set, the delete was skipped
+	assert.Equal(t, len(updates), 1)
+	dispatcher.Dispatch(GetRequest{Key: key, ResultChan: resultChan})
+	result := <-resultChan
+	assert.Equal(t, result.Data.Bytes(), kmv.Bytes())
+}
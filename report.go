@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The most groups a single report can return
+const maxReportGroups = 1000
+
+var (
+	InvalidReportPattern = errors.New("Report patterns need at least one distinct {dimension}")
+	TooManyReportGroups  = NewAPIError(400, "TOO_MANY_GROUPS", "Report has too many groups, group by fewer dimensions", false)
+)
+
+// A key pattern such as users:{country}:{date}, where every {dimension}
+// captures one or more characters of the keys it matches
+type reportPattern struct {
+	re         *regexp.Regexp
+	dimensions []string
+	prefix     string // the literal start of the pattern, which keys are scanned from
+}
+
+func parseReportPattern(pattern string) (*reportPattern, error) {
+	rp := &reportPattern{}
+	expr := "^"
+	last := 0
+	seen := make(map[string]bool)
+	for _, match := range templateField.FindAllStringSubmatchIndex(pattern, -1) {
+		dimension := pattern[match[2]:match[3]]
+		if seen[dimension] {
+			return nil, InvalidReportPattern
+		}
+		seen[dimension] = true
+		if len(rp.dimensions) == 0 {
+			rp.prefix = pattern[:match[0]]
+		}
+		rp.dimensions = append(rp.dimensions, dimension)
+		expr += regexp.QuoteMeta(pattern[last:match[0]]) + "(.+?)"
+		last = match[1]
+	}
+	if len(rp.dimensions) == 0 {
+		return nil, InvalidReportPattern
+	}
+	rp.re = regexp.MustCompile(expr + regexp.QuoteMeta(pattern[last:]) + "$")
+	return rp, nil
+}
+
+// The value of every dimension of the pattern in key, or nil if key doesn't
+// match the pattern
+func (rp *reportPattern) match(key []byte) map[string]string {
+	captures := rp.re.FindSubmatch(key)
+	if captures == nil {
+		return nil
+	}
+	values := make(map[string]string, len(rp.dimensions))
+	for i, dimension := range rp.dimensions {
+		values[dimension] = string(captures[i+1])
+	}
+	return values
+}
+
+type reportGroup struct {
+	Dimensions  map[string]string `json:"dimensions"`
+	Cardinality float64           `json:"cardinality"`
+	Keys        int               `json:"keys"`
+
+	id         string
+	partitions map[string]*kminvalues.KMinValues
+}
+
+type report struct {
+	Pattern string         `json:"pattern"`
+	GroupBy []string       `json:"group_by"`
+	Union   string         `json:"union,omitempty"`
+	Groups  []*reportGroup `json:"groups"`
+}
+
+// Joins the values of dimensions into an id with a NUL between them, which
+// keys can't hold
+func dimensionsID(values map[string]string, dimensions []string) string {
+	parts := make([]string, len(dimensions))
+	for i, dimension := range dimensions {
+		parts[i] = values[dimension]
+	}
+	return strings.Join(parts, internalKeyPrefix)
+}
+
+// Groups the keys matching `pattern`, eg: users:{country}:{date}, by the
+// values of the `group_by` dimensions (comma separated, default all of them,
+// none if it is empty) and estimates the cardinality of every group.  Cardinalities are summed
+// over the dimensions that aren't grouped by, which should split the keys into
+// disjoint sets, so with `union` set to a dimension the sets are unioned
+// across it instead, eg: the users of a country over several dates.  Without
+// `union` only the summaries of the keys are read.
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	pattern, err := parseReportPattern(reqParams.Get("pattern"))
+	if err != nil {
+		HttpError(w, 500, "INVALID_ARG_PATTERN")
+		return
+	}
+
+	union := reqParams.Get("union")
+	if union != "" && !containsString(pattern.dimensions, union) {
+		HttpError(w, 500, "INVALID_ARG_UNION")
+		return
+	}
+
+	groupBy := []string{}
+	if _, given := reqParams["group_by"]; given {
+		groupBy = append(groupBy, splitList(reqParams.Get("group_by"))...)
+		for _, dimension := range groupBy {
+			if !containsString(pattern.dimensions, dimension) || dimension == union {
+				HttpError(w, 500, "INVALID_ARG_GROUP_BY")
+				return
+			}
+		}
+	} else {
+		for _, dimension := range pattern.dimensions {
+			if dimension != union {
+				groupBy = append(groupBy, dimension)
+			}
+		}
+	}
+
+	// With a union the keys of a group are unioned within partitions that
+	// agree on every other dimension, and the partitions summed
+	var partitionBy []string
+	for _, dimension := range pattern.dimensions {
+		if dimension != union && !containsString(groupBy, dimension) {
+			partitionBy = append(partitionBy, dimension)
+		}
+	}
+
+	groups := make(map[string]*reportGroup)
+	groupFor := func(values map[string]string) *reportGroup {
+		id := dimensionsID(values, groupBy)
+		group, found := groups[id]
+		if !found && len(groups) < maxReportGroups {
+			group = &reportGroup{Dimensions: make(map[string]string, len(groupBy)), id: id}
+			for _, dimension := range groupBy {
+				group.Dimensions[dimension] = values[dimension]
+			}
+			groups[id] = group
+		}
+		return group
+	}
+
+	prefix := []byte(pattern.prefix)
+	tooMany := false
+	if union == "" {
+		err = scanSummaries(dispatcher.database, prefix, nil, func(key []byte, summary keySummary) bool {
+			values := pattern.match(key)
+			if values == nil {
+				return true
+			}
+			group := groupFor(values)
+			if group == nil {
+				tooMany = true
+				return false
+			}
+			group.Cardinality += summary.Cardinality
+			group.Keys++
+			return true
+		})
+	} else {
+		err = scanKeys(dispatcher.database, prefix, nil, func(key, data []byte, kmv *kminvalues.KMinValues) bool {
+			values := pattern.match(key)
+			if values == nil {
+				return true
+			}
+			group := groupFor(values)
+			if group == nil {
+				tooMany = true
+				return false
+			}
+			if group.partitions == nil {
+				group.partitions = make(map[string]*kminvalues.KMinValues)
+			}
+			partition := dimensionsID(values, partitionBy)
+			if merged, found := group.partitions[partition]; found {
+				merged.Merge(kmv)
+			} else {
+				group.partitions[partition] = kmv
+			}
+			group.Keys++
+			return true
+		})
+	}
+	if err == nil && tooMany {
+		err = TooManyReportGroups
+	}
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+
+	result := report{Pattern: reqParams.Get("pattern"), GroupBy: groupBy, Union: union, Groups: make([]*reportGroup, 0, len(groups))}
+	for _, group := range groups {
+		for _, kmv := range group.partitions {
+			group.Cardinality += kmv.Cardinality()
+		}
+		result.Groups = append(result.Groups, group)
+	}
+	sort.Slice(result.Groups, func(i, j int) bool { return result.Groups[i].id < result.Groups[j].id })
+	HttpResponse(w, 200, result)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReportPattern(t *testing.T) {
+	pattern, err := parseReportPattern("users:{country}:{date}")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pattern.prefix, "users:")
+	assert.Equal(t, pattern.dimensions, []string{"country", "date"})
+	assert.Equal(t, pattern.match([]byte("users:US:2017-07-14")), map[string]string{"country": "US", "date": "2017-07-14"})
+	assert.Equal(t, pattern.match([]byte("users:US")), map[string]string(nil))
+	assert.Equal(t, pattern.match([]byte("visits:US:2017-07-14")), map[string]string(nil))
+
+	_, err = parseReportPattern("users:all")
+	assert.Equal(t, err, InvalidReportPattern)
+	_, err = parseReportPattern("users:{date}:{date}")
+	assert.Equal(t, err, InvalidReportPattern)
+}
+
+func TestReportHandler(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	// every country sees users 0-99 on the first date and 50-149 on the second
+	resultChan := make(chan Result)
+	var keys []string
+	for _, country := range []string{"FR", "US"} {
+		for d, date := range []string{"d1", "d2"} {
+			key := fmt.Sprintf("_GOTEST_REPORT:%s:%s", country, date)
+			keys = append(keys, key)
+			for i := 50 * d; i < 50*d+100; i++ {
+				hash := Hashify([]byte(fmt.Sprintf("%s%d", country, i)))
+				dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, ResultChan: resultChan})
+				<-resultChan
+			}
+		}
+	}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	getReport := func(query string) report {
+		w := httptest.NewRecorder()
+		ReportHandler(w, httptest.NewRequest("GET", "/report?pattern=_GOTEST_REPORT:{country}:{date}&"+query, nil))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data report `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	result := getReport("")
+	assert.Equal(t, result.GroupBy, []string{"country", "date"})
+	assert.Equal(t, len(result.Groups), 4)
+	assert.Equal(t, result.Groups[1].Dimensions, map[string]string{"country": "FR", "date": "d2"})
+	assert.Equal(t, result.Groups[1].Cardinality, 100.0)
+
+	result = getReport("group_by=date")
+	assert.Equal(t, len(result.Groups), 2)
+	assert.Equal(t, result.Groups[0].Cardinality, 200.0)
+	assert.Equal(t, result.Groups[0].Keys, 2)
+
+	result = getReport("union=date")
+	assert.Equal(t, result.GroupBy, []string{"country"})
+	assert.Equal(t, len(result.Groups), 2)
+	assert.Equal(t, result.Groups[1].Dimensions, map[string]string{"country": "US"})
+	assert.Equal(t, result.Groups[1].Cardinality, 150.0)
+
+	// countries are summed, dates unioned within each of them
+	result = getReport("group_by=&union=date")
+	assert.Equal(t, len(result.Groups), 1)
+	assert.Equal(t, result.Groups[0].Cardinality, 300.0)
+	assert.Equal(t, result.Groups[0].Keys, 4)
+
+	w := httptest.NewRecorder()
+	ReportHandler(w, httptest.NewRequest("GET", "/report?pattern=_GOTEST_REPORT:{country}&group_by=date", nil))
+	assert.Equal(t, decodeError(t, w).Error.Code, "INVALID_ARG_GROUP_BY")
+}
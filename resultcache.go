@@ -0,0 +1,160 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var intersections = NewIntersectionCache(0)
+
+// Bytes taken by an entry besides its key
+const cachedIntersectionOverhead = 128
+
+type resultCacheStats struct {
+	Capacity  int    `json:"capacity"`
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type cachedIntersection struct {
+	key          string
+	intersection kminvalues.Intersection
+}
+
+// Caches intersections, which Jaccard, correlation and intersection queries
+// are built from, keyed by the versions of the sets taking part.  A version
+// is a hash of the set's bytes, so as soon as any of the sets is updated its
+// cached results no longer match and they are left to be evicted, least
+// recently used first, with no need to track writes.
+type IntersectionCache struct {
+	sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+	stats    resultCacheStats
+}
+
+func NewIntersectionCache(capacity int) *IntersectionCache {
+	return &IntersectionCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		stats:    resultCacheStats{Capacity: capacity},
+	}
+}
+
+func sketchVersion(kmv *kminvalues.KMinValues) uint64 {
+	return dataVersion(kmv.Bytes())
+}
+
+func sketchVersions(sets []*kminvalues.KMinValues) []uint64 {
+	versions := make([]uint64, len(sets))
+	for i, kmv := range sets {
+		versions[i] = sketchVersion(kmv)
+	}
+	return versions
+}
+
+// The order of the sets doesn't change their intersection, so their versions
+// are sorted
+func intersectionCacheKey(m int, versions []uint64) string {
+	sorted := make([]string, len(versions))
+	for i, version := range versions {
+		sorted[i] = fmt.Sprintf("%016x", version)
+	}
+	sort.Strings(sorted)
+	return fmt.Sprintf("%d:%s", m, strings.Join(sorted, ","))
+}
+
+func (ic *IntersectionCache) Intersect(sets ...*kminvalues.KMinValues) kminvalues.Intersection {
+	return ic.IntersectAtLeast(len(sets), sets...)
+}
+
+// Same as kminvalues.IntersectAtLeast, answered from the cache when the same
+// versions of the sets were intersected before
+func (ic *IntersectionCache) IntersectAtLeast(m int, sets ...*kminvalues.KMinValues) kminvalues.Intersection {
+	if ic.capacity <= 0 {
+		return kminvalues.IntersectAtLeast(m, sets...)
+	}
+	return ic.intersect(m, sets, sketchVersions(sets))
+}
+
+// Intersects every pair of sets, in order, hashing each set only once
+func (ic *IntersectionCache) Correlate(sets []*kminvalues.KMinValues, f func(i, j int, intersection kminvalues.Intersection)) {
+	var versions []uint64
+	if ic.capacity > 0 {
+		versions = sketchVersions(sets)
+	}
+	for i := range sets {
+		for j := i + 1; j < len(sets); j++ {
+			pair := []*kminvalues.KMinValues{sets[i], sets[j]}
+			if versions == nil {
+				f(i, j, kminvalues.Intersect(pair...))
+			} else {
+				f(i, j, ic.intersect(2, pair, []uint64{versions[i], versions[j]}))
+			}
+		}
+	}
+}
+
+func (ic *IntersectionCache) intersect(m int, sets []*kminvalues.KMinValues, versions []uint64) kminvalues.Intersection {
+	key := intersectionCacheKey(m, versions)
+	ic.Lock()
+	if element, found := ic.entries[key]; found {
+		ic.lru.MoveToFront(element)
+		ic.stats.Hits++
+		ic.Unlock()
+		return element.Value.(*cachedIntersection).intersection
+	}
+	ic.stats.Misses++
+	ic.Unlock()
+
+	intersection := kminvalues.IntersectAtLeast(m, sets...)
+
+	ic.Lock()
+	defer ic.Unlock()
+	if _, found := ic.entries[key]; !found {
+		ic.entries[key] = ic.lru.PushFront(&cachedIntersection{key, intersection})
+		for ic.lru.Len() > ic.capacity {
+			oldest := ic.lru.Back()
+			ic.lru.Remove(oldest)
+			delete(ic.entries, oldest.Value.(*cachedIntersection).key)
+			ic.stats.Evictions++
+		}
+	}
+	return intersection
+}
+
+func (ic *IntersectionCache) Stats() resultCacheStats {
+	ic.Lock()
+	defer ic.Unlock()
+	stats := ic.stats
+	stats.Entries = ic.lru.Len()
+	return stats
+}
+
+// Approximate bytes held by the entries, counting the list and map overhead
+func (ic *IntersectionCache) memoryBytes() int64 {
+	ic.Lock()
+	defer ic.Unlock()
+	var total int64
+	for key := range ic.entries {
+		total += 2*int64(len(key)) + cachedIntersectionOverhead
+	}
+	return total
+}
+
+// Drops every entry, eg: to free memory
+func (ic *IntersectionCache) Purge() {
+	ic.Lock()
+	defer ic.Unlock()
+	ic.stats.Evictions += uint64(ic.lru.Len())
+	ic.entries = make(map[string]*list.Element)
+	ic.lru.Init()
+}
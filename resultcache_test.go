@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"testing"
+)
+
+func cacheTestSet(start, count int) *kminvalues.KMinValues {
+	kmv := kminvalues.NewKMinValues(64)
+	for i := start; i < start+count; i++ {
+		kmv.AddHash(uint64(i) << 40)
+	}
+	return kmv
+}
+
+func TestIntersectionCache(t *testing.T) {
+	cache := NewIntersectionCache(2)
+	a, b, c := cacheTestSet(0, 100), cacheTestSet(50, 100), cacheTestSet(75, 100)
+
+	expected := kminvalues.Intersect(a, b)
+	assert.Equal(t, cache.Intersect(a, b), expected)
+	assert.Equal(t, cache.Intersect(b, a), expected)
+	assert.Equal(t, cache.Stats().Hits, uint64(1))
+	assert.Equal(t, cache.Stats().Misses, uint64(1))
+
+	// an updated set has a new version, so its old results aren't used
+	b.AddHash(1)
+	assert.Equal(t, cache.Intersect(a, b), kminvalues.Intersect(a, b))
+	assert.Equal(t, cache.Stats().Misses, uint64(2))
+
+	assert.Equal(t, cache.IntersectAtLeast(2, a, b, c), kminvalues.IntersectAtLeast(2, a, b, c))
+	stats := cache.Stats()
+	assert.Equal(t, stats.Entries, 2)
+	assert.Equal(t, stats.Evictions, uint64(1))
+	assert.Equal(t, stats.Capacity, 2)
+}
+
+func TestIntersectionCacheCorrelate(t *testing.T) {
+	sets := []*kminvalues.KMinValues{cacheTestSet(0, 100), cacheTestSet(50, 100), cacheTestSet(75, 100)}
+	for _, cache := range []*IntersectionCache{NewIntersectionCache(0), NewIntersectionCache(10)} {
+		pairs := 0
+		cache.Correlate(sets, func(i, j int, intersection kminvalues.Intersection) {
+			assert.Equal(t, intersection, kminvalues.Intersect(sets[i], sets[j]))
+			pairs++
+		})
+		assert.Equal(t, pairs, 3)
+	}
+
+	cache := NewIntersectionCache(10)
+	cache.Correlate(sets, func(i, j int, intersection kminvalues.Intersection) {})
+	cache.Correlate(sets, func(i, j int, intersection kminvalues.Intersection) {})
+	assert.Equal(t, cache.Stats().Hits, uint64(3))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var hashSalts map[string][]byte
+
+// Values hashed per worker by hashValues
+const hashChunkSize = 1000
+
+// Loads a JSON file of key prefixes and the environment variable holding the
+// secret salt for keys starting with them, eg: {"tenant1:" : "TENANT1_SALT"}
+func LoadHashSalts(filename string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var variables map[string]string
+	err = json.Unmarshal(data, &variables)
+	if err != nil {
+		return nil, err
+	}
+
+	salts := make(map[string][]byte, len(variables))
+	for prefix, variable := range variables {
+		salt := os.Getenv(variable)
+		if salt == "" {
+			return nil, fmt.Errorf("Environment variable %s for %q is not set", variable, prefix)
+		}
+		salts[prefix] = []byte(salt)
+	}
+	return salts, nil
+}
+
+// Finds the salt of the longest prefix matching key, if any
+func saltFor(key string) []byte {
+	return longestPrefix(hashSalts, key)
+}
+
+// Hashes a value counted in key.  Values of keys with a salt are hashed with
+// HMAC-SHA256 keyed by the salt instead of murmur3, so that without the salt
+// their hashes can't be matched against those of the same values elsewhere.
+func hashValue(key, value string) uint64 {
+	high, _ := hashValue128(key, value)
+	return high
+}
+
+// Same as hashValue along with the low half of the value's 128bit hash, which
+// only 128bit sets keep
+func hashValue128(key, value string) (high, low uint64) {
+	salt := saltFor(key)
+	if salt == nil {
+		return Hashify128([]byte(value))
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	sum := mac.Sum(nil)
+	return binary.LittleEndian.Uint64(sum), binary.LittleEndian.Uint64(sum[8:])
+}
+
+// Same as hashValue128 for every value of a batch counted in key, with the
+// salt looked up and the HMAC set up once per batch rather than per value.
+// Batches of more than hashChunkSize values are split between up to
+// --hash-workers goroutines.
+func hashValues(key string, values []string) (highs, lows []uint64) {
+	highs, lows = make([]uint64, len(values)), make([]uint64, len(values))
+	salt := saltFor(key)
+	hashChunk := func(start, end int) {
+		var mac hash.Hash
+		if salt != nil {
+			mac = hmac.New(sha256.New, salt)
+		}
+		var sum []byte
+		for i := start; i < end; i++ {
+			if mac == nil {
+				highs[i], lows[i] = Hashify128([]byte(values[i]))
+				continue
+			}
+			mac.Reset()
+			mac.Write([]byte(values[i]))
+			sum = mac.Sum(sum[:0])
+			highs[i], lows[i] = binary.LittleEndian.Uint64(sum), binary.LittleEndian.Uint64(sum[8:])
+		}
+	}
+
+	workers := (len(values) + hashChunkSize - 1) / hashChunkSize
+	if workers > *hashWorkers {
+		workers = *hashWorkers
+	}
+	if workers <= 1 {
+		hashChunk(0, len(values))
+		return highs, lows
+	}
+	var wg sync.WaitGroup
+	chunk := (len(values) + workers - 1) / workers
+	for start := 0; start < len(values); start += chunk {
+		end := start + chunk
+		if end > len(values) {
+			end = len(values)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			hashChunk(start, end)
+		}(start, end)
+	}
+	wg.Wait()
+	return highs, lows
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHashSalts(t *testing.T) {
+	file, _ := ioutil.TempFile("", "salts")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"tenant1:" : "GOTEST_SALT1", "tenant2:" : "GOTEST_SALT2"}`)
+	file.Close()
+
+	os.Setenv("GOTEST_SALT1", "secret1")
+	defer os.Unsetenv("GOTEST_SALT1")
+	_, err := LoadHashSalts(file.Name())
+	assert.NotEqual(t, err, nil)
+
+	os.Setenv("GOTEST_SALT2", "secret2")
+	defer os.Unsetenv("GOTEST_SALT2")
+	hashSalts, err = LoadHashSalts(file.Name())
+	assert.Equal(t, err, nil)
+	defer func() { hashSalts = nil }()
+
+	value := "user@example.com"
+	assert.Equal(t, hashValue("other", value), Hashify([]byte(value)))
+	assert.Equal(t, hashValue("tenant1:a", value), hashValue("tenant1:b", value))
+	assert.NotEqual(t, hashValue("tenant1:a", value), hashValue("tenant2:a", value))
+	assert.NotEqual(t, hashValue("tenant1:a", value), Hashify([]byte(value)))
+
+	request, err := newMultiAddRequest([]string{"tenant1:a", "tenant2:a"}, value, 64, nil)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, request.Hashes, []uint64{hashValue("tenant1:a", value), hashValue("tenant2:a", value)})
+}
+
+func TestHashValues(t *testing.T) {
+	hashSalts = map[string][]byte{"tenant1:": []byte("secret1")}
+	defer func() { hashSalts = nil }()
+	defer func(workers int) { *hashWorkers = workers }(*hashWorkers)
+
+	values := make([]string, 2500)
+	for i := range values {
+		values[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	for _, workers := range []int{1, 4} {
+		*hashWorkers = workers
+		for _, key := range []string{"other", "tenant1:a"} {
+			highs, lows := hashValues(key, values)
+			for i, value := range values {
+				high, low := hashValue128(key, value)
+				assert.Equal(t, highs[i], high)
+				assert.Equal(t, lows[i], low)
+			}
+		}
+	}
+	highs, lows := hashValues("other", nil)
+	assert.Equal(t, len(highs)+len(lows), 0)
+}
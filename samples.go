@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/jmhodges/levigo"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const defaultSampleN = 10
+
+func sampleKey(key string) []byte {
+	return []byte(internalKeyPrefix + "sample:" + key)
+}
+
+// The sample of a set holds the values behind the smallest hashes added to
+// it.  Since hashes are uniformly distributed, they are a uniform sample of
+// the distinct values that were counted.  Adds value to the sample of key if
+// its hash is among the --sample-size smallest.  Only called for hashes the set kept, since a hash the set threw
+// away is too large to be in its sample.
+func updateSample(batch *Batch, key string, hash uint64, value []byte) error {
+	data, err := batch.Get(sampleKey(key))
+	if err != nil {
+		return err
+	}
+	sample, err := decodeValues(data)
+	if err != nil {
+		return err
+	}
+
+	i := sort.Search(len(sample), func(i int) bool { return sample[i].hash >= hash })
+	if i >= *sampleSize || i < len(sample) && sample[i].hash == hash {
+		return nil
+	}
+	sample = append(sample, valueEntry{})
+	copy(sample[i+1:], sample[i:])
+	sample[i] = valueEntry{hash, value}
+	if len(sample) > *sampleSize {
+		sample = sample[:*sampleSize]
+	}
+
+	batch.Put(sampleKey(key), encodeValues(sample))
+	return nil
+}
+
+// Returns up to `n` (default 10) of the values that were added to `key` with
+// /add, picked uniformly from the distinct values that were counted.
+func SampleHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	n := defaultSampleN
+	if n_raw := reqParams.Get("n"); n_raw != "" {
+		n, err = strconv.Atoi(n_raw)
+		if err != nil || n <= 0 {
+			HttpError(w, 500, "INVALID_ARG_N")
+			return
+		}
+	}
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := readValue(dispatcher.database, ro, sampleKey(key))
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	sample, err := decodeValues(data)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+
+	if len(sample) > n {
+		sample = sample[:n]
+	}
+	values := make([]string, len(sample))
+	for i, entry := range sample {
+		values[i] = string(entry.value)
+	}
+	HttpResponse(w, 200, values)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	*sampleSize = 3
+	defer func() { *sampleSize = 0 }()
+
+	key := "_GOTEST_SAMPLE"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	values := make([]string, 20)
+	for i := range values {
+		values[i] = fmt.Sprintf("value%d", i)
+		for j := 0; j < 2; j++ {
+			dispatcher.Dispatch(AddHashRequest{Key: key, Hash: Hashify([]byte(values[i])), Value: []byte(values[i]), ResultChan: resultChan})
+			<-resultChan
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return Hashify([]byte(values[i])) < Hashify([]byte(values[j]))
+	})
+
+	getSample := func(query string) []string {
+		w := httptest.NewRecorder()
+		SampleHandler(w, httptest.NewRequest("GET", "/sample?"+query, nil))
+		assert.Equal(t, w.Code, 200)
+		response := struct {
+			Data []string `json:"data"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Data
+	}
+
+	assert.Equal(t, getSample("key="+key), values[:3])
+	assert.Equal(t, getSample("key="+key+"&n=2"), values[:2])
+
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, len(getSample("key="+key)), 0)
+
+	sample := []valueEntry{{1, []byte("a")}, {2, []byte("")}, {3, []byte("ccc")}}
+	decoded, err := decodeValues(encodeValues(sample))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded, sample)
+	_, err = decodeValues([]byte{0, 0, 0, 0, 0, 0, 0, 1, 5})
+	assert.Equal(t, err, CorruptValues)
+}
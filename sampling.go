@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// How often the add rate of every key is measured
+const samplingWindow = time.Second
+
+// Switches keys whose add rate goes over threshold adds a second to sampled
+// ingestion, keeping only the adds whose hash is in the lowest fraction rate
+// of the hash space.  Since a set only keeps its smallest hashes the sampled
+// adds are the ones that could have changed it, so estimates stay unbiased
+// while the set holds more than k/rate distinct values.  Rates are measured
+// every samplingWindow and a key that slows down is ingested fully again.
+type KeySampler struct {
+	sync.Mutex
+	threshold float64
+	started   time.Time
+	counts    map[string]int
+	rates     map[string]float64
+}
+
+var keySampler = NewKeySampler(0)
+
+func NewKeySampler(threshold float64) *KeySampler {
+	return &KeySampler{
+		threshold: threshold,
+		started:   time.Now(),
+		counts:    make(map[string]int),
+		rates:     make(map[string]float64),
+	}
+}
+
+// Counts an add of hash to key and reports whether it should be ingested
+func (ks *KeySampler) Admit(key string, hash uint64) bool {
+	return ks.admitAt(key, hash, time.Now())
+}
+
+func (ks *KeySampler) admitAt(key string, hash uint64, now time.Time) bool {
+	if ks.threshold <= 0 {
+		return true
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	if elapsed := now.Sub(ks.started); elapsed >= samplingWindow {
+		ks.measure(elapsed)
+		ks.started = now
+	}
+	ks.counts[key]++
+
+	rate, sampled := ks.rates[key]
+	return !sampled || float64(hash) < rate*math.MaxUint64
+}
+
+// Works out the sampling rate of every key from the adds counted over elapsed
+func (ks *KeySampler) measure(elapsed time.Duration) {
+	rates := make(map[string]float64)
+	for key, count := range ks.counts {
+		// Sampled keys were still counted in full, so this is their real rate
+		perSecond := float64(count) / elapsed.Seconds()
+		if perSecond > ks.threshold {
+			rates[key] = ks.threshold / perSecond
+		}
+	}
+	ks.rates = rates
+	ks.counts = make(map[string]int)
+}
+
+// Returns the sampling rate of every key being sampled
+func (ks *KeySampler) Rates() map[string]float64 {
+	ks.Lock()
+	defer ks.Unlock()
+	rates := make(map[string]float64, len(ks.rates))
+	for key, rate := range ks.rates {
+		rates[key] = rate
+	}
+	return rates
+}
+
+// Drops the keys of a multi key add that aren't admitting its value, and
+// reports whether any are left
+func (ks *KeySampler) filter(request MultiAddHashRequest) (MultiAddHashRequest, bool) {
+	if ks.threshold <= 0 {
+		return request, true
+	}
+	filtered := request
+	filtered.Keys = nil
+	if request.Hashes != nil {
+		filtered.Hashes, filtered.Lows, filtered.Values = nil, nil, nil
+	}
+	for i, key := range request.Keys {
+		hash := request.Hash
+		if request.Hashes != nil {
+			hash = request.Hashes[i]
+		}
+		if !ks.Admit(key, hash) {
+			continue
+		}
+		filtered.Keys = append(filtered.Keys, key)
+		if request.Hashes != nil {
+			filtered.Hashes = append(filtered.Hashes, hash)
+			if request.Lows != nil {
+				filtered.Lows = append(filtered.Lows, request.Lows[i])
+			}
+			filtered.Values = append(filtered.Values, request.Values[i])
+		}
+	}
+	return filtered, len(filtered.Keys) != 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestKeySampler(t *testing.T) {
+	ks := NewKeySampler(10)
+	start := ks.started
+	low, high := uint64(0), uint64(math.MaxUint64)
+
+	// keys aren't sampled until their rate has been measured
+	for i := 0; i < 40; i++ {
+		assert.Equal(t, ks.admitAt("hot", high, start), true)
+	}
+	ks.admitAt("cold", high, start)
+
+	// hot went at 40 adds a second so a quarter of the hash space is kept
+	next := start.Add(samplingWindow)
+	assert.Equal(t, ks.admitAt("hot", high, next), false)
+	assert.Equal(t, ks.admitAt("hot", low, next), true)
+	assert.Equal(t, ks.admitAt("hot", high/5, next), true)
+	assert.Equal(t, ks.admitAt("hot", high/10*3, next), false)
+	assert.Equal(t, ks.admitAt("cold", high, next), true)
+	assert.Equal(t, ks.Rates(), map[string]float64{"hot": 0.25})
+
+	// hot slowed down so it's ingested fully again
+	assert.Equal(t, ks.admitAt("hot", high, next.Add(samplingWindow)), true)
+	assert.Equal(t, len(ks.Rates()), 0)
+
+	// nothing is sampled with a threshold of 0
+	ks = NewKeySampler(0)
+	for i := 0; i < 100; i++ {
+		ks.admitAt("hot", high, ks.started.Add(time.Duration(i)*samplingWindow))
+	}
+	assert.Equal(t, ks.Admit("hot", high), true)
+}
+
+func TestKeySamplerFilter(t *testing.T) {
+	ks := NewKeySampler(1)
+	ks.rates = map[string]float64{"a": 0.5}
+	high := uint64(math.MaxUint64)
+
+	request, admitted := ks.filter(MultiAddHashRequest{Keys: []string{"a", "b"}, Hash: high})
+	assert.Equal(t, admitted, true)
+	assert.Equal(t, request.Keys, []string{"b"})
+
+	request, admitted = ks.filter(MultiAddHashRequest{
+		Keys:   []string{"a", "b"},
+		Hashes: []uint64{1, high},
+		Values: [][]byte{[]byte("x"), []byte("y")},
+	})
+	assert.Equal(t, admitted, true)
+	assert.Equal(t, request.Keys, []string{"a", "b"})
+	assert.Equal(t, request.Hashes, []uint64{1, high})
+
+	_, admitted = ks.filter(MultiAddHashRequest{Keys: []string{"a"}, Hash: high})
+	assert.Equal(t, admitted, false)
+}
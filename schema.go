@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A schema describes the values that may be added to the keys starting with
+// a prefix so that malformed values are refused instead of being counted, eg:
+//
+//	{"users:" : {"type" : "uuid"}, "orders:" : {"pattern" : "^ord_[0-9]+$"}}
+//
+// Values are checked once they have been normalized.
+type Schema struct {
+	Type    string `json:"type,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	pattern *regexp.Regexp
+}
+
+type Schemas map[string]*Schema
+
+var (
+	schemas      Schemas
+	EmptyValue   = NewAPIError(500, "MISSING_ARG_VALUE", "Value is empty", false)
+	InvalidValue = NewAPIError(422, "INVALID_VALUE", "Value does not match the key's schema", false)
+	UnknownType  = errors.New("Unknown schema type")
+	uuidPattern  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	schemaTypes  = map[string]func(string) bool{
+		"int": func(value string) bool {
+			_, err := strconv.ParseInt(value, 10, 64)
+			return err == nil
+		},
+		"uuid":  uuidPattern.MatchString,
+		"email": emailPattern.MatchString,
+		"url": func(value string) bool {
+			u, err := url.Parse(value)
+			return err == nil && u.Scheme != "" && u.Host != ""
+		},
+		"token": func(value string) bool {
+			return strings.IndexFunc(value, unicode.IsSpace) < 0
+		},
+	}
+)
+
+func LoadSchemas(filename string) (Schemas, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := Schemas{}
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return nil, err
+	}
+	for prefix, schema := range loaded {
+		if schema == nil {
+			schema = &Schema{}
+			loaded[prefix] = schema
+		}
+		if _, found := schemaTypes[schema.Type]; schema.Type != "" && !found {
+			return nil, fmt.Errorf("%s %q for prefix %q", UnknownType, schema.Type, prefix)
+		}
+		if schema.Pattern != "" {
+			schema.pattern, err = regexp.Compile(schema.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern for prefix %q: %s", prefix, err)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+func (schema *Schema) Valid(value string) bool {
+	if schema.Type != "" && !schemaTypes[schema.Type](value) {
+		return false
+	}
+	return schema.pattern == nil || schema.pattern.MatchString(value)
+}
+
+// Returns whether value may be added to key under the schema of its longest
+// prefix.  Keys without a schema take any value.
+func (s Schemas) Valid(key, value string) bool {
+	schema := longestPrefix(s, key)
+	return schema == nil || schema.Valid(value)
+}
+
+// Normalizes value for key and checks it against the key's schema, returning
+// the value that should be counted
+func prepareValue(key, value string) (string, error) {
+	value = normalizeRules.Normalize(key, value)
+	if value == "" {
+		return "", EmptyValue
+	}
+	if !schemas.Valid(key, value) {
+		return "", InvalidValue
+	}
+	return value, nil
+}
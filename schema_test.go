@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSchemas(t *testing.T) {
+	file, err := ioutil.TempFile("", "schemas")
+	assert.Equal(t, err, nil)
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"users:": {"type": "uuid"},
+		"orders:": {"type": "token", "pattern": "^ord_"},
+		"orders:legacy:": null
+	}`)
+	file.Close()
+
+	loaded, err := LoadSchemas(file.Name())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loaded.Valid("users:all", "6ba7b810-9dad-11d1-80b4-00c04fd430c8"), true)
+	assert.Equal(t, loaded.Valid("users:all", "6ba7b810"), false)
+	assert.Equal(t, loaded.Valid("orders:all", "ord_12"), true)
+	assert.Equal(t, loaded.Valid("orders:all", "ord_ 12"), false)
+	assert.Equal(t, loaded.Valid("orders:all", "12"), false)
+	assert.Equal(t, loaded.Valid("orders:legacy:all", "12"), true)
+	assert.Equal(t, loaded.Valid("other", " "), true)
+
+	schemas = loaded
+	defer func() { schemas = nil }()
+	_, err = prepareValue("users:all", "nope")
+	assert.Equal(t, err, InvalidValue)
+
+	w := httptest.NewRecorder()
+	AddHandler(w, httptest.NewRequest("GET", "/add?key=users:all&value=nope", nil))
+	assert.Equal(t, w.Code, 422)
+
+	w = httptest.NewRecorder()
+	form := "key=orders:all&key=users:all&value=ord_1"
+	r := httptest.NewRequest("POST", "/multiadd", nil)
+	r.URL.RawQuery = form
+	MultiAddHandler(w, r)
+	assert.Equal(t, w.Code, 422)
+}
+
+func TestLoadSchemasErrors(t *testing.T) {
+	file, err := ioutil.TempFile("", "schemas")
+	assert.Equal(t, err, nil)
+	defer os.Remove(file.Name())
+	file.WriteString(`{"users:": {"type": "colour"}}`)
+	file.Close()
+
+	_, err = LoadSchemas(file.Name())
+	assert.NotEqual(t, err, nil)
+}
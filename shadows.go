@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// A shadow rule mirrors the hashes added to keys starting with a prefix into
+// a shadow set with other parameters, eg:
+//
+//	{"users:" : {"k" : 4096}, "orders:" : {"width" : 128}}
+//
+// so a change of k or width can be compared with the live sets before it is
+// rolled out.  Parameters left out are the primary set's.
+type ShadowRule struct {
+	K     int `json:"k,omitempty"`
+	Width int `json:"width,omitempty"`
+}
+
+type ShadowRules map[string]*ShadowRule
+
+var shadowRules ShadowRules
+
+var KeyNotShadowed = NewAPIError(404, "KEY_NOT_SHADOWED", "Key has no shadow", false)
+
+func LoadShadowRules(filename string) (ShadowRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := ShadowRules{}
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return nil, err
+	}
+	for prefix, rule := range loaded {
+		if rule == nil || rule.K == 0 && rule.Width == 0 {
+			return nil, fmt.Errorf("No k or width for prefix %q", prefix)
+		}
+		if rule.K < 0 {
+			return nil, fmt.Errorf("Invalid k for prefix %q", prefix)
+		}
+		if rule.Width != 0 && rule.Width != 32 && rule.Width != 64 && rule.Width != 128 {
+			return nil, fmt.Errorf("Invalid width for prefix %q", prefix)
+		}
+	}
+	return loaded, nil
+}
+
+// The shadow rule of the longest prefix of key, nil if it isn't shadowed
+func (s ShadowRules) For(key string) *ShadowRule {
+	return longestPrefix(s, key)
+}
+
+func shadowKey(key string) []byte {
+	return []byte(internalKeyPrefix + "shadow:" + key)
+}
+
+// Reads the shadow of key, creating it with the parameters of its rule and
+// primary when it doesn't exist
+func readShadow(batch *Batch, key string, rule *ShadowRule, primary *kminvalues.KMinValues) (*kminvalues.KMinValues, error) {
+	data, err := batch.Get(shadowKey(key))
+	if err != nil {
+		return nil, err
+	} else if len(data) != 0 {
+		return kminvalues.KMinValuesFromBytes(data)
+	}
+	k, width := rule.K, rule.Width
+	if k == 0 {
+		k = primary.MaxSize()
+	}
+	if width == 0 {
+		width = primary.HashWidth()
+	}
+	return kminvalues.NewKMinValuesWidth(k, width)
+}
+
+// Adds hashes, along with their low halves or nil lows, to the shadow of key
+// if it has one.  primary is the key's set, after they were added to it.
+func mirrorShadow(batch *Batch, key string, primary *kminvalues.KMinValues, highs, lows []uint64) error {
+	rule := shadowRules.For(key)
+	if rule == nil {
+		return nil
+	}
+	shadow, err := readShadow(batch, key, rule, primary)
+	if err != nil {
+		return err
+	}
+	added := false
+	for i, high := range highs {
+		var low uint64
+		if lows != nil {
+			low = lows[i]
+		}
+		added = shadow.AddHash128(high, low) || added
+	}
+	if added {
+		batch.Put(shadowKey(key), shadow.Bytes())
+	}
+	return nil
+}
+
+// Removes hashes from the shadow of key if it has one
+func unmirrorShadow(batch *Batch, key string, hashes []uint64) error {
+	if shadowRules.For(key) == nil {
+		return nil
+	}
+	data, err := batch.Get(shadowKey(key))
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	shadow, err := kminvalues.KMinValuesFromBytes(data)
+	if err != nil {
+		return err
+	}
+	removed := false
+	for _, hash := range hashes {
+		removed = shadow.RemoveHash(hash) || removed
+	}
+	if removed {
+		batch.Put(shadowKey(key), shadow.Bytes())
+	}
+	return nil
+}
+
+type sketchStats struct {
+	Cardinality   float64 `json:"cardinality"`
+	K             int     `json:"k"`
+	Width         int     `json:"width"`
+	Hashes        int     `json:"hashes"`
+	Bytes         int     `json:"bytes"`
+	RelativeError float64 `json:"relative_error"`
+}
+
+func newSketchStats(kmv *kminvalues.KMinValues) sketchStats {
+	return sketchStats{
+		Cardinality:   kmv.Cardinality(),
+		K:             kmv.MaxSize(),
+		Width:         kmv.HashWidth(),
+		Hashes:        kmv.Len(),
+		Bytes:         len(kmv.Bytes()),
+		RelativeError: relativeErrorFor(kmv.MaxSize(), kmv.Len() >= kmv.MaxSize()),
+	}
+}
+
+// A shadowed key's set next to its shadow.  Difference is how far the
+// shadow's estimate is from the primary's, relative to the primary's.
+type shadowComparison struct {
+	Key        string      `json:"key"`
+	Primary    sketchStats `json:"primary"`
+	Shadow     sketchStats `json:"shadow"`
+	Difference float64     `json:"difference"`
+}
+
+func compareShadow(key string, primary, shadow *kminvalues.KMinValues) shadowComparison {
+	comparison := shadowComparison{
+		Key:     key,
+		Primary: newSketchStats(primary),
+		Shadow:  newSketchStats(shadow),
+	}
+	if comparison.Primary.Cardinality != 0 {
+		comparison.Difference = (comparison.Shadow.Cardinality - comparison.Primary.Cardinality) / comparison.Primary.Cardinality
+	}
+	return comparison
+}
+
+// Compares every shadow starting with prefix with its primary set, skipping
+// shadows whose key was deleted
+func compareShadows(database *levigo.DB, prefix string) ([]shadowComparison, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+
+	it := database.NewIterator(ro)
+	defer it.Close()
+	comparisons := []shadowComparison{}
+	start := shadowKey(prefix)
+	for it.Seek(start); it.Valid() && bytes.HasPrefix(it.Key(), start); it.Next() {
+		key := string(it.Key()[len(shadowKey("")):])
+		shadow, err := kminvalues.KMinValuesFromBytes(openValue(it.Key(), it.Value()))
+		if err != nil {
+			continue
+		}
+		data, err := readValue(database, ro, []byte(key))
+		if err != nil {
+			return nil, err
+		} else if len(data) == 0 {
+			continue
+		}
+		primary, err := kminvalues.KMinValuesFromBytes(data)
+		if err != nil {
+			continue
+		}
+		comparisons = append(comparisons, compareShadow(key, primary, shadow))
+	}
+	return comparisons, it.GetError()
+}
+
+// Compares the shadowed keys starting with `prefix`, or only `key`, with
+// their shadows
+func ShadowsHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key, prefix := reqParams.Get("key"), reqParams.Get("prefix")
+	if key != "" {
+		prefix = key
+	}
+	comparisons, err := compareShadows(dispatcher.database, prefix)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	if key != "" {
+		for _, comparison := range comparisons {
+			if comparison.Key == key {
+				HttpResponse(w, 200, comparison)
+				return
+			}
+		}
+		HttpResultError(w, key, KeyNotShadowed)
+		return
+	}
+	HttpResponse(w, 200, comparisons)
+}
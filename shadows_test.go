@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLoadShadowRules(t *testing.T) {
+	file, _ := ioutil.TempFile("", "shadows")
+	defer os.Remove(file.Name())
+	file.WriteString(`{"users:" : {"k" : 4096}, "users:eu:" : {"width" : 128}}`)
+	file.Close()
+
+	rules, err := LoadShadowRules(file.Name())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, rules.For("users:us").K, 4096)
+	assert.Equal(t, rules.For("users:eu:1").Width, 128)
+	assert.Equal(t, rules.For("orders") == nil, true)
+
+	file, _ = os.Create(file.Name())
+	file.WriteString(`{"users:" : {}}`)
+	file.Close()
+	_, err = LoadShadowRules(file.Name())
+	assert.NotEqual(t, err, nil)
+}
+
+func TestShadowKeys(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	shadowRules = ShadowRules{"_GOTEST_SHADOW": &ShadowRule{K: 64}}
+	defer func() { shadowRules = nil }()
+
+	key := "_GOTEST_SHADOW"
+	resultChan := make(chan Result)
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	hashes := make([]uint64, 100)
+	for i := range hashes {
+		hashes[i] = GetRandHash()
+	}
+	dispatcher.Dispatch(ImportRequest{Key: key, Hashes: hashes[:50], ResultChan: resultChan})
+	<-resultChan
+	for _, hash := range hashes[50:] {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, ResultChan: resultChan})
+		<-resultChan
+	}
+	compare := func() (int, shadowComparison) {
+		w := httptest.NewRecorder()
+		ShadowsHandler(w, httptest.NewRequest("GET", "/admin/shadows?key="+key, nil))
+		var response struct{ Data shadowComparison }
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Data
+	}
+	code, comparison := compare()
+	assert.Equal(t, code, 200)
+	assert.Equal(t, comparison.Primary.K, *defaultSize)
+	assert.Equal(t, comparison.Primary.Hashes, 100)
+	assert.Equal(t, comparison.Shadow.K, 64)
+	assert.Equal(t, comparison.Shadow.Hashes, 64)
+	assert.Equal(t, comparison.Shadow.Width, comparison.Primary.Width)
+	assert.Equal(t, comparison.Shadow.Bytes < comparison.Primary.Bytes, true)
+
+	var removed int
+	dispatcher.Dispatch(RemoveValuesRequest{Key: key, Hashes: hashes, Removed: &removed, ResultChan: resultChan})
+	<-resultChan
+	code, comparison = compare()
+	assert.Equal(t, code, 200)
+	assert.Equal(t, comparison.Primary.Hashes, 0)
+	assert.Equal(t, comparison.Shadow.Hashes, 0)
+
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	code, _ = compare()
+	assert.Equal(t, code, 404)
+}
+
+// Sets too small to have a relative error still encode
+func TestSketchStatsSmallK(t *testing.T) {
+	kmv := kminvalues.NewKMinValues(2)
+	kmv.AddHash(1)
+	kmv.AddHash(2)
+	stats := newSketchStats(kmv)
+	assert.Equal(t, stats.RelativeError, 0.0)
+	_, err := json.Marshal(stats)
+	assert.Equal(t, err, nil)
+}
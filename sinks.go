@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Rows written to a sink at a time
+	sinkBatchSize = 1000
+	// Longest wait before a run that failed is tried again
+	sinkRetry = 5 * time.Minute
+)
+
+var (
+	sinks      *Sinks
+	sinkClient = &http.Client{Timeout: time.Minute}
+)
+
+// The estimate of a key on the day it was exported
+type aggregateRow struct {
+	Key           string  `json:"key"`
+	Date          string  `json:"date"`
+	Cardinality   float64 `json:"cardinality"`
+	RelativeError float64 `json:"relative_error"`
+}
+
+// Where aggregates are pushed, eg: a warehouse table.  Write is given the
+// rows of a run sinkBatchSize at a time and a run that fails is tried again
+// whole, so tables should be keyed on (key, date).
+type Sink interface {
+	Write(rows []aggregateRow) error
+}
+
+// The types of sinks --sinks can configure
+var sinkTypes = map[string]func(config *SinkConfig) (Sink, error){
+	"clickhouse": newClickHouseSink,
+	"bigquery":   newBigQuerySink,
+	"sql":        newSQLSink,
+}
+
+// A schedule pushing the estimates of the keys starting with Prefix, and
+// matching the Tags filters if any, to a sink every Interval, eg:
+//
+//	{"name" : "warehouse", "type" : "clickhouse", "prefix" : "users:", "interval" : "24h",
+//	 "options" : {"url" : "http://clickhouse:8123", "table" : "cardinalities"}}
+type SinkConfig struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Prefix   string            `json:"prefix,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Interval string            `json:"interval,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+
+	filters  []tagFilter
+	interval time.Duration
+}
+
+func LoadSinks(filename string) ([]*SinkConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []*SinkConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i, config := range configs {
+		if config == nil || config.Name == "" {
+			return nil, fmt.Errorf("Sink %d has no name", i)
+		} else if names[config.Name] {
+			return nil, fmt.Errorf("Sink %q is configured twice", config.Name)
+		}
+		names[config.Name] = true
+		if _, found := sinkTypes[config.Type]; !found {
+			return nil, fmt.Errorf("Unknown type %q for sink %q", config.Type, config.Name)
+		}
+		config.interval = 24 * time.Hour
+		if config.Interval != "" {
+			if config.interval, err = time.ParseDuration(config.Interval); err != nil || config.interval <= 0 {
+				return nil, fmt.Errorf("Invalid interval for sink %q", config.Name)
+			}
+		}
+		if config.filters, err = parseTagFilters(config.Tags); err != nil {
+			return nil, fmt.Errorf("Invalid tags for sink %q", config.Name)
+		}
+	}
+	return configs, nil
+}
+
+func sinkKey(name string) []byte {
+	return []byte(internalKeyPrefix + "sink:" + name)
+}
+
+type sinkStatus struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	LastRun  time.Time `json:"last_run"`
+	LastRows int       `json:"last_rows"`
+	NextRun  time.Time `json:"next_run"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type scheduledSink struct {
+	sync.Mutex
+	config *SinkConfig
+	sink   Sink
+	status sinkStatus
+}
+
+// Pushes aggregates to every configured sink on its schedule.  The time of a
+// sink's last run is kept in the DB, so restarts neither skip nor repeat runs.
+type Sinks struct {
+	sinks []*scheduledSink
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewSinks(configs []*SinkConfig) (*Sinks, error) {
+	s := &Sinks{stop: make(chan struct{})}
+	for _, config := range configs {
+		sink, err := sinkTypes[config.Type](config)
+		if err != nil {
+			return nil, err
+		}
+		s.sinks = append(s.sinks, &scheduledSink{
+			config: config,
+			sink:   sink,
+			status: sinkStatus{Name: config.Name, Type: config.Type},
+		})
+	}
+	return s, nil
+}
+
+func (s *Sinks) Start() {
+	for _, ss := range s.sinks {
+		ss.status.LastRun = loadLastRun(dispatcher.database, ss.config.Name)
+		ss.status.NextRun = ss.status.LastRun.Add(ss.config.interval)
+		s.wg.Add(1)
+		go func(ss *scheduledSink) {
+			defer s.wg.Done()
+			for {
+				ss.Lock()
+				wait := time.Until(ss.status.NextRun)
+				ss.Unlock()
+				select {
+				case <-s.stop:
+					return
+				case now := <-time.After(wait):
+					ss.run(dispatcher.database, now)
+				}
+			}
+		}(ss)
+	}
+}
+
+// Stops the sinks, waiting for runs under way to finish
+func (s *Sinks) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *Sinks) Status() []sinkStatus {
+	statuses := make([]sinkStatus, len(s.sinks))
+	for i, ss := range s.sinks {
+		ss.Lock()
+		statuses[i] = ss.status
+		ss.Unlock()
+	}
+	return statuses
+}
+
+func loadLastRun(database *levigo.DB, name string) time.Time {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	var lastRun time.Time
+	if data, err := database.Get(ro, sinkKey(name)); err == nil && len(data) != 0 {
+		lastRun.UnmarshalText(data)
+	}
+	return lastRun
+}
+
+// Pushes the rows of every key to the sink, recording the run once they
+// were all written.  A failed run is tried again after the interval or
+// sinkRetry, whichever is shorter.
+func (ss *scheduledSink) run(database *levigo.DB, now time.Time) {
+	rows, err := aggregateRows(database, ss.config, now)
+	for start := 0; err == nil && start < len(rows); start += sinkBatchSize {
+		end := start + sinkBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		err = ss.sink.Write(rows[start:end])
+	}
+	if err == nil {
+		data, _ := now.MarshalText()
+		wo := levigo.NewWriteOptions()
+		err = database.Put(wo, sinkKey(ss.config.Name), data)
+		wo.Close()
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+	if err != nil {
+		log.Printf("Could not push aggregates to sink %s: %s", ss.config.Name, err)
+		ss.status.Error = err.Error()
+		retry := ss.config.interval
+		if retry > sinkRetry {
+			retry = sinkRetry
+		}
+		ss.status.NextRun = now.Add(retry)
+		return
+	}
+	ss.status.Error = ""
+	ss.status.LastRun, ss.status.LastRows = now, len(rows)
+	ss.status.NextRun = now.Add(ss.config.interval)
+}
+
+// The rows of the keys a sink exports, from their summaries
+func aggregateRows(database *levigo.DB, config *SinkConfig, now time.Time) ([]aggregateRow, error) {
+	date := now.UTC().Format("2006-01-02")
+	rows := []aggregateRow{}
+	add := func(key []byte, summary keySummary) {
+		rows = append(rows, aggregateRow{
+			Key:           string(key),
+			Date:          date,
+			Cardinality:   summary.Cardinality,
+			RelativeError: relativeErrorFor(summary.K, summary.Hashes >= summary.K),
+		})
+	}
+	prefix := []byte(config.Prefix)
+	if len(config.filters) != 0 {
+		return rows, scanTaggedSummaries(database, prefix, nil, config.filters, func(key []byte, tags map[string]string, summary keySummary) bool {
+			add(key, summary)
+			return true
+		})
+	}
+	return rows, scanSummaries(database, prefix, nil, func(key []byte, summary keySummary) bool {
+		add(key, summary)
+		return true
+	})
+}
+
+// Inserts rows as JSONEachRow through the HTTP interface of ClickHouse at
+// `url`, into `table`, as `user` with the password in the environment
+// variable `password_env`
+type clickHouseSink struct {
+	url      string
+	table    string
+	user     string
+	password string
+}
+
+func newClickHouseSink(config *SinkConfig) (Sink, error) {
+	ch := &clickHouseSink{
+		url:   strings.TrimSuffix(config.Options["url"], "/"),
+		table: config.Options["table"],
+		user:  config.Options["user"],
+	}
+	if ch.url == "" || ch.table == "" {
+		return nil, fmt.Errorf("No url or table for clickhouse sink %q", config.Name)
+	}
+	if variable := config.Options["password_env"]; variable != "" {
+		ch.password = os.Getenv(variable)
+	}
+	return ch, nil
+}
+
+func (ch *clickHouseSink) Write(rows []aggregateRow) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, row := range rows {
+		encoder.Encode(row)
+	}
+	query := url.Values{"query": {fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", ch.table)}}
+	req, err := http.NewRequest("POST", ch.url+"/?"+query.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	if ch.user != "" {
+		req.Header.Set("X-ClickHouse-User", ch.user)
+		req.Header.Set("X-ClickHouse-Key", ch.password)
+	}
+	return sinkRequest(req, nil)
+}
+
+// Streams rows into a BigQuery table with insertAll, as the `project`,
+// `dataset` and `table` options name it.  The OAuth access token is read
+// from `token_file` before every batch, so whatever refreshes the token only
+// has to rewrite the file.  Rows get (key, date) as their insert ID so that
+// BigQuery drops those a retry sends again.
+type bigQuerySink struct {
+	endpoint  string
+	tokenFile string
+}
+
+func newBigQuerySink(config *SinkConfig) (Sink, error) {
+	project, dataset, table := config.Options["project"], config.Options["dataset"], config.Options["table"]
+	if project == "" || dataset == "" || table == "" {
+		return nil, fmt.Errorf("No project, dataset or table for bigquery sink %q", config.Name)
+	}
+	endpoint := config.Options["endpoint"]
+	if endpoint == "" {
+		endpoint = "https://bigquery.googleapis.com"
+	}
+	return &bigQuerySink{
+		endpoint:  fmt.Sprintf("%s/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll", strings.TrimSuffix(endpoint, "/"), project, dataset, table),
+		tokenFile: config.Options["token_file"],
+	}, nil
+}
+
+func (bq *bigQuerySink) Write(rows []aggregateRow) error {
+	type insertRow struct {
+		InsertID string       `json:"insertId"`
+		JSON     aggregateRow `json:"json"`
+	}
+	request := struct {
+		Rows []insertRow `json:"rows"`
+	}{make([]insertRow, len(rows))}
+	for i, row := range rows {
+		request.Rows[i] = insertRow{InsertID: row.Key + "\x00" + row.Date, JSON: row}
+	}
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequest("POST", bq.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bq.tokenFile != "" {
+		token, err := ioutil.ReadFile(bq.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	var response struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	if err := sinkRequest(req, &response); err != nil {
+		return err
+	} else if len(response.InsertErrors) != 0 {
+		return fmt.Errorf("BigQuery rejected %d rows: %s", len(response.InsertErrors), response.InsertErrors[0])
+	}
+	return nil
+}
+
+// Sends a request to a sink, decoding its JSON response into response if
+// given
+func sinkRequest(req *http.Request, response interface{}) error {
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("sink returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	} else if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
+
+// Upserts rows into `table`, with columns key, date, cardinality and
+// relative_error, of the database/sql database `dsn` through `driver`, eg:
+// Postgres with the lib/pq or pgx driver.  The driver has to be compiled
+// into the server with a blank import.  Every batch is a transaction, and rows
+// already written by a failed run are overwritten when it is retried.
+type sqlSink struct {
+	db     *sql.DB
+	insert string
+}
+
+func newSQLSink(config *SinkConfig) (Sink, error) {
+	driver, dsn, table := config.Options["driver"], config.Options["dsn"], config.Options["table"]
+	if driver == "" || dsn == "" || table == "" {
+		return nil, fmt.Errorf("No driver, dsn or table for sql sink %q", config.Name)
+	}
+	drivers := sql.Drivers()
+	if i := sort.SearchStrings(drivers, driver); i == len(drivers) || drivers[i] != driver {
+		return nil, fmt.Errorf("Driver %q of sql sink %q isn't compiled in", driver, config.Name)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	placeholders := "?, ?, ?, ?"
+	upsert := "ON CONFLICT (key, date) DO UPDATE SET cardinality = excluded.cardinality, relative_error = excluded.relative_error"
+	switch driver {
+	case "postgres", "pgx":
+		placeholders = "$1, $2, $3, $4"
+	case "mysql":
+		upsert = "ON DUPLICATE KEY UPDATE cardinality = VALUES(cardinality), relative_error = VALUES(relative_error)"
+	}
+	return &sqlSink{
+		db:     db,
+		insert: fmt.Sprintf("INSERT INTO %s (key, date, cardinality, relative_error) VALUES (%s) %s", table, placeholders, upsert),
+	}, nil
+}
+
+func (ss *sqlSink) Write(rows []aggregateRow) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(ss.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err := stmt.Exec(row.Key, row.Date, row.Cardinality, row.RelativeError); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Lists the sinks, when they last ran and when they run next
+func SinksHandler(w http.ResponseWriter, r *http.Request) {
+	if sinks == nil {
+		HttpResponse(w, 200, []sinkStatus{})
+		return
+	}
+	HttpResponse(w, 200, sinks.Status())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadSinks(t *testing.T) {
+	file, _ := ioutil.TempFile("", "sinks")
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"name" : "warehouse", "type" : "clickhouse", "tags" : ["team=growth"], "options" : {"url" : "http://localhost:8123", "table" : "t"}}]`)
+	file.Close()
+	configs, err := LoadSinks(file.Name())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, configs[0].interval, 24*time.Hour)
+	assert.Equal(t, configs[0].filters, []tagFilter{{Name: "team", Value: "growth"}})
+
+	file, _ = os.Create(file.Name())
+	file.WriteString(`[{"name" : "warehouse", "type" : "clickhouse", "interval" : "-1h"}]`)
+	file.Close()
+	_, err = LoadSinks(file.Name())
+	assert.NotEqual(t, err, nil)
+
+	_, err = NewSinks([]*SinkConfig{{Name: "warehouse", Type: "sql", Options: map[string]string{"driver": "missing", "dsn": "x", "table": "t"}}})
+	assert.NotEqual(t, err, nil)
+}
+
+var testRows = []aggregateRow{
+	{Key: "a", Date: "2024-01-01", Cardinality: 10, RelativeError: 0},
+	{Key: "b", Date: "2024-01-01", Cardinality: 5000, RelativeError: 0.025},
+}
+
+func TestClickHouseSink(t *testing.T) {
+	var query, user, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, user = r.URL.Query().Get("query"), r.Header.Get("X-ClickHouse-User")
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	sink, err := newClickHouseSink(&SinkConfig{Options: map[string]string{"url": server.URL, "table": "cardinalities", "user": "loader"}})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, sink.Write(testRows), nil)
+	assert.Equal(t, query, "INSERT INTO cardinalities FORMAT JSONEachRow")
+	assert.Equal(t, user, "loader")
+	assert.Equal(t, body, `{"key":"a","date":"2024-01-01","cardinality":10,"relative_error":0}`+"\n"+
+		`{"key":"b","date":"2024-01-01","cardinality":5000,"relative_error":0.025}`+"\n")
+}
+
+func TestBigQuerySink(t *testing.T) {
+	token, _ := ioutil.TempFile("", "token")
+	defer os.Remove(token.Name())
+	token.WriteString("secret\n")
+	token.Close()
+
+	var path, authorization string
+	var request struct {
+		Rows []struct {
+			InsertID string       `json:"insertId"`
+			JSON     aggregateRow `json:"json"`
+		} `json:"rows"`
+	}
+	reject := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, authorization = r.URL.Path, r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&request)
+		if reject {
+			io.WriteString(w, `{"insertErrors" : [{"index" : 0, "errors" : [{"reason" : "invalid"}]}]}`)
+		} else {
+			io.WriteString(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	sink, err := newBigQuerySink(&SinkConfig{Options: map[string]string{
+		"endpoint": server.URL, "project": "p", "dataset": "d", "table": "t", "token_file": token.Name(),
+	}})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, sink.Write(testRows), nil)
+	assert.Equal(t, path, "/bigquery/v2/projects/p/datasets/d/tables/t/insertAll")
+	assert.Equal(t, authorization, "Bearer secret")
+	assert.Equal(t, len(request.Rows), 2)
+	assert.Equal(t, request.Rows[1].InsertID, "b\x002024-01-01")
+	assert.Equal(t, request.Rows[1].JSON, testRows[1])
+
+	reject = true
+	assert.NotEqual(t, sink.Write(testRows), nil)
+}
+
+// A database/sql driver recording the arguments of every statement executed.
+// Rows are unique by key and date unless upserted, and the statement after
+// failAt rows fails once.
+type recordingDriver struct {
+	sync.Mutex
+	query     string
+	rows      [][]driver.Value
+	stored    map[string]bool
+	failAt    int
+	committed int
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.query = query
+	return recordingStmt{c.d}, nil
+}
+func (c recordingConn) Close() error              { return nil }
+func (c recordingConn) Begin() (driver.Tx, error) { return recordingTx{c.d}, nil }
+
+type recordingStmt struct{ d *recordingDriver }
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return 4 }
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.d.failAt > 0 && len(s.d.rows) == s.d.failAt {
+		s.d.failAt = 0
+		return nil, errors.New("connection reset")
+	}
+	id := args[0].(string) + "\x00" + args[1].(string)
+	if s.d.stored[id] && !strings.Contains(s.d.query, "DO UPDATE") {
+		return nil, errors.New("duplicate key")
+	}
+	s.d.stored[id] = true
+	s.d.rows = append(s.d.rows, args)
+	return driver.RowsAffected(1), nil
+}
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) { return nil, driver.ErrSkip }
+
+type recordingTx struct{ d *recordingDriver }
+
+func (tx recordingTx) Commit() error   { tx.d.committed++; return nil }
+func (tx recordingTx) Rollback() error { return nil }
+
+var testDriver = &recordingDriver{stored: make(map[string]bool)}
+
+func init() {
+	sql.Register("gocountme_recording", testDriver)
+}
+
+func TestSQLSink(t *testing.T) {
+	sink, err := newSQLSink(&SinkConfig{Options: map[string]string{"driver": "gocountme_recording", "dsn": "test", "table": "cardinalities"}})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, sink.Write(testRows), nil)
+	assert.Equal(t, testDriver.query, "INSERT INTO cardinalities (key, date, cardinality, relative_error) VALUES (?, ?, ?, ?) "+
+		"ON CONFLICT (key, date) DO UPDATE SET cardinality = excluded.cardinality, relative_error = excluded.relative_error")
+	assert.Equal(t, testDriver.committed, 1)
+	assert.Equal(t, testDriver.rows[1], []driver.Value{"b", "2024-01-01", 5000.0, 0.025})
+
+	// a run that failed after its first batch is retried whole
+	testDriver.rows, testDriver.stored = nil, make(map[string]bool)
+	testDriver.failAt = 1
+	assert.Equal(t, sink.Write(testRows[:1]), nil)
+	assert.NotEqual(t, sink.Write(testRows[1:]), nil)
+	assert.Equal(t, sink.Write(testRows[:1]), nil)
+	assert.Equal(t, sink.Write(testRows[1:]), nil)
+	assert.Equal(t, len(testDriver.rows), 3)
+}
+
+type capturingSink struct {
+	rows chan []aggregateRow
+}
+
+func (cs capturingSink) Write(rows []aggregateRow) error {
+	cs.rows <- rows
+	return nil
+}
+
+func TestSinkSchedule(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	resultChan := make(chan Result)
+	for _, key := range []string{"_GOTEST_SINK:a", "_GOTEST_SINK:b"} {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		<-resultChan
+		defer func(key string) {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}(key)
+	}
+	defer func() {
+		wo := levigo.NewWriteOptions()
+		defer wo.Close()
+		dispatcher.database.Delete(wo, sinkKey("capture"))
+	}()
+
+	captured := capturingSink{make(chan []aggregateRow, 10)}
+	sinkTypes["capture"] = func(*SinkConfig) (Sink, error) { return captured, nil }
+	defer delete(sinkTypes, "capture")
+	config := &SinkConfig{Name: "capture", Type: "capture", Prefix: "_GOTEST_SINK:", interval: time.Hour}
+
+	// a sink that never ran runs right away
+	s, err := NewSinks([]*SinkConfig{config})
+	assert.Equal(t, err, nil)
+	s.Start()
+	rows := <-captured.rows
+	s.Stop()
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0].Key, "_GOTEST_SINK:a")
+	assert.Equal(t, rows[0].Date, time.Now().UTC().Format("2006-01-02"))
+	assert.Equal(t, rows[0].Cardinality, 1.0)
+	status := s.Status()[0]
+	assert.Equal(t, status.LastRows, 2)
+	assert.Equal(t, status.Error, "")
+
+	// and then waits for its interval, even across restarts
+	s, _ = NewSinks([]*SinkConfig{config})
+	s.Start()
+	time.Sleep(10 * time.Millisecond)
+	s.Stop()
+	assert.Equal(t, len(captured.rows), 0)
+	assert.Equal(t, s.Status()[0].NextRun.Sub(status.LastRun), time.Hour)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+type sketchHash struct {
+	Hash  uint64  `json:"hash"`
+	Value *string `json:"value,omitempty"`
+}
+
+type sketchView struct {
+	Key    string       `json:"key"`
+	K      int          `json:"k"`
+	Width  int          `json:"width"`
+	Hashes []sketchHash `json:"hashes"`
+}
+
+func valueIndexKey(key string) []byte {
+	return []byte(internalKeyPrefix + "values:" + key)
+}
+
+// Keeps track of the values that were added to a set.  The value is added to
+// the sample of the set if its hash was just retained and, with
+// --index-values, recorded as the latest value seen for its hash as long as
+// the hash is retained.
+func recordValue(batch *Batch, key string, kmv *kminvalues.KMinValues, hash uint64, value []byte, added bool) error {
+	if value == nil {
+		return nil
+	}
+	if added && *sampleSize > 0 {
+		if err := updateSample(batch, key, hash, value); err != nil {
+			return err
+		}
+	}
+	if *indexValues && (added || kmv.FindHash(hash) >= 0) {
+		return updateValueIndex(batch, key, kmv, hash, value)
+	}
+	return nil
+}
+
+// Records value as the original of hash, dropping the values of any hashes
+// the set no longer retains so that the index never holds more than k values
+func updateValueIndex(batch *Batch, key string, kmv *kminvalues.KMinValues, hash uint64, value []byte) error {
+	data, err := batch.Get(valueIndexKey(key))
+	if err != nil {
+		return err
+	}
+	entries, err := decodeValues(data)
+	if err != nil {
+		return err
+	}
+
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].hash >= hash })
+	if i < len(entries) && entries[i].hash == hash && string(entries[i].value) == string(value) {
+		return nil
+	}
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.hash != hash && kmv.FindHash(entry.hash) >= 0 {
+			kept = append(kept, entry)
+		}
+	}
+	i = sort.Search(len(kept), func(i int) bool { return kept[i].hash >= hash })
+	kept = append(kept, valueEntry{})
+	copy(kept[i+1:], kept[i:])
+	kept[i] = valueEntry{hash, value}
+
+	batch.Put(valueIndexKey(key), encodeValues(kept))
+	return nil
+}
+
+// Returns the retained hashes of `key`, in the same order as /get, along with
+// the latest value added for each of them when --index-values is on.  Hashes
+// that came from merged sets or /addhash have no value.
+func SketchHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	resultChan := make(chan Result)
+	getRequest := GetRequest{
+		Key:        key,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(getRequest); err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	result := <-resultChan
+	if result.Error != nil {
+		HttpResultError(w, result.Key, result.Error)
+		return
+	}
+	kmv := result.Data
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := readValue(dispatcher.database, ro, valueIndexKey(key))
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	if notModified(w, r, sketchETag(kmv, data)) {
+		return
+	}
+	entries, err := decodeValues(data)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+
+	view := sketchView{
+		Key:    key,
+		K:      kmv.MaxSize(),
+		Width:  kmv.HashWidth(),
+		Hashes: make([]sketchHash, kmv.Len()),
+	}
+	for i := range view.Hashes {
+		view.Hashes[i].Hash = kmv.GetHash(i)
+	}
+	for _, entry := range entries {
+		if i := kmv.FindHash(entry.hash); i >= 0 {
+			value := string(entry.value)
+			view.Hashes[i].Value = &value
+		}
+	}
+	HttpResponse(w, 200, view)
+}
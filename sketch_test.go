@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSketchValues(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	*indexValues = true
+	defer func() { *indexValues = false }()
+
+	key := "_GOTEST_SKETCH"
+	resultChan := make(chan Result)
+	dispatcher.Dispatch(SetRequest{Key: key, Kmv: kminvalues.NewKMinValues(3), ResultChan: resultChan})
+	<-resultChan
+	defer func() {
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}()
+
+	add := func(hash uint64, value string) {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, Value: []byte(value), ResultChan: resultChan})
+		<-resultChan
+	}
+	for i := 5; i > 0; i-- {
+		add(uint64(i)<<32, fmt.Sprintf("value%d", i))
+	}
+	add(2<<32, "collision")
+
+	// values of hashes which were pushed out are dropped
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, _ := dispatcher.database.Get(ro, valueIndexKey(key))
+	entries, _ := decodeValues(data)
+	assert.Equal(t, len(entries), 3)
+	assert.Equal(t, entries[2].hash, uint64(3)<<32)
+
+	dispatcher.Dispatch(AddHashRequest{Key: key, Hash: 0, ResultChan: resultChan})
+	<-resultChan
+
+	w := httptest.NewRecorder()
+	SketchHandler(w, httptest.NewRequest("GET", "/sketch?key="+key, nil))
+	assert.Equal(t, w.Code, 200)
+	response := struct {
+		Data sketchView `json:"data"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	hashes := response.Data.Hashes
+	assert.Equal(t, len(hashes), 3)
+	assert.Equal(t, hashes[0].Hash, uint64(2)<<32)
+	assert.Equal(t, *hashes[0].Value, "collision")
+	assert.Equal(t, *hashes[1].Value, "value1")
+	assert.Equal(t, hashes[2].Value, (*string)(nil))
+
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+var eventSources *EventSources
+
+// Where events come from.  Run reads events until stop is closed or the
+// source runs out, passing the fields of every one to emit, which blocks
+// until the event was added and written to the DB, whatever the flush mode,
+// and returns an error only if it should be delivered again, eg: while the
+// server is read-only.  emit can be called concurrently.  Run returns why it
+// stopped, nil if it was asked to or ran out.
+type Source interface {
+	Run(stop <-chan struct{}, emit func(fields url.Values) error) error
+}
+
+// The types of sources --sources can configure.  A source that needs a
+// client library, eg: for Kafka or SQS, is added by registering its
+// constructor here, and then only needs a config entry per pipeline.
+var sourceTypes = map[string]func(config *SourceConfig) (Source, error){
+	"file": newFileSource,
+	"http": newHTTPSource,
+	"nats": newNATSSource,
+}
+
+// Parses a record of a source into its fields
+type sourceParser func(record []byte) (url.Values, error)
+
+// Parsers by format.  csv records are the columns named by Columns, regex
+// records the named groups of Pattern and line records a single `value` field.
+var sourceParsers = map[string]func(config *SourceConfig) sourceParser{
+	"json":  func(*SourceConfig) sourceParser { return parseJSONRecord },
+	"query": func(*SourceConfig) sourceParser { return parseQueryRecord },
+	"csv":   func(config *SourceConfig) sourceParser { return csvRecordParser(config.Columns) },
+	"regex": func(config *SourceConfig) sourceParser { return regexRecordParser(config.pattern) },
+	"line":  func(*SourceConfig) sourceParser { return parseLineRecord },
+}
+
+var UnmatchedRecord = errors.New("Record doesn't match the source's pattern")
+
+// A pipeline of events ingested from a source, eg:
+//
+//	{"name" : "clicks", "type" : "file", "format" : "json", "options" : {"path" : "/var/log/clicks.log", "follow" : "true"},
+//	 "keys" : ["clicks:{day}", "clicks:{day}:{country}"], "value" : "user_id"}
+//
+// counts the user_id of every event of a JSON lines file under keys filled in
+// from its fields as /fanout templates are.  Events are added as the binary
+// ingestion protocol adds them, so they are normalized, checked and sampled
+// like any other add.
+type SourceConfig struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Format  string            `json:"format"`
+	Columns []string          `json:"columns,omitempty"`
+	Pattern string            `json:"pattern,omitempty"`
+	Keys    []string          `json:"keys"`
+	Value   string            `json:"value"`
+	Options map[string]string `json:"options,omitempty"`
+
+	pattern *regexp.Regexp
+	parse   sourceParser
+}
+
+func LoadSources(filename string) ([]*SourceConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []*SourceConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i, config := range configs {
+		if config == nil || config.Name == "" {
+			return nil, fmt.Errorf("Source %d has no name", i)
+		} else if names[config.Name] {
+			return nil, fmt.Errorf("Source %q is configured twice", config.Name)
+		}
+		names[config.Name] = true
+		if _, found := sourceTypes[config.Type]; !found {
+			return nil, fmt.Errorf("Unknown type %q for source %q", config.Type, config.Name)
+		}
+		if config.Format == "" {
+			config.Format = "line"
+		}
+		parser, found := sourceParsers[config.Format]
+		if !found {
+			return nil, fmt.Errorf("Unknown format %q for source %q", config.Format, config.Name)
+		} else if config.Format == "csv" && len(config.Columns) == 0 {
+			return nil, fmt.Errorf("No columns for csv source %q", config.Name)
+		} else if config.Format == "regex" {
+			if config.pattern, err = regexp.Compile(config.Pattern); err != nil || config.Pattern == "" {
+				return nil, fmt.Errorf("Invalid pattern for regex source %q", config.Name)
+			}
+		}
+		config.parse = parser(config)
+		if len(config.Keys) == 0 {
+			return nil, fmt.Errorf("No keys for source %q", config.Name)
+		}
+		if config.Value == "" {
+			config.Value = "value"
+		}
+	}
+	return configs, nil
+}
+
+func parseJSONRecord(record []byte) (url.Values, error) {
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	fields := url.Values{}
+	for name, value := range object {
+		switch value := value.(type) {
+		case string:
+			fields.Set(name, value)
+		case json.Number, bool:
+			fields.Set(name, fmt.Sprint(value))
+		}
+	}
+	return fields, nil
+}
+
+func parseQueryRecord(record []byte) (url.Values, error) {
+	return url.ParseQuery(string(record))
+}
+
+func csvRecordParser(columns []string) sourceParser {
+	return func(record []byte) (url.Values, error) {
+		values, err := csv.NewReader(bytes.NewReader(record)).Read()
+		if err != nil {
+			return nil, err
+		}
+		fields := url.Values{}
+		for i, column := range columns {
+			if i < len(values) {
+				fields.Set(column, values[i])
+			}
+		}
+		return fields, nil
+	}
+}
+
+func regexRecordParser(pattern *regexp.Regexp) sourceParser {
+	return func(record []byte) (url.Values, error) {
+		match := pattern.FindSubmatch(record)
+		if match == nil {
+			return nil, UnmatchedRecord
+		}
+		fields := url.Values{}
+		for i, name := range pattern.SubexpNames() {
+			if name != "" && match[i] != nil {
+				fields.Set(name, string(match[i]))
+			}
+		}
+		return fields, nil
+	}
+}
+
+func parseLineRecord(record []byte) (url.Values, error) {
+	return url.Values{"value": {string(record)}}, nil
+}
+
+// Accepts POSTs of records, one per line, on its own `address`, and answers
+// once they have been added, with the error of the last record to be sent
+// again if any has to be
+type httpSource struct {
+	address string
+	parse   sourceParser
+}
+
+func newHTTPSource(config *SourceConfig) (Source, error) {
+	address := config.Options["address"]
+	if address == "" {
+		return nil, fmt.Errorf("No address for http source %q", config.Name)
+	}
+	return &httpSource{address: address, parse: config.parse}, nil
+}
+
+func (hs *httpSource) Run(stop <-chan struct{}, emit func(fields url.Values) error) error {
+	listener, err := net.Listen("tcp", hs.address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			HttpError(w, 405, "METHOD_NOT_ALLOWED")
+			return
+		}
+		var failed error
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, ingestMaxField)
+		for scanner.Scan() {
+			if err := emitRecord(scanner.Bytes(), hs.parse, emit); err != nil {
+				failed = err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			HttpError(w, 500, "INVALID_BODY")
+			return
+		} else if failed != nil {
+			HttpResultError(w, "", failed)
+			return
+		}
+		HttpResponse(w, 200, "OK")
+	})}
+	// Shutdown waits for the records already POSTed to be added
+	shutdown := make(chan struct{})
+	go func() {
+		<-stop
+		server.Shutdown(context.Background())
+		close(shutdown)
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdown
+	return nil
+}
+
+// Parses a record, without its line ending, and emits it unless it is empty.
+// Unreadable records are emitted without fields to be skipped.
+func emitRecord(record []byte, parse sourceParser, emit func(fields url.Values) error) error {
+	record = bytes.TrimRight(record, "\r\n")
+	if len(record) == 0 {
+		return nil
+	}
+	fields, err := parse(record)
+	if err != nil {
+		fields = nil
+	}
+	return emit(fields)
+}
+
+type sourceStatus struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Running  bool   `json:"running"`
+	Events   uint64 `json:"events"`
+	Added    uint64 `json:"added"`
+	Rejected uint64 `json:"rejected"`
+	Skipped  uint64 `json:"skipped"`
+	Error    string `json:"error,omitempty"`
+}
+
+type runningSource struct {
+	sync.Mutex
+	config  *SourceConfig
+	source  Source
+	status  sourceStatus
+	stopped bool
+	err     error
+}
+
+// Adds the value of an event to the keys it maps to.  Events that can't be
+// parsed, or have no value or keys, are skipped.  Returns the error of an add
+// that was rejected for now rather than for good, eg: under memory pressure.
+func (rs *runningSource) emit(fields url.Values) error {
+	atomic.AddUint64(&rs.status.Events, 1)
+	value := fields.Get(rs.config.Value)
+	keys := expandTemplates(rs.config.Keys, fields)
+	if fields == nil || value == "" || len(keys) == 0 {
+		atomic.AddUint64(&rs.status.Skipped, 1)
+		return nil
+	}
+	results := make([]chan Result, len(keys))
+	for i, key := range keys {
+		results[i] = ingestRecord(key, value)
+	}
+	var retry error
+	for _, resultChan := range results {
+		result := <-resultChan
+		if result.Error == nil {
+			atomic.AddUint64(&rs.status.Added, 1)
+			continue
+		}
+		atomic.AddUint64(&rs.status.Rejected, 1)
+		if apiErr, ok := result.Error.(*APIError); result.Error == ReadOnly || ok && apiErr.Retryable {
+			retry = result.Error
+		}
+	}
+	return retry
+}
+
+// Runs the configured sources, each in its own goroutine
+type EventSources struct {
+	sources []*runningSource
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewEventSources(configs []*SourceConfig) (*EventSources, error) {
+	es := &EventSources{stop: make(chan struct{})}
+	for _, config := range configs {
+		source, err := sourceTypes[config.Type](config)
+		if err != nil {
+			return nil, err
+		}
+		es.sources = append(es.sources, &runningSource{
+			config: config,
+			source: source,
+			status: sourceStatus{Name: config.Name, Type: config.Type},
+		})
+	}
+	return es, nil
+}
+
+func (es *EventSources) Start() {
+	for _, rs := range es.sources {
+		es.wg.Add(1)
+		go func(rs *runningSource) {
+			defer es.wg.Done()
+			err := rs.source.Run(es.stop, rs.emit)
+			if err != nil {
+				log.Printf("Source %s stopped: %s", rs.config.Name, err)
+			}
+			rs.Lock()
+			rs.stopped, rs.err = true, err
+			rs.Unlock()
+		}(rs)
+	}
+}
+
+// Stops the sources once the events they already read have been added
+func (es *EventSources) Stop() {
+	close(es.stop)
+	es.wg.Wait()
+}
+
+func (es *EventSources) Status() []sourceStatus {
+	statuses := make([]sourceStatus, len(es.sources))
+	for i, rs := range es.sources {
+		statuses[i] = sourceStatus{
+			Name:     rs.status.Name,
+			Type:     rs.status.Type,
+			Events:   atomic.LoadUint64(&rs.status.Events),
+			Added:    atomic.LoadUint64(&rs.status.Added),
+			Rejected: atomic.LoadUint64(&rs.status.Rejected),
+			Skipped:  atomic.LoadUint64(&rs.status.Skipped),
+		}
+		rs.Lock()
+		statuses[i].Running = !rs.stopped
+		if rs.err != nil {
+			statuses[i].Error = rs.err.Error()
+		}
+		rs.Unlock()
+	}
+	return statuses
+}
+
+// Lists the event sources and how many of their events were added
+func SourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if eventSources == nil {
+		HttpResponse(w, 200, []sourceStatus{})
+		return
+	}
+	HttpResponse(w, 200, eventSources.Status())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestSourceParsers(t *testing.T) {
+	fields, err := parseJSONRecord([]byte(`{"day" : "mon", "user_id" : 42, "new" : true, "nested" : {}}`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fields, url.Values{"day": {"mon"}, "user_id": {"42"}, "new": {"true"}})
+
+	fields, err = csvRecordParser([]string{"day", "user_id"})([]byte(`mon,"4,2"`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fields, url.Values{"day": {"mon"}, "user_id": {"4,2"}})
+
+	fields, err = regexRecordParser(regexp.MustCompile(`user=(?P<user>\S+)( country=(?P<country>\w+))?`))([]byte("user=alice via=web"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fields, url.Values{"user": {"alice"}})
+
+	fields, _ = parseLineRecord([]byte("a b"))
+	assert.Equal(t, fields.Get("value"), "a b")
+	_, err = parseJSONRecord([]byte("{"))
+	assert.NotEqual(t, err, nil)
+}
+
+func TestLoadSources(t *testing.T) {
+	file, _ := ioutil.TempFile("", "sources")
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"name" : "clicks", "type" : "file", "format" : "csv", "keys" : ["a"]}]`)
+	file.Close()
+	_, err := LoadSources(file.Name())
+	assert.NotEqual(t, err, nil)
+
+	file, _ = os.Create(file.Name())
+	file.WriteString(`[{"name" : "clicks", "type" : "kafka", "keys" : ["a"]}]`)
+	file.Close()
+	_, err = LoadSources(file.Name())
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const (
+	fillRatioBuckets = 10
+	defaultStatsTop  = 10
+	maxStatsTop      = 1000
+)
+
+// Aggregate statistics over every set in the keyspace.  FillRatios[i] counts
+// the sets holding between i/10 and (i+1)/10 of their k hashes, with full sets
+// counted in the last bucket.
+type keyspaceStats struct {
+	Keys       int                   `json:"keys"`
+	Hashes     int                   `json:"hashes"`
+	Bytes      int                   `json:"bytes"`
+	FillRatios [fillRatioBuckets]int `json:"fill_ratios"`
+	Largest    []keyInfo             `json:"largest"`
+}
+
+func (stats *keyspaceStats) add(key []byte, summary keySummary, top int) {
+	stats.Keys++
+	stats.Hashes += summary.Hashes
+	stats.Bytes += summary.Bytes
+
+	if summary.K > 0 {
+		bucket := summary.Hashes * fillRatioBuckets / summary.K
+		if bucket >= fillRatioBuckets {
+			bucket = fillRatioBuckets - 1
+		}
+		stats.FillRatios[bucket]++
+	}
+
+	// Largest is kept sorted biggest first
+	n := len(stats.Largest)
+	if top == 0 || n == top && stats.Largest[n-1].Bytes >= summary.Bytes {
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return stats.Largest[i].Bytes < summary.Bytes })
+	if n < top {
+		stats.Largest = append(stats.Largest, keyInfo{})
+	}
+	copy(stats.Largest[i+1:], stats.Largest[i:])
+	stats.Largest[i] = newKeyInfo(key, summary)
+}
+
+// Scans the summaries of the keyspace, or of the keys starting with `prefix`,
+// and returns the number of keys, retained hashes and bytes stored, the
+// distribution of how full the sets are and the `top` (default 10) largest
+// sets.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	top := defaultStatsTop
+	if top_raw := reqParams.Get("top"); top_raw != "" {
+		top, err = strconv.Atoi(top_raw)
+		if err != nil || top < 0 || top > maxStatsTop {
+			HttpError(w, 500, "INVALID_ARG_TOP")
+			return
+		}
+	}
+
+	stats := keyspaceStats{Largest: make([]keyInfo, 0, top)}
+	prefix := []byte(reqParams.Get("prefix"))
+	err = scanSummaries(dispatcher.database, prefix, nil, func(key []byte, summary keySummary) bool {
+		stats.add(key, summary, top)
+		return true
+	})
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	HttpResponse(w, 200, stats)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceStats(t *testing.T) {
+	stats := keyspaceStats{}
+	for i := 1; i <= 10; i++ {
+		kmv := kminvalues.NewKMinValues(10)
+		for j := 0; j < i; j++ {
+			kmv.AddHash(GetRandHash())
+		}
+		stats.add([]byte(fmt.Sprintf("key%d", i)), newKeySummary(kmv, kmv.Bytes(), time.Now()), 3)
+	}
+
+	assert.Equal(t, stats.Keys, 10)
+	assert.Equal(t, stats.Hashes, 55)
+	assert.Equal(t, stats.Bytes, 10*8+55*8)
+	assert.Equal(t, stats.FillRatios, [fillRatioBuckets]int{0, 1, 1, 1, 1, 1, 1, 1, 1, 2})
+
+	assert.Equal(t, len(stats.Largest), 3)
+	assert.Equal(t, stats.Largest[0].Key, "key10")
+	assert.Equal(t, stats.Largest[2].Key, "key8")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"log"
+	"math"
+	"time"
+)
+
+// Summaries written per batch by backfillSummaries
+const backfillBatchSize = 1000
+
+// Marks a database whose sets all have a summary
+var summariesBackfilled = []byte(internalKeyPrefix + "summaries")
+
+var CorruptSummary = errors.New("Could not read stored summary")
+
+func summaryKey(key string) []byte {
+	return []byte(internalKeyPrefix + "summary:" + key)
+}
+
+// A few bytes describing a stored set, written along with it, so that listing
+// and counting keys never reads the sets themselves.  Min and Max are the
+// smallest and largest retained hashes and Version is the same as the ETag of
+// /cardinality.  Updated is zero for sets summarized by backfillSummaries.
+type keySummary struct {
+	Cardinality float64
+	K           int
+	Width       int
+	Hashes      int
+	Bytes       int
+	Min         uint64
+	Max         uint64
+	Version     uint64
+	Updated     time.Time
+}
+
+// Summarizes kmv as it is about to be stored as data
+func newKeySummary(kmv *kminvalues.KMinValues, data []byte, updated time.Time) keySummary {
+	summary := keySummary{
+		Cardinality: kmv.Cardinality(),
+		K:           kmv.MaxSize(),
+		Width:       kmv.HashWidth(),
+		Hashes:      kmv.Len(),
+		Bytes:       len(data),
+		Version:     dataVersion(data),
+		Updated:     updated,
+	}
+	if kmv.Len() > 0 {
+		summary.Max = kmv.GetHash(0)
+		summary.Min = kmv.GetHash(kmv.Len() - 1)
+	}
+	return summary
+}
+
+// The relative error of an estimate from sets of k hashes, as
+// KMinValues.RelativeError gives it, or 0 if the sets weren't full since they
+// are then counted exactly
+func relativeErrorFor(k int, full bool) float64 {
+	if !full || k <= 2 {
+		return 0
+	}
+	return math.Sqrt(2.0 / (math.Pi * float64(k-2)))
+}
+
+func encodeSummary(summary keySummary) []byte {
+	buf := make([]byte, 0, 8+7*binary.MaxVarintLen64)
+	var word [8]byte
+	binary.BigEndian.PutUint64(word[:], math.Float64bits(summary.Cardinality))
+	buf = append(buf, word[:]...)
+
+	var varint [binary.MaxVarintLen64]byte
+	for _, field := range []uint64{
+		uint64(summary.K), uint64(summary.Width), uint64(summary.Hashes),
+		uint64(summary.Bytes), summary.Min, summary.Max, summary.Version,
+	} {
+		buf = append(buf, varint[:binary.PutUvarint(varint[:], field)]...)
+	}
+	updated := int64(0)
+	if !summary.Updated.IsZero() {
+		updated = summary.Updated.UnixNano()
+	}
+	return append(buf, varint[:binary.PutVarint(varint[:], updated)]...)
+}
+
+func decodeSummary(data []byte) (keySummary, error) {
+	var summary keySummary
+	if len(data) < 8 {
+		return summary, CorruptSummary
+	}
+	summary.Cardinality = math.Float64frombits(binary.BigEndian.Uint64(data))
+	data = data[8:]
+
+	var fields [7]uint64
+	for i := range fields {
+		field, n := binary.Uvarint(data)
+		if n <= 0 {
+			return summary, CorruptSummary
+		}
+		fields[i], data = field, data[n:]
+	}
+	updated, n := binary.Varint(data)
+	if n <= 0 || n != len(data) {
+		return summary, CorruptSummary
+	}
+	summary.K, summary.Width, summary.Hashes = int(fields[0]), int(fields[1]), int(fields[2])
+	summary.Bytes, summary.Min, summary.Max, summary.Version = int(fields[3]), fields[4], fields[5], fields[6]
+	if updated != 0 {
+		summary.Updated = time.Unix(0, updated).UTC()
+	}
+	return summary, nil
+}
+
+// Reads the summary of key, returning false if it has none or it can't be read
+func readSummary(batch *Batch, key string) (keySummary, bool, error) {
+	data, err := batch.Get(summaryKey(key))
+	if err != nil || len(data) == 0 {
+		return keySummary{}, false, err
+	}
+	summary, err := decodeSummary(data)
+	if err != nil {
+		log.Printf("Ignoring unreadable summary of %q: %s", key, err)
+		return keySummary{}, false, nil
+	}
+	return summary, true, nil
+}
+
+// Same as scanKeys but visits the summaries of the sets instead
+func scanSummaries(database *levigo.DB, prefix, after []byte, visit func(key []byte, summary keySummary) bool) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+
+	it := database.NewIterator(ro)
+	defer it.Close()
+
+	start := summaryKey(string(prefix))
+	if bytes.Compare(after, prefix) >= 0 {
+		start = summaryKey(string(after))
+		it.Seek(start)
+		if it.Valid() && bytes.Equal(it.Key(), start) {
+			it.Next()
+		}
+	} else {
+		it.Seek(start)
+	}
+
+	namespace := len(summaryKey(""))
+	for ; it.Valid(); it.Next() {
+		stored := it.Key()
+		if !bytes.HasPrefix(stored, summaryKey(string(prefix))) {
+			break
+		}
+		summary, err := decodeSummary(openValue(stored, it.Value()))
+		if err != nil {
+			log.Printf("Skipping unreadable summary %q: %s", stored, err)
+			continue
+		}
+		if !visit(stored[namespace:], summary) {
+			break
+		}
+	}
+	return it.GetError()
+}
+
+// Writes a summary for every set stored before summaries were, once
+func backfillSummaries(database *levigo.DB) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	done, err := database.Get(ro, summariesBackfilled)
+	if err != nil || len(done) != 0 {
+		return err
+	}
+
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	n := 0
+	var writeErr error
+	err = scanKeys(database, nil, nil, func(key, data []byte, kmv *kminvalues.KMinValues) bool {
+		stored := summaryKey(string(key))
+		wb.Put(stored, sealValue(stored, encodeSummary(newKeySummary(kmv, data, time.Time{}))))
+		if n++; n%backfillBatchSize == 0 {
+			if writeErr = database.Write(wo, wb); writeErr != nil {
+				return false
+			}
+			wb.Clear()
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	} else if writeErr != nil {
+		return writeErr
+	}
+	wb.Put(summariesBackfilled, []byte{1})
+	if err := database.Write(wo, wb); err != nil {
+		return err
+	}
+	log.Printf("Summarized %d sets", n)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"testing"
+	"time"
+)
+
+func TestSummaryEncoding(t *testing.T) {
+	kmv := kminvalues.NewKMinValues(10)
+	for i := 0; i < 20; i++ {
+		kmv.AddHash(GetRandHash())
+	}
+	data := kmv.Bytes()
+	summary := newKeySummary(kmv, data, time.Unix(1500000000, 0).UTC())
+	assert.Equal(t, summary.Hashes, 10)
+	assert.Equal(t, summary.Max, kmv.GetHash(0))
+	assert.Equal(t, summary.Min, kmv.GetHash(9))
+	assert.Equal(t, summary.Version, dataVersion(data))
+
+	decoded, err := decodeSummary(encodeSummary(summary))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded, summary)
+
+	summary.Updated = time.Time{}
+	decoded, err = decodeSummary(encodeSummary(summary))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded.Updated.IsZero(), true)
+
+	encoded := encodeSummary(summary)
+	_, err = decodeSummary(encoded[:len(encoded)-1])
+	assert.Equal(t, err, CorruptSummary)
+	_, err = decodeSummary(append(encoded, 0))
+	assert.Equal(t, err, CorruptSummary)
+}
+
+func TestSummaryWrites(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_SUMMARY"
+	resultChan := make(chan Result)
+	for i := 0; i < 3; i++ {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		<-resultChan
+	}
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, _ := dispatcher.database.Get(ro, summaryKey(key))
+	summary, err := decodeSummary(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, summary.Hashes, 3)
+	assert.Equal(t, summary.Cardinality, 3.0)
+	assert.Equal(t, time.Since(summary.Updated) < time.Minute, true)
+
+	// cardinality is read from the summary rather than the set
+	stored, _ := dispatcher.database.Get(ro, []byte(key))
+	summary.Cardinality = 42
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	dispatcher.database.Put(wo, summaryKey(key), encodeSummary(summary))
+	var cardinality float64
+	var version uint64
+	dispatcher.Dispatch(CardinalityRequest{Key: key, Cardinality: &cardinality, Version: &version, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, cardinality, 42.0)
+	assert.Equal(t, version, dataVersion(stored))
+
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	data, _ = dispatcher.database.Get(ro, summaryKey(key))
+	assert.Equal(t, len(data), 0)
+}
+
+func TestBackfillSummaries(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	key := "_GOTEST_BACKFILL"
+	kmv := kminvalues.NewKMinValues(10)
+	kmv.AddHash(GetRandHash())
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	dispatcher.database.Put(wo, []byte(key), kmv.Bytes())
+	dispatcher.database.Delete(wo, summariesBackfilled)
+	defer dispatcher.database.Delete(wo, []byte(key))
+	defer dispatcher.database.Delete(wo, summaryKey(key))
+
+	assert.Equal(t, backfillSummaries(dispatcher.database), nil)
+	data, _ := dispatcher.database.Get(ro, summaryKey(key))
+	summary, err := decodeSummary(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, summary.Hashes, 1)
+	assert.Equal(t, summary.Updated.IsZero(), true)
+
+	// only ever done once
+	dispatcher.database.Delete(wo, summaryKey(key))
+	assert.Equal(t, backfillSummaries(dispatcher.database), nil)
+	data, _ = dispatcher.database.Get(ro, summaryKey(key))
+	assert.Equal(t, len(data), 0)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jmhodges/levigo"
+	"github.com/mynameisfiber/gocountme/kminvalues"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Most tags a key may have
+const maxKeyTags = 64
+
+var (
+	InvalidTag  = NewAPIError(400, "INVALID_TAG", "Tags are name=value with a non-empty name", false)
+	TooManyTags = NewAPIError(400, "TOO_MANY_TAGS", "Keys have at most 64 tags", false)
+)
+
+func tagsKey(key string) []byte {
+	return []byte(internalKeyPrefix + "tags:" + key)
+}
+
+// A tag filter matches keys with the tag name set to value, or set at all if
+// only the name was given
+type tagFilter struct {
+	Name  string
+	Value string
+	Any   bool
+}
+
+// Parses tags given as name=value
+func parseTags(tags_raw []string) (map[string]string, error) {
+	tags := make(map[string]string, len(tags_raw))
+	for _, tag := range tags_raw {
+		name, value, found := strings.Cut(tag, "=")
+		if !found || name == "" {
+			return nil, InvalidTag
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// Parses filters given as name=value, or just a name for any value
+func parseTagFilters(filters_raw []string) ([]tagFilter, error) {
+	filters := make([]tagFilter, 0, len(filters_raw))
+	for _, filter := range filters_raw {
+		name, value, found := strings.Cut(filter, "=")
+		if name == "" {
+			return nil, InvalidTag
+		}
+		filters = append(filters, tagFilter{Name: name, Value: value, Any: !found})
+	}
+	return filters, nil
+}
+
+func matchTags(tags map[string]string, filters []tagFilter) bool {
+	for _, filter := range filters {
+		value, found := tags[filter.Name]
+		if !found || !filter.Any && value != filter.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeTags(data []byte) (map[string]string, error) {
+	tags := make(map[string]string)
+	if len(data) == 0 {
+		return tags, nil
+	}
+	err := json.Unmarshal(data, &tags)
+	return tags, err
+}
+
+// Sets and removes tags of a key and stores the tags it ends up with in Tags.
+// Tags are kept apart from the set, so keys can be tagged before any value is
+// added to them, and are deleted along with it.
+type TagRequest struct {
+	Key        string
+	Set        map[string]string
+	Remove     []string
+	Tags       *map[string]string
+	ResultChan chan Result
+}
+
+func (tr TagRequest) RequestKeys() []string { return []string{tr.Key} }
+
+func (tr TagRequest) WriteResult(result Result) {
+	result.Key = tr.Key
+	tr.ResultChan <- result
+}
+
+func (tr TagRequest) Execute(batch *Batch) (*kminvalues.KMinValues, error) {
+	if tr.Key == "" {
+		return nil, NoKeySpecified
+	} else if isInternalKey([]byte(tr.Key)) {
+		return nil, InvalidKey
+	}
+	data, err := batch.Get(tagsKey(tr.Key))
+	if err != nil {
+		return nil, err
+	}
+	tags, err := decodeTags(data)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range tr.Set {
+		tags[name] = value
+	}
+	for _, name := range tr.Remove {
+		delete(tags, name)
+	}
+	if len(tags) > maxKeyTags {
+		return nil, TooManyTags
+	}
+
+	if len(tags) == 0 {
+		if err := batch.Delete(tagsKey(tr.Key)); err != nil {
+			return nil, err
+		}
+	} else {
+		data, _ := json.Marshal(tags)
+		batch.Put(tagsKey(tr.Key), data)
+	}
+	*tr.Tags = tags
+	return nil, nil
+}
+
+func readTags(database *levigo.DB, key string) (map[string]string, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := readValue(database, ro, tagsKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTags(data)
+}
+
+// Calls visit with the tags of every tagged key starting with prefix, in key
+// order, starting after the key `after`, until visit returns false
+func scanTags(database *levigo.DB, prefix, after []byte, visit func(key []byte, tags map[string]string) bool) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+
+	it := database.NewIterator(ro)
+	defer it.Close()
+
+	start := tagsKey(string(prefix))
+	if bytes.Compare(after, prefix) >= 0 {
+		start = tagsKey(string(after))
+		it.Seek(start)
+		if it.Valid() && bytes.Equal(it.Key(), start) {
+			it.Next()
+		}
+	} else {
+		it.Seek(start)
+	}
+
+	namespace := len(tagsKey(""))
+	for ; it.Valid(); it.Next() {
+		stored := it.Key()
+		if !bytes.HasPrefix(stored, tagsKey(string(prefix))) {
+			break
+		}
+		tags, err := decodeTags(openValue(stored, it.Value()))
+		if err != nil {
+			log.Printf("Skipping unreadable tags %q: %s", stored, err)
+			continue
+		}
+		if !visit(stored[namespace:], tags) {
+			break
+		}
+	}
+	return it.GetError()
+}
+
+// Same as scanSummaries but only visits the keys whose tags match filters,
+// along with their tags.  Tagged keys without a set are skipped.
+func scanTaggedSummaries(database *levigo.DB, prefix, after []byte, filters []tagFilter, visit func(key []byte, tags map[string]string, summary keySummary) bool) error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	return scanTags(database, prefix, after, func(key []byte, tags map[string]string) bool {
+		if !matchTags(tags, filters) {
+			return true
+		}
+		data, err := readValue(database, ro, summaryKey(string(key)))
+		if err != nil || len(data) == 0 {
+			return true
+		}
+		summary, err := decodeSummary(data)
+		if err != nil {
+			return true
+		}
+		return visit(key, tags, summary)
+	})
+}
+
+// Sets the `tag`s, given as name=value, of `key` and removes its `untag`
+// tags, given by name, and returns the tags the key ends up with
+func TagHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	set, err := parseTags(reqParams["tag"])
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+
+	var tags map[string]string
+	resultChan := make(chan Result, 1)
+	tagRequest := TagRequest{
+		Key:        key,
+		Set:        set,
+		Remove:     reqParams["untag"],
+		Tags:       &tags,
+		ResultChan: resultChan,
+	}
+	if err := submitRequest(withBatching(tagRequest, reqParams)); err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	if result := <-resultChan; result.Error != nil {
+		HttpResultError(w, key, result.Error)
+		return
+	}
+	HttpResponse(w, 200, tags)
+}
+
+// Returns the tags of `key`
+func TagsHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	key := reqParams.Get("key")
+	if key == "" {
+		HttpError(w, 500, "MISSING_ARG_KEY")
+		return
+	}
+
+	tags, err := readTags(dispatcher.database, key)
+	if err != nil {
+		HttpResultError(w, key, err)
+		return
+	}
+	HttpResponse(w, 200, tags)
+}
+
+type tagGroup struct {
+	Value       string  `json:"value"`
+	Cardinality float64 `json:"cardinality"`
+	Keys        int     `json:"keys"`
+
+	union *kminvalues.KMinValues
+}
+
+type tagReport struct {
+	Tags    []string    `json:"tags"`
+	GroupBy string      `json:"group_by,omitempty"`
+	Union   bool        `json:"union"`
+	Groups  []*tagGroup `json:"groups"`
+}
+
+// Aggregates the keys whose tags match every `tag` filter, grouped by the
+// value of their `group_by` tag if given.  The cardinalities of the keys of a
+// group are summed from their summaries, or with `union=true` their sets are
+// read and unioned.
+func TagReportHandler(w http.ResponseWriter, r *http.Request) {
+	reqParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		HttpError(w, 500, "INVALID_URI")
+		return
+	}
+
+	filters, err := parseTagFilters(reqParams["tag"])
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+	union := false
+	if union_raw := reqParams.Get("union"); union_raw != "" {
+		union, err = strconv.ParseBool(union_raw)
+		if err != nil {
+			HttpError(w, 500, "INVALID_ARG_UNION")
+			return
+		}
+	}
+	groupBy := reqParams.Get("group_by")
+	if groupBy != "" {
+		filters = append(filters, tagFilter{Name: groupBy, Any: true})
+	}
+
+	result := tagReport{Tags: append([]string{}, reqParams["tag"]...), GroupBy: groupBy, Union: union, Groups: []*tagGroup{}}
+	groups := make(map[string]*tagGroup)
+	tooMany := false
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	err = scanTaggedSummaries(dispatcher.database, nil, nil, filters, func(key []byte, tags map[string]string, summary keySummary) bool {
+		group, found := groups[tags[groupBy]]
+		if !found {
+			if len(groups) == maxReportGroups {
+				tooMany = true
+				return false
+			}
+			group = &tagGroup{Value: tags[groupBy]}
+			groups[group.Value] = group
+			result.Groups = append(result.Groups, group)
+		}
+		if !union {
+			group.Cardinality += summary.Cardinality
+			group.Keys++
+			return true
+		}
+		data, err := readValue(dispatcher.database, ro, key)
+		if err != nil || len(data) == 0 {
+			return true
+		}
+		kmv, err := kminvalues.KMinValuesFromBytes(data)
+		if err != nil {
+			log.Printf("Skipping unreadable set %q: %s", key, err)
+			return true
+		}
+		if group.union == nil {
+			group.union = kmv
+		} else {
+			group.union.Merge(kmv)
+		}
+		group.Keys++
+		return true
+	})
+	if err == nil && tooMany {
+		err = TooManyReportGroups
+	}
+	if err != nil {
+		HttpResultError(w, "", err)
+		return
+	}
+
+	for _, group := range result.Groups {
+		if group.union != nil {
+			group.Cardinality = group.union.Cardinality()
+		}
+	}
+	sort.Slice(result.Groups, func(i, j int) bool { return result.Groups[i].Value < result.Groups[j].Value })
+	HttpResponse(w, 200, result)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTagFilters(t *testing.T) {
+	tags, err := parseTags([]string{"team=growth", "empty="})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, tags, map[string]string{"team": "growth", "empty": ""})
+	_, err = parseTags([]string{"team"})
+	assert.Equal(t, err, InvalidTag)
+
+	filters, err := parseTagFilters([]string{"team=growth", "retention"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, matchTags(map[string]string{"team": "growth", "retention": "90d"}, filters), true)
+	assert.Equal(t, matchTags(map[string]string{"team": "growth"}, filters), false)
+	assert.Equal(t, matchTags(map[string]string{"team": "ads", "retention": "90d"}, filters), false)
+	_, err = parseTagFilters([]string{"=growth"})
+	assert.Equal(t, err, InvalidTag)
+}
+
+func TestTags(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	resultChan := make(chan Result)
+	keys := []string{"_GOTEST_TAGS_A", "_GOTEST_TAGS_B", "_GOTEST_TAGS_C"}
+	for i, key := range keys {
+		for j := 0; j <= 10*i; j++ {
+			dispatcher.Dispatch(AddHashRequest{Key: key, Hash: Hashify([]byte(fmt.Sprintf("%d", j))), ResultChan: resultChan})
+			<-resultChan
+		}
+	}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	get := func(handler func(w *httptest.ResponseRecorder), result interface{}) int {
+		w := httptest.NewRecorder()
+		handler(w)
+		json.Unmarshal(w.Body.Bytes(), &struct{ Data interface{} }{result})
+		return w.Code
+	}
+	tag := func(query string) (int, map[string]string) {
+		var tags map[string]string
+		code := get(func(w *httptest.ResponseRecorder) {
+			TagHandler(w, httptest.NewRequest("GET", "/tag?"+query, nil))
+		}, &tags)
+		return code, tags
+	}
+
+	code, tags := tag("key=_GOTEST_TAGS_A&tag=team=growth&tag=retention=90d")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, tags, map[string]string{"team": "growth", "retention": "90d"})
+	code, tags = tag("key=_GOTEST_TAGS_B&tag=team=growth&tag=scratch=")
+	assert.Equal(t, code, 200)
+	_, tags = tag("key=_GOTEST_TAGS_B&untag=scratch")
+	assert.Equal(t, tags, map[string]string{"team": "growth"})
+	tag("key=_GOTEST_TAGS_C&tag=team=ads")
+	code, _ = tag("key=_GOTEST_TAGS_C&tag=team")
+	assert.Equal(t, code, 400)
+
+	get(func(w *httptest.ResponseRecorder) {
+		TagsHandler(w, httptest.NewRequest("GET", "/tags?key=_GOTEST_TAGS_A", nil))
+	}, &tags)
+	assert.Equal(t, tags, map[string]string{"team": "growth", "retention": "90d"})
+
+	var page keysPage
+	get(func(w *httptest.ResponseRecorder) {
+		KeysHandler(w, httptest.NewRequest("GET", "/keys?prefix=_GOTEST_TAGS&tag=team=growth", nil))
+	}, &page)
+	assert.Equal(t, len(page.Keys), 2)
+	assert.Equal(t, page.Keys[0].Key, keys[0])
+	assert.Equal(t, page.Keys[1].Tags, map[string]string{"team": "growth"})
+	get(func(w *httptest.ResponseRecorder) {
+		KeysHandler(w, httptest.NewRequest("GET", "/keys?prefix=_GOTEST_TAGS&tag=team&limit=1&after=_GOTEST_TAGS_A", nil))
+	}, &page)
+	assert.Equal(t, len(page.Keys), 1)
+	assert.Equal(t, page.Keys[0].Key, keys[1])
+	assert.Equal(t, page.Next, keys[1])
+
+	var report tagReport
+	get(func(w *httptest.ResponseRecorder) {
+		TagReportHandler(w, httptest.NewRequest("GET", "/tags/report?group_by=team", nil))
+	}, &report)
+	assert.Equal(t, len(report.Groups), 2)
+	assert.Equal(t, *report.Groups[0], tagGroup{Value: "ads", Cardinality: 21, Keys: 1})
+	assert.Equal(t, *report.Groups[1], tagGroup{Value: "growth", Cardinality: 12, Keys: 2})
+	get(func(w *httptest.ResponseRecorder) {
+		TagReportHandler(w, httptest.NewRequest("GET", "/tags/report?tag=team=growth&union=true", nil))
+	}, &report)
+	assert.Equal(t, len(report.Groups), 1)
+	assert.Equal(t, report.Groups[0].Cardinality, 11.0)
+
+	// deleting a key deletes its tags
+	dispatcher.Dispatch(DeleteRequest{Key: keys[0], ResultChan: resultChan})
+	<-resultChan
+	tags, _ = readTags(dispatcher.database, keys[0])
+	assert.Equal(t, len(tags), 0)
+}
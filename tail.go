@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// How often followed files are checked for new lines, and new files for
+	// the glob
+	sourcePollInterval = 250 * time.Millisecond
+	// How long to wait before adding a record rejected for now again
+	sourceRetry = time.Second
+	// Bytes at the start of a file that tell it apart from the file that was
+	// at its path before it was rotated
+	tailFingerprintSize = 1024
+)
+
+// How far a file source read a file.  The file is recognized by the hash of
+// its first HeadSize bytes, so a new file at the same path is read from its
+// start rather than from the offset of the one it replaced.
+type tailCheckpoint struct {
+	Offset   int64  `json:"offset"`
+	Head     uint64 `json:"head"`
+	HeadSize int64  `json:"head_size"`
+}
+
+func checkpointKey(source, path string) []byte {
+	return []byte(internalKeyPrefix + "checkpoint:" + source + "\x00" + path)
+}
+
+// Reads the lines of the files matching the glob `path`.  With
+// `follow=true` files are tailed: new lines are read as they are appended,
+// files that start matching are picked up, and once a file is rotated, by
+// renaming or truncating it, the lines left in it are read before the file
+// that took its place is read from the start.  Unless `checkpoint=false`,
+// the offset of every file is saved once its lines were added, so a restart
+// resumes where the last run left off.  Files without a checkpoint are read
+// from the start, except when following a file that already existed, which
+// is read from its end as tail -f does.
+type fileSource struct {
+	name       string
+	pattern    string
+	follow     bool
+	checkpoint bool
+	parse      sourceParser
+}
+
+func newFileSource(config *SourceConfig) (Source, error) {
+	fs := &fileSource{name: config.Name, pattern: config.Options["path"], checkpoint: true, parse: config.parse}
+	if fs.pattern == "" {
+		return nil, fmt.Errorf("No path for file source %q", config.Name)
+	} else if _, err := filepath.Match(fs.pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid path for file source %q", config.Name)
+	}
+	var err error
+	if follow_raw := config.Options["follow"]; follow_raw != "" {
+		if fs.follow, err = strconv.ParseBool(follow_raw); err != nil {
+			return nil, fmt.Errorf("Invalid follow for file source %q", config.Name)
+		}
+	}
+	if checkpoint_raw := config.Options["checkpoint"]; checkpoint_raw != "" {
+		if fs.checkpoint, err = strconv.ParseBool(checkpoint_raw); err != nil {
+			return nil, fmt.Errorf("Invalid checkpoint for file source %q", config.Name)
+		}
+	}
+	return fs, nil
+}
+
+// A file being read
+type tailedFile struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	partial []byte
+	offset  int64 // of the first byte of partial
+	saved   int64 // offset of the last checkpoint
+}
+
+func (fs *fileSource) Run(stop <-chan struct{}, emit func(fields url.Values) error) error {
+	database := dispatcher.database
+	tails := make(map[string]*tailedFile)
+	defer func() {
+		for _, tail := range tails {
+			fs.save(database, tail)
+			tail.file.Close()
+		}
+	}()
+
+	started := false
+	for {
+		paths, _ := filepath.Glob(fs.pattern)
+		sort.Strings(paths)
+		if len(paths) == 0 && !fs.follow {
+			return fmt.Errorf("No files match %s", fs.pattern)
+		}
+		for _, path := range paths {
+			if tails[path] != nil {
+				continue
+			}
+			tail, err := fs.open(database, path, fs.follow && !started)
+			if err != nil {
+				log.Printf("Could not open %s for source %s: %s", path, fs.name, err)
+				continue
+			}
+			tails[path] = tail
+		}
+		started = true
+
+		for _, path := range paths {
+			tail := tails[path]
+			if tail == nil {
+				continue
+			}
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if err := fs.read(stop, tail, emit); err != nil {
+				return err
+			}
+			fs.save(database, tail)
+			if !fs.follow || fs.rotated(tail) {
+				tail.file.Close()
+				delete(tails, path)
+			}
+		}
+		if !fs.follow {
+			return nil
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(sourcePollInterval):
+		}
+	}
+}
+
+// Opens a file at its checkpoint, or at its end if atEnd and it has none
+func (fs *fileSource) open(database *levigo.DB, path string, atEnd bool) (*tailedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	tail := &tailedFile{path: path, file: file, info: info}
+
+	checkpoint, found := fs.load(database, path)
+	if found && checkpoint.Offset <= info.Size() && fingerprint(file, checkpoint.HeadSize) == checkpoint.Head {
+		tail.offset = checkpoint.Offset
+	} else if atEnd {
+		tail.offset = info.Size()
+	}
+	if _, err := file.Seek(tail.offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	tail.saved = tail.offset
+	tail.reader = bufio.NewReader(file)
+	return tail, nil
+}
+
+// Reads and adds the lines of a file up to its end, keeping a last line
+// without a line ending for later if following the file.  Records rejected
+// for now are added again until they get in or the source is stopped.
+func (fs *fileSource) read(stop <-chan struct{}, tail *tailedFile, emit func(fields url.Values) error) error {
+	for {
+		line, err := tail.reader.ReadBytes('\n')
+		tail.partial = append(tail.partial, line...)
+		if err == io.EOF && (fs.follow || len(tail.partial) == 0) {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		for emitRecord(tail.partial, fs.parse, emit) != nil {
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(sourceRetry):
+			}
+		}
+		tail.offset += int64(len(tail.partial))
+		tail.partial = tail.partial[:0]
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+	}
+}
+
+// Whether a followed file was rotated since it was opened.  A file that was
+// truncated is read again from its start, and one that was renamed or
+// removed is done with once its last lines were read.
+func (fs *fileSource) rotated(tail *tailedFile) bool {
+	info, err := os.Stat(tail.path)
+	if err != nil || !os.SameFile(tail.info, info) {
+		return true
+	}
+	if info.Size() < tail.offset+int64(len(tail.partial)) {
+		tail.file.Seek(0, io.SeekStart)
+		tail.reader.Reset(tail.file)
+		tail.partial = tail.partial[:0]
+		tail.offset, tail.saved = 0, -1
+	}
+	return false
+}
+
+// The hash of the first size bytes of file
+func fingerprint(file *os.File, size int64) uint64 {
+	head := make([]byte, size)
+	n, _ := file.ReadAt(head, 0)
+	h := fnv.New64a()
+	h.Write(head[:n])
+	return h.Sum64()
+}
+
+func (fs *fileSource) load(database *levigo.DB, path string) (tailCheckpoint, bool) {
+	var checkpoint tailCheckpoint
+	if !fs.checkpoint {
+		return checkpoint, false
+	}
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := database.Get(ro, checkpointKey(fs.name, path))
+	if err != nil || len(data) == 0 {
+		return checkpoint, false
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return checkpoint, false
+	}
+	return checkpoint, true
+}
+
+// Saves the offset of the lines of a file that were added, if it moved
+func (fs *fileSource) save(database *levigo.DB, tail *tailedFile) {
+	if !fs.checkpoint || tail.offset == tail.saved {
+		return
+	}
+	checkpoint := tailCheckpoint{Offset: tail.offset, HeadSize: tail.offset}
+	if checkpoint.HeadSize > tailFingerprintSize {
+		checkpoint.HeadSize = tailFingerprintSize
+	}
+	checkpoint.Head = fingerprint(tail.file, checkpoint.HeadSize)
+	data, _ := json.Marshal(checkpoint)
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	if err := database.Put(wo, checkpointKey(fs.name, tail.path), data); err != nil {
+		log.Printf("Could not save checkpoint of %s for source %s: %s", tail.path, fs.name, err)
+		return
+	}
+	tail.saved = tail.offset
+}
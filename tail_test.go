@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func deleteCheckpoint(source, path string) {
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	dispatcher.database.Delete(wo, checkpointKey(source, path))
+}
+
+func TestFileSource(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	events, _ := ioutil.TempFile("", "events")
+	defer os.Remove(events.Name())
+	events.WriteString("{\"day\" : \"mon\", \"country\" : \"us\", \"user_id\" : 1}\n")
+	events.WriteString("{\"day\" : \"mon\", \"user_id\" : 2}\n")
+	events.WriteString("not json\n")
+	events.WriteString("{\"day\" : \"tue\", \"country\" : \"us\", \"user_id\" : 1}")
+	events.Close()
+	defer deleteCheckpoint("events", events.Name())
+
+	config := &SourceConfig{
+		Name:    "events",
+		Type:    "file",
+		Keys:    []string{"_GOTEST_SOURCE:{day}", "_GOTEST_SOURCE:{day}:{country}"},
+		Value:   "user_id",
+		Options: map[string]string{"path": events.Name()},
+		parse:   parseJSONRecord,
+	}
+	es, err := NewEventSources([]*SourceConfig{config})
+	assert.Equal(t, err, nil)
+	es.Start()
+	for es.Status()[0].Running {
+		time.Sleep(time.Millisecond)
+	}
+	es.Stop()
+
+	status := es.Status()[0]
+	assert.Equal(t, status.Error, "")
+	assert.Equal(t, status.Events, uint64(4))
+	assert.Equal(t, status.Added, uint64(5))
+	assert.Equal(t, status.Skipped, uint64(1))
+
+	resultChan := make(chan Result)
+	for key, expected := range map[string]float64{
+		"_GOTEST_SOURCE:mon": 2, "_GOTEST_SOURCE:mon:us": 1, "_GOTEST_SOURCE:tue": 1, "_GOTEST_SOURCE:tue:us": 1,
+	} {
+		var cardinality float64
+		var version uint64
+		dispatcher.Dispatch(CardinalityRequest{Key: key, Cardinality: &cardinality, Version: &version, ResultChan: resultChan})
+		<-resultChan
+		assert.Equal(t, cardinality, expected)
+		dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+		<-resultChan
+	}
+}
+
+func TestTailedFiles(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+
+	dir, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	defer deleteCheckpoint("app", path)
+	log, _ := os.Create(path)
+	fmt.Fprintf(log, "user=old\n")
+
+	pattern := `user=(?P<user>\S+)`
+	config := &SourceConfig{
+		Name:    "app",
+		Type:    "file",
+		Keys:    []string{"_GOTEST_TAIL"},
+		Value:   "user",
+		Options: map[string]string{"path": filepath.Join(dir, "*.log"), "follow": "true"},
+		pattern: regexp.MustCompile(pattern),
+	}
+	config.parse = regexRecordParser(config.pattern)
+	run := func() *EventSources {
+		es, err := NewEventSources([]*SourceConfig{config})
+		assert.Equal(t, err, nil)
+		es.Start()
+		return es
+	}
+	waitFor := func(es *EventSources, events uint64) {
+		for deadline := time.Now().Add(5 * time.Second); es.Status()[0].Events < events && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, es.Status()[0].Events, events)
+	}
+
+	// lines already there when the file is first followed are skipped
+	es := run()
+	time.Sleep(2 * sourcePollInterval)
+	fmt.Fprintf(log, "user=a\nuser=b\nuser=")
+	waitFor(es, 2)
+	fmt.Fprintf(log, "c\n")
+	waitFor(es, 3)
+
+	// the lines written to a rotated file are read before its replacement
+	os.Rename(path, path+".1")
+	fmt.Fprintf(log, "user=d\n")
+	log.Close()
+	log, _ = os.Create(path)
+	fmt.Fprintf(log, "user=e\n")
+	waitFor(es, 5)
+	es.Stop()
+
+	// a restart picks up where the last run left off
+	fmt.Fprintf(log, "user=f\n")
+	log.Close()
+	es = run()
+	waitFor(es, 1)
+	es.Stop()
+
+	resultChan := make(chan Result)
+	var cardinality float64
+	var version uint64
+	dispatcher.Dispatch(CardinalityRequest{Key: "_GOTEST_TAIL", Cardinality: &cardinality, Version: &version, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, cardinality, 6.0)
+	dispatcher.Dispatch(DeleteRequest{Key: "_GOTEST_TAIL", ResultChan: resultChan})
+	<-resultChan
+}
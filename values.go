@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Keys starting with this prefix hold data the server keeps alongside the
+// sets and can't be used as set names
+const internalKeyPrefix = "\x00"
+
+var (
+	InvalidKey    = NewAPIError(400, "INVALID_KEY", "Keys can't start with a NUL byte", false)
+	CorruptValues = errors.New("Could not read stored values")
+)
+
+const valueHashSize = 8
+
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(internalKeyPrefix))
+}
+
+// A value added to a set along with its full 64bit hash
+type valueEntry struct {
+	hash  uint64
+	value []byte
+}
+
+// Values are stored sorted by hash as the big endian hash followed by the
+// uvarint length of the value and the value itself.
+func decodeValues(data []byte) ([]valueEntry, error) {
+	var entries []valueEntry
+	for len(data) != 0 {
+		if len(data) < valueHashSize {
+			return nil, CorruptValues
+		}
+		hash := binary.BigEndian.Uint64(data)
+		length, n := binary.Uvarint(data[valueHashSize:])
+		if n <= 0 {
+			return nil, CorruptValues
+		}
+		data = data[valueHashSize+n:]
+		if uint64(len(data)) < length {
+			return nil, CorruptValues
+		}
+		entries = append(entries, valueEntry{hash, data[:length]})
+		data = data[length:]
+	}
+	return entries, nil
+}
+
+func encodeValues(entries []valueEntry) []byte {
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	for _, entry := range entries {
+		binary.BigEndian.PutUint64(scratch[:valueHashSize], entry.hash)
+		buf.Write(scratch[:valueHashSize])
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(len(entry.value)))])
+		buf.Write(entry.value)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"github.com/jmhodges/levigo"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var verifier = NewExactVerifier(nil, 0)
+
+type verification struct {
+	Key           string  `json:"key"`
+	Exact         int     `json:"exact"`
+	Estimate      float64 `json:"estimate"`
+	RelativeError float64 `json:"relative_error"`
+	Status        string  `json:"status"`
+}
+
+// The hashes added to a key since it was first seen, which is an exact count
+// of its distinct values as long as the key was empty then and nothing was
+// merged into it since
+type exactSet struct {
+	hashes   map[uint64]struct{}
+	complete bool
+	full     bool
+}
+
+func (es *exactSet) status() string {
+	switch {
+	case es.full:
+		return "over_limit"
+	case !es.complete:
+		return "incomplete"
+	}
+	return "verifying"
+}
+
+// Keeps exact sets of the hashes added to the keys starting with one of
+// prefixes, up to limit hashes per key, so the estimates of those keys can be
+// checked against the truth before an exact pipeline is turned off.  Only
+// hashes added since the server started are known, so keys that already held
+// values when first seen can't be verified.
+type ExactVerifier struct {
+	sync.Mutex
+	prefixes []string
+	limit    int
+	sets     map[string]*exactSet
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewExactVerifier(prefixes []string, limit int) *ExactVerifier {
+	return &ExactVerifier{
+		prefixes: prefixes,
+		limit:    limit,
+		sets:     make(map[string]*exactSet),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (ev *ExactVerifier) verified(key string) bool {
+	for _, prefix := range ev.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether key has an exact set kept for it
+func (ev *ExactVerifier) tracks(key string) bool {
+	return len(ev.prefixes) != 0 && ev.verified(key)
+}
+
+// Records hashes added to key, whose set was empty before if fresh
+func (ev *ExactVerifier) Observe(key string, fresh bool, hashes ...uint64) {
+	if len(ev.prefixes) == 0 || !ev.verified(key) {
+		return
+	}
+	ev.Lock()
+	defer ev.Unlock()
+	set, found := ev.sets[key]
+	if !found {
+		set = &exactSet{hashes: make(map[uint64]struct{}), complete: fresh}
+		ev.sets[key] = set
+	}
+	for _, hash := range hashes {
+		if set.full {
+			return
+		} else if _, seen := set.hashes[hash]; seen {
+			continue
+		} else if len(set.hashes) == ev.limit {
+			set.full = true
+			set.hashes = nil
+			return
+		}
+		set.hashes[hash] = struct{}{}
+	}
+}
+
+// Marks the exact set of key as no longer matching the stored set, eg: after
+// another set was merged into it
+func (ev *ExactVerifier) Invalidate(key string) {
+	if len(ev.prefixes) == 0 {
+		return
+	}
+	ev.Lock()
+	defer ev.Unlock()
+	if set, found := ev.sets[key]; found {
+		set.complete = false
+	}
+}
+
+// Drops the exact set of a deleted key, so it starts over empty
+func (ev *ExactVerifier) Forget(key string) {
+	if len(ev.prefixes) == 0 {
+		return
+	}
+	ev.Lock()
+	delete(ev.sets, key)
+	ev.Unlock()
+}
+
+// A change a request makes to the exact set of a key, applied once its batch
+// is written so that dry runs and failed writes leave the exact sets alone
+type exactUpdate struct {
+	key        string
+	fresh      bool
+	hashes     []uint64
+	invalidate bool
+	forget     bool
+}
+
+func (ev *ExactVerifier) apply(update exactUpdate) {
+	switch {
+	case update.forget:
+		ev.Forget(update.key)
+	case update.invalidate:
+		ev.Invalidate(update.key)
+	default:
+		ev.Observe(update.key, update.fresh, update.hashes...)
+	}
+}
+
+// Compares the exact count of every tracked key with the estimate stored in
+// its summary, sorted by key
+func (ev *ExactVerifier) Verify(database *levigo.DB) []verification {
+	ev.Lock()
+	verifications := make([]verification, 0, len(ev.sets))
+	for key, set := range ev.sets {
+		verifications = append(verifications, verification{Key: key, Exact: len(set.hashes), Status: set.status()})
+	}
+	ev.Unlock()
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	for i := range verifications {
+		v := &verifications[i]
+		data, err := readValue(database, ro, summaryKey(v.Key))
+		if err != nil {
+			continue
+		}
+		summary, err := decodeSummary(data)
+		if err != nil {
+			continue
+		}
+		v.Estimate = summary.Cardinality
+		if v.Exact > 0 {
+			v.RelativeError = (v.Estimate - float64(v.Exact)) / float64(v.Exact)
+		}
+	}
+	sort.Slice(verifications, func(i, j int) bool { return verifications[i].Key < verifications[j].Key })
+	return verifications
+}
+
+// Logs the error of every verifiable key every interval
+func (ev *ExactVerifier) Start(interval time.Duration) {
+	go func() {
+		defer close(ev.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ev.logErrors()
+			case <-ev.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (ev *ExactVerifier) Stop() {
+	close(ev.stop)
+	<-ev.done
+}
+
+func (ev *ExactVerifier) logErrors() {
+	var worst float64
+	n := 0
+	for _, v := range ev.Verify(dispatcher.database) {
+		if v.Status != "verifying" {
+			continue
+		}
+		log.Printf("Verification of %q: estimated %.1f against %d exactly, %+.2f%% off", v.Key, v.Estimate, v.Exact, 100*v.RelativeError)
+		worst = math.Max(worst, math.Abs(v.RelativeError))
+		n++
+	}
+	if n != 0 {
+		log.Printf("Verified %d keys, the worst estimate is %.2f%% off", n, 100*worst)
+	}
+}
+
+// Lists the keys under --verify-keys with their exact count, estimate, the
+// relative error of the estimate and whether it can be verified: `verifying`,
+// `incomplete` for keys that held values before they were tracked or had sets
+// merged into them, or `over_limit` past --verify-limit values.
+func VerificationHandler(w http.ResponseWriter, r *http.Request) {
+	HttpResponse(w, 200, verifier.Verify(dispatcher.database))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestExactVerifierObserve(t *testing.T) {
+	ev := NewExactVerifier([]string{"verified:"}, 3)
+	ev.Observe("verified:a", true, 1, 2, 2)
+	ev.Observe("other", true, 1)
+	ev.Observe("verified:b", false, 1)
+	assert.Equal(t, len(ev.sets), 2)
+	assert.Equal(t, len(ev.sets["verified:a"].hashes), 2)
+	assert.Equal(t, ev.sets["verified:a"].status(), "verifying")
+	assert.Equal(t, ev.sets["verified:b"].status(), "incomplete")
+
+	ev.Observe("verified:a", false, 3, 1)
+	assert.Equal(t, ev.sets["verified:a"].status(), "verifying")
+	ev.Observe("verified:a", false, 4)
+	assert.Equal(t, ev.sets["verified:a"].status(), "over_limit")
+
+	ev.Observe("verified:c", true, 1)
+	ev.Invalidate("verified:c")
+	assert.Equal(t, ev.sets["verified:c"].status(), "incomplete")
+	ev.Forget("verified:c")
+	_, found := ev.sets["verified:c"]
+	assert.Equal(t, found, false)
+}
+
+func TestExactVerifierVerify(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	defaultVerifier := verifier
+	verifier = NewExactVerifier([]string{"_GOTEST_VERIFY"}, 1000)
+	defer func() { verifier = defaultVerifier }()
+
+	key := "_GOTEST_VERIFY"
+	resultChan := make(chan Result)
+	for i := 0; i < 100; i++ {
+		hash := Hashify([]byte(fmt.Sprintf("%d", i%50)))
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: hash, ResultChan: resultChan})
+		<-resultChan
+	}
+
+	verifications := verifier.Verify(dispatcher.database)
+	assert.Equal(t, len(verifications), 1)
+	assert.Equal(t, verifications[0].Key, key)
+	assert.Equal(t, verifications[0].Exact, 50)
+	assert.Equal(t, verifications[0].Estimate, 50.0)
+	assert.Equal(t, verifications[0].RelativeError, 0.0)
+	assert.Equal(t, verifications[0].Status, "verifying")
+
+	// dry runs and rejected writes leave the exact sets alone
+	var dryRunChanges []dryRunChange
+	hash := Hashify([]byte("dry run"))
+	dispatcher.Dispatch(DryRunRequest{RequestCommand: AddHashRequest{Key: key, Hash: hash}, Changes: &dryRunChanges, ResultChan: resultChan})
+	<-resultChan
+	dispatcher.Dispatch(DryRunRequest{RequestCommand: DeleteRequest{Key: key}, Changes: &dryRunChanges, ResultChan: resultChan})
+	<-resultChan
+	*maxK = 1
+	dispatcher.Dispatch(AddHashRequest{Key: key + "_LARGE", Hash: hash, ResultChan: resultChan})
+	result := <-resultChan
+	*maxK = 0
+	assert.Equal(t, result.Error, SketchTooLarge)
+	verifications = verifier.Verify(dispatcher.database)
+	assert.Equal(t, len(verifications), 1)
+	assert.Equal(t, verifications[0].Exact, 50)
+
+	dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+	<-resultChan
+	assert.Equal(t, len(verifier.Verify(dispatcher.database)), 0)
+}
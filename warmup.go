@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jmhodges/levigo"
+	"log"
+	"time"
+)
+
+// How often the access counts of hot keys are saved for --warmup-keys
+const hotKeysSaveInterval = time.Minute
+
+var (
+	hotKeysRecord = []byte(internalKeyPrefix + "hotkeys")
+	hotKeysSaver  *HotKeysSaver
+)
+
+// Replaces the tracked keys with accesses, eg: those saved before a restart
+func (kt *KeyTracker) Restore(accesses []keyAccess) {
+	kt.Lock()
+	defer kt.Unlock()
+	kt.keys = make(map[string]*keyAccess, len(accesses))
+	for i := range accesses {
+		if len(kt.keys) < kt.capacity {
+			kt.keys[accesses[i].Key] = &accesses[i]
+		}
+	}
+}
+
+func saveHotKeys(database *levigo.DB) error {
+	data, err := json.Marshal(hotKeys.Top(hotKeys.capacity, "total"))
+	if err != nil {
+		return err
+	}
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	return database.Put(wo, hotKeysRecord, data)
+}
+
+// The access counts saved by the last run, most accessed first
+func loadHotKeys(database *levigo.DB) ([]keyAccess, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := database.Get(ro, hotKeysRecord)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var accesses []keyAccess
+	err = json.Unmarshal(data, &accesses)
+	return accesses, err
+}
+
+// Reads the sets and summaries of the first n keys of accesses so that they
+// are in the LevelDB cache, and the OS's, before the first requests for them
+// arrive.  Returns the number of sets read.
+func warmUp(database *levigo.DB, accesses []keyAccess, n int) int {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	warmed := 0
+	for i := 0; i < len(accesses) && i < n; i++ {
+		data, err := database.Get(ro, []byte(accesses[i].Key))
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		database.Get(ro, summaryKey(accesses[i].Key))
+		warmed++
+	}
+	return warmed
+}
+
+// Saves the access counts of hot keys every hotKeysSaveInterval and once more
+// when stopped, so the next run can warm up the keys that were hot
+type HotKeysSaver struct {
+	database *levigo.DB
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewHotKeysSaver(database *levigo.DB) *HotKeysSaver {
+	return &HotKeysSaver{
+		database: database,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (hs *HotKeysSaver) Start() {
+	go func() {
+		defer close(hs.done)
+		ticker := time.NewTicker(hotKeysSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				hs.save()
+			case <-hs.stop:
+				hs.save()
+				return
+			}
+		}
+	}()
+}
+
+func (hs *HotKeysSaver) Stop() {
+	close(hs.stop)
+	<-hs.done
+}
+
+func (hs *HotKeysSaver) save() {
+	if err := saveHotKeys(hs.database); err != nil {
+		log.Printf("Could not save the hot keys: %s", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"github.com/jmhodges/levigo"
+	"testing"
+)
+
+func TestWarmUp(t *testing.T) {
+	SetupDB()
+	defer CloseDB()
+	defer func(tracker *KeyTracker) { hotKeys = tracker }(hotKeys)
+
+	resultChan := make(chan Result)
+	keys := []string{"_GOTEST_WARMUP0", "_GOTEST_WARMUP1"}
+	for _, key := range keys {
+		dispatcher.Dispatch(AddHashRequest{Key: key, Hash: GetRandHash(), ResultChan: resultChan})
+		<-resultChan
+	}
+	defer func() {
+		for _, key := range keys {
+			dispatcher.Dispatch(DeleteRequest{Key: key, ResultChan: resultChan})
+			<-resultChan
+		}
+	}()
+
+	hotKeys = NewKeyTracker(1, 10)
+	for i := 0; i < 3; i++ {
+		hotKeys.Sample([]string{keys[1]}, false)
+	}
+	hotKeys.Sample([]string{keys[0], "_GOTEST_WARMUP_MISSING"}, true)
+	assert.Equal(t, saveHotKeys(dispatcher.database), nil)
+	defer func() {
+		wo := levigo.NewWriteOptions()
+		defer wo.Close()
+		dispatcher.database.Delete(wo, hotKeysRecord)
+	}()
+
+	hotKeys = NewKeyTracker(1, 10)
+	accesses, err := loadHotKeys(dispatcher.database)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(accesses), 3)
+	assert.Equal(t, accesses[0].Key, keys[1])
+	assert.Equal(t, accesses[0].Reads, 3.0)
+
+	hotKeys.Restore(accesses)
+	assert.Equal(t, hotKeys.Top(1, "reads")[0].Key, keys[1])
+
+	assert.Equal(t, warmUp(dispatcher.database, accesses, 1), 1)
+	// keys that were deleted since are skipped
+	assert.Equal(t, warmUp(dispatcher.database, accesses, 10), 2)
+}